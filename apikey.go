@@ -0,0 +1,475 @@
+package seven5
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//API_KEY_HEADER is the header checked for an api key by default, in
+	//addition to "Authorization: Bearer <key>".
+	API_KEY_HEADER = "X-API-Key"
+	//API_KEY_PREFIX starts every api key, so keys are easy to spot (and to
+	//search for in places they should not be).
+	API_KEY_PREFIX = "s5k_"
+	//API_KEY_ALL_SCOPES is the scope that includes every other scope.
+	API_KEY_ALL_SCOPES = "*"
+)
+
+//APIKey is an api key as it is stored.  The secret part of the key is not
+//stored, only its hash, so a key can't be recovered from the store.  A zero
+//Expires means the key does not expire.
+type APIKey struct {
+	Id       string
+	UniqueId string
+	Name     string
+	Hash     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+}
+
+//expired is true if the key can't be used at the time given.
+func (self *APIKey) expired(now time.Time) bool {
+	return !self.Expires.IsZero() && !now.Before(self.Expires)
+}
+
+//APIKeyStore keeps api keys.  Load returns nil, nil for a key that is not
+//in the store.  Touch sets the LastUsed of a key that is in the store and
+//does nothing if it is not, so a key revoked while it is being used is not
+//saved again.  Implementations must be safe to use from multiple goroutines.
+type APIKeyStore interface {
+	Load(id string) (*APIKey, error)
+	Save(*APIKey) error
+	Delete(id string) error
+	List(uniqueId string) ([]*APIKey, error)
+	Touch(id string, lastUsed time.Time) error
+}
+
+//MemoryAPIKeyStore keeps api keys in a map, so they are lost at exit.  This
+//is mostly useful for tests.
+type MemoryAPIKeyStore struct {
+	lock sync.RWMutex
+	keys map[string]*APIKey
+}
+
+//NewMemoryAPIKeyStore returns an empty MemoryAPIKeyStore.
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[string]*APIKey)}
+}
+
+//Load returns a copy of the key.
+func (self *MemoryAPIKeyStore) Load(id string) (*APIKey, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	k, ok := self.keys[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *k
+	return &c, nil
+}
+
+//Save stores a copy of the key.
+func (self *MemoryAPIKeyStore) Save(k *APIKey) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c := *k
+	self.keys[k.Id] = &c
+	return nil
+}
+
+//Delete removes the key.
+func (self *MemoryAPIKeyStore) Delete(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.keys, id)
+	return nil
+}
+
+//Touch sets the LastUsed of the key, if it is still in the store.
+func (self *MemoryAPIKeyStore) Touch(id string, lastUsed time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if k, ok := self.keys[id]; ok {
+		k.LastUsed = lastUsed
+	}
+	return nil
+}
+
+//List returns copies of the keys of the unique id.
+func (self *MemoryAPIKeyStore) List(uniqueId string) ([]*APIKey, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var result []*APIKey
+	for _, k := range self.keys {
+		if k.UniqueId == uniqueId {
+			c := *k
+			result = append(result, &c)
+		}
+	}
+	return result, nil
+}
+
+//SessionSource finds the session of a request that has no session cookie from
+//other credentials in the request, such as an api key.  Session returns nil,
+//nil if the request has no credentials the source understands.  APIKeys and
+//JWT are SessionSources.
+type SessionSource interface {
+	Session(r *http.Request, sm SessionManager) (Session, error)
+}
+
+//bearerToken returns the token of the "Authorization: Bearer" header, or ""
+//if there is none.
+func bearerToken(r *http.Request) string {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+//ScopedSession is implemented by sessions that may only be used for some
+//things, such as the sessions of api keys and JWTs.  The RawDispatcher
+//checks the scopes of these sessions before any Authorizer (see ScopeFunc).
+type ScopedSession interface {
+	Session
+	Scopes() []string
+}
+
+//SessionHasScope returns true if the session may be used for the scope.
+//Sessions that are not ScopedSessions, such as those of users that logged
+//in, may be used for anything.  A nil session has no scopes.
+func SessionHasScope(s Session, scope string) bool {
+	if s == nil {
+		return false
+	}
+	scoped, ok := s.(ScopedSession)
+	if !ok {
+		return true
+	}
+	for _, sc := range scoped.Scopes() {
+		if sc == scope || sc == API_KEY_ALL_SCOPES {
+			return true
+		}
+	}
+	return false
+}
+
+//APIKeySession is the session of a request that was authenticated with an api
+//key.  It lasts only for the request, so it can't be updated.
+type APIKeySession struct {
+	key *APIKey
+	ud  interface{}
+}
+
+//SessionId returns the id of the api key, which is not a secret.
+func (self *APIKeySession) SessionId() string {
+	return self.key.Id
+}
+
+//UserData returns the result of the session manager's Generate for the
+//owner of the key.
+func (self *APIKeySession) UserData() interface{} {
+	return self.ud
+}
+
+//UniqueId returns the owner of the key.
+func (self *APIKeySession) UniqueId() string {
+	return self.key.UniqueId
+}
+
+//Scopes returns the scopes of the key.
+func (self *APIKeySession) Scopes() []string {
+	return self.key.Scopes
+}
+
+//Key returns the key used for the request.
+func (self *APIKeySession) Key() *APIKey {
+	return self.key
+}
+
+//APIKeys mints and checks api keys for clients that can't use cookies.  A key
+//is API_KEY_PREFIX, the id of the key, "_" and a random secret; the store
+//has the id and the hash of the secret.  Clients send the key in the header
+//"Authorization: Bearer <key>" or in one of the Headers.  Bearer tokens that
+//don't start with API_KEY_PREFIX are left for other SessionSources.
+type APIKeys struct {
+	store APIKeyStore
+	clock Clock
+	//Headers are checked for a key, in order, if there is no Authorization
+	//header.  The default is API_KEY_HEADER.
+	Headers []string
+}
+
+//NewAPIKeys returns an APIKeys that keeps keys in the store given.  If clock
+//is nil, the SystemClock is used.
+func NewAPIKeys(store APIKeyStore, clock Clock) *APIKeys {
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+	return &APIKeys{store: store, clock: clock, Headers: []string{API_KEY_HEADER}}
+}
+
+func apiKeyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyRandom(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("failed to read the random stream: %v", err)
+	}
+	return b
+}
+
+//Mint creates a key for the unique id.  The key returned is the only copy of
+//the secret, it can't be recovered later.  A zero expires means the key does
+//not expire.
+func (self *APIKeys) Mint(uniq string, name string, scopes []string, expires time.Time) (string, *APIKey, error) {
+	if uniq == "" {
+		return "", nil, fmt.Errorf("api keys must have an owner")
+	}
+	id := hex.EncodeToString(apiKeyRandom(8))
+	secret := base64.RawURLEncoding.EncodeToString(apiKeyRandom(32))
+	key := &APIKey{
+		Id:       id,
+		UniqueId: uniq,
+		Name:     name,
+		Hash:     apiKeyHash(secret),
+		Scopes:   scopes,
+		Created:  self.clock.Now(),
+		Expires:  expires,
+	}
+	if err := self.store.Save(key); err != nil {
+		return "", nil, err
+	}
+	log.Printf("[APIKEY] minted key %s for %s", id, uniq)
+	return API_KEY_PREFIX + id + "_" + secret, key, nil
+}
+
+//Verify returns the stored key for the key given, or nil if it is not a valid
+//key, has been revoked or has expired.  The last use of the key is recorded,
+//at most once a minute.
+func (self *APIKeys) Verify(token string) (*APIKey, error) {
+	if !strings.HasPrefix(token, API_KEY_PREFIX) {
+		return nil, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, API_KEY_PREFIX), "_", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	key, err := self.store.Load(parts[0])
+	if err != nil || key == nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(apiKeyHash(parts[1]))) != 1 {
+		return nil, nil
+	}
+	now := self.clock.Now()
+	if key.expired(now) {
+		return nil, nil
+	}
+	if now.Sub(key.LastUsed) >= sessionTouchInterval {
+		key.LastUsed = now
+		if err := self.store.Touch(key.Id, now); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+//Revoke deletes a key of the unique id.  It returns an Error with the code
+//http.StatusNotFound if the unique id has no such key.
+func (self *APIKeys) Revoke(uniq string, id string) error {
+	key, err := self.store.Load(id)
+	if err != nil {
+		return err
+	}
+	if key == nil || key.UniqueId != uniq {
+		return HTTPError(http.StatusNotFound, fmt.Sprintf("no api key %s", id))
+	}
+	log.Printf("[APIKEY] revoked key %s of %s", id, uniq)
+	return self.store.Delete(id)
+}
+
+//List returns the keys of the unique id.
+func (self *APIKeys) List(uniq string) ([]*APIKey, error) {
+	return self.store.List(uniq)
+}
+
+//Credential returns the key in the request, or "" if there is none.
+func (self *APIKeys) Credential(r *http.Request) string {
+	if token := bearerToken(r); strings.HasPrefix(token, API_KEY_PREFIX) {
+		return token
+	}
+	for _, h := range self.Headers {
+		if v := strings.TrimSpace(r.Header.Get(h)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+//Session returns the session for the key in the request, or nil if there is
+//no key.  The user data of the session is the result of the session
+//manager's Generate for the owner of the key.  A request with a key that is
+//not valid, or whose owner Generate doesn't know (nil user data), gets an
+//Error with the code http.StatusUnauthorized.
+func (self *APIKeys) Session(r *http.Request, sm SessionManager) (Session, error) {
+	token := self.Credential(r)
+	if token == "" {
+		return nil, nil
+	}
+	key, err := self.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, HTTPError(http.StatusUnauthorized, "bad api key")
+	}
+	var ud interface{}
+	if sm != nil {
+		if ud, err = sm.Generate(key.UniqueId); err != nil {
+			return nil, err
+		}
+		if ud == nil {
+			return nil, HTTPError(http.StatusUnauthorized, "unknown api key owner")
+		}
+	}
+	return &APIKeySession{key: key, ud: ud}, nil
+}
+
+//APIKeyInfo is the wire type of APIKeyResource.  Key is only set in the
+//response to a Post, which mints the key.
+type APIKeyInfo struct {
+	Id       string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+	Key      string
+}
+
+func newAPIKeyInfo(k *APIKey) *APIKeyInfo {
+	return &APIKeyInfo{
+		Id:       k.Id,
+		Name:     k.Name,
+		Scopes:   k.Scopes,
+		Created:  k.Created,
+		Expires:  k.Expires,
+		LastUsed: k.LastUsed,
+	}
+}
+
+//APIKeyResource lets users mint, see and revoke their own api keys.  It
+//implements RestIndex, RestFindUdid, RestPost and RestDeleteUdid and is
+//typically registered like this:
+//	base.ResourceSeparateUdid("APIKey", &APIKeyInfo{}, r, r, r, nil, r)
+//Keys can't be minted or revoked by requests authenticated with a key or any
+//other ScopedSession, whatever its scopes.
+type APIKeyResource struct {
+	keys *APIKeys
+}
+
+//NewAPIKeyResource returns a resource for the keys given.
+func NewAPIKeyResource(keys *APIKeys) *APIKeyResource {
+	return &APIKeyResource{keys: keys}
+}
+
+//Index returns the keys of the current user.
+func (self *APIKeyResource) Index(pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := self.keys.List(uniq)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*APIKeyInfo, len(keys))
+	for i, k := range keys {
+		result[i] = newAPIKeyInfo(k)
+	}
+	return result, nil
+}
+
+//Find returns one key of the current user.
+func (self *APIKeyResource) Find(id string, pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	k, err := self.keys.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || k.UniqueId != uniq {
+		return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no api key %s", id))
+	}
+	return newAPIKeyInfo(k), nil
+}
+
+//refuseScoped returns an Error with the code http.StatusForbidden if the
+//session of the request is a ScopedSession, so that a leaked key or token
+//can't be used to make more keys or to revoke the owner's keys.
+func refuseScoped(pb PBundle, what string) error {
+	if _, ok := pb.Session().(ScopedSession); ok {
+		return HTTPError(http.StatusForbidden, fmt.Sprintf("api keys and tokens can't %s api keys", what))
+	}
+	return nil
+}
+
+//Post mints a key for the current user with the Name, Scopes and Expires of
+//the body.  The Key of the result is the only time the key is available.
+func (self *APIKeyResource) Post(i interface{}, pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	if err := refuseScoped(pb, "mint"); err != nil {
+		return nil, err
+	}
+	req, ok := i.(*APIKeyInfo)
+	if !ok || req == nil {
+		return nil, HTTPError(http.StatusBadRequest, "api key description is required")
+	}
+	token, k, err := self.keys.Mint(uniq, req.Name, req.Scopes, req.Expires)
+	if err != nil {
+		return nil, err
+	}
+	result := newAPIKeyInfo(k)
+	result.Key = token
+	return result, nil
+}
+
+//Delete revokes a key of the current user.
+func (self *APIKeyResource) Delete(id string, pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	if err := refuseScoped(pb, "revoke"); err != nil {
+		return nil, err
+	}
+	k, err := self.keys.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.keys.Revoke(uniq, id); err != nil {
+		return nil, err
+	}
+	return newAPIKeyInfo(k), nil
+}
@@ -0,0 +1,165 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	API_KEY_TABLE = "api_key_record"
+)
+
+//APIKeyRecord is the row type used by QbsAPIKeyStore.  The scopes are
+//separated by spaces.
+type APIKeyRecord struct {
+	Id       int64
+	KeyId    string
+	UniqueId string
+	Name     string
+	Hash     string
+	Scopes   string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+}
+
+func (self *APIKeyRecord) key() *APIKey {
+	return &APIKey{Id: self.KeyId, UniqueId: self.UniqueId, Name: self.Name, Hash: self.Hash,
+		Scopes: strings.Fields(self.Scopes), Created: self.Created, Expires: self.Expires,
+		LastUsed: self.LastUsed}
+}
+
+//QbsAPIKeyStore keeps api keys in the api_key_record table, which can be
+//created with APIKeyMigrationUp.
+type QbsAPIKeyStore struct {
+	store *QbsStore
+}
+
+//NewQbsAPIKeyStore returns an api key store that uses the database of the
+//QbsStore given.
+func NewQbsAPIKeyStore(s *QbsStore) *QbsAPIKeyStore {
+	return &QbsAPIKeyStore{store: s}
+}
+
+func (self *QbsAPIKeyStore) find(q *qbs.Qbs, id string) (*APIKeyRecord, error) {
+	rec := &APIKeyRecord{}
+	err := q.WhereEqual("key_id", id).Find(rec)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//Load reads the key's row.
+func (self *QbsAPIKeyStore) Load(id string) (*APIKey, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rec, err := self.find(q, id)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	return rec.key(), nil
+}
+
+//Save creates or updates the key's row.
+func (self *QbsAPIKeyStore) Save(k *APIKey) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	rec, err := self.find(q, k.Id)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		rec = &APIKeyRecord{KeyId: k.Id}
+	}
+	rec.UniqueId = k.UniqueId
+	rec.Name = k.Name
+	rec.Hash = k.Hash
+	rec.Scopes = strings.Join(k.Scopes, " ")
+	rec.Created = k.Created
+	rec.Expires = k.Expires
+	rec.LastUsed = k.LastUsed
+	_, err = q.Save(rec)
+	return err
+}
+
+//Delete removes the key's row.
+func (self *QbsAPIKeyStore) Delete(id string) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.WhereEqual("key_id", id).Delete(&APIKeyRecord{})
+	return err
+}
+
+//Touch updates the last_used column of the key's row, if there is one.  It
+//never creates a row.
+func (self *QbsAPIKeyStore) Touch(id string, lastUsed time.Time) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Exec(fmt.Sprintf("UPDATE %s SET last_used = ? WHERE key_id = ?", API_KEY_TABLE), lastUsed, id)
+	return err
+}
+
+//List reads the rows of the keys of the unique id.
+func (self *QbsAPIKeyStore) List(uniqueId string) ([]*APIKey, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	var recs []*APIKeyRecord
+	if err := q.WhereEqual("unique_id", uniqueId).FindAll(&recs); err != nil {
+		return nil, err
+	}
+	result := make([]*APIKey, len(recs))
+	for i, rec := range recs {
+		result[i] = rec.key()
+	}
+	return result, nil
+}
+
+//APIKeyMigrationUp is a migration function (see the migrate package) that
+//creates the table used by QbsAPIKeyStore.  This is postgres specific.
+func APIKeyMigrationUp(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		id BIGSERIAL PRIMARY KEY,
+		key_id VARCHAR(64) NOT NULL UNIQUE,
+		unique_id VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL DEFAULT '',
+		hash VARCHAR(128) NOT NULL,
+		scopes TEXT NOT NULL DEFAULT '',
+		created TIMESTAMP WITH TIME ZONE NOT NULL,
+		expires TIMESTAMP WITH TIME ZONE,
+		last_used TIMESTAMP WITH TIME ZONE)`, API_KEY_TABLE))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE INDEX %s_unique_id_idx ON %s (unique_id)",
+		API_KEY_TABLE, API_KEY_TABLE))
+	return err
+}
+
+//APIKeyMigrationDown is the inverse of APIKeyMigrationUp.
+func APIKeyMigrationDown(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", API_KEY_TABLE))
+	return err
+}
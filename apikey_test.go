@@ -0,0 +1,152 @@
+package seven5
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	store := NewMemoryAPIKeyStore()
+	keys := NewAPIKeys(store, clock)
+	token, k, err := keys.Mint("fred", "cli", []string{"read"}, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unable to mint: %v", err)
+	}
+	stored, _ := store.Load(k.Id)
+	if stored == nil || bytes.Contains([]byte(token), []byte(stored.Hash)) {
+		t.Fatalf("expected only the hash of the secret to be stored: %+v", stored)
+	}
+	if v, err := keys.Verify(token); err != nil || v == nil || v.UniqueId != "fred" {
+		t.Fatalf("bad verify: %+v %v", v, err)
+	}
+	for _, bad := range []string{"", token[:len(token)-1], API_KEY_PREFIX + k.Id + "_nope", "bogus"} {
+		if v, _ := keys.Verify(bad); v != nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/rest/x", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	s, err := keys.Session(r, nil)
+	if err != nil || SessionUniqueId(s) != "fred" {
+		t.Fatalf("bad session from bearer: %+v %v", s, err)
+	}
+	if !SessionHasScope(s, "read") || SessionHasScope(s, "write") {
+		t.Errorf("bad scopes: %v", s.(ScopedSession).Scopes())
+	}
+	if !SessionHasScope(NewSimpleSession(nil, "x"), "write") || SessionHasScope(nil, "read") {
+		t.Errorf("expected sessions without scopes to have every scope")
+	}
+	r = httptest.NewRequest("GET", "http://example.com/rest/x", nil)
+	r.Header.Set(API_KEY_HEADER, token)
+	if s, _ := keys.Session(r, nil); s == nil {
+		t.Errorf("expected key in %s to be found", API_KEY_HEADER)
+	}
+
+	clock.Advance(time.Minute)
+	store.Delete(k.Id)
+	if v, _ := keys.Verify(token); v != nil {
+		t.Errorf("expected revoked key to be refused")
+	}
+	store.Touch(k.Id, clock.Now())
+	if v, _ := store.Load(k.Id); v != nil {
+		t.Errorf("expected touch not to bring back a revoked key")
+	}
+	store.Save(stored)
+
+	clock.Advance(time.Hour)
+	if v, _ := keys.Verify(token); v != nil {
+		t.Errorf("expected expired key to be refused")
+	}
+}
+
+func TestAPIKeyResource(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	cm := NewSimpleCookieMapper("test")
+	base := NewBaseDispatcher(sm, cm)
+	keys := NewAPIKeys(NewMemoryAPIKeyStore(), nil)
+	base.IO.(*RawIOHook).Sources = []SessionSource{keys}
+	r := NewAPIKeyResource(keys)
+	base.ResourceSeparateUdid("APIKey", &APIKeyInfo{}, r, r, r, nil, r)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", base)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s, _ := sm.Assign("fred", "data", time.Time{})
+	cookie := &http.Cookie{Name: cm.CookieName(), Value: s.SessionId()}
+	body, _ := json.Marshal(&APIKeyInfo{Name: "cli", Scopes: []string{"apikey:read"}})
+	req, _ := http.NewRequest("POST", server.URL+"/rest/apikey", bytes.NewReader(body))
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+	var minted APIKeyInfo
+	json.NewDecoder(resp.Body).Decode(&minted)
+	resp.Body.Close()
+	if minted.Key == "" || minted.Id == "" {
+		t.Fatalf("expected a key: %+v", minted)
+	}
+
+	withKey := func(method, path, key string) *http.Request {
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		return req
+	}
+	resp, err = http.DefaultClient.Do(withKey("GET", "/rest/apikey", minted.Key))
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	var infos []*APIKeyInfo
+	json.NewDecoder(resp.Body).Decode(&infos)
+	resp.Body.Close()
+	if len(infos) != 1 || infos[0].Key != "" || infos[0].Id != minted.Id {
+		t.Errorf("expected the key without its secret: %+v", infos)
+	}
+	resp, err = http.DefaultClient.Do(withKey("POST", "/rest/apikey", minted.Key))
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	resp, err = http.DefaultClient.Do(withKey("GET", "/rest/apikey", minted.Key+"x"))
+	checkHttpStatus(t, resp, err, http.StatusUnauthorized)
+
+	resp, err = http.DefaultClient.Do(withKey("DELETE", "/rest/apikey/"+minted.Id, minted.Key))
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	req, _ = http.NewRequest("DELETE", server.URL+"/rest/apikey/"+minted.Id, nil)
+	req.AddCookie(cookie)
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	resp, err = http.DefaultClient.Do(withKey("GET", "/rest/apikey", minted.Key))
+	checkHttpStatus(t, resp, err, http.StatusUnauthorized)
+}
+
+func TestAPIKeyScopesWithoutRBAC(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	base := NewBaseDispatcher(sm, NewSimpleCookieMapper("test"))
+	keys := NewAPIKeys(NewMemoryAPIKeyStore(), nil)
+	base.IO.(*RawIOHook).Sources = []SessionSource{keys}
+	base.Rez(&someWire{}, &someResource{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", base)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	reader, _, _ := keys.Mint("fred", "reader", []string{"somewire:read"}, time.Time{})
+	do := func(method, path, body string) (*http.Response, error) {
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+reader)
+		return http.DefaultClient.Do(req)
+	}
+	resp, err := do("GET", "/rest/somewire", "")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	resp, err = do("GET", "/rest/somewire/7", "")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	resp, err = do("POST", "/rest/somewire", `{"Foo":"bar"}`)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	resp, err = do("PUT", "/rest/somewire/7", `{"Id":7,"Foo":"bar"}`)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	resp, err = do("DELETE", "/rest/somewire/7", "")
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+}
@@ -0,0 +1,276 @@
+package seven5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+)
+
+var (
+	APP_SHUT_DOWN = errors.New("application has been shut down")
+)
+
+//AppConfig is the declarative description of an application that is
+//consumed by NewApp.  Only Name and Deploy are required, everything else
+//has a reasonable default.
+type AppConfig struct {
+	//Name is the application name, used to name the session cookie.
+	Name string
+	//Deploy is consulted for the port to listen on and for test mode.
+	Deploy DeploymentEnvironment
+	//Generator is passed to NewSimpleSessionManager when SessionMgr is nil.
+	Generator Generator
+	//SessionStore, if not nil, is where the SimpleSessionManager keeps its
+	//sessions when SessionMgr is nil.  The default keeps them in memory.
+	SessionStore SessionStore
+	//Session, if not nil, controls the expiration of sessions of the
+	//SimpleSessionManager used when SessionMgr is nil.  SessionStore, if set,
+	//replaces its Store.
+	Session *SessionConfig
+	//SessionMgr is used in place of a SimpleSessionManager if it is not nil.
+	//If it is also a ValidatingSessionManager, the password handler routes
+	//are installed at AuthPath and MePath.
+	SessionMgr SessionManager
+	//CookieMap is used in place of a SimpleCookieMapper if it is not nil.  If
+	//SessionMgr is a CookieSessionManager, its CookieMapper is the default.
+	CookieMap CookieMapper
+	//AuthPath and MePath default to /auth and /me.
+	AuthPath string
+	MePath   string
+	//StaticDir is the base directory for the component matcher, if this is
+	//"" the static content is not served.
+	StaticDir string
+	//Homepage is the result used for the URL "/" by the component matcher.
+	Homepage ComponentResult
+	//Components are added to the component matcher.
+	Components []StaticComponent
+	//ErrorDispatcher is installed on the ServeMux if it is not nil.
+	ErrorDispatcher ErrorDispatcher
+	//ShutdownTimeout is how long in-flight requests are given to finish
+	//after a SIGTERM, defaults to DEFAULT_SHUTDOWN_TIMEOUT.
+	ShutdownTimeout time.Duration
+	//Tenants, if not nil, is used by both the rest dispatcher and the
+	//component matcher to determine the tenant of each request.
+	Tenants TenantResolver
+	//CSRF, if not nil, is used by the rest dispatcher and the password
+	//handler to defend against cross site request forgery.
+	CSRF *CSRFGuard
+	//SessionSources let the rest dispatcher find the session of requests
+	//without a session cookie, such as requests with an api key or a JWT.
+	//Resources such as the APIKeyResource must be registered with Resources.
+	SessionSources []SessionSource
+	//Remember, if not nil, is used by the rest dispatcher and the password
+	//handler to keep users logged in with remember me tokens.
+	Remember *RememberMe
+	//Throttle, if not nil, is used by the password handler to slow down
+	//password guessing.
+	Throttle *LoginThrottle
+	//TwoFactor, if not nil, turns on two factor authentication in the
+	//password handler; the SessionMgr must be a TwoFactorSessionManager.
+	TwoFactor *TwoFactor
+	//Resources, if not nil, is called with the BaseDispatcher so the
+	//application can register its rest resources.
+	Resources func(*BaseDispatcher)
+	//Routes, if not nil, is called with the ServeMux after all the standard
+	//routes have been installed so the application can add its own.
+	Routes func(*ServeMux)
+}
+
+//App is the assembly of the parts that nearly every seven5 application
+//needs: a session manager, cookie mapper, BaseDispatcher mounted at /rest,
+//password handling and a component matcher for static content.  It also
+//owns the lifecycle of the http.Server.
+type App struct {
+	Config     *AppConfig
+	SessionMgr SessionManager
+	CookieMap  CookieMapper
+	Base       *BaseDispatcher
+	Mux        *ServeMux
+	Matcher    *SimpleComponentMatcher
+	Password   *SimplePasswordHandler
+
+	server      *http.Server
+	stopped     chan struct{}
+	shutdownErr error
+	once        sync.Once
+	mu          sync.Mutex
+	closed      bool
+}
+
+//NewApp creates the session manager, cookie mapper, dispatcher and mux
+//described by conf and installs the standard routes.  The Resources
+//and Routes hooks in conf are called before this function returns.
+func NewApp(conf *AppConfig) *App {
+	if conf.Name == "" {
+		panic("application name is required")
+	}
+	if conf.Deploy == nil {
+		panic("deployment environment is required")
+	}
+	result := &App{
+		Config:     conf,
+		SessionMgr: conf.SessionMgr,
+		CookieMap:  conf.CookieMap,
+		Mux:        NewServeMux(),
+		stopped:    make(chan struct{}),
+	}
+	result.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.Deploy.Port()),
+		Handler: result.Mux,
+	}
+	if result.SessionMgr == nil {
+		sc := SessionConfig{}
+		if conf.Session != nil {
+			sc = *conf.Session
+		}
+		if conf.SessionStore != nil {
+			sc.Store = conf.SessionStore
+		}
+		result.SessionMgr = NewSimpleSessionManagerWithConfig(conf.Generator, &sc)
+	}
+	if csm, ok := result.SessionMgr.(*CookieSessionManager); ok {
+		csm.SetCSRFGuard(conf.CSRF)
+	}
+	if result.CookieMap == nil {
+		if csm, ok := result.SessionMgr.(*CookieSessionManager); ok {
+			result.CookieMap = csm.CookieMapper()
+		} else {
+			result.CookieMap = NewSimpleCookieMapper(conf.Name)
+		}
+	}
+	if conf.ErrorDispatcher != nil {
+		result.Mux.SetErrorDispatcher(conf.ErrorDispatcher)
+	}
+	result.Base = NewBaseDispatcher(result.SessionMgr, result.CookieMap)
+	result.Base.Tenants = conf.Tenants
+	if raw, ok := result.Base.IO.(*RawIOHook); ok {
+		raw.CSRF = conf.CSRF
+		raw.Sources = conf.SessionSources
+		raw.Remember = conf.Remember
+	}
+	result.Mux.Dispatch("/rest/", result.Base)
+
+	if vsm, ok := result.SessionMgr.(ValidatingSessionManager); ok {
+		authPath, mePath := conf.AuthPath, conf.MePath
+		if authPath == "" {
+			authPath = "/auth"
+		}
+		if mePath == "" {
+			mePath = "/me"
+		}
+		result.Password = NewSimplePasswordHandler(vsm, result.CookieMap)
+		result.Password.SetCSRFGuard(conf.CSRF)
+		result.Password.SetRememberMe(conf.Remember)
+		result.Password.SetLoginThrottle(conf.Throttle)
+		result.Password.SetTwoFactor(conf.TwoFactor)
+		result.Mux.HandleFunc(authPath, result.Password.AuthHandler)
+		result.Mux.HandleFunc(mePath, result.Password.MeHandler)
+	}
+
+	if conf.StaticDir != "" {
+		result.Matcher = NewSimpleComponentMatcher(result.CookieMap, result.SessionMgr,
+			conf.StaticDir, conf.Homepage, conf.Deploy.IsTest(), conf.Components...)
+		if conf.Tenants != nil {
+			result.Matcher.SetTenantResolver(conf.Tenants)
+		}
+		result.Mux.Handle("/", result.Matcher)
+	}
+
+	if conf.Resources != nil {
+		conf.Resources(result.Base)
+	}
+	if conf.Routes != nil {
+		conf.Routes(result.Mux)
+	}
+	return result
+}
+
+//AddComponents adds StaticComponents to the component matcher.  This panics
+//if the application was configured without a StaticDir.
+func (self *App) AddComponents(sc ...StaticComponent) {
+	if self.Matcher == nil {
+		panic("no component matcher, set StaticDir in the AppConfig")
+	}
+	self.Matcher.AddComponents(sc...)
+}
+
+//ListenAndServe starts the http server on the port given by the deployment
+//environment and blocks until the server stops.  When the process receives
+//SIGTERM or SIGINT, the server stops accepting connections, waits up to
+//ShutdownTimeout for in-flight requests to finish, and then closes the
+//session manager (if it is an io.Closer).  The return value is nil on a
+//clean shutdown and APP_SHUT_DOWN if Shutdown has already been called.  If
+//the server can't listen, the session manager is closed too.
+func (self *App) ListenAndServe() error {
+	self.mu.Lock()
+	closed := self.closed
+	self.mu.Unlock()
+	if closed {
+		return APP_SHUT_DOWN
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("[APP] received %v, shutting down", s)
+			self.Shutdown()
+		case <-quit:
+		}
+	}()
+
+	log.Printf("[APP] %s listening on %s", self.Config.Name, self.server.Addr)
+	if err := self.server.ListenAndServe(); err != http.ErrServerClosed {
+		self.Shutdown()
+		return err
+	}
+	<-self.stopped
+	return self.shutdownErr
+}
+
+//Shutdown stops the http server gracefully, draining in-flight requests
+//for at most ShutdownTimeout, and then closes the session manager.  This is
+//called automatically by ListenAndServe on SIGTERM but can be called by
+//applications that want to stop the server for other reasons.  After
+//Shutdown, ListenAndServe does not start the server.
+func (self *App) Shutdown() error {
+	self.mu.Lock()
+	self.closed = true
+	self.mu.Unlock()
+	self.once.Do(self.shutdown)
+	return self.shutdownErr
+}
+
+func (self *App) shutdown() {
+	defer close(self.stopped)
+	timeout := self.Config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := self.server.Shutdown(ctx)
+	if closer, ok := self.SessionMgr.(io.Closer); ok {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	self.shutdownErr = err
+}
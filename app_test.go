@@ -0,0 +1,170 @@
+package seven5
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testDeploy struct {
+	port int
+}
+
+func (self *testDeploy) GetQbsStore() *QbsStore {
+	return nil
+}
+func (self *testDeploy) IsTest() bool {
+	return true
+}
+func (self *testDeploy) Port() int {
+	return self.port
+}
+func (self *testDeploy) RedirectHost() string {
+	return fmt.Sprintf(REDIRECT_HOST_TEST, self.port)
+}
+
+//freePort returns a port that nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestNewAppRequired(t *testing.T) {
+	for name, conf := range map[string]*AppConfig{
+		"no name":   {Deploy: &testDeploy{}},
+		"no deploy": {Name: "test"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected NewApp to panic", name)
+				}
+			}()
+			NewApp(conf)
+		}()
+	}
+}
+
+func TestAppLifecycle(t *testing.T) {
+	port := freePort(t)
+	started := make(chan bool)
+	app := NewApp(&AppConfig{
+		Name:    "test",
+		Deploy:  &testDeploy{port: port},
+		Session: &SessionConfig{Keys: testSessionKeys()},
+		Resources: func(base *BaseDispatcher) {
+			base.Rez(&someWire{}, &someResource{})
+		},
+		Routes: func(mux *ServeMux) {
+			mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte("done"))
+			})
+		},
+	})
+	if app.Base == nil || app.Mux == nil || app.CookieMap == nil || app.SessionMgr == nil {
+		t.Fatalf("expected NewApp to fill in the parts: %+v", app)
+	}
+	if app.Password != nil || app.Matcher != nil {
+		t.Errorf("expected no password handler or matcher without a validating manager or static dir")
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- app.ListenAndServe()
+	}()
+	base := fmt.Sprintf("http://127.0.0.1:%d", port)
+	var resp *http.Response
+	var err error
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get(base + "/rest/somewire/7"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	resp.Body.Close()
+
+	//a request in flight is allowed to finish by Shutdown
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		slow <- err
+	}()
+	<-started
+	if err := app.Shutdown(); err != nil {
+		t.Errorf("unexpected error from Shutdown: %v", err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("expected the request in flight to finish: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected ListenAndServe to return nil after Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe did not return after Shutdown")
+	}
+	if err := app.Shutdown(); err != nil {
+		t.Errorf("expected a second Shutdown to do nothing: %v", err)
+	}
+
+	//the session manager is closed, but does not block
+	done := make(chan error, 1)
+	go func() {
+		_, err := app.SessionMgr.Assign("fred", "data", time.Time{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != SESSION_MANAGER_CLOSED {
+			t.Errorf("expected the closed error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session manager blocked after Shutdown")
+	}
+	if err := app.ListenAndServe(); err != APP_SHUT_DOWN {
+		t.Errorf("expected the server not to start again: %v", err)
+	}
+}
+
+func TestAppShutdownBeforeListen(t *testing.T) {
+	app := NewApp(&AppConfig{Name: "test", Deploy: &testDeploy{port: freePort(t)},
+		Session: &SessionConfig{Keys: testSessionKeys()}})
+	if err := app.Shutdown(); err != nil {
+		t.Errorf("unexpected error from Shutdown: %v", err)
+	}
+	if err := app.ListenAndServe(); err != APP_SHUT_DOWN {
+		t.Errorf("expected the server not to start after Shutdown: %v", err)
+	}
+}
+
+func TestAppListenError(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	app := NewApp(&AppConfig{Name: "test", Deploy: &testDeploy{port: l.Addr().(*net.TCPAddr).Port},
+		Session: &SessionConfig{Keys: testSessionKeys()}})
+	if err := app.ListenAndServe(); err == nil || err == APP_SHUT_DOWN {
+		t.Fatalf("expected an error listening on a port in use: %v", err)
+	}
+	if _, err := app.SessionMgr.Assign("fred", "data", time.Time{}); err != SESSION_MANAGER_CLOSED {
+		t.Errorf("expected the session manager to be closed after a listen error: %v", err)
+	}
+}
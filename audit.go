@@ -0,0 +1,148 @@
+package seven5
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-Id"
+)
+
+//AuditRecord is a description of a single successful POST, PUT or DELETE
+//on a rest resource.  Before and After are the json encodings of the
+//resource before and after the change; Before is "" for a POST, and
+//for a PUT or DELETE if the resource has no Find.  UniqueId is the unique id
+//of the user's session (see UniqueSession), "" if there was no session.
+//Tenant is the tenant of the request, "" if there is none.  This is also the wire type for the audit log rest resource.
+type AuditRecord struct {
+	Id         int64
+	Resource   string
+	ResourceId string
+	Method     string
+	UniqueId   string
+	Tenant     string
+	Before     string
+	After      string
+	RequestId  string
+	Created    time.Time
+}
+
+//AuditSink is the destination for audit records.  Implementations must
+//be safe for use from multiple goroutines.  Errors returned from Record
+//are logged but do not affect the response to the client, since the change
+//has already been made.
+type AuditSink interface {
+	Record(*AuditRecord) error
+}
+
+//Auditor is consulted by the RawDispatcher, if one is installed, to record
+//each successful change made through the rest resources.
+type Auditor struct {
+	Sink AuditSink
+}
+
+//NewAuditor returns an Auditor that writes to the given sink.
+func NewAuditor(sink AuditSink) *Auditor {
+	return &Auditor{Sink: sink}
+}
+
+//Encode returns the json encoding of a wire object for use as the Before
+//or After of a record, or "" if it cannot be encoded.
+func (self *Auditor) Encode(i interface{}) string {
+	if i == nil {
+		return ""
+	}
+	buf, err := json.Marshal(i)
+	if err != nil {
+		log.Printf("[AUDIT] unable to encode %T: %v", i, err)
+		return ""
+	}
+	return string(buf)
+}
+
+//Record builds the audit record for a change and sends it to the sink.  The
+//resource is the collection path, like house/12/room.  If the client sent the
+//X-Request-Id header that value is used for the request id, otherwise a new
+//one is created.
+func (self *Auditor) Record(r *http.Request, pb PBundle, resource string, id string,
+	before interface{}, after interface{}) {
+	reqId := strings.TrimSpace(r.Header.Get(REQUEST_ID_HEADER))
+	if reqId == "" {
+		reqId = UDID()
+	}
+	rec := &AuditRecord{
+		Resource:   resource,
+		ResourceId: id,
+		Method:     strings.ToUpper(r.Method),
+		UniqueId:   SessionUniqueId(pb.Session()),
+		Tenant:     BundleTenant(pb),
+		Before:     self.Encode(before),
+		After:      self.Encode(after),
+		RequestId:  reqId,
+		Created:    time.Now(),
+	}
+	if err := self.Sink.Record(rec); err != nil {
+		log.Printf("[AUDIT] failed to record %s %s/%s: %v", rec.Method, resource, id, err)
+	}
+}
+
+//beforeCapturer is implemented by resources that make their changes in a
+//transaction, like the qbs wrappers.  If capturesBefore returns true the
+//resource reads the object it changes inside that transaction and gives it
+//to captureBefore, so the Before of the audit record is the value that was
+//really replaced, not one read before the transaction started.
+type beforeCapturer interface {
+	capturesBefore() bool
+}
+
+//beforeCapture is implemented by the bundle to hold the value given by a
+//beforeCapturer.  It only calls find if the dispatcher is auditing.
+type beforeCapture interface {
+	auditBefore()
+	captureBefore(find func() (interface{}, error))
+	capturedBefore() (interface{}, bool)
+}
+
+//captureBefore passes find to the bundle, if it can capture the value.
+func captureBefore(pb PBundle, find func() (interface{}, error)) {
+	if c, ok := pb.(beforeCapture); ok {
+		c.captureBefore(find)
+	}
+}
+
+//JsonLinesAuditSink writes each record as a single line of json to a file.
+type JsonLinesAuditSink struct {
+	f    *os.File
+	enc  *json.Encoder
+	lock sync.Mutex
+}
+
+//NewJsonLinesAuditSink opens (or creates) the file at path for appending
+//audit records.
+func NewJsonLinesAuditSink(path string) (*JsonLinesAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &JsonLinesAuditSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+//Record writes the record as a line of json.
+func (self *JsonLinesAuditSink) Record(rec *AuditRecord) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.enc.Encode(rec)
+}
+
+//Close closes the underlying file.
+func (self *JsonLinesAuditSink) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.f.Close()
+}
@@ -0,0 +1,146 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	AUDIT_TABLE = "audit_record"
+)
+
+//QbsAuditSink stores audit records in the audit_record table of a QbsStore.
+//If the store has tenants, each record goes to the store of the tenant of
+//the request, and records without a tenant go to the store itself.  The
+//table can be created with AuditMigrationUp.
+type QbsAuditSink struct {
+	store *QbsStore
+}
+
+//NewQbsAuditSink returns a sink that writes to the given store.
+func NewQbsAuditSink(s *QbsStore) *QbsAuditSink {
+	return &QbsAuditSink{store: s}
+}
+
+//Record saves the record in its own transaction, independent of the
+//transaction (if any) used by the resource that made the change.
+func (self *QbsAuditSink) Record(rec *AuditRecord) error {
+	s := self.store
+	if rec.Tenant != "" {
+		var err error
+		if s, err = self.store.ForTenant(rec.Tenant); err != nil {
+			return err
+		}
+	}
+	q, err := s.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Save(rec)
+	return err
+}
+
+//AuditMigrationUp is a migration function (see the migrate package) that
+//creates the table used by QbsAuditSink.  This is postgres specific.
+func AuditMigrationUp(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		id BIGSERIAL PRIMARY KEY,
+		resource VARCHAR(255) NOT NULL,
+		resource_id VARCHAR(255) NOT NULL,
+		method VARCHAR(16) NOT NULL,
+		unique_id VARCHAR(255) NOT NULL,
+		tenant VARCHAR(255) NOT NULL,
+		before TEXT NOT NULL,
+		after TEXT NOT NULL,
+		request_id VARCHAR(64) NOT NULL,
+		created TIMESTAMP WITH TIME ZONE NOT NULL)`, AUDIT_TABLE))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE INDEX %s_resource_idx ON %s (resource, resource_id)",
+		AUDIT_TABLE, AUDIT_TABLE))
+	return err
+}
+
+//AuditMigrationDown is the inverse of AuditMigrationUp.
+func AuditMigrationDown(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", AUDIT_TABLE))
+	return err
+}
+
+//AuditResource is a read-only resource for browsing the records kept by
+//QbsAuditSink.  It implements QbsRestIndex and QbsRestFind and is typically
+//registered like this:
+//	base.ResourceSeparate("AuditRecord", &AuditRecord{},
+//		QbsWrapIndex(r, store), QbsWrapFind(r, store), nil, nil, nil)
+//Index understands the query parameters resource, resource_id, unique_id,
+//method, request_id, since and until (seconds since the epoch), offset
+//and limit.  Results are newest first.  If the request has a tenant only
+//the records of that tenant are visible.
+type AuditResource struct {
+	allow func(PBundle) bool
+}
+
+//NewAuditResource returns an AuditResource that only allows access to
+//the audit log when allow returns true.  Allow must not be nil, the audit
+//log is not something every user should see.
+func NewAuditResource(allow func(PBundle) bool) *AuditResource {
+	return &AuditResource{allow: allow}
+}
+
+//AllowRead checks the allow function given at creation time.
+func (self *AuditResource) AllowRead(pb PBundle) bool {
+	return self.allow(pb)
+}
+
+//Allow checks the allow function given at creation time.
+func (self *AuditResource) Allow(id int64, method string, pb PBundle) bool {
+	return method == "GET" && self.allow(pb)
+}
+
+//IndexQbs returns audit records matching the filters in the query parameters.
+func (self *AuditResource) IndexQbs(pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	cond := qbs.NewCondition("id > ?", 0)
+	if t := BundleTenant(pb); t != "" {
+		cond = cond.AndEqual("tenant", t)
+	}
+	for _, col := range []string{"resource", "resource_id", "unique_id", "method", "request_id"} {
+		if v, ok := pb.Query(col); ok {
+			cond = cond.AndEqual(col, v)
+		}
+	}
+	if since := pb.IntQueryParameter("since", 0); since > 0 {
+		cond = cond.And("created >= ?", time.Unix(since, 0))
+	}
+	if until := pb.IntQueryParameter("until", 0); until > 0 {
+		cond = cond.And("created < ?", time.Unix(until, 0))
+	}
+	limit, offset := PageParameters(pb, 100)
+
+	var result []*AuditRecord
+	err := q.Condition(cond).OrderByDesc("created").Limit(limit).Offset(offset).FindAll(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//FindQbs returns a single audit record.
+func (self *AuditResource) FindQbs(id int64, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	rec := &AuditRecord{Id: id}
+	if err := q.Find(rec); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no audit record %d", id))
+		}
+		return nil, err
+	}
+	if t := BundleTenant(pb); t != "" && rec.Tenant != t {
+		return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no audit record %d", id))
+	}
+	return rec, nil
+}
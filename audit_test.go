@@ -0,0 +1,103 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type memAuditSink struct {
+	lock    sync.Mutex
+	records []*AuditRecord
+}
+
+func (self *memAuditSink) Record(rec *AuditRecord) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.records = append(self.records, rec)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	sink := &memAuditSink{}
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, "/rest")
+	raw.Audit = NewAuditor(sink)
+	raw.Rez(&someWire{}, &someResource{})
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/rest/somewire/12")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if len(sink.records) != 0 {
+		t.Fatalf("GET should not be audited, got %d records", len(sink.records))
+	}
+
+	req, _ := http.NewRequest("PUT", server.URL+"/rest/somewire/12", strings.NewReader("{\"Id\":12,\"Foo\":\"bar\"}"))
+	req.Header.Set(REQUEST_ID_HEADER, "abc")
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if len(sink.records) != 1 {
+		t.Fatalf("expected one audit record, got %d", len(sink.records))
+	}
+	rec := sink.records[0]
+	if rec.Method != "PUT" || rec.Resource != "somewire" || rec.ResourceId != "12" || rec.RequestId != "abc" {
+		t.Errorf("bad audit record: %+v", rec)
+	}
+	if rec.Before == "" || rec.After == "" {
+		t.Errorf("expected before and after in audit record: %+v", rec)
+	}
+}
+
+//capturingResource captures the value before a change itself, like the qbs
+//wrappers do in their transaction, and that value differs from Find.
+type capturingResource struct {
+	someResource
+}
+
+func (self *capturingResource) capturesBefore() bool {
+	return true
+}
+
+func (self *capturingResource) Put(id int64, i interface{}, p PBundle) (interface{}, error) {
+	captureBefore(p, func() (interface{}, error) {
+		return &someWire{id, "captured"}, nil
+	})
+	return self.someResource.Put(id, i, p)
+}
+
+func TestAuditCapturedBefore(t *testing.T) {
+	sink := &memAuditSink{}
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, "/rest")
+	raw.Audit = NewAuditor(sink)
+	raw.Rez(&someWire{}, &capturingResource{})
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL+"/rest/somewire/12", strings.NewReader("{\"Id\":12,\"Foo\":\"bar\"}"))
+	resp, err := http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if len(sink.records) != 1 {
+		t.Fatalf("expected one audit record, got %d", len(sink.records))
+	}
+	if !strings.Contains(sink.records[0].Before, "captured") {
+		t.Errorf("expected the captured value as before, got %s", sink.records[0].Before)
+	}
+
+	//a bundle that is not auditing ignores the capture
+	pb := &simplePBundle{}
+	captureBefore(pb, func() (interface{}, error) {
+		t.Fatalf("find should not be called when not auditing")
+		return nil, nil
+	})
+	if _, caught := pb.capturedBefore(); caught {
+		t.Errorf("nothing should be captured when not auditing")
+	}
+}
@@ -11,7 +11,7 @@ package seven5
 func NewBaseDispatcher(sm SessionManager, cm CookieMapper) *BaseDispatcher {
 	prefix := "/rest"
 	result := &BaseDispatcher{}
-	io := &RawIOHook{&JsonDecoder{}, &JsonEncoder{}, cm}
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
 	result.RawDispatcher = NewRawDispatcher(io, sm, result, prefix)
 	return result
 }
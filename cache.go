@@ -0,0 +1,291 @@
+package seven5
+
+import (
+	"container/list"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//CacheStore is the storage used by ResponseCache.  Every entry has a tag,
+//which is the tenant and the path of the collection (resource names and
+//parent ids, like acme|house/12/room) that the entry was computed from.
+//Implementations must be safe for use from multiple goroutines.
+type CacheStore interface {
+	//Get returns the value stored at key, if it is present and has not expired.
+	Get(key string) (interface{}, bool)
+	//Put stores the value at key until expires.
+	Put(key string, tag string, value interface{}, expires time.Time)
+	//Invalidate removes all entries whose tag is tag or begins with tag+"/".
+	Invalidate(tag string)
+}
+
+//CacheVary computes the part of the cache key that depends on who is
+//asking, such as the session or the user's role.  Two requests for the same
+//url that return different strings from a CacheVary never share an entry.
+type CacheVary func(PBundle) string
+
+//CacheVaryByUser gives each user, as identified by the unique id of the
+//session, its own cache entries, so a user shares entries between their
+//sessions.  A session without a unique id gets entries of its own.  Requests
+//without a session share entries with each other.  This is the default when
+//no CacheVary is given.
+func CacheVaryByUser(pb PBundle) string {
+	s := pb.Session()
+	if s == nil {
+		return ""
+	}
+	if uniq := SessionUniqueId(s); uniq != "" {
+		return "u:" + uniq
+	}
+	return "s:" + s.SessionId()
+}
+
+//CacheVaryBySession gives each session its own cache entries.  Requests
+//without a session share entries with each other.
+func CacheVaryBySession(pb PBundle) string {
+	if pb.Session() == nil {
+		return ""
+	}
+	return "s:" + pb.Session().SessionId()
+}
+
+//CacheVaryByRole lets users with the same roles (see SessionRoles) share
+//cache entries.  Use it only for resources whose results depend on the
+//roles of the caller and nothing else about them.
+func CacheVaryByRole(pb PBundle) string {
+	roles := append([]string{}, SessionRoles(pb)...)
+	sort.Strings(roles)
+	return "r:" + strings.Join(roles, ",")
+}
+
+//CacheShared lets every caller share the cache entries.  Use it only for
+//resources whose results do not depend on the caller at all.
+func CacheShared(pb PBundle) string {
+	return ""
+}
+
+//CachePolicy describes how the results of Index and Find are cached for a
+//single resource.
+type CachePolicy struct {
+	TTL  time.Duration
+	Vary CacheVary
+}
+
+//ResponseCache is an opt-in, server-side cache that sits in front of the
+//RestIndex and RestFind methods of resources.  It is consulted by the
+//RawDispatcher after authorization checks have passed, so a cached value is
+//never returned to a user that could not have called the resource.  Any
+//successful POST, PUT or DELETE invalidates the entries for that resource
+//and for all resources below it in the RestNode tree.  Note that the cached
+//value is the object returned by the resource, not its encoding, so
+//resources must not modify values they have returned.
+type ResponseCache struct {
+	Store    CacheStore
+	policies map[reflect.Type]*CachePolicy
+	lock     sync.RWMutex
+}
+
+//NewResponseCache returns a ResponseCache that keeps its entries in store.
+//No resources are cached until Cache is called.
+func NewResponseCache(store CacheStore) *ResponseCache {
+	return &ResponseCache{
+		Store:    store,
+		policies: make(map[reflect.Type]*CachePolicy),
+	}
+}
+
+//Cache turns on caching for the resource with the given wire type.  If the
+//vary function is nil, CacheVaryByUser is used so that responses are never
+//shared between users; pass CacheShared if the results do not depend on the
+//caller.
+func (self *ResponseCache) Cache(wireExample interface{}, ttl time.Duration, vary CacheVary) {
+	if vary == nil {
+		vary = CacheVaryByUser
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.policies[reflect.TypeOf(wireExample)] = &CachePolicy{TTL: ttl, Vary: vary}
+}
+
+//policy returns the policy for the given wire type or nil if the type is not
+//cached.
+func (self *ResponseCache) policy(t reflect.Type) *CachePolicy {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.policies[t]
+}
+
+//Lookup returns the result of fn, possibly from the cache.  The tag is the
+//path of the collection being accessed, the id is "" for Index.  Entries
+//are kept separately for each tenant.  Errors returned by fn are never cached.
+func (self *ResponseCache) Lookup(d *restShared, tag string, id string, r *http.Request,
+	pb PBundle, fn func() (interface{}, error)) (interface{}, error) {
+
+	p := self.policy(d.typ)
+	if p == nil {
+		return fn()
+	}
+	tag = cacheTag(BundleTenant(pb), tag)
+	key := tag + "|" + id + "|" + r.URL.Query().Encode()
+	if p.Vary != nil {
+		key = key + "|" + p.Vary(pb)
+	}
+	if v, ok := self.Store.Get(key); ok {
+		return v, nil
+	}
+	v, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	self.Store.Put(key, tag, v, time.Now().Add(p.TTL))
+	return v, nil
+}
+
+//Invalidate removes the tenant's entries for the collection at tag and
+//everything below it.  Other tenants' entries are kept.
+func (self *ResponseCache) Invalidate(tenant string, tag string) {
+	self.Store.Invalidate(cacheTag(tenant, tag))
+}
+
+//cacheTag is the tag of the tenant's entries for the collection path.
+func cacheTag(tenant string, path string) string {
+	return tenant + "|" + path
+}
+
+//LRUCacheStore is an in-memory CacheStore that holds at most a fixed number
+//of entries, discarding the least recently used when it is full.  The keys
+//are indexed by tag, so invalidation only visits the entries it removes.
+type LRUCacheStore struct {
+	max   int
+	order *list.List
+	items map[string]*list.Element
+	tags  *tagNode
+	lock  sync.Mutex
+}
+
+//tagNode holds the keys of the entries with one tag, and the nodes of the
+//tags below it, one for each further segment of the tag.
+type tagNode struct {
+	keys     map[string]bool
+	children map[string]*tagNode
+}
+
+func newTagNode() *tagNode {
+	return &tagNode{keys: make(map[string]bool), children: make(map[string]*tagNode)}
+}
+
+//collect appends the keys of this node and all the nodes below it.
+func (self *tagNode) collect(keys []string) []string {
+	for k := range self.keys {
+		keys = append(keys, k)
+	}
+	for _, child := range self.children {
+		keys = child.collect(keys)
+	}
+	return keys
+}
+
+type lruEntry struct {
+	key     string
+	tag     string
+	value   interface{}
+	expires time.Time
+}
+
+//NewLRUCacheStore returns an LRUCacheStore that holds at most max entries.
+func NewLRUCacheStore(max int) *LRUCacheStore {
+	return &LRUCacheStore{
+		max:   max,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+		tags:  newTagNode(),
+	}
+}
+
+//Get returns the value at key and marks it as recently used.  Expired
+//values are removed and not returned.
+func (self *LRUCacheStore) Get(key string) (interface{}, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	elem, ok := self.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if entry.expires.Before(time.Now()) {
+		self.remove(elem)
+		return nil, false
+	}
+	self.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+//Put stores the value at key, evicting the least recently used entry if
+//the store is full.
+func (self *LRUCacheStore) Put(key string, tag string, value interface{}, expires time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if elem, ok := self.items[key]; ok {
+		self.remove(elem)
+	}
+	self.items[key] = self.order.PushFront(&lruEntry{key, tag, value, expires})
+	node := self.tags
+	for _, seg := range strings.Split(tag, "/") {
+		child, ok := node.children[seg]
+		if !ok {
+			child = newTagNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+	node.keys[key] = true
+	for self.order.Len() > self.max {
+		self.remove(self.order.Back())
+	}
+}
+
+//Invalidate removes all entries with the tag given or a tag below it.
+func (self *LRUCacheStore) Invalidate(tag string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	node := self.tags
+	for _, seg := range strings.Split(tag, "/") {
+		if node = node.children[seg]; node == nil {
+			return
+		}
+	}
+	for _, key := range node.collect(nil) {
+		self.remove(self.items[key])
+	}
+}
+
+//Len returns the number of entries currently held, including any that have
+//expired but not yet been removed.
+func (self *LRUCacheStore) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.order.Len()
+}
+
+//remove drops the entry and prunes the tag nodes left empty by it.
+func (self *LRUCacheStore) remove(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	self.order.Remove(elem)
+	delete(self.items, entry.key)
+	segs := strings.Split(entry.tag, "/")
+	path := []*tagNode{self.tags}
+	for _, seg := range segs {
+		path = append(path, path[len(path)-1].children[seg])
+	}
+	delete(path[len(segs)].keys, entry.key)
+	for i := len(segs); i > 0; i-- {
+		if len(path[i].keys) > 0 || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, segs[i-1])
+	}
+}
@@ -0,0 +1,179 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheStore(t *testing.T) {
+	store := NewLRUCacheStore(2)
+	future := time.Now().Add(time.Hour)
+
+	store.Put("a", "foo", 1, future)
+	store.Put("b", "foo/1/bar", 2, future)
+	if _, ok := store.Get("a"); !ok { //a is now most recent
+		t.Fatalf("failed to find a")
+	}
+	store.Put("c", "baz", 3, future)
+	if _, ok := store.Get("b"); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if v, ok := store.Get("c"); !ok || v.(int) != 3 {
+		t.Errorf("failed to find c: %v", v)
+	}
+
+	store.Put("d", "baz", 4, time.Now().Add(-1*time.Second))
+	if _, ok := store.Get("d"); ok {
+		t.Errorf("expected d to be expired")
+	}
+
+	store.Put("e", "foo/1/bar", 5, future)
+	store.Put("f", "foobar", 6, future)
+	store.Invalidate("foo")
+	if _, ok := store.Get("e"); ok {
+		t.Errorf("expected e to be invalidated with its parent")
+	}
+	if _, ok := store.Get("f"); !ok {
+		t.Errorf("foobar is not below foo, should not be invalidated")
+	}
+	store.Invalidate("foobar")
+	if store.Len() != 0 || len(store.tags.children) != 0 {
+		t.Errorf("expected the tags of removed entries to be pruned: %+v", store.tags.children)
+	}
+}
+
+func TestResponseCacheTenants(t *testing.T) {
+	c := NewResponseCache(NewLRUCacheStore(10))
+	c.Cache(&someWire{}, time.Hour, CacheShared)
+	d := &restShared{typ: reflect.TypeOf(&someWire{})}
+	r := httptest.NewRequest("GET", "/rest/somewire", nil)
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	lookup := func(tenant string) interface{} {
+		pb := &simplePBundle{}
+		setBundleTenant(pb, tenant)
+		v, _ := c.Lookup(d, "somewire", "", r, pb, fn)
+		return v
+	}
+	acme, other := lookup("acme"), lookup("other")
+	if acme == other || lookup("acme") != acme {
+		t.Fatalf("expected an entry for each tenant: %v %v", acme, other)
+	}
+	c.Invalidate("acme", "somewire")
+	if lookup("acme") == acme {
+		t.Errorf("expected the tenant's entry to be invalidated")
+	}
+	if lookup("other") != other {
+		t.Errorf("expected the other tenant's entry to be kept")
+	}
+}
+
+/*---------------------------------------------------------------------------------------*/
+
+type countingResource struct {
+	index, find int
+}
+
+func (self *countingResource) Index(pb PBundle) (interface{}, error) {
+	self.index++
+	return []*someWire{&someWire{1, "index"}}, nil
+}
+func (self *countingResource) Find(id int64, pb PBundle) (interface{}, error) {
+	self.find++
+	return &someWire{id, "find"}, nil
+}
+func (self *countingResource) Post(i interface{}, pb PBundle) (interface{}, error) {
+	return &someWire{2, "post"}, nil
+}
+func (self *countingResource) Put(id int64, i interface{}, pb PBundle) (interface{}, error) {
+	return &someWire{id, "put"}, nil
+}
+func (self *countingResource) Delete(id int64, pb PBundle) (interface{}, error) {
+	return &someWire{id, "delete"}, nil
+}
+
+func TestResponseCache(t *testing.T) {
+	res := &countingResource{}
+	sub := &someSubResource{}
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.Rez(&someWire{}, res)
+	raw.SubResourceSeparate(&someWire{}, &someSubWire{}, sub, sub, sub, sub, sub)
+	raw.Cache = NewResponseCache(NewLRUCacheStore(100))
+	raw.Cache.Cache(&someWire{}, time.Hour, nil)
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := new(http.Client)
+
+	for i := 0; i < 3; i++ {
+		makeRequestAndCheckStatus(t, client, "GET", server.URL+"/rest/somewire", "", http.StatusOK, true)
+		makeRequestAndCheckStatus(t, client, "GET", server.URL+"/rest/somewire/7", "", http.StatusOK, false)
+	}
+	if res.index != 1 || res.find != 1 {
+		t.Fatalf("expected one call each to Index and Find, got %d and %d", res.index, res.find)
+	}
+
+	//different query is a different entry
+	makeRequestAndCheckStatus(t, client, "GET", server.URL+"/rest/somewire/7?x=1", "", http.StatusOK, false)
+	if res.find != 2 {
+		t.Errorf("expected query parameters to be part of the key")
+	}
+
+	//a mutation on the child collection does not touch the parent
+	body := "{ \"Id\":-1, \"Bar\":\"grak\"}"
+	req := makeReq(t, "POST", server.URL+"/rest/somewire/7/somesubwire", body)
+	resp, err := client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+	makeRequestAndCheckStatus(t, client, "GET", server.URL+"/rest/somewire", "", http.StatusOK, true)
+	if res.index != 1 {
+		t.Errorf("child mutation should not invalidate parent")
+	}
+	if res.find != 3 {
+		t.Errorf("expected the parent Find during dispatch to bypass the cache")
+	}
+
+	makeRequestAndCheckStatus(t, client, "PUT", server.URL+"/rest/somewire/7", "{}", http.StatusOK, false)
+	makeRequestAndCheckStatus(t, client, "GET", server.URL+"/rest/somewire", "", http.StatusOK, true)
+	makeRequestAndCheckStatus(t, client, "GET", server.URL+"/rest/somewire/7", "", http.StatusOK, false)
+	if res.index != 2 || res.find != 4 {
+		t.Errorf("expected PUT to invalidate, got %d and %d calls", res.index, res.find)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	anon := &simplePBundle{}
+	fred1 := &simplePBundle{s: &SimpleSession{id: "a", uniq: "fred", ud: &rolesUser{"fred", []string{"b", "a"}}}}
+	fred2 := &simplePBundle{s: &SimpleSession{id: "b", uniq: "fred", ud: &rolesUser{"fred", []string{"a", "b"}}}}
+	barney := &simplePBundle{s: &SimpleSession{id: "c", uniq: "barney", ud: &rolesUser{"barney", []string{"a"}}}}
+	noUniq := &simplePBundle{s: &SimpleSession{id: "fred"}}
+
+	if CacheVaryByUser(fred1) != CacheVaryByUser(fred2) || CacheVaryByUser(fred1) == CacheVaryByUser(barney) {
+		t.Errorf("expected users to be kept apart but not their sessions")
+	}
+	if CacheVaryByUser(noUniq) == CacheVaryByUser(fred1) || CacheVaryByUser(anon) == CacheVaryByUser(noUniq) {
+		t.Errorf("a session without a unique id should not share with a user or the anonymous")
+	}
+	if CacheVaryBySession(fred1) == CacheVaryBySession(fred2) {
+		t.Errorf("expected sessions to be kept apart")
+	}
+	if CacheVaryByRole(fred1) != CacheVaryByRole(fred2) || CacheVaryByRole(fred1) == CacheVaryByRole(barney) ||
+		CacheVaryByRole(anon) == CacheVaryByRole(barney) {
+		t.Errorf("expected roles, in any order, to decide the entry")
+	}
+
+	//nil vary is by user
+	c := NewResponseCache(NewLRUCacheStore(10))
+	c.Cache(&someWire{}, time.Hour, nil)
+	if p := c.policy(reflect.TypeOf(&someWire{})); p.Vary(fred1) != CacheVaryByUser(fred1) {
+		t.Errorf("expected the default vary to be by user")
+	}
+}
@@ -1,10 +1,16 @@
 package client
 
 const (
-	AUTH_OP_LOGIN         = "login"
-	AUTH_OP_LOGOUT        = "logout"
-	AUTH_OP_PWD_RESET     = "pwdreset"
-	AUTH_OP_PWD_RESET_REQ = "pwdresetreq"
+	AUTH_OP_LOGIN          = "login"
+	AUTH_OP_LOGIN_REMEMBER = "loginremember"
+	AUTH_OP_LOGIN_TOTP     = "logintotp"
+	AUTH_OP_LOGOUT         = "logout"
+	AUTH_OP_LOGOUT_ALL     = "logoutall"
+	AUTH_OP_PWD_RESET      = "pwdreset"
+	AUTH_OP_PWD_RESET_REQ  = "pwdresetreq"
+	AUTH_OP_TOTP_ENROLL    = "totpenroll"
+	AUTH_OP_TOTP_CONFIRM   = "totpconfirm"
+	AUTH_OP_TOTP_DISABLE   = "totpdisable"
 )
 
 type PasswordAuthParameters struct {
@@ -13,4 +19,16 @@ type PasswordAuthParameters struct {
 	ResetRequestUdid string
 	UserUdid         string
 	Op               string
+	Token            string
+	Code             string
+}
+
+type TOTPEnrollment struct {
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+type TwoFactorChallenge struct {
+	Token string
 }
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"fmt"
+)
+
+//Link is a single link in the _links object sent by a server that is
+//decorating its responses with links.
+type Link struct {
+	Href string `json:"href"`
+}
+
+//Links is the type to embed in a wire type to receive the links the server
+//computed for an object.  It should be declared as
+//	Links Links `json:"_links,omitempty"`
+//so that it is ignored when the object is sent back to the server.
+type Links map[string]Link
+
+//Href returns the url for the relation rel and true, or "" and false
+//if the server did not send such a link.
+func (self Links) Href(rel string) (string, bool) {
+	l, ok := self[rel]
+	if !ok {
+		return "", false
+	}
+	return l.Href, true
+}
+
+//AjaxFollow behaves like AjaxGet with the url taken from the link rel
+//in links.  If there is no such link, the error channel is sent the
+//code 404 and no call to the server is made.
+func AjaxFollow(ptrToStruct interface{}, links Links, rel string) (chan interface{}, chan AjaxError) {
+	href, ok := links.Href(rel)
+	if !ok {
+		return noSuchLink(rel)
+	}
+	return AjaxGet(ptrToStruct, href)
+}
+
+//AjaxFollowIndex behaves like AjaxIndex with the url taken from the link
+//rel in links.  This is typically used with the link named for a
+//subresource.  If there is no such link, the error channel is sent the
+//code 404 and no call to the server is made.
+func AjaxFollowIndex(ptrToSliceOfPtrToStruct interface{}, links Links, rel string) (chan interface{}, chan AjaxError) {
+	href, ok := links.Href(rel)
+	if !ok {
+		return noSuchLink(rel)
+	}
+	return AjaxIndex(ptrToSliceOfPtrToStruct, href)
+}
+
+func noSuchLink(rel string) (chan interface{}, chan AjaxError) {
+	contentCh := make(chan interface{})
+	errCh := make(chan AjaxError)
+	go func() {
+		errCh <- AjaxError{404, fmt.Sprintf("no link named %s", rel)}
+	}()
+	return contentCh, errCh
+}
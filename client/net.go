@@ -11,6 +11,12 @@ import (
 	"github.com/gopherjs/jquery"
 )
 
+const (
+	//CSRF_COOKIE and CSRF_HEADER must match the server side's.
+	CSRF_COOKIE = "seven5-csrf"
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
 // AjaxError is returned on the error channel after a call to an Ajax method.
 type AjaxError struct {
 	StatusCode int
@@ -76,7 +82,9 @@ func AjaxGet(ptrToStruct interface{}, path string) (chan interface{}, chan AjaxE
 }
 
 //AjaxRawChannels is the lower level interface to the "raw" Ajax call.  Most users
-//should use AjaxGet, AjaxPost, AjaxIndex or AjaxPut.
+//should use AjaxGet, AjaxPost, AjaxIndex or AjaxPut.  Requests other than GET and
+//HEAD carry the csrf token from the cookie CSRF_COOKIE in the header CSRF_HEADER,
+//if there is such a cookie.
 func AjaxRawChannels(output interface{}, body string, contentChan chan interface{}, errChan chan AjaxError,
 	method string, path string, extraHeaders map[string]interface{}) error {
 
@@ -90,6 +98,15 @@ func AjaxRawChannels(output interface{}, body string, contentChan chan interface
 	if body != "" {
 		m["data"] = body
 	}
+	if method != "GET" && method != "HEAD" {
+		if token := csrfToken(); token != "" {
+			headers := map[string]interface{}{CSRF_HEADER: token}
+			for k, v := range extraHeaders {
+				headers[k] = v
+			}
+			extraHeaders = headers
+		}
+	}
 	if extraHeaders != nil {
 		m["headers"] = extraHeaders
 	}
@@ -219,3 +236,14 @@ func getFieldName(f reflect.StructField) string {
 	}
 	return f.Name
 }
+
+//csrfToken returns the value of the cookie CSRF_COOKIE, or "" if there is none.
+func csrfToken() string {
+	for _, c := range strings.Split(js.Global.Get("document").Get("cookie").String(), ";") {
+		c = strings.TrimSpace(c)
+		if strings.HasPrefix(c, CSRF_COOKIE+"=") {
+			return c[len(CSRF_COOKIE)+1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package seven5
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock is the source of the current time for code whose behavior depends
+//on it, such as session expiration.  Tests can supply a FakeClock to control
+//time.
+type Clock interface {
+	Now() time.Time
+}
+
+//SystemClock is the Clock that returns the real time.
+type SystemClock struct {
+}
+
+//Now returns time.Now().
+func (self *SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+//FakeClock is a Clock whose time only changes when Set or Advance is called.
+type FakeClock struct {
+	now  time.Time
+	lock sync.Mutex
+}
+
+//NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+//Now returns the clock's current time.
+func (self *FakeClock) Now() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.now
+}
+
+//Set changes the clock's current time.
+func (self *FakeClock) Set(t time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.now = t
+}
+
+//Advance moves the clock's current time forward by d.
+func (self *FakeClock) Advance(d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.now = self.now.Add(d)
+}
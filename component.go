@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 )
 
 //SimpleIdComponent is designed to allow urls like /foo/1 to work.  IdComponent serves
@@ -295,6 +295,7 @@ type SimpleComponentMatcher struct {
 	cm       CookieMapper
 	sm       SessionManager
 	isTest   bool
+	tenants  TenantResolver
 }
 
 //NewSimpleComponentMatcher takes any number of StaticComponent objects and
@@ -323,6 +324,28 @@ func (c *SimpleComponentMatcher) AddComponents(sc ...StaticComponent) {
 	c.comp = append(c.comp, sc...)
 }
 
+//SetTenantResolver makes the matcher determine the tenant of each request
+//with the resolver given.  When a request has a tenant, a file in the
+//directory basedir/tenants/<tenant> is served in preference to the file at
+//the same path under basedir, so tenants can override some of the static
+//content.
+func (c *SimpleComponentMatcher) SetTenantResolver(t TenantResolver) {
+	c.tenants = t
+}
+
+//tenantFilepath returns the path of the file that overrides path for the
+//given tenant, or "" if there can be no such file.
+func (c *SimpleComponentMatcher) tenantFilepath(tenant, path string) string {
+	if tenant == "" || tenant == "." || tenant == ".." || strings.ContainsAny(tenant, "/\\") {
+		return ""
+	}
+	rel, err := filepath.Rel(c.basedir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.Join(c.basedir, TENANT_DIR, tenant, rel)
+}
+
 //FormFilepath is used to convert a url like "/foo/123/view.html" into
 //"/en/web/foo/123/view.html" for processing in the filesystem.  If the lang
 //and ui are already present in the path, such as /fr/mobile/foo/123/view.html,
@@ -466,7 +489,7 @@ func (self *SimpleComponentMatcher) ServeHTTP(w http.ResponseWriter, r *http.Req
 		//it's a no cookie, which is not a problem
 	} else {
 		//we had a cookie, let's try to look it up
-		rtn, err := self.sm.Find(id)
+		rtn, err := findSession(self.sm, id, r)
 		if err != nil {
 			log.Printf("[SERVE] error trying to find session (%s): %v", r.URL.Path, err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -482,20 +505,26 @@ func (self *SimpleComponentMatcher) ServeHTTP(w http.ResponseWriter, r *http.Req
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
-				session, err = self.sm.Assign(rtn.UniqueId, sd, time.Time{})
+				session, err = assignSession(self.sm, rtn.UniqueId, sd, r)
 				if err != nil {
 					log.Printf("[SERVE] error trying to assign session (%s): %v", r.URL.Path, err)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				//the new session has a new id
+				self.cm.AssociateCookie(w, session)
 			} else {
 				//this means that the Find() returned a session object inside rtn
 				session = rtn.Session
+				if rtn.Renewed {
+					self.cm.AssociateCookie(w, session)
+				}
 			}
 		}
 	}
 
 	//session, if there is one, is assigned here to the correct session
+	session = bindSession(self.sm, session, w)
 	pbundle, err := NewSimplePBundle(r, session, self.sm)
 	if err != nil {
 		log.Printf("[SERVE] error trying to create parameter bundle (%s): %v", r.URL.Path, err)
@@ -503,9 +532,31 @@ func (self *SimpleComponentMatcher) ServeHTTP(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	result := self.Match(pbundle, r.URL.Path)
+	path := r.URL.Path
+	tenantPrefix := ""
+	if self.tenants != nil {
+		parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		tenant, rest, err := resolveTenant(self.tenants, r, parts, pbundle)
+		if err != nil {
+			log.Printf("[SERVE] unable to determine tenant (%s): %v", r.URL.Path, err)
+			if e, ok := err.(*Error); ok {
+				http.Error(w, e.Msg, e.StatusCode)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		setBundleTenant(pbundle, tenant)
+		if len(rest) < len(parts) {
+			tenantPrefix = "/" + strings.Join(parts[:len(parts)-len(rest)], "/")
+		}
+		path = "/" + strings.Join(rest, "/")
+	}
+
+	result := self.Match(pbundle, path)
 	if result.Status != http.StatusOK {
 		if result.Status == http.StatusMovedPermanently {
+			result.Redir = tenantPrefix + result.Redir
 			log.Printf("[REDIR] %+v -> %v", r.URL, result.Redir)
 			http.Redirect(w, r, result.Redir, result.Status)
 		} else {
@@ -518,6 +569,11 @@ func (self *SimpleComponentMatcher) ServeHTTP(w http.ResponseWriter, r *http.Req
 			return
 		}
 		finalPath := self.FormFilepath("en", "web", result.Path)
+		if override := self.tenantFilepath(BundleTenant(pbundle), finalPath); override != "" {
+			if info, err := os.Stat(override); err == nil && !info.IsDir() {
+				finalPath = override
+			}
+		}
 		if self.isTest {
 			path := GopathSearch(result.Path)
 			if path != "" {
@@ -0,0 +1,320 @@
+package seven5
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	//DEFAULT_RESET_LIFETIME is how long a password reset request can be used.
+	DEFAULT_RESET_LIFETIME = time.Hour
+)
+
+//Credential is the password of a user as it is stored.  Hash is made by a
+//PasswordHasher.  ResetHash is the hash of the pending password reset
+//request, if there is one.  The TOTP fields are the user's TwoFactorState.
+type Credential struct {
+	UniqueId     string
+	Username     string
+	Hash         string
+	ResetHash    string
+	ResetExpires time.Time
+	Updated      time.Time
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+	Recovery     []string
+}
+
+//CredentialStore keeps credentials.  Load and LoadUnique return nil, nil for
+//a user that is not in the store.  Implementations must be safe to use from
+//multiple goroutines.
+type CredentialStore interface {
+	Load(username string) (*Credential, error)
+	LoadUnique(uniqueId string) (*Credential, error)
+	Save(*Credential) error
+	Delete(uniqueId string) error
+	//SwapTwoFactor sets the TOTP fields of the credential of the unique id
+	//to state, if they are still old (see SameTwoFactor), atomically.
+	SwapTwoFactor(uniqueId string, old, state *TwoFactorState) (bool, error)
+}
+
+//MemoryCredentialStore keeps credentials in a map, so they are lost at exit.
+//This is mostly useful for tests.
+type MemoryCredentialStore struct {
+	lock  sync.Mutex
+	creds map[string]*Credential
+}
+
+//NewMemoryCredentialStore returns an empty MemoryCredentialStore.
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{creds: make(map[string]*Credential)}
+}
+
+//Load returns a copy of the credential of the username.
+func (self *MemoryCredentialStore) Load(username string) (*Credential, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, c := range self.creds {
+		if c.Username == username {
+			cp := *c
+			return &cp, nil
+		}
+	}
+	return nil, nil
+}
+
+//LoadUnique returns a copy of the credential of the unique id.
+func (self *MemoryCredentialStore) LoadUnique(uniqueId string) (*Credential, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c, ok := self.creds[uniqueId]
+	if !ok {
+		return nil, nil
+	}
+	cp := *c
+	return &cp, nil
+}
+
+//Save stores a copy of the credential.
+func (self *MemoryCredentialStore) Save(c *Credential) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	cp := *c
+	self.creds[c.UniqueId] = &cp
+	return nil
+}
+
+//Delete removes the credential of the unique id.
+func (self *MemoryCredentialStore) Delete(uniqueId string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.creds, uniqueId)
+	return nil
+}
+
+//twoFactor returns the two factor state in the credential, or nil.
+func (self *Credential) twoFactor() *TwoFactorState {
+	if self.TOTPSecret == "" {
+		return nil
+	}
+	return &TwoFactorState{Secret: self.TOTPSecret, Enabled: self.TOTPEnabled, LastStep: self.TOTPLastStep,
+		Recovery: append([]string(nil), self.Recovery...)}
+}
+
+//setTwoFactor replaces the two factor state in the credential; nil removes
+//it.
+func (self *Credential) setTwoFactor(state *TwoFactorState) {
+	if state == nil {
+		state = &TwoFactorState{}
+	}
+	self.TOTPSecret = state.Secret
+	self.TOTPEnabled = state.Enabled
+	self.TOTPLastStep = state.LastStep
+	self.Recovery = append([]string(nil), state.Recovery...)
+}
+
+//SwapTwoFactor replaces the two factor state of the unique id if it is old.
+func (self *MemoryCredentialStore) SwapTwoFactor(uniqueId string, old, state *TwoFactorState) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c, ok := self.creds[uniqueId]
+	if !ok || !SameTwoFactor(c.twoFactor(), old) {
+		return false, nil
+	}
+	c.setTwoFactor(state)
+	return true, nil
+}
+
+//PasswordSessionManager is a ValidatingSessionManager wrapped around a
+//SimpleSessionManager that checks passwords against a CredentialStore.  With
+//a QbsCredentialStore, this is a complete password login for applications
+//that use QBS.  Hashes are checked with the PasswordHasher and, when a user
+//logs in with a hash made with older settings, the hash is replaced.  The
+//user data of a session is the result of the session manager's Generate for
+//the unique id.  It is also a TwoFactorSessionManager.
+type PasswordSessionManager struct {
+	*SimpleSessionManager
+	store  CredentialStore
+	hasher *PasswordHasher
+	clock  Clock
+	dummy  string
+	once   sync.Once
+	resets sync.WaitGroup
+	//ResetLifetime is how long a reset request can be used, the default is
+	//DEFAULT_RESET_LIFETIME.
+	ResetLifetime time.Duration
+	//SendReset, if not nil, delivers the id of a new reset request to the
+	//user, typically by email.  Without it, reset requests can't be used.
+	SendReset func(c *Credential, requestId string) error
+}
+
+//NewPasswordSessionManager returns a PasswordSessionManager for the session
+//manager and store given.  If hasher is nil, the result of
+//NewPasswordHasher is used; if clock is nil, the SystemClock is used.
+func NewPasswordSessionManager(sm *SimpleSessionManager, store CredentialStore, hasher *PasswordHasher, clock Clock) *PasswordSessionManager {
+	if hasher == nil {
+		hasher = NewPasswordHasher()
+	}
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+	return &PasswordSessionManager{
+		SimpleSessionManager: sm,
+		store:                store,
+		hasher:               hasher,
+		clock:                clock,
+		ResetLifetime:        DEFAULT_RESET_LIFETIME,
+	}
+}
+
+//SetPassword creates or replaces the password of the unique id.  Any reset
+//request is cancelled.
+func (self *PasswordSessionManager) SetPassword(uniq, username, pwd string) error {
+	if pwd == "" {
+		return HTTPError(http.StatusBadRequest, "password can't be empty")
+	}
+	hash, err := self.hasher.Hash(pwd)
+	if err != nil {
+		return err
+	}
+	c, err := self.store.LoadUnique(uniq)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		c = &Credential{UniqueId: uniq}
+	}
+	c.Username = username
+	c.Hash = hash
+	c.ResetHash = ""
+	c.ResetExpires = time.Time{}
+	c.Updated = self.clock.Now()
+	return self.store.Save(c)
+}
+
+//LoadTwoFactor returns the two factor state of the unique id, or nil if it
+//has none.
+func (self *PasswordSessionManager) LoadTwoFactor(uniq string) (*TwoFactorState, error) {
+	c, err := self.store.LoadUnique(uniq)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return c.twoFactor(), nil
+}
+
+//SwapTwoFactor stores the two factor state of the unique id if the stored
+//state is still old.  A nil state removes it.
+func (self *PasswordSessionManager) SwapTwoFactor(uniq string, old, state *TwoFactorState) (bool, error) {
+	return self.store.SwapTwoFactor(uniq, old, state)
+}
+
+//wasteTime checks the password against a hash that can't match, so that a
+//login with an unknown username takes as long as one with a bad password.
+func (self *PasswordSessionManager) wasteTime(pwd string) {
+	self.once.Do(func() {
+		self.dummy, _ = self.hasher.Hash(hex.EncodeToString(apiKeyRandom(16)))
+	})
+	self.hasher.Verify(pwd, self.dummy)
+}
+
+//ValidateCredentials returns the unique id and user data of the user if the
+//password is right, or "" if it is not.
+func (self *PasswordSessionManager) ValidateCredentials(username, pwd string) (string, interface{}, error) {
+	c, err := self.store.Load(username)
+	if err != nil {
+		return "", nil, err
+	}
+	if c == nil || c.Hash == "" {
+		self.wasteTime(pwd)
+		return "", nil, nil
+	}
+	ok, rehash, err := self.hasher.Verify(pwd, c.Hash)
+	if err != nil {
+		//take as long as a real check, so a bad hash can't be told apart
+		self.wasteTime(pwd)
+		log.Printf("[PASSWORD] unable to check password of %s: %v", c.UniqueId, err)
+		return "", nil, nil
+	}
+	if !ok {
+		return "", nil, nil
+	}
+	if rehash {
+		if err := self.SetPassword(c.UniqueId, c.Username, pwd); err != nil {
+			log.Printf("[PASSWORD] unable to upgrade password hash of %s: %v", c.UniqueId, err)
+		}
+	}
+	ud, err := self.Generate(c.UniqueId)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.UniqueId, ud, nil
+}
+
+//SendUserDetails sends the user data to the client as json.
+func (self *PasswordSessionManager) SendUserDetails(i interface{}, w http.ResponseWriter) error {
+	return SendJson(w, i)
+}
+
+//GenerateResetRequest creates a reset request for the username and gives it
+//to SendReset.  Only the hash of the request's id is stored and the id is
+//never returned, the result is always "".  The request is made in the
+//background, so a username that is not known takes as long as one that is
+//and the caller can't tell which usernames exist; failures are logged.
+func (self *PasswordSessionManager) GenerateResetRequest(username string) (string, error) {
+	if self.SendReset == nil {
+		return "", HTTPError(http.StatusNotImplemented, "password reset is not available")
+	}
+	self.resets.Add(1)
+	go func() {
+		defer self.resets.Done()
+		if err := self.sendReset(username); err != nil {
+			log.Printf("[PASSWORD] unable to make reset request: %v", err)
+		}
+	}()
+	return "", nil
+}
+
+//sendReset stores a new reset request for the username, if it is known, and
+//gives its id to SendReset.
+func (self *PasswordSessionManager) sendReset(username string) error {
+	c, err := self.store.Load(username)
+	if err != nil || c == nil {
+		return err
+	}
+	id := hex.EncodeToString(apiKeyRandom(16))
+	c.ResetHash = apiKeyHash(id)
+	c.ResetExpires = self.clock.Now().Add(self.ResetLifetime)
+	if err := self.store.Save(c); err != nil {
+		return err
+	}
+	if err := self.SendReset(c, id); err != nil {
+		return fmt.Errorf("unable to send reset request to %s: %v", c.UniqueId, err)
+	}
+	return nil
+}
+
+//UseResetRequest sets the password of the unique id if the reset request
+//is the user's current one and has not expired.  A request can only be used
+//once.
+func (self *PasswordSessionManager) UseResetRequest(uniq, requestId, pwd string) (bool, error) {
+	c, err := self.store.LoadUnique(uniq)
+	if err != nil || c == nil || c.ResetHash == "" || pwd == "" {
+		return false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKeyHash(requestId)), []byte(c.ResetHash)) != 1 {
+		return false, nil
+	}
+	if !self.clock.Now().Before(c.ResetExpires) {
+		return false, nil
+	}
+	if err := self.SetPassword(c.UniqueId, c.Username, pwd); err != nil {
+		return false, err
+	}
+	return true, nil
+}
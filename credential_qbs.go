@@ -0,0 +1,169 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	CREDENTIAL_TABLE = "credential_record"
+)
+
+//CredentialRecord is the row type used by QbsCredentialStore.  Recovery is
+//the hashes of the recovery codes, separated by spaces.
+type CredentialRecord struct {
+	Id           int64
+	UniqueId     string
+	Username     string
+	Hash         string
+	ResetHash    string
+	ResetExpires time.Time
+	Updated      time.Time
+	TotpSecret   string
+	TotpEnabled  bool
+	TotpLastStep int64
+	Recovery     string
+}
+
+//QbsCredentialStore keeps credentials in the credential_record table, which
+//can be created with CredentialMigrationUp.
+type QbsCredentialStore struct {
+	store *QbsStore
+}
+
+//NewQbsCredentialStore returns a credential store that uses the database of
+//the QbsStore given.
+func NewQbsCredentialStore(s *QbsStore) *QbsCredentialStore {
+	return &QbsCredentialStore{store: s}
+}
+
+func (self *QbsCredentialStore) find(q *qbs.Qbs, field, value string) (*CredentialRecord, error) {
+	rec := &CredentialRecord{}
+	err := q.WhereEqual(field, value).Find(rec)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (self *QbsCredentialStore) load(field, value string) (*Credential, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rec, err := self.find(q, field, value)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	return &Credential{UniqueId: rec.UniqueId, Username: rec.Username, Hash: rec.Hash,
+		ResetHash: rec.ResetHash, ResetExpires: rec.ResetExpires, Updated: rec.Updated,
+		TOTPSecret: rec.TotpSecret, TOTPEnabled: rec.TotpEnabled, TOTPLastStep: rec.TotpLastStep,
+		Recovery: strings.Fields(rec.Recovery)}, nil
+}
+
+//Load reads the row of the username.
+func (self *QbsCredentialStore) Load(username string) (*Credential, error) {
+	return self.load("username", username)
+}
+
+//LoadUnique reads the row of the unique id.
+func (self *QbsCredentialStore) LoadUnique(uniqueId string) (*Credential, error) {
+	return self.load("unique_id", uniqueId)
+}
+
+//Save creates or updates the row of the credential's unique id.
+func (self *QbsCredentialStore) Save(c *Credential) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	rec, err := self.find(q, "unique_id", c.UniqueId)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		rec = &CredentialRecord{UniqueId: c.UniqueId}
+	}
+	rec.Username = c.Username
+	rec.Hash = c.Hash
+	rec.ResetHash = c.ResetHash
+	rec.ResetExpires = c.ResetExpires
+	rec.Updated = c.Updated
+	rec.TotpSecret = c.TOTPSecret
+	rec.TotpEnabled = c.TOTPEnabled
+	rec.TotpLastStep = c.TOTPLastStep
+	rec.Recovery = strings.Join(c.Recovery, " ")
+	_, err = q.Save(rec)
+	return err
+}
+
+//Delete removes the row of the unique id.
+func (self *QbsCredentialStore) Delete(uniqueId string) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.WhereEqual("unique_id", uniqueId).Delete(&CredentialRecord{})
+	return err
+}
+
+//SwapTwoFactor updates the two factor columns of the unique id's row with a
+//single UPDATE that only matches if they still hold old.
+func (self *QbsCredentialStore) SwapTwoFactor(uniqueId string, old, state *TwoFactorState) (bool, error) {
+	if old == nil {
+		old = &TwoFactorState{}
+	}
+	if state == nil {
+		state = &TwoFactorState{}
+	}
+	q, err := self.store.Qbs()
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	result, err := q.Exec(fmt.Sprintf(`UPDATE %s SET totp_secret = ?, totp_enabled = ?,
+		totp_last_step = ?, recovery = ? WHERE unique_id = ? AND totp_secret = ? AND
+		totp_enabled = ? AND totp_last_step = ? AND recovery = ?`, CREDENTIAL_TABLE),
+		state.Secret, state.Enabled, state.LastStep, strings.Join(state.Recovery, " "), uniqueId,
+		old.Secret, old.Enabled, old.LastStep, strings.Join(old.Recovery, " "))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+//CredentialMigrationUp is a migration function (see the migrate package)
+//that creates the table used by QbsCredentialStore.  This is postgres
+//specific.
+func CredentialMigrationUp(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		id BIGSERIAL PRIMARY KEY,
+		unique_id VARCHAR(255) NOT NULL UNIQUE,
+		username VARCHAR(255) NOT NULL UNIQUE,
+		hash VARCHAR(255) NOT NULL,
+		reset_hash VARCHAR(128) NOT NULL DEFAULT '',
+		reset_expires TIMESTAMP WITH TIME ZONE,
+		updated TIMESTAMP WITH TIME ZONE NOT NULL,
+		totp_secret VARCHAR(64) NOT NULL DEFAULT '',
+		totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		totp_last_step BIGINT NOT NULL DEFAULT 0,
+		recovery TEXT NOT NULL DEFAULT '')`, CREDENTIAL_TABLE))
+	return err
+}
+
+//CredentialMigrationDown is the inverse of CredentialMigrationUp.
+func CredentialMigrationDown(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", CREDENTIAL_TABLE))
+	return err
+}
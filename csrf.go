@@ -0,0 +1,172 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	//CSRF_COOKIE is the name of the cookie that holds the token of the session.
+	//It is readable by javascript, unlike the session cookie should be.
+	CSRF_COOKIE = "seven5-csrf"
+	//CSRF_HEADER is the header that must hold the token on unsafe requests.
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
+//csrfSafeMethods don't change anything on the server, so they are not checked.
+var csrfSafeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+//CSRFGuard defends against cross site request forgery with two checks on
+//requests that are not GET, HEAD, OPTIONS or TRACE.  First, if the request
+//has an Origin header (or, failing that, a Referer) its scheme and host must
+//be those of the request or one of Origins; "Origin: null", sent by sandboxed
+//frames and some redirects, is always cross origin.  Second, if the request has a session
+//cookie, the header CSRF_HEADER must have the token of that session.  The
+//token is an HMAC of the session id, so it changes with the session id and
+//the server keeps no state for it.  The token is sent to the client in the
+//cookie CSRF_COOKIE (this is the "double submit" pattern) and the client
+//library copies it into the header.  Requests without a session cookie only
+//get the first check, as they carry no credentials a forger could use.
+type CSRFGuard struct {
+	key []byte
+	//Origins are the origins, such as "https://example.com", that may send
+	//requests in addition to the origin of the server.  The scheme of the
+	//server is https only if the request came over TLS, so a server behind a
+	//proxy that terminates TLS must list its public origin here.
+	Origins []string
+	//ExemptPaths are url path prefixes that are not checked, such as
+	//the path of a webhook called by another site.
+	ExemptPaths []string
+	//ExemptFunc, if not nil, is called for requests not otherwise exempt and
+	//if it returns true the request is not checked.
+	ExemptFunc func(*http.Request) bool
+}
+
+//NewCSRFGuard returns a guard that computes tokens with the key given.  If
+//the key is empty a random one is used; this is fine for a single server
+//but clients must get a new token after a restart.  Servers that share
+//sessions must share the key.
+func NewCSRFGuard(key []byte) *CSRFGuard {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic("unable to create csrf key: " + err.Error())
+		}
+	}
+	return &CSRFGuard{key: key}
+}
+
+//Token returns the token of the session id.
+func (self *CSRFGuard) Token(sessionId string) string {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(sessionId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Exempt returns true if the request is not checked.
+func (self *CSRFGuard) Exempt(r *http.Request) bool {
+	if csrfSafeMethods[r.Method] {
+		return true
+	}
+	for _, p := range self.ExemptPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return self.ExemptFunc != nil && self.ExemptFunc(r)
+}
+
+//Check returns nil if the request may proceed.  The sessionId is the value
+//of the session cookie in the request, or "" if there is none.  The error is
+//an Error with the code http.StatusForbidden.
+func (self *CSRFGuard) Check(r *http.Request, sessionId string) error {
+	if self.Exempt(r) {
+		return nil
+	}
+	if !self.sameOrigin(r) {
+		log.Printf("[CSRF] refused %s %s from origin %q referer %q", r.Method, r.URL.Path,
+			r.Header.Get("Origin"), r.Referer())
+		return HTTPError(http.StatusForbidden, "cross origin request refused")
+	}
+	if sessionId == "" {
+		return nil
+	}
+	token := r.Header.Get(CSRF_HEADER)
+	if token == "" || !hmac.Equal([]byte(token), []byte(self.Token(sessionId))) {
+		log.Printf("[CSRF] refused %s %s with missing or bad token", r.Method, r.URL.Path)
+		return HTTPError(http.StatusForbidden, "missing or bad csrf token")
+	}
+	return nil
+}
+
+//sameOrigin checks the Origin header, or the Referer if there is no Origin.
+//A request with neither is allowed, the token check has to catch it.
+func (self *CSRFGuard) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "null" {
+		return false
+	}
+	if origin == "" {
+		origin = r.Referer()
+		if origin == "" {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	o := u.Scheme + "://" + u.Host
+	for _, allowed := range self.Origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), o) {
+			return true
+		}
+	}
+	return false
+}
+
+//Issue sends the token of the session id to the client, unless the request
+//shows that the client already has it.  This should be called whenever the
+//session cookie is set.
+func (self *CSRFGuard) Issue(w http.ResponseWriter, r *http.Request, sessionId string) {
+	token := self.Token(sessionId)
+	if r != nil {
+		if c, err := r.Cookie(CSRF_COOKIE); err == nil && c.Value == token {
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:  CSRF_COOKIE,
+		Value: token,
+		Path:  "/",
+	})
+}
+
+//RemoveCookie removes the token from the client, for use when the session
+//cookie is removed.
+func (self *CSRFGuard) RemoveCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   CSRF_COOKIE,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
@@ -0,0 +1,155 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFGuard(t *testing.T) {
+	g := NewCSRFGuard([]byte("key"))
+	g.Origins = []string{"https://partner.example.com"}
+	g.ExemptPaths = []string{"/hooks/"}
+	token := g.Token("sid")
+	if token == g.Token("other") || token != NewCSRFGuard([]byte("key")).Token("sid") {
+		t.Fatalf("token should depend on the session id and key only")
+	}
+
+	cases := []struct {
+		method, path, origin, referer, token, sid string
+		ok                                        bool
+	}{
+		{"GET", "/rest/x", "https://evil.com", "", "", "sid", true},
+		{"POST", "/rest/x", "", "", "", "", true},
+		{"POST", "/rest/x", "https://evil.com", "", "", "", false},
+		{"POST", "/rest/x", "", "https://evil.com/page", token, "sid", false},
+		{"POST", "/rest/x", "null", "", token, "sid", false},
+		{"POST", "/rest/x", "", "", "", "sid", false},
+		{"POST", "/rest/x", "", "", g.Token("other"), "sid", false},
+		{"POST", "/rest/x", "", "", token, "sid", true},
+		{"PUT", "/rest/x", "http://example.com", "", token, "sid", true},
+		{"PUT", "/rest/x", "https://example.com", "", token, "sid", false},
+		{"PUT", "/rest/x", "", "http://example.com/page", token, "sid", true},
+		{"DELETE", "/rest/x", "https://partner.example.com", "", token, "sid", true},
+		{"POST", "/hooks/pay", "https://evil.com", "", "", "sid", true},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest(c.method, "http://example.com"+c.path, nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.referer != "" {
+			r.Header.Set("Referer", c.referer)
+		}
+		if c.token != "" {
+			r.Header.Set(CSRF_HEADER, c.token)
+		}
+		err := g.Check(r, c.sid)
+		if (err == nil) != c.ok {
+			t.Errorf("case %d: expected ok=%v but got %v", i, c.ok, err)
+		}
+		if e, isOurs := err.(*Error); err != nil && (!isOurs || e.StatusCode != http.StatusForbidden) {
+			t.Errorf("case %d: expected forbidden but got %v", i, err)
+		}
+	}
+
+	//the scheme of the server comes from the connection
+	for origin, ok := range map[string]bool{"https://example.com": true, "http://example.com": false} {
+		r := httptest.NewRequest("POST", "https://example.com/rest/x", nil)
+		r.Header.Set("Origin", origin)
+		if err := g.Check(r, ""); (err == nil) != ok {
+			t.Errorf("%s to a TLS server: expected ok=%v but got %v", origin, ok, err)
+		}
+	}
+}
+
+func TestCSRFBundleHook(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	cm := NewSimpleCookieMapper("test")
+	base := NewBaseDispatcher(sm, cm)
+	g := NewCSRFGuard(nil)
+	base.IO.(*RawIOHook).CSRF = g
+	r := NewSessionResource(sm)
+	base.ResourceSeparateUdid("Session", &SessionInfo{}, r, r, nil, nil, r)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", base)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s, _ := sm.Assign("fred", "data", time.Time{})
+	cookie := &http.Cookie{Name: cm.CookieName(), Value: s.SessionId()}
+
+	//a safe request gets the token
+	req, _ := http.NewRequest("GET", server.URL+"/rest/session", nil)
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	var token string
+	for _, c := range resp.Cookies() {
+		if c.Name == CSRF_COOKIE {
+			token = c.Value
+		}
+	}
+	if token != g.Token(s.SessionId()) {
+		t.Fatalf("expected token in cookie but got %q", token)
+	}
+
+	handle := sessionHandle("fred", s.SessionId())
+	req, _ = http.NewRequest("DELETE", server.URL+"/rest/session/"+handle, nil)
+	req.AddCookie(cookie)
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	if sr, _ := sm.Find(s.SessionId()); sr == nil || sr.Session == nil {
+		t.Fatalf("forged request should not destroy the session")
+	}
+
+	req.Header.Set(CSRF_HEADER, token)
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+}
+
+//updatingResource changes the user data of the session on every Post.
+type updatingResource struct{}
+
+func (self *updatingResource) Post(i interface{}, pb PBundle) (interface{}, error) {
+	if _, err := pb.UpdateSession(pb.Session().UserData().(string) + "+"); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func TestCSRFCookieSession(t *testing.T) {
+	sm := NewCookieSessionManager("test", nil, &SessionConfig{Keys: testSessionKeys()}, nil)
+	g := NewCSRFGuard(nil)
+	sm.SetCSRFGuard(g)
+	base := NewBaseDispatcher(sm, sm.CookieMapper())
+	base.IO.(*RawIOHook).CSRF = g
+	base.ResourceSeparate("Update", &someWire{}, nil, nil, &updatingResource{}, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", base)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s, _ := sm.Assign("fred", "data", time.Time{})
+	cookies := map[string]string{sm.CookieMapper().CookieName(): s.SessionId(), CSRF_COOKIE: g.Token(s.SessionId())}
+	post := func() {
+		req, _ := http.NewRequest("POST", server.URL+"/rest/update", strings.NewReader(`{"Foo":"x"}`))
+		for name, value := range cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		req.Header.Set(CSRF_HEADER, cookies[CSRF_COOKIE])
+		resp, err := http.DefaultClient.Do(req)
+		checkHttpStatus(t, resp, err, http.StatusCreated)
+		for _, c := range resp.Cookies() {
+			cookies[c.Name] = c.Value
+		}
+	}
+	post()
+	if cookies[CSRF_COOKIE] != g.Token(cookies[sm.CookieMapper().CookieName()]) {
+		t.Fatalf("expected the token of the updated session")
+	}
+	post()
+}
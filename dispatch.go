@@ -1,6 +1,7 @@
 package seven5
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"os"
@@ -20,7 +21,8 @@ type Dispatcher interface {
 //on top of the existing "handler" abstraction in the net/http package.
 type ServeMux struct {
 	*http.ServeMux
-	err ErrorDispatcher
+	err   ErrorDispatcher
+	cache *HTTPCachePolicy
 }
 
 //ErrorDispatcher is a special case of dispatcher that is only invoked when other Dispatchers return
@@ -28,7 +30,8 @@ type ServeMux struct {
 //The original response writer and request are passed to the ErrorDispatch() method to allow
 //the error dispatcher to take any action desired.  An error dispatcher that does nothing will
 //implicitly allow whatever calls the other dispatcher placed on the response writer to proceed.
-//ErrorDispatcher is also called when no dispatcher is found (404).
+//ErrorDispatch is called after the other dispatcher has finished, so the body it wrote for the
+//error is known (see ErrorBody).  ErrorDispatcher is also called when no dispatcher is found (404).
 type ErrorDispatcher interface {
 	ErrorDispatch(int, http.ResponseWriter, *http.Request)
 	PanicDispatch(interface{}, http.ResponseWriter, *http.Request)
@@ -38,7 +41,8 @@ type ErrorDispatcher interface {
 //handler, which may be nil.
 func NewServeMux() *ServeMux {
 	return &ServeMux{
-		http.NewServeMux(), nil,
+		ServeMux: http.NewServeMux(),
+		cache:    NO_CACHE_POLICY,
 	}
 }
 
@@ -50,11 +54,27 @@ func (self *ServeMux) SetErrorDispatcher(e ErrorDispatcher) {
 	self.err = e
 }
 
+//CachePolicy returns the cache policy applied to every dispatched response
+//before the dispatcher is called.
+func (self *ServeMux) CachePolicy() *HTTPCachePolicy {
+	return self.cache
+}
+
+//SetCachePolicy changes the cache policy applied to every dispatched response,
+//which is NO_CACHE_POLICY by default.  Dispatchers may replace it with their
+//own headers for particular responses, as the RawDispatcher does.
+func (self *ServeMux) SetCachePolicy(p *HTTPCachePolicy) {
+	self.cache = p
+}
+
 //ServeHTTP is a simple wrapper around the http.ServeMux method of the same name that incorporates
 //an error wrapper to allow it to implement the ErrorDispatcher protocol.
 func (self *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if self.err != nil {
-		w = &ErrWrapper{w, r, self.err}
+		wrapper := &ErrWrapper{ResponseWriter: w, req: r, err: self.err}
+		self.ServeMux.ServeHTTP(wrapper, r)
+		wrapper.finish()
+		return
 	}
 	self.ServeMux.ServeHTTP(w, r)
 }
@@ -74,14 +94,19 @@ func (self *ServeMux) Dispatch(pattern string, dispatcher Dispatcher) {
 
 				if self.err != nil {
 					self.err.PanicDispatch(err, w, r)
+					if wrapper, ok := w.(*ErrWrapper); ok {
+						//the panic replaces any error that was reported
+						wrapper.status = 0
+					}
 				} else {
 					fmt.Fprintf(os.Stderr, "++++++++++++ FORCING ANOTHER PANIC: %v ++++++++++++\n", err)
 					panic(err)
 				}
 			}
 		}()
-		w.Header().Add("Cache-Control", "no-cache, must-revalidate") //HTTP 1.1
-		w.Header().Add("Pragma", "no-cache")                         //HTTP 1.0
+		if self.cache != nil {
+			self.cache.Apply(w)
+		}
 		b := dispatcher.Dispatch(self, w, r)
 		if b != nil {
 			b.ServeHTTP(w, r)
@@ -94,14 +119,88 @@ func (self *ServeMux) Dispatch(pattern string, dispatcher Dispatcher) {
 //ErrorDispatcher in case of an error status code being written.
 type ErrWrapper struct {
 	http.ResponseWriter
-	req *http.Request
-	err ErrorDispatcher
+	req    *http.Request
+	err    ErrorDispatcher
+	wrote  bool
+	status int
+	body   bytes.Buffer
 }
 
-//WriteHeader is a wrapper around the http.ResponseWriter method of the same name.  It simply
-//traps status code writes of 300 or greater and calls the error dispatcher to handle it.
+//WriteHeader is a wrapper around the http.ResponseWriter method of the same name.  It
+//traps status code writes of 300 or greater and holds them, and the body written after
+//them, until the request is finished; then the error dispatcher is called to handle
+//the error.  If the error dispatcher does not write the status itself, the original
+//status is written.  If the error dispatcher writes a response, the body written by the
+//code that reported the error is discarded.
 func (self *ErrWrapper) WriteHeader(status int) {
-	if (status / 100) > 2 {
-		self.err.ErrorDispatch(status, self.ResponseWriter, self.req)
+	if self.wrote {
+		return
+	}
+	self.wrote = true
+	if (status / 100) <= 2 {
+		self.ResponseWriter.WriteHeader(status)
+		return
+	}
+	self.status = status
+}
+
+//Write is a wrapper around the http.ResponseWriter method of the same name that holds
+//the data if an error status has been written.
+func (self *ErrWrapper) Write(b []byte) (int, error) {
+	if self.status != 0 {
+		return self.body.Write(b)
+	}
+	self.wrote = true
+	return self.ResponseWriter.Write(b)
+}
+
+//started is true if part of the response has been sent to the client.
+func (self *ErrWrapper) started() bool {
+	return self.wrote && self.status == 0
+}
+
+//finish calls the error dispatcher if an error status was written.
+func (self *ErrWrapper) finish() {
+	if self.status == 0 {
+		return
+	}
+	status := self.status
+	self.status = 0
+	tracker := &statusTracker{ResponseWriter: self.ResponseWriter, body: self.body.Bytes()}
+	self.err.ErrorDispatch(status, tracker, self.req)
+	if !tracker.wroteHeader {
+		self.ResponseWriter.WriteHeader(status)
 	}
+	if !tracker.wroteBody {
+		self.ResponseWriter.Write(tracker.body)
+	}
+}
+
+//ErrorBody returns the body that was written with the error status by the code that
+//reported the error, such as the text given to http.Error.  The response writer must
+//be the one passed to ErrorDispatch; for others the result is nil.
+func ErrorBody(w http.ResponseWriter) []byte {
+	if tracker, ok := w.(*statusTracker); ok {
+		return tracker.body
+	}
+	return nil
+}
+
+//statusTracker records whether the error dispatcher wrote to the response.
+type statusTracker struct {
+	http.ResponseWriter
+	body        []byte
+	wroteHeader bool
+	wroteBody   bool
+}
+
+func (self *statusTracker) WriteHeader(status int) {
+	self.wroteHeader = true
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *statusTracker) Write(b []byte) (int, error) {
+	self.wroteHeader = true
+	self.wroteBody = true
+	return self.ResponseWriter.Write(b)
 }
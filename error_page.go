@@ -0,0 +1,248 @@
+package seven5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	ERROR_TEMPLATE_DIR = "errors"
+	INCIDENT_HEADER    = "X-Incident-Id"
+	PROBLEM_JSON       = "application/problem+json"
+)
+
+//ErrorPage is the data given to the templates that render error pages.
+//Method, URL, Header and Stack are only filled in when the dispatcher is in
+//test mode.
+type ErrorPage struct {
+	Status   int
+	Title    string
+	Incident string
+	Test     bool
+	Method   string
+	URL      string
+	Header   http.Header
+	Stack    string
+}
+
+//Problem is the json body sent for errors on rest resources, in the form
+//of RFC 7807.
+type Problem struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Instance string      `json:"instance,omitempty"`
+	Incident string      `json:"incident,omitempty"`
+	Detail   string      `json:"detail,omitempty"`
+	Request  interface{} `json:"request,omitempty"`
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+{{if .Incident}}<p>If you report this problem, please mention incident {{.Incident}}.</p>{{end}}
+{{if .Test}}<h2>{{.Method}} {{.URL}}</h2>
+<pre>{{range $k, $v := .Header}}{{$k}}: {{$v}}
+{{end}}</pre>
+{{if .Stack}}<pre>{{.Stack}}</pre>{{end}}{{end}}
+</body>
+</html>
+`))
+
+//DefaultErrorDispatcher is an ErrorDispatcher suitable for production.
+//Requests for the rest resources (urls that start with the Prefix) or that
+//prefer json get a json Problem, everything else gets an html page.  The
+//html page is rendered from the template errors/<status>.html, or if that
+//is not present errors/error.html, in the static content directory of the
+//Matcher, using the language directory that best matches the request.  If
+//neither template can be found, a simple built-in page is used.  In test
+//mode, the request details and the stack trace of panics are included in
+//the response; they are never shown otherwise.  Each panic is given an
+//incident id which is logged with the stack trace and shown to the user, so
+//that a report from a user can be matched with the log.  The Detail of the
+//Problem for a client (4xx) error is the text the resource gave with the
+//error, such as with http.Error; the text given with a server (5xx) error is
+//not shown.
+type DefaultErrorDispatcher struct {
+	Matcher *SimpleComponentMatcher
+	Prefix  string
+	IsTest  bool
+
+	templates map[string]*template.Template
+	lock      sync.Mutex
+}
+
+//NewDefaultErrorDispatcher returns an error dispatcher that renders pages
+//with templates found via matcher (which may be nil) and problem json for
+//urls that start with prefix, typically /rest.
+func NewDefaultErrorDispatcher(matcher *SimpleComponentMatcher, prefix string, isTest bool) *DefaultErrorDispatcher {
+	return &DefaultErrorDispatcher{
+		Matcher:   matcher,
+		Prefix:    prefix,
+		IsTest:    isTest,
+		templates: make(map[string]*template.Template),
+	}
+}
+
+//ErrorDispatch sends the error page or problem for the status.
+func (self *DefaultErrorDispatcher) ErrorDispatch(status int, w http.ResponseWriter, r *http.Request) {
+	if status/100 == 3 {
+		//redirects are not errors, let them through
+		return
+	}
+	detail := ""
+	if status/100 == 4 {
+		//the explanation of a client error is meant for the client, unlike a server error
+		detail = strings.TrimSpace(string(ErrorBody(w)))
+	}
+	self.send(status, "", detail, w, r)
+}
+
+//PanicDispatch logs the panic with a new incident id and sends a 500.  If the
+//response has already been started, the 500 can't be sent, so the response
+//is aborted (with http.ErrAbortHandler) and the client sees a broken response
+//rather than one that looks complete.
+func (self *DefaultErrorDispatcher) PanicDispatch(i interface{}, w http.ResponseWriter, r *http.Request) {
+	started := false
+	if wrapper, ok := w.(*ErrWrapper); ok {
+		//don't want the 500 to come back to ErrorDispatch
+		w = wrapper.ResponseWriter
+		started = wrapper.started()
+	}
+	incident := UDID()
+	buf := make([]byte, 16384)
+	stack := string(buf[:runtime.Stack(buf, false)])
+	log.Printf("[PANIC] incident %s: %s %s: %v\n%s", incident, r.Method, r.URL, i, stack)
+	if started {
+		log.Printf("[PANIC] incident %s: response already started, aborting it", incident)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set(INCIDENT_HEADER, incident)
+	self.send(http.StatusInternalServerError, incident, fmt.Sprintf("%v\n\n%s", i, stack), w, r)
+}
+
+//wantsJson is true for the rest resources and clients that ask for json
+//rather than html.
+func (self *DefaultErrorDispatcher) wantsJson(r *http.Request) bool {
+	if self.Prefix != "" && strings.HasPrefix(r.URL.Path, self.Prefix+"/") {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "text/html")
+}
+
+func (self *DefaultErrorDispatcher) send(status int, incident string, detail string, w http.ResponseWriter, r *http.Request) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if self.wantsJson(r) {
+		self.sendProblem(status, incident, detail, w, r)
+		return
+	}
+	page := &ErrorPage{
+		Status:   status,
+		Title:    http.StatusText(status),
+		Incident: incident,
+		Test:     self.IsTest,
+	}
+	if self.IsTest {
+		page.Method = r.Method
+		page.URL = r.URL.String()
+		page.Header = r.Header
+		page.Stack = detail
+	}
+	var buf bytes.Buffer
+	if err := self.template(status, r).Execute(&buf, page); err != nil {
+		log.Printf("[ERROR] unable to render error page for %d: %v", status, err)
+		buf.Reset()
+		defaultErrorTemplate.Execute(&buf, page)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (self *DefaultErrorDispatcher) sendProblem(status int, incident string, detail string, w http.ResponseWriter, r *http.Request) {
+	p := &Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Instance: r.URL.Path,
+		Incident: incident,
+	}
+	if self.IsTest || status/100 == 4 {
+		p.Detail = detail
+	}
+	if self.IsTest {
+		p.Request = map[string]interface{}{
+			"method": r.Method,
+			"url":    r.URL.String(),
+			"header": r.Header,
+		}
+	}
+	buf, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", PROBLEM_JSON)
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+//language picks the first language in the Accept-Language header that the
+//matcher knows, or en.
+func (self *DefaultErrorDispatcher) language(r *http.Request) string {
+	for _, l := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		l = strings.TrimSpace(strings.Split(l, ";")[0])
+		l = strings.ToLower(strings.Split(l, "-")[0])
+		if l != "" && l != "fixed" && self.Matcher.isKnownLang(l) {
+			return l
+		}
+	}
+	return "en"
+}
+
+//template returns the template for the status, from the static content
+//directory if possible.  Templates are loaded once, except in test mode.
+func (self *DefaultErrorDispatcher) template(status int, r *http.Request) *template.Template {
+	if self.Matcher == nil {
+		return defaultErrorTemplate
+	}
+	lang := self.language(r)
+	for _, name := range []string{fmt.Sprintf("%d.html", status), "error.html"} {
+		path := self.Matcher.FormFilepath(lang, "web", "/"+ERROR_TEMPLATE_DIR+"/"+name)
+		if t := self.load(path); t != nil {
+			return t
+		}
+	}
+	return defaultErrorTemplate
+}
+
+//load returns the template at path, or nil if it cannot be loaded.
+func (self *DefaultErrorDispatcher) load(path string) *template.Template {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if t, ok := self.templates[path]; ok && !self.IsTest {
+		return t
+	}
+	var t *template.Template
+	if _, err := os.Stat(path); err == nil {
+		t, err = template.ParseFiles(path)
+		if err != nil {
+			log.Printf("[ERROR] unable to parse error template %s: %v", path, err)
+			t = nil
+		}
+	}
+	self.templates[path] = t
+	return t
+}
@@ -0,0 +1,134 @@
+package seven5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type silentErrDispatch struct {
+}
+
+func (self *silentErrDispatch) ErrorDispatch(status int, w http.ResponseWriter, r *http.Request) {
+}
+
+func (self *silentErrDispatch) PanicDispatch(i interface{}, w http.ResponseWriter, r *http.Request) {
+}
+
+func TestErrWrapperKeepsStatus(t *testing.T) {
+	mux := NewServeMux()
+	mux.SetErrorDispatcher(&silentErrDispatch{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/nothing")
+	checkHttpStatus(t, resp, err, http.StatusNotFound)
+}
+
+func TestDefaultErrorDispatcher(t *testing.T) {
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, "/rest")
+	mux := NewServeMux()
+	mux.SetErrorDispatcher(NewDefaultErrorDispatcher(nil, "/rest", false))
+	mux.Dispatch("/rest/", raw)
+	mux.Dispatch("/die", &panicDispatch{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/rest/nothing/1")
+	checkHttpStatus(t, resp, err, http.StatusNotFound)
+	if resp.Header.Get("Content-Type") != PROBLEM_JSON {
+		t.Errorf("expected problem json but got %s", resp.Header.Get("Content-Type"))
+	}
+	var p Problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatalf("unable to decode problem: %v", err)
+	}
+	if p.Status != http.StatusNotFound || p.Instance != "/rest/nothing/1" || p.Request != nil {
+		t.Errorf("bad problem: %+v", p)
+	}
+
+	//an unknown resource without an id is not found, not a panic
+	resp, err = http.Get(server.URL + "/rest/nothing")
+	checkHttpStatus(t, resp, err, http.StatusNotFound)
+
+	resp, err = http.Get(server.URL + "/die")
+	checkHttpStatus(t, resp, err, http.StatusInternalServerError)
+	incident := resp.Header.Get(INCIDENT_HEADER)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if incident == "" || !strings.Contains(string(body), incident) {
+		t.Errorf("expected incident %q in page: %s", incident, body)
+	}
+	if strings.Contains(string(body), FLEAZIL) {
+		t.Errorf("panic details should not be shown outside of test mode: %s", body)
+	}
+}
+
+//statusDispatch reports an error with the text of the request's path.
+type statusDispatch struct {
+	status int
+}
+
+func (self *statusDispatch) Dispatch(s *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
+	http.Error(w, "secret "+r.URL.Path, self.status)
+	return nil
+}
+
+func TestDefaultErrorDispatcherDetail(t *testing.T) {
+	mux := NewServeMux()
+	mux.SetErrorDispatcher(NewDefaultErrorDispatcher(nil, "/rest", false))
+	mux.Dispatch("/rest/client", &statusDispatch{http.StatusConflict})
+	mux.Dispatch("/rest/server", &statusDispatch{http.StatusBadGateway})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/rest/client")
+	checkHttpStatus(t, resp, err, http.StatusConflict)
+	var p Problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatalf("unable to decode problem: %v", err)
+	}
+	if p.Detail != "secret /rest/client" {
+		t.Errorf("expected the resource's text as the detail of a client error: %+v", p)
+	}
+
+	resp, err = http.Get(server.URL + "/rest/server")
+	checkHttpStatus(t, resp, err, http.StatusBadGateway)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if strings.Contains(string(body), "secret") || resp.Header.Get("Content-Type") != PROBLEM_JSON {
+		t.Errorf("expected the text of a server error to be hidden: %s", body)
+	}
+}
+
+//latePanicDispatch panics after it has started the response.
+type latePanicDispatch struct {
+}
+
+func (self *latePanicDispatch) Dispatch(s *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	//more than the server buffers, so the start of the response is sent
+	w.Write([]byte(strings.Repeat("x", 65536)))
+	panic(FLEAZIL)
+}
+
+func TestPanicAfterResponseStarted(t *testing.T) {
+	mux := NewServeMux()
+	mux.SetErrorDispatcher(NewDefaultErrorDispatcher(nil, "/rest", true))
+	mux.Dispatch("/late", &latePanicDispatch{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/late")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Errorf("expected the response to be aborted, got %q", body)
+	}
+	if strings.Contains(string(body), FLEAZIL) || strings.Contains(string(body), "Internal") {
+		t.Errorf("expected no error page in a started response: %q", body)
+	}
+}
@@ -0,0 +1,294 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	FIELD_TAG     = "perm"
+	FIELD_NOBODY  = "-"
+	FIELD_ANYBODY = "*"
+)
+
+//FieldWriteMode controls what RawIOHook does when a client sends a value
+//for a field it is not allowed to write.
+type FieldWriteMode int
+
+const (
+	//FIELD_WRITE_REJECT refuses the request with 403 (Forbidden).
+	FIELD_WRITE_REJECT FieldWriteMode = iota
+	//FIELD_WRITE_IGNORE replaces the value sent before the body is given to
+	//the resource.  For a PUT, the value of the field in the object returned
+	//by the resource's finder is used, so the stored value is kept; for a
+	//POST, or a resource without a finder, the zero value is used.
+	FIELD_WRITE_IGNORE
+)
+
+//FieldPolicy decides which fields of a wire type a request may see and
+//which it may set.  The fields of anonymous struct fields, which json puts
+//at the top level, are considered too, and if the anonymous field itself is
+//not allowed, none of its fields are.
+type FieldPolicy interface {
+	CanRead(wire reflect.Type, field reflect.StructField, pb PBundle) bool
+	CanWrite(wire reflect.Type, field reflect.StructField, pb PBundle) bool
+}
+
+//TagFieldPolicy is a FieldPolicy that reads the perm tag on the fields of
+//the wire type, like this:
+//	Salary int64  `perm:"read=admin|hr,write=admin"`
+//	IsAdmin bool  `perm:"write=-"`
+//The value of read or write is a list of roles separated by |, where - means
+//nobody and * means anybody.  If read or write is not given, anybody may
+//read or write the field.  Roles are computed with the RoleFunc.
+type TagFieldPolicy struct {
+	Roles RoleFunc
+}
+
+//NewTagFieldPolicy returns a policy that uses the perm tags and the given
+//roles.  If roles is nil, SessionRoles is used.
+func NewTagFieldPolicy(roles RoleFunc) *TagFieldPolicy {
+	if roles == nil {
+		roles = SessionRoles
+	}
+	return &TagFieldPolicy{Roles: roles}
+}
+
+//CanRead checks the read roles of the field's perm tag.
+func (self *TagFieldPolicy) CanRead(wire reflect.Type, field reflect.StructField, pb PBundle) bool {
+	return self.check(field, "read", pb)
+}
+
+//CanWrite checks the write roles of the field's perm tag.
+func (self *TagFieldPolicy) CanWrite(wire reflect.Type, field reflect.StructField, pb PBundle) bool {
+	return self.check(field, "write", pb)
+}
+
+func (self *TagFieldPolicy) check(field reflect.StructField, op string, pb PBundle) bool {
+	allowed, ok := parsePermTag(field.Tag.Get(FIELD_TAG))[op]
+	if !ok {
+		return true
+	}
+	for _, role := range allowed {
+		if role == FIELD_ANYBODY {
+			return true
+		}
+	}
+	for _, have := range self.Roles(pb) {
+		for _, role := range allowed {
+			if role == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//parsePermTag turns read=a|b,write=c into a map from op to the roles.
+func parsePermTag(tag string) map[string][]string {
+	result := make(map[string][]string)
+	if tag == "" {
+		return result
+	}
+	for _, clause := range strings.Split(tag, ",") {
+		pair := strings.SplitN(strings.TrimSpace(clause), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		var roles []string
+		for _, r := range strings.Split(pair[1], "|") {
+			if r = strings.TrimSpace(r); r != "" && r != FIELD_NOBODY {
+				roles = append(roles, r)
+			}
+		}
+		result[strings.TrimSpace(pair[0])] = roles
+	}
+	return result
+}
+
+//jsonFieldName returns the name of the field in the json encoding, or ""
+//if the field is not encoded.
+func jsonFieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+//forbiddenFields returns the fields of the wire type that the policy does
+//not allow for the bundle.  The Index of each is from the wire type.
+func forbiddenFields(policy FieldPolicy, wire reflect.Type, pb PBundle, write bool) []reflect.StructField {
+	return forbiddenIn(policy, wire, wire.Elem(), nil, pb, write, false)
+}
+
+//forbiddenIn returns the forbidden fields of strukt, which is at index in
+//the wire type.  If all is true, every field is forbidden.
+func forbiddenIn(policy FieldPolicy, wire reflect.Type, strukt reflect.Type, index []int, pb PBundle,
+	write bool, all bool) []reflect.StructField {
+	var result []reflect.StructField
+	for i := 0; i < strukt.NumField(); i++ {
+		f := strukt.Field(i)
+		f.Index = append(append([]int(nil), index...), i)
+		var ok bool
+		if write {
+			ok = policy.CanWrite(wire, f, pb)
+		} else {
+			ok = policy.CanRead(wire, f, pb)
+		}
+		if embedded := embeddedStruct(f); embedded != nil {
+			result = append(result, forbiddenIn(policy, wire, embedded, f.Index, pb, write, all || !ok)...)
+			continue
+		}
+		if jsonFieldName(f) == "" {
+			continue
+		}
+		if all || !ok {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+//embeddedStruct returns the struct type of an anonymous field whose fields
+//json puts at the top level, or nil.
+func embeddedStruct(f reflect.StructField) reflect.Type {
+	tag := f.Tag.Get("json")
+	if !f.Anonymous || tag == "-" || strings.Split(tag, ",")[0] != "" {
+		return nil
+	}
+	t := f.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+//fieldAt returns the field of the struct v at the index.  Nil embedded
+//pointers on the way are allocated if alloc is true; otherwise, or if they
+//can't be set, the result is not valid.
+func fieldAt(v reflect.Value, index []int, alloc bool) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+//stripFields converts a wire object, or a slice of them, into a value with
+//the same json encoding less the fields the bundle may not read.  The
+//value may already have been converted by addLinks.
+func stripFields(policy FieldPolicy, d *restShared, pb PBundle, i interface{}) (interface{}, error) {
+	forbidden := forbiddenFields(policy, d.typ, pb, false)
+	if len(forbidden) == 0 {
+		return i, nil
+	}
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Slice {
+		return stripOne(forbidden, i)
+	}
+	result := make([]interface{}, v.Len())
+	for n := 0; n < v.Len(); n++ {
+		one, err := stripOne(forbidden, v.Index(n).Interface())
+		if err != nil {
+			return nil, err
+		}
+		result[n] = one
+	}
+	return result, nil
+}
+
+func stripOne(forbidden []reflect.StructField, wire interface{}) (interface{}, error) {
+	raw, err := json.Marshal(wire)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return wire, nil
+	}
+	for _, f := range forbidden {
+		delete(fields, jsonFieldName(f))
+	}
+	return fields, nil
+}
+
+//checkWrites looks for values of fields the bundle may not write in the
+//json body that was decoded into wireObj.  Depending on mode, it either
+//returns a 403 error or replaces those values with the ones of the object
+//returned by current, or zero values if current is nil.
+func checkWrites(policy FieldPolicy, mode FieldWriteMode, d *restShared, pb PBundle,
+	body []byte, wireObj reflect.Value, current func() (interface{}, error)) error {
+	forbidden := forbiddenFields(policy, d.typ, pb, true)
+	if len(forbidden) == 0 {
+		return nil
+	}
+	var sent map[string]json.RawMessage
+	if err := json.Unmarshal(body, &sent); err != nil {
+		return err
+	}
+	var stored reflect.Value
+	loaded := false
+	for _, f := range forbidden {
+		name := jsonFieldName(f)
+		present := false
+		for k := range sent {
+			//encoding/json matches keys without regard to case
+			if strings.EqualFold(k, name) {
+				present = true
+				break
+			}
+		}
+		if !present {
+			continue
+		}
+		if mode == FIELD_WRITE_REJECT {
+			return HTTPError(http.StatusForbidden, fmt.Sprintf("not allowed to write field %s", name))
+		}
+		if !loaded && current != nil {
+			obj, err := current()
+			if err != nil {
+				return err
+			}
+			if v := reflect.ValueOf(obj); v.IsValid() && v.Type() == wireObj.Type() && !v.IsNil() {
+				stored = v.Elem()
+			}
+		}
+		loaded = true
+		fv := fieldAt(wireObj.Elem(), f.Index, true)
+		if !fv.IsValid() || !fv.CanSet() {
+			continue
+		}
+		value := reflect.Zero(fv.Type())
+		if stored.IsValid() {
+			if sv := fieldAt(stored, f.Index, false); sv.IsValid() {
+				value = sv
+			}
+		}
+		fv.Set(value)
+	}
+	return nil
+}
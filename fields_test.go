@@ -0,0 +1,128 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type permAudit struct {
+	Reviewer string `perm:"write=admin"`
+}
+
+type permSecret struct {
+	Pin string
+}
+
+type permWire struct {
+	Id      int64
+	Name    string
+	Salary  int64 `perm:"read=admin|hr,write=admin"`
+	IsAdmin bool  `json:"admin" perm:"write=-"`
+	permAudit
+	*permSecret `perm:"read=-"`
+}
+
+func TestFieldPermissions(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	io.Fields = NewTagFieldPolicy(nil)
+	d := &restShared{typ: reflect.TypeOf(&permWire{})}
+
+	user := NewTestPBundle(nil, nil, NewSimpleSession(&rolesUser{"fred", nil}, "x"), nil,
+		map[string]string{}, nil)
+	hr := NewTestPBundle(nil, nil, NewSimpleSession(&rolesUser{"jane", []string{"hr"}}, "y"), nil,
+		map[string]string{}, nil)
+
+	send := func(pb PBundle) map[string]interface{} {
+		w := httptest.NewRecorder()
+		io.SendHook(d, w, pb, []*permWire{&permWire{1, "fred", 100, true, permAudit{"boss"}, &permSecret{"1234"}}}, "")
+		var result []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("unable to decode %q: %v", w.Body.String(), err)
+		}
+		return result[0]
+	}
+	if _, ok := send(user)["Salary"]; ok {
+		t.Errorf("user should not see salary")
+	}
+	if found := send(hr); found["Salary"] != float64(100) || found["admin"] != true || found["Reviewer"] != "boss" {
+		t.Errorf("hr should see all fields: %+v", found)
+	}
+	if _, ok := send(hr)["Pin"]; ok {
+		t.Errorf("nobody should see the fields of an embedded struct that can't be read")
+	}
+
+	body := func(s string) *http.Request {
+		r, _ := http.NewRequest("PUT", "/rest/permwire/1", strings.NewReader(s))
+		return r
+	}
+	if _, err := io.FieldBodyHook(body(`{"Id":1,"Name":"fred"}`), d, user, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, b := range []string{`{"Id":1,"salary":1000}`, `{"Id":1,"reviewer":"jane"}`} {
+		_, err := io.FieldBodyHook(body(b), d, hr, nil)
+		if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusForbidden {
+			t.Errorf("expected forbidden for %s but got %v", b, err)
+		}
+	}
+	io.FieldWrites = FIELD_WRITE_IGNORE
+	obj, err := io.FieldBodyHook(body(`{"Id":1,"Name":"x","admin":true}`), d, hr, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w := obj.(*permWire); w.IsAdmin || w.Name != "x" {
+		t.Errorf("expected admin to be ignored: %+v", w)
+	}
+	stored := &permWire{Id: 1, Name: "fred", Salary: 100, IsAdmin: true, permAudit: permAudit{"boss"}}
+	current := func() (interface{}, error) { return stored, nil }
+	obj, err = io.FieldBodyHook(body(`{"Id":1,"Name":"x","admin":false,"Salary":5,"Reviewer":"jane"}`), d, hr, current)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w := obj.(*permWire); !w.IsAdmin || w.Salary != 100 || w.Reviewer != "boss" || w.Name != "x" {
+		t.Errorf("expected ignored fields to keep their stored values: %+v", w)
+	}
+}
+
+//permResource keeps one permWire.
+type permResource struct {
+	stored *permWire
+}
+
+func (self *permResource) Find(id int64, pb PBundle) (interface{}, error) {
+	c := *self.stored
+	return &c, nil
+}
+
+func (self *permResource) Put(id int64, i interface{}, pb PBundle) (interface{}, error) {
+	self.stored = i.(*permWire)
+	return self.stored, nil
+}
+
+func TestFieldIgnoreDispatch(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	cm := NewSimpleCookieMapper("test")
+	base := NewBaseDispatcher(sm, cm)
+	base.IO.(*RawIOHook).Fields = NewTagFieldPolicy(nil)
+	base.IO.(*RawIOHook).FieldWrites = FIELD_WRITE_IGNORE
+	rez := &permResource{stored: &permWire{Id: 1, Name: "fred", Salary: 100, IsAdmin: true}}
+	base.ResourceSeparate("PermWire", &permWire{}, nil, rez, nil, rez, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", base)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s, _ := sm.Assign("fred", &rolesUser{"fred", nil}, time.Time{})
+	req, _ := http.NewRequest("PUT", server.URL+"/rest/permwire/1", strings.NewReader(`{"Id":1,"Name":"x","Salary":0,"admin":false}`))
+	req.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+	resp, err := http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if rez.stored.Name != "x" || rez.stored.Salary != 100 || !rez.stored.IsAdmin {
+		t.Errorf("expected ignored fields to keep their stored values: %+v", rez.stored)
+	}
+}
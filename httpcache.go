@@ -0,0 +1,117 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//HTTPCachePolicy describes the Cache-Control sent with a response.  A
+//policy with a MaxAge of zero tells browsers and proxies to revalidate the
+//response every time it is used, which is the default for everything
+//dispatched by a ServeMux.
+type HTTPCachePolicy struct {
+	//Public allows shared caches (proxies) to keep the response, otherwise
+	//only the browser may.
+	Public bool
+	MaxAge time.Duration
+	//StaleWhileRevalidate allows a cache to use a stale response for this
+	//long while it fetches a new one.
+	StaleWhileRevalidate time.Duration
+	//VaryCookie tells caches that the response depends on the cookies, so
+	//different users do not get each other's responses.
+	VaryCookie bool
+	//NoStore forbids keeping the response at all.
+	NoStore bool
+}
+
+//NO_CACHE_POLICY is the policy used by a ServeMux unless it is changed with
+//SetCachePolicy.
+var NO_CACHE_POLICY = &HTTPCachePolicy{}
+
+//CacheControl returns the value of the Cache-Control header for the policy.
+func (self *HTTPCachePolicy) CacheControl() string {
+	if self.NoStore {
+		return "no-store"
+	}
+	if self.MaxAge <= 0 {
+		return "no-cache, must-revalidate"
+	}
+	var parts []string
+	if self.Public {
+		parts = append(parts, "public")
+	} else {
+		parts = append(parts, "private")
+	}
+	parts = append(parts, fmt.Sprintf("max-age=%d", int64(self.MaxAge/time.Second)))
+	if self.StaleWhileRevalidate > 0 {
+		parts = append(parts, fmt.Sprintf("stale-while-revalidate=%d", int64(self.StaleWhileRevalidate/time.Second)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+//Apply sets the headers for the policy on the response, replacing any
+//previously set.  It must be called before the header is written.
+func (self *HTTPCachePolicy) Apply(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Cache-Control", self.CacheControl()) //HTTP 1.1
+	if self.NoStore || self.MaxAge <= 0 {
+		h.Set("Pragma", "no-cache") //HTTP 1.0
+	} else {
+		h.Del("Pragma")
+	}
+	if self.VaryCookie {
+		for _, v := range h["Vary"] {
+			if v == "Cookie" {
+				return
+			}
+		}
+		h.Add("Vary", "Cookie")
+	}
+}
+
+//HTTPCacher is an interface that a rest resource's Index or Find
+//implementation can implement to choose the cache policy of its successful
+//GET responses.  Returning nil leaves the choice to the dispatcher.
+type HTTPCacher interface {
+	HTTPCache(PBundle) *HTTPCachePolicy
+}
+
+//HTTPCacheDefaults are the policies a RawDispatcher uses for successful GET
+//responses of resources that are not HTTPCachers, depending on whether
+//the request has a session.
+type HTTPCacheDefaults struct {
+	Anonymous     *HTTPCachePolicy
+	Authenticated *HTTPCachePolicy
+}
+
+//NewHTTPCacheDefaults returns defaults that let anonymous responses be kept
+//by any cache for maxAge, and make responses to logged in users private and
+//always revalidated.  Both vary on the cookie, since the same url gives
+//different results when logged in.
+func NewHTTPCacheDefaults(maxAge time.Duration) *HTTPCacheDefaults {
+	return &HTTPCacheDefaults{
+		Anonymous:     &HTTPCachePolicy{Public: true, MaxAge: maxAge, VaryCookie: true},
+		Authenticated: &HTTPCachePolicy{VaryCookie: true},
+	}
+}
+
+//Policy returns the default policy for the bundle.
+func (self *HTTPCacheDefaults) Policy(pb PBundle) *HTTPCachePolicy {
+	if pb.Session() == nil {
+		return self.Anonymous
+	}
+	return self.Authenticated
+}
+
+//findHTTPCacher returns the first of the implementations that is an
+//HTTPCacher, or nil.
+func findHTTPCacher(impl ...interface{}) HTTPCacher {
+	for _, i := range impl {
+		if c, ok := i.(HTTPCacher); ok {
+			return c
+		}
+	}
+	return nil
+}
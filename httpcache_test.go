@@ -0,0 +1,63 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cachedResource struct {
+	someResource
+}
+
+func (self *cachedResource) HTTPCache(pb PBundle) *HTTPCachePolicy {
+	return &HTTPCachePolicy{Public: true, MaxAge: time.Minute, StaleWhileRevalidate: 10 * time.Second}
+}
+
+func (self *cachedResource) Find(id int64, pb PBundle) (interface{}, error) {
+	if id == 13 {
+		SetBundleCachePolicy(pb, &HTTPCachePolicy{NoStore: true})
+	}
+	return &someWire{id, "find"}, nil
+}
+
+func TestHTTPCachePolicy(t *testing.T) {
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, "/rest")
+	raw.HTTPCache = NewHTTPCacheDefaults(5 * time.Minute)
+	raw.Rez(&someWire{}, &someResource{})
+	raw.Resource("Cached", &someWire{}, &cachedResource{})
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	check := func(resp *http.Response, expected string) {
+		if cc := resp.Header.Get("Cache-Control"); cc != expected {
+			t.Errorf("%s: expected Cache-Control %q but got %q", resp.Request.URL, expected, cc)
+		}
+	}
+	resp, err := http.Get(server.URL + "/rest/cached/12")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	check(resp, "public, max-age=60, stale-while-revalidate=10")
+	if resp.Header.Get("Pragma") != "" {
+		t.Errorf("cachable response should not have Pragma")
+	}
+
+	resp, err = http.Get(server.URL + "/rest/cached/13")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	check(resp, "no-store")
+
+	resp, err = http.Get(server.URL + "/rest/somewire/12")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	check(resp, "public, max-age=300")
+	if resp.Header.Get("Vary") != "Cookie" {
+		t.Errorf("expected Vary: Cookie but got %v", resp.Header["Vary"])
+	}
+
+	resp, err = http.Post(server.URL+"/rest/somewire", "text/json", strings.NewReader(`{"Foo":"bar"}`))
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+	check(resp, "no-cache, must-revalidate")
+}
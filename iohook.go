@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"os"
 	"reflect"
-	"time"
 )
 
 //IOHook is an interface provided as a convenience to those who want to override
@@ -23,11 +22,41 @@ type IOHook interface {
 	CookieMapper() CookieMapper
 }
 
+//FieldBodyHook is implemented by IOHooks that check the fields set by a body
+//against a FieldPolicy, such as the RawIOHook.  The RawDispatcher calls
+//FieldBodyHook in place of BodyHook if the IOHook has it.  For a PUT, current
+//returns the object the body replaces, so that fields the client may not
+//write can keep their values; otherwise current is nil.
+type FieldBodyHook interface {
+	FieldBodyHook(r *http.Request, obj *restShared, pb PBundle, current func() (interface{}, error)) (interface{}, error)
+}
+
 //RawIOHook is the default implementation of the IOHook used by the RawDispatcher.
 type RawIOHook struct {
 	Dec       Decoder
 	Enc       Encoder
 	CookieMap CookieMapper
+	//Links turns on decoration of responses with a HAL-style _links field
+	//on each object and pagination links in the Link header.  This assumes
+	//that Enc produces json.
+	Links bool
+	//Fields, if not nil, is consulted to remove fields the client may not
+	//read from responses and to check for fields the client may not write
+	//in request bodies.  This assumes that Enc and Dec use json.
+	Fields FieldPolicy
+	//FieldWrites says what to do with a body that sets a field that the
+	//client may not write.
+	FieldWrites FieldWriteMode
+	//CSRF, if not nil, checks requests for cross site request forgery before
+	//the session is used and sends the token of the session to the client.
+	CSRF *CSRFGuard
+	//Sources are asked, in order, for the session of requests that don't have
+	//a session cookie, such as requests with an api key.
+	Sources []SessionSource
+	//Remember, if not nil, gives requests without a session a new one if they
+	//have a remember me token.  Only GET, HEAD, OPTIONS and TRACE requests
+	//are given sessions this way, so a forged request can't use the token.
+	Remember *RememberMe
 }
 
 //CookieMapper is exposed because other parts of the system may need access to the
@@ -49,7 +78,37 @@ func NewRawIOHook(d Decoder, e Encoder, c CookieMapper) *RawIOHook {
 //BodyHook is called to create a wire object of the appopriate type and fill in the values
 //in that object from the request body.  BodyHook calls the decoder provided at creation time
 //take the bytes provided by the body and initialize the object that is ultimately returned.
+//The fields set by the body are not checked against the field policy, that is done by
+//FieldBodyHook.
 func (self *RawIOHook) BodyHook(r *http.Request, obj *restShared) (interface{}, error) {
+	wireObj, _, err := self.decodeBody(r, obj)
+	if err != nil || !wireObj.IsValid() {
+		return nil, err
+	}
+	return wireObj.Interface(), nil
+}
+
+//FieldBodyHook is BodyHook followed, if there is a field policy, by a check of the
+//fields set by the body.  With FIELD_WRITE_IGNORE, a field the client may not write is
+//copied from the result of current, or set to its zero value if current is nil.
+func (self *RawIOHook) FieldBodyHook(r *http.Request, obj *restShared, pb PBundle,
+	current func() (interface{}, error)) (interface{}, error) {
+	wireObj, data, err := self.decodeBody(r, obj)
+	if err != nil || !wireObj.IsValid() {
+		return nil, err
+	}
+	if self.Fields != nil {
+		if err := checkWrites(self.Fields, self.FieldWrites, obj, pb, data, wireObj, current); err != nil {
+			return nil, err
+		}
+	}
+	return wireObj.Interface(), nil
+}
+
+//decodeBody reads the body and decodes it into a new wire object, which is
+//returned with the bytes of the body.  The object is not valid if there is
+//no body.
+func (self *RawIOHook) decodeBody(r *http.Request, obj *restShared) (reflect.Value, []byte, error) {
 	limitedData := make([]byte, MAX_FORM_SIZE)
 	curr := 0
 	gotEof := false
@@ -61,30 +120,33 @@ func (self *RawIOHook) BodyHook(r *http.Request, obj *restShared) (interface{},
 			break
 		}
 		if err != nil {
-			return nil, err
+			return reflect.Value{}, nil, err
 		}
 	}
 	//if curr==0 then we are done because there is no body
 	if curr == 0 {
-		return nil, nil
+		return reflect.Value{}, nil, nil
 	}
 	if !gotEof {
-		return nil, errors.New(fmt.Sprintf("Body is too large! max is %d", MAX_FORM_SIZE))
+		return reflect.Value{}, nil, errors.New(fmt.Sprintf("Body is too large! max is %d", MAX_FORM_SIZE))
 	}
 	//we have a body of data, need to decode it... first allocate one
 	strukt := obj.typ.Elem() //we have checked that this is a ptr to struct at insert
 	wireObj := reflect.New(strukt)
 	if err := self.Dec.Decode(limitedData[:curr], wireObj.Interface()); err != nil {
-		return nil, err
+		return reflect.Value{}, nil, err
 	}
-	return wireObj.Interface(), nil
+	return wireObj, limitedData[:curr], nil
 }
 
 //BundleHook is called to create the bundle of parameters from the request. It often will be
 //using cookies and sessions to compute the bundle.  Note that the ResponseWriter is passed
 //here but the BundleHook _must_ be careful to not force it out the server--it should only
 //add headers.  Note that the session manager may receive a call back if the consumer
-//of the pbundle does Update().
+//of the pbundle does Update().  If there is a CSRFGuard, a request that fails its
+//check gets an Error with the code http.StatusForbidden.  The session of a request
+//with no session cookie comes from the first of the Sources to find one, and
+//an error from a source (such as for a bad api key) is returned.
 func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm SessionManager) (PBundle, error) {
 	var session Session
 	if self.CookieMap != nil {
@@ -93,16 +155,24 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 		if err != nil && err != NO_SUCH_COOKIE {
 			return nil, err
 		}
+		if self.CSRF != nil {
+			if csrfErr := self.CSRF.Check(r, id); csrfErr != nil {
+				return nil, csrfErr
+			}
+		}
 		var findErr error
 		if sm != nil {
 			var sr *SessionReturn
 			if err != NO_SUCH_COOKIE {
-				sr, findErr = sm.Find(id)
+				sr, findErr = findSession(sm, id, r)
 				if findErr != nil {
 					return nil, findErr
 				}
 				if sr == nil {
 					self.CookieMap.RemoveCookie(w)
+					if self.CSRF != nil {
+						self.CSRF.RemoveCookie(w)
+					}
 				}
 				if sr != nil {
 					if sr.UniqueId != "" {
@@ -112,18 +182,44 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 							return nil, genErr
 						} else if ud != nil {
 							var assignErr error
-							session, assignErr = sm.Assign(sr.UniqueId, ud, time.Time{})
+							session, assignErr = assignSession(sm, sr.UniqueId, ud, r)
 							if assignErr != nil {
 								return nil, assignErr
 							}
+							self.CookieMap.AssociateCookie(w, session)
 						}
 					} else {
 						//we have a session
 						session = sr.Session
+						if sr.Renewed {
+							self.CookieMap.AssociateCookie(w, session)
+						}
 					}
 				}
 			}
 		}
+		if session == nil && self.Remember != nil && sm != nil && csrfSafeMethods[r.Method] {
+			var remErr error
+			if session, remErr = self.Remember.Exchange(w, r, sm); remErr != nil {
+				return nil, remErr
+			}
+			if session != nil {
+				self.CookieMap.AssociateCookie(w, session)
+			}
+		}
+		session = bindSession(sm, session, w)
+		if self.CSRF != nil && session != nil {
+			self.CSRF.Issue(w, r, session.SessionId())
+		}
+	}
+	for _, src := range self.Sources {
+		if session != nil {
+			break
+		}
+		var srcErr error
+		if session, srcErr = src.Session(r, sm); srcErr != nil {
+			return nil, srcErr
+		}
 	}
 	pb, err := NewSimplePBundle(r, session, sm)
 	if err != nil {
@@ -137,12 +233,35 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 //parameter is provided, then the response code is "Created" otherwise "OK" is returned.
 //SendHook calls the encoder for the encoding of the object into a sequence of bytes for transmission.
 //If the pb is not null, then the SendHook should examine it for outgoing headers, trailers, and
-//transmit them.
+//transmit them.  If Links is true, the object is decorated with links
+//before it is encoded.  If there is a field policy, fields the client may not
+//read are removed.  If the PBundle has a cache policy, it is applied.
 func (self *RawIOHook) SendHook(d *restShared, w http.ResponseWriter, pb PBundle, i interface{}, location string) {
 	if err := self.verifyReturnType(d, i); err != nil {
 		http.Error(w, fmt.Sprintf("%s", err), http.StatusExpectationFailed)
 		return
 	}
+	if self.Links && i != nil {
+		if v := reflect.ValueOf(i); v.Kind() == reflect.Slice {
+			for rel, href := range paginationLinks(pb, v.Len()) {
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"%s\"", href, rel))
+			}
+		}
+		var err error
+		i, err = addLinks(d, pb, i)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to add links: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if self.Fields != nil && i != nil {
+		var err error
+		i, err = stripFields(self.Fields, d, pb, i)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to remove fields: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
 	encoded, err := self.Enc.Encode(i, true)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("unable to encode: %s", err), http.StatusInternalServerError)
@@ -152,6 +271,9 @@ func (self *RawIOHook) SendHook(d *restShared, w http.ResponseWriter, pb PBundle
 		w.Header().Add(k, pb.ReturnHeader(k))
 	}
 	w.Header().Add("Content-Type", "text/json")
+	if p := BundleCachePolicy(pb); p != nil {
+		p.Apply(w)
+	}
 	if location != "" {
 		w.Header().Add("Location", location)
 		w.WriteHeader(http.StatusCreated)
@@ -0,0 +1,656 @@
+package seven5
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	//DEFAULT_JWT_LIFETIME is how long a JWT minted by Mint is valid.
+	DEFAULT_JWT_LIFETIME = 15 * time.Minute
+	//JWT_MIN_HMAC_KEY is the length, in bytes, of the shortest key allowed for
+	//the HS algorithms.
+	JWT_MIN_HMAC_KEY = 32
+)
+
+//jwtHashes are the algorithms supported and the hash each one uses.
+var jwtHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+//jwtCurves are the curves of the ES algorithms.
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+//JWTKey is a key that signs or verifies JWTs with one algorithm: HS256,
+//HS384, HS512 (HMAC), RS256, RS384, RS512 (RSA PKCS #1 v1.5) or ES256,
+//ES384, ES512 (ECDSA).  The Id is the "kid" of the JWTs it signs and of
+//the key in a JWKS.
+type JWTKey struct {
+	Id      string
+	Alg     string
+	secret  []byte
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+//NewHMACJWTKey returns a key that signs and verifies with the secret, which
+//must be at least JWT_MIN_HMAC_KEY bytes long.
+func NewHMACJWTKey(id string, alg string, secret []byte) (*JWTKey, error) {
+	if !strings.HasPrefix(alg, "HS") || jwtHashes[alg] == 0 {
+		return nil, fmt.Errorf("%s is not an HMAC algorithm", alg)
+	}
+	if len(secret) < JWT_MIN_HMAC_KEY {
+		return nil, fmt.Errorf("HMAC key must be at least %d bytes, but was %d", JWT_MIN_HMAC_KEY, len(secret))
+	}
+	return &JWTKey{Id: id, Alg: alg, secret: secret}, nil
+}
+
+//NewJWTSigningKey returns a key that signs with the private key, which must
+//be an *rsa.PrivateKey for the RS algorithms or an *ecdsa.PrivateKey on the
+//curve of the ES algorithm.  The key also verifies.
+func NewJWTSigningKey(id string, alg string, private crypto.Signer) (*JWTKey, error) {
+	key, err := NewJWTVerifyingKey(id, alg, private.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.private = private
+	return key, nil
+}
+
+//NewJWTVerifyingKey returns a key that only verifies, with the public key.
+func NewJWTVerifyingKey(id string, alg string, public crypto.PublicKey) (*JWTKey, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || jwtHashes[alg] == 0 {
+			return nil, fmt.Errorf("%s is not an RSA algorithm", alg)
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key must be at least 2048 bits, but was %d", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if curve, ok := jwtCurves[alg]; !ok || curve != pub.Curve {
+			return nil, fmt.Errorf("%s is not an ECDSA algorithm for the curve of the key", alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+	return &JWTKey{Id: id, Alg: alg, public: public}, nil
+}
+
+func (self *JWTKey) digest(input []byte) []byte {
+	h := jwtHashes[self.Alg].New()
+	h.Write(input)
+	return h.Sum(nil)
+}
+
+//sign returns the signature of the input.
+func (self *JWTKey) sign(input []byte) ([]byte, error) {
+	if self.secret != nil {
+		mac := hmac.New(jwtHashes[self.Alg].New, self.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	}
+	switch priv := self.private.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, priv, jwtHashes[self.Alg], self.digest(input))
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, self.digest(input))
+		if err != nil {
+			return nil, err
+		}
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	}
+	return nil, fmt.Errorf("key %s can't sign", self.Id)
+}
+
+//verify returns nil if sig is a signature of the input.
+func (self *JWTKey) verify(input []byte, sig []byte) error {
+	ok := false
+	if self.secret != nil {
+		mac := hmac.New(jwtHashes[self.Alg].New, self.secret)
+		mac.Write(input)
+		ok = hmac.Equal(sig, mac.Sum(nil))
+	} else {
+		switch pub := self.public.(type) {
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(pub, jwtHashes[self.Alg], self.digest(input), sig) == nil
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if len(sig) == 2*size {
+				r := new(big.Int).SetBytes(sig[:size])
+				s := new(big.Int).SetBytes(sig[size:])
+				ok = ecdsa.Verify(pub, self.digest(input), r, s)
+			}
+		}
+	}
+	if !ok {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+//jwk is a key in a JWKS (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	K   string `json:"k,omitempty"`
+}
+
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+var jwkCurves = map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}
+
+func jwkInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+//key returns the JWTKey of the jwk.
+func (self *jwk) key() (*JWTKey, error) {
+	switch self.Kty {
+	case "RSA":
+		n, err := jwkInt(self.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(self.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("bad RSA exponent")
+		}
+		alg := self.Alg
+		if alg == "" {
+			alg = "RS256"
+		}
+		return NewJWTVerifyingKey(self.Kid, alg, &rsa.PublicKey{N: n, E: int(e.Int64())})
+	case "EC":
+		alg, ok := jwkCurves[self.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", self.Crv)
+		}
+		x, err := jwkInt(self.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(self.Y)
+		if err != nil {
+			return nil, err
+		}
+		curve := jwtCurves[alg]
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key is not on the curve %s", self.Crv)
+		}
+		return NewJWTVerifyingKey(self.Kid, alg, &ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(self.K)
+		if err != nil {
+			return nil, err
+		}
+		alg := self.Alg
+		if alg == "" {
+			alg = "HS256"
+		}
+		return NewHMACJWTKey(self.Kid, alg, secret)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", self.Kty)
+}
+
+//ParseJWKS returns the signature keys of a JWKS (a json object with an array
+//of keys in "keys").  RSA, EC and oct (HMAC) keys are supported; keys of other
+//types, or for a "use" other than "sig", are skipped.
+func ParseJWKS(b []byte) ([]*JWTKey, error) {
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var result []*JWTKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			log.Printf("[JWT] skipping key %d (%s) of JWKS: %v", i, k.Kid, err)
+			continue
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+//LoadJWKS reads the JWKS file at path, see ParseJWKS.
+func LoadJWKS(path string) ([]*JWTKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(b)
+}
+
+//MarshalJWKS returns a JWKS with the public parts of the keys, suitable for
+//publishing to the services that verify the JWTs.  HMAC keys are secrets
+//and are left out.
+func MarshalJWKS(keys ...*JWTKey) ([]byte, error) {
+	set := jwks{Keys: []*jwk{}}
+	for _, k := range keys {
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, &jwk{Kty: "RSA", Kid: k.Id, Alg: k.Alg, Use: "sig",
+				N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			x, y := make([]byte, size), make([]byte, size)
+			pub.X.FillBytes(x)
+			pub.Y.FillBytes(y)
+			set.Keys = append(set.Keys, &jwk{Kty: "EC", Kid: k.Id, Alg: k.Alg, Use: "sig",
+				Crv: pub.Curve.Params().Name, X: base64.RawURLEncoding.EncodeToString(x),
+				Y: base64.RawURLEncoding.EncodeToString(y)})
+		}
+	}
+	return json.Marshal(&set)
+}
+
+//JWTClaims are the claims of a JWT.  The registered claims (RFC 7519) have
+//fields, Extra has the others.  A zero time means the claim is not present.
+type JWTClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	Expires   time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	Id        string
+	Extra     map[string]interface{}
+}
+
+var jwtRegisteredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+
+func (self *JWTClaims) marshal() ([]byte, error) {
+	m := make(map[string]interface{})
+	for k, v := range self.Extra {
+		m[k] = v
+	}
+	for _, k := range jwtRegisteredClaims {
+		delete(m, k)
+	}
+	set := func(k, v string) {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	setTime := func(k string, t time.Time) {
+		if !t.IsZero() {
+			m[k] = t.Unix()
+		}
+	}
+	set("iss", self.Issuer)
+	set("sub", self.Subject)
+	set("jti", self.Id)
+	if len(self.Audience) == 1 {
+		m["aud"] = self.Audience[0]
+	} else if len(self.Audience) > 1 {
+		m["aud"] = self.Audience
+	}
+	setTime("exp", self.Expires)
+	setTime("nbf", self.NotBefore)
+	setTime("iat", self.IssuedAt)
+	return json.Marshal(m)
+}
+
+func (self *JWTClaims) unmarshal(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	m := make(map[string]interface{})
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	str := func(k string) (string, error) {
+		v, ok := m[k]
+		if !ok {
+			return "", nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("claim %s is not a string", k)
+		}
+		return s, nil
+	}
+	num := func(k string) (time.Time, error) {
+		v, ok := m[k]
+		if !ok {
+			return time.Time{}, nil
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return time.Time{}, fmt.Errorf("claim %s is not a number", k)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(int64(f), 0), nil
+	}
+	var err error
+	if self.Issuer, err = str("iss"); err != nil {
+		return err
+	}
+	if self.Subject, err = str("sub"); err != nil {
+		return err
+	}
+	if self.Id, err = str("jti"); err != nil {
+		return err
+	}
+	if self.Expires, err = num("exp"); err != nil {
+		return err
+	}
+	if self.NotBefore, err = num("nbf"); err != nil {
+		return err
+	}
+	if self.IssuedAt, err = num("iat"); err != nil {
+		return err
+	}
+	switch aud := m["aud"].(type) {
+	case nil:
+	case string:
+		self.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return fmt.Errorf("claim aud is not a string or array of strings")
+			}
+			self.Audience = append(self.Audience, s)
+		}
+	default:
+		return fmt.Errorf("claim aud is not a string or array of strings")
+	}
+	for _, k := range jwtRegisteredClaims {
+		delete(m, k)
+	}
+	self.Extra = m
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+//JWT mints and verifies JWTs (RFC 7519) in the compact JWS form.  When an
+//Issuer or Audience is set, minted tokens have it and verified tokens must
+//have it.  JWT is a SessionSource for requests with a JWT in the
+//"Authorization: Bearer" header; the subject of the token is the unique id of
+//the session.
+type JWT struct {
+	clock  Clock
+	signer *JWTKey
+	keys   map[string]*JWTKey
+	Issuer string
+	//Audience is the audience of minted tokens, and one of the audiences a
+	//token must have to be verified.
+	Audience string
+	//Lifetime is how long minted tokens are valid, the default is
+	//DEFAULT_JWT_LIFETIME.
+	Lifetime time.Duration
+	//Leeway is allowed for the difference of the clocks of the servers when
+	//checking exp and nbf.
+	Leeway time.Duration
+	//MaxAge, if set, is the longest time after its iat that a token is
+	//accepted.  A token without exp is only accepted if MaxAge is set and
+	//the token has an iat.
+	MaxAge time.Duration
+}
+
+//NewJWT returns a JWT that mints tokens with the signer and verifies tokens
+//with the signer or any of the other keys.  The signer may be nil, for a JWT
+//that only verifies.  Keys are chosen by the "kid" of a token, a token
+//without one can only be verified if there is only one key.  If clock is nil,
+//the SystemClock is used.
+func NewJWT(clock Clock, signer *JWTKey, verify ...*JWTKey) *JWT {
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+	result := &JWT{clock: clock, signer: signer, keys: make(map[string]*JWTKey), Lifetime: DEFAULT_JWT_LIFETIME}
+	if signer != nil {
+		verify = append([]*JWTKey{signer}, verify...)
+	}
+	for _, k := range verify {
+		result.keys[k.Id] = k
+	}
+	return result
+}
+
+//Sign returns the token for the claims, exactly as they are.
+func (self *JWT) Sign(claims *JWTClaims) (string, error) {
+	if self.signer == nil || (self.signer.secret == nil && self.signer.private == nil) {
+		return "", fmt.Errorf("no key to sign JWTs with")
+	}
+	header, err := json.Marshal(&jwtHeader{Alg: self.signer.Alg, Typ: "JWT", Kid: self.signer.Id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := claims.marshal()
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := self.signer.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+//Mint returns a token for the unique id with the extra claims, which may
+//be nil.  The token expires after the Lifetime and has a random jti.
+func (self *JWT) Mint(uniq string, extra map[string]interface{}) (string, error) {
+	if uniq == "" {
+		return "", fmt.Errorf("JWTs must have a subject")
+	}
+	now := self.clock.Now()
+	claims := &JWTClaims{
+		Issuer:   self.Issuer,
+		Subject:  uniq,
+		Expires:  now.Add(self.Lifetime),
+		IssuedAt: now,
+		Id:       hex.EncodeToString(apiKeyRandom(16)),
+		Extra:    extra,
+	}
+	if self.Audience != "" {
+		claims.Audience = []string{self.Audience}
+	}
+	return self.Sign(claims)
+}
+
+//MintSession returns a token for the unique id of the session, see Mint.
+func (self *JWT) MintSession(s Session, extra map[string]interface{}) (string, error) {
+	return self.Mint(SessionUniqueId(s), extra)
+}
+
+//Verify checks the signature, time limits, issuer and audience of the token
+//and returns its claims.  A token must have an exp, or an iat if MaxAge is
+//set, so that it doesn't last forever.
+func (self *JWT) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("JWT must have 3 parts, but has %d", len(parts))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode JWT header: %v", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("unable to decode JWT header: %v", err)
+	}
+	key, ok := self.keys[header.Kid]
+	if !ok && header.Kid == "" && len(self.keys) == 1 {
+		for _, k := range self.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key %q to verify JWT", header.Kid)
+	}
+	if header.Alg != key.Alg {
+		return nil, fmt.Errorf("JWT algorithm %q is not the %s of key %q", header.Alg, key.Alg, key.Id)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode JWT signature: %v", err)
+	}
+	if err := key.verify([]byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode JWT claims: %v", err)
+	}
+	claims := &JWTClaims{}
+	if err := claims.unmarshal(payload); err != nil {
+		return nil, err
+	}
+	now := self.clock.Now()
+	if claims.Expires.IsZero() && (self.MaxAge == 0 || claims.IssuedAt.IsZero()) {
+		return nil, fmt.Errorf("JWT has no expiration")
+	}
+	if !claims.Expires.IsZero() && !now.Before(claims.Expires.Add(self.Leeway)) {
+		return nil, fmt.Errorf("JWT expired at %v", claims.Expires)
+	}
+	if self.MaxAge != 0 && !claims.IssuedAt.IsZero() && !now.Before(claims.IssuedAt.Add(self.MaxAge+self.Leeway)) {
+		return nil, fmt.Errorf("JWT issued at %v is too old", claims.IssuedAt)
+	}
+	if !claims.NotBefore.IsZero() && now.Add(self.Leeway).Before(claims.NotBefore) {
+		return nil, fmt.Errorf("JWT not valid before %v", claims.NotBefore)
+	}
+	if self.Issuer != "" && claims.Issuer != self.Issuer {
+		return nil, fmt.Errorf("JWT issuer %q is not %q", claims.Issuer, self.Issuer)
+	}
+	if self.Audience != "" {
+		found := false
+		for _, a := range claims.Audience {
+			found = found || a == self.Audience
+		}
+		if !found {
+			return nil, fmt.Errorf("JWT audience %v does not include %q", claims.Audience, self.Audience)
+		}
+	}
+	return claims, nil
+}
+
+//JWTSession is the session of a request that was authenticated with a JWT.
+//It lasts only for the request, so it can't be updated.  If the token has a
+//"scope" claim, the session has those (space separated) scopes; otherwise it
+//has all of them.
+type JWTSession struct {
+	token  string
+	claims *JWTClaims
+	ud     interface{}
+}
+
+//SessionId returns the token.
+func (self *JWTSession) SessionId() string {
+	return self.token
+}
+
+//UserData returns the result of the session manager's Generate for the
+//subject of the token.
+func (self *JWTSession) UserData() interface{} {
+	return self.ud
+}
+
+//UniqueId returns the subject of the token.
+func (self *JWTSession) UniqueId() string {
+	return self.claims.Subject
+}
+
+//Scopes returns the scopes of the token.
+func (self *JWTSession) Scopes() []string {
+	if scope, ok := self.claims.Extra["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	return []string{API_KEY_ALL_SCOPES}
+}
+
+//Claims returns the claims of the token.
+func (self *JWTSession) Claims() *JWTClaims {
+	return self.claims
+}
+
+//Session returns the session for the JWT in the request, or nil if there is
+//no bearer token that looks like a JWT.  A request with a token that can't
+//be verified, or whose subject the session manager's Generate doesn't know
+//(nil user data), gets an Error with the code http.StatusUnauthorized.
+func (self *JWT) Session(r *http.Request, sm SessionManager) (Session, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	claims, err := self.Verify(token)
+	if err != nil {
+		log.Printf("[JWT] refused token for %s: %v", r.URL.Path, err)
+		return nil, HTTPError(http.StatusUnauthorized, "bad token")
+	}
+	if claims.Subject == "" {
+		return nil, HTTPError(http.StatusUnauthorized, "token has no subject")
+	}
+	var ud interface{}
+	if sm != nil {
+		if ud, err = sm.Generate(claims.Subject); err != nil {
+			return nil, err
+		}
+		if ud == nil {
+			return nil, HTTPError(http.StatusUnauthorized, "unknown token subject")
+		}
+	}
+	return &JWTSession{token: token, claims: claims, ud: ud}, nil
+}
@@ -0,0 +1,246 @@
+package seven5
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testJWTKeys returns a signing key for each algorithm, generated for the test.
+func testJWTKeys(t *testing.T) []*JWTKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+	var result []*JWTKey
+	for _, alg := range []string{"HS256", "HS384", "HS512"} {
+		k, err := NewHMACJWTKey("k-"+alg, alg, bytes.Repeat([]byte{7}, JWT_MIN_HMAC_KEY))
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		result = append(result, k)
+	}
+	for _, alg := range []string{"RS256", "RS384", "RS512"} {
+		k, err := NewJWTSigningKey("k-"+alg, alg, rsaKey)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		result = append(result, k)
+	}
+	for alg, curve := range map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("unable to generate EC key: %v", err)
+		}
+		k, err := NewJWTSigningKey("k-"+alg, alg, ecKey)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		result = append(result, k)
+	}
+	return result
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	for _, k := range testJWTKeys(t) {
+		j := NewJWT(clock, k)
+		token, err := j.Mint("fred", map[string]interface{}{"role": "admin"})
+		if err != nil {
+			t.Fatalf("%s: unable to mint: %v", k.Alg, err)
+		}
+		claims, err := j.Verify(token)
+		if err != nil || claims.Subject != "fred" || claims.Extra["role"] != "admin" || claims.Id == "" {
+			t.Errorf("%s: bad verify: %+v %v", k.Alg, claims, err)
+		}
+		parts := strings.Split(token, ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sig[0] ^= 1
+		tampered := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+		if _, err := j.Verify(tampered); err == nil {
+			t.Errorf("%s: expected tampered signature to fail", k.Alg)
+		}
+		other, _ := (&JWTClaims{Subject: "barney", Expires: clock.Now().Add(time.Hour)}).marshal()
+		forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(other) + "." + parts[2]
+		if _, err := j.Verify(forged); err == nil {
+			t.Errorf("%s: expected changed claims to fail", k.Alg)
+		}
+	}
+}
+
+func TestJWTClaimChecks(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	key, _ := NewHMACJWTKey("k1", "HS256", bytes.Repeat([]byte{7}, JWT_MIN_HMAC_KEY))
+	j := NewJWT(clock, key)
+	j.Issuer = "https://auth.example.com"
+	j.Audience = "api"
+	j.Leeway = 30 * time.Second
+
+	token, _ := j.Mint("fred", nil)
+	if _, err := j.Verify(token); err != nil {
+		t.Fatalf("unable to verify: %v", err)
+	}
+	clock.Advance(DEFAULT_JWT_LIFETIME + 10*time.Second)
+	if _, err := j.Verify(token); err != nil {
+		t.Errorf("expected leeway to allow a token that just expired: %v", err)
+	}
+	clock.Advance(time.Minute)
+	if _, err := j.Verify(token); err == nil {
+		t.Errorf("expected expired token to fail")
+	}
+
+	now := clock.Now()
+	cases := map[string]*JWTClaims{
+		"not yet valid":  {Issuer: j.Issuer, Subject: "fred", Audience: []string{"api"}, NotBefore: now.Add(time.Hour)},
+		"wrong issuer":   {Issuer: "https://evil.com", Subject: "fred", Audience: []string{"api"}},
+		"wrong audience": {Issuer: j.Issuer, Subject: "fred", Audience: []string{"web", "other"}},
+		"no audience":    {Issuer: j.Issuer, Subject: "fred"},
+	}
+	for name, c := range cases {
+		token, _ := j.Sign(c)
+		if _, err := j.Verify(token); err == nil {
+			t.Errorf("%s: expected verify to fail", name)
+		}
+	}
+	token, _ = j.Sign(&JWTClaims{Issuer: j.Issuer, Subject: "fred", Audience: []string{"web", "api"},
+		Expires: now.Add(time.Hour)})
+	if _, err := j.Verify(token); err != nil {
+		t.Errorf("expected one of many audiences to be enough: %v", err)
+	}
+
+	//no exp is only allowed with a MaxAge and an iat
+	forever, _ := j.Sign(&JWTClaims{Issuer: j.Issuer, Subject: "fred", Audience: []string{"api"}, IssuedAt: now})
+	if _, err := j.Verify(forever); err == nil {
+		t.Errorf("expected token without exp to fail")
+	}
+	j.MaxAge = time.Hour
+	if _, err := j.Verify(forever); err != nil {
+		t.Errorf("expected token with iat to be verified with a MaxAge: %v", err)
+	}
+	noIat, _ := j.Sign(&JWTClaims{Issuer: j.Issuer, Subject: "fred", Audience: []string{"api"}})
+	if _, err := j.Verify(noIat); err == nil {
+		t.Errorf("expected token without exp or iat to fail")
+	}
+	clock.Advance(time.Hour + time.Minute)
+	if _, err := j.Verify(forever); err == nil {
+		t.Errorf("expected token older than MaxAge to fail")
+	}
+	j.MaxAge = 0
+
+	//"none" and algorithm confusion
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+	parts := strings.Split(token, ".")
+	if _, err := j.Verify(none + "." + parts[1] + "."); err == nil {
+		t.Errorf("expected alg none to fail")
+	}
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := NewJWTSigningKey("k2", "HS256", rsaKey); err == nil {
+		t.Errorf("expected RSA key for HS256 to be refused")
+	}
+	if _, err := NewHMACJWTKey("k3", "HS256", []byte("short")); err == nil {
+		t.Errorf("expected short HMAC key to be refused")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	keys := testJWTKeys(t)
+	b, err := MarshalJWKS(keys...)
+	if err != nil {
+		t.Fatalf("unable to marshal: %v", err)
+	}
+	if bytes.Contains(b, []byte(`"oct"`)) {
+		t.Errorf("HMAC keys must not be published")
+	}
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(path, b, 0600)
+	public, err := LoadJWKS(path)
+	if err != nil || len(public) != 6 {
+		t.Fatalf("expected 6 public keys: %d %v", len(public), err)
+	}
+	verifier := NewJWT(nil, nil, public...)
+	for _, k := range keys {
+		if k.secret != nil {
+			continue
+		}
+		token, err := NewJWT(nil, k).Mint("fred", nil)
+		if err != nil {
+			t.Fatalf("%s: unable to mint: %v", k.Alg, err)
+		}
+		if claims, err := verifier.Verify(token); err != nil || claims.Subject != "fred" {
+			t.Errorf("%s: expected verify with JWKS key: %v", k.Alg, err)
+		}
+	}
+	if _, err := verifier.Mint("fred", nil); err == nil {
+		t.Errorf("expected verify only JWT to refuse to mint")
+	}
+	unknown, _ := NewHMACJWTKey("nobody", "HS256", bytes.Repeat([]byte{9}, JWT_MIN_HMAC_KEY))
+	token, _ := NewJWT(nil, unknown).Mint("fred", nil)
+	if _, err := verifier.Verify(token); err == nil {
+		t.Errorf("expected token with unknown kid to fail")
+	}
+}
+
+func TestJWTSessionSource(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	key, _ := NewHMACJWTKey("k1", "HS256", bytes.Repeat([]byte{7}, JWT_MIN_HMAC_KEY))
+	j := NewJWT(nil, key)
+	apiKeys := NewAPIKeys(NewMemoryAPIKeyStore(), nil)
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, NewSimpleCookieMapper("test"))
+	io.Sources = []SessionSource{apiKeys, j}
+
+	s, _ := sm.Assign("fred", "data", time.Time{})
+	token, _ := j.MintSession(s, map[string]interface{}{"scope": "read write"})
+	r := httptest.NewRequest("GET", "http://example.com/rest/x", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	pb, err := io.BundleHook(httptest.NewRecorder(), r, sm)
+	if err != nil || SessionUniqueId(pb.Session()) != "fred" || pb.Session().UserData() != "fred" {
+		t.Fatalf("expected session from JWT: %v", err)
+	}
+	if !SessionHasScope(pb.Session(), "write") || SessionHasScope(pb.Session(), "admin") {
+		t.Errorf("bad scopes: %v", pb.Session().(ScopedSession).Scopes())
+	}
+
+	r.Header.Set("Authorization", "Bearer "+token+"x")
+	_, err = io.BundleHook(httptest.NewRecorder(), r, sm)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected bad token to be unauthorized: %v", err)
+	}
+
+	//a subject or key owner that Generate doesn't know is refused
+	ghosts := NewSimpleSessionManagerWithConfig(&unknownGen{}, &SessionConfig{Keys: testSessionKeys()})
+	defer ghosts.Close()
+	ghost, _ := j.Mint("ghost", nil)
+	r.Header.Set("Authorization", "Bearer "+ghost)
+	_, err = io.BundleHook(httptest.NewRecorder(), r, ghosts)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unknown subject to be unauthorized: %v", err)
+	}
+	key2, _, _ := apiKeys.Mint("ghost", "test", nil, time.Time{})
+	r.Header.Set("Authorization", "Bearer "+key2)
+	_, err = io.BundleHook(httptest.NewRecorder(), r, ghosts)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unknown key owner to be unauthorized: %v", err)
+	}
+}
+
+//unknownGen knows no users.
+type unknownGen struct {
+}
+
+func (self *unknownGen) Generate(uniqueId string) (interface{}, error) {
+	return nil, nil
+}
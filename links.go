@@ -0,0 +1,175 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+const (
+	LINKS_FIELD  = "_links"
+	OFFSET_PARAM = "offset"
+	LIMIT_PARAM  = "limit"
+	//MAX_PAGE_LIMIT is the largest page an index resource returns.
+	MAX_PAGE_LIMIT = 1000
+)
+
+//PageParameters returns the limit and offset query parameters of an Index
+//request.  The limit is def if it is not given, and is kept between 1 and
+//MAX_PAGE_LIMIT so a client can't ask for a whole table; the offset is not
+//negative.  Index resources that page their results should use this.
+func PageParameters(pb PBundle, def int) (int, int) {
+	limit := pb.IntQueryParameter(LIMIT_PARAM, int64(def))
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > MAX_PAGE_LIMIT {
+		limit = MAX_PAGE_LIMIT
+	}
+	offset := pb.IntQueryParameter(OFFSET_PARAM, 0)
+	if offset < 0 {
+		offset = 0
+	}
+	return int(limit), int(offset)
+}
+
+//Link is a single HAL-style link, as it appears in the _links object of an
+//encoded wire type.
+type Link struct {
+	Href string `json:"href"`
+}
+
+//Linker can be implemented by a resource that wants to add its own links to
+//the wire types it returns, when the IOHook is decorating responses with links.
+//The map returned is from relation name to url; it is merged with the
+//standard links, and can replace them.  Wire is a single instance of the
+//resource's wire type, never a slice.
+type Linker interface {
+	Links(wire interface{}, pb PBundle) map[string]string
+}
+
+//findLinker returns the first of the resource's implementation objects
+//that implements Linker, or nil.
+func findLinker(impl ...interface{}) Linker {
+	for _, i := range impl {
+		if l, ok := i.(Linker); ok {
+			return l
+		}
+	}
+	return nil
+}
+
+//wireId returns the Id (or Udid) field of a wire type as a string, or ""
+//if the wire type does not have the field.
+func wireId(isUdid bool, i interface{}) string {
+	p := reflect.ValueOf(i)
+	if p.Kind() != reflect.Ptr || p.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	if isUdid {
+		f := p.Elem().FieldByName("Udid")
+		if !f.IsValid() || f.Kind() != reflect.String {
+			return ""
+		}
+		return f.String()
+	}
+	f := p.Elem().FieldByName("Id")
+	if !f.IsValid() || f.Kind() != reflect.Int64 {
+		return ""
+	}
+	return fmt.Sprintf("%d", f.Int())
+}
+
+//computeLinks returns the links for a single wire object of the resource d.
+//The standard links are self, collection, parent (for subresources) and
+//one for each subresource collection, named by the subresource.
+func computeLinks(d *restShared, pb PBundle, wire interface{}) map[string]Link {
+	result := make(map[string]Link)
+	collection := BundleResourcePath(pb)
+	result["collection"] = Link{collection}
+	if d.parent != nil {
+		result["parent"] = Link{collection[:strings.LastIndex(collection, "/")]}
+	}
+	if id := wireId(d.udid, wire); id != "" {
+		self := collection + "/" + id
+		result["self"] = Link{self}
+		for _, child := range d.children {
+			result[child] = Link{self + "/" + child}
+		}
+	}
+	if d.linker != nil {
+		for rel, href := range d.linker.Links(wire, pb) {
+			result[rel] = Link{href}
+		}
+	}
+	return result
+}
+
+//paginationLinks computes the next and prev urls for an Index result of
+//length n, based on the offset and limit query parameters.  Nothing is
+//returned if the request did not have a limit.  Only the offset and limit
+//are carried in the returned urls.
+func paginationLinks(pb PBundle, n int) map[string]string {
+	result := make(map[string]string)
+	if pb.IntQueryParameter(LIMIT_PARAM, 0) <= 0 {
+		return result
+	}
+	limit, offset := PageParameters(pb, 0)
+	page := func(o int) string {
+		v := url.Values{}
+		v.Set(OFFSET_PARAM, fmt.Sprint(o))
+		v.Set(LIMIT_PARAM, fmt.Sprint(limit))
+		return BundleResourcePath(pb) + "?" + v.Encode()
+	}
+	if n >= limit {
+		result["next"] = page(offset + limit)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		result["prev"] = page(prev)
+	}
+	return result
+}
+
+//addLinks converts a wire object, or a slice of them, into a value that has
+//the same json encoding plus a _links field on each object.
+func addLinks(d *restShared, pb PBundle, i interface{}) (interface{}, error) {
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Slice {
+		return linkOne(d, pb, i)
+	}
+	result := make([]interface{}, v.Len())
+	for n := 0; n < v.Len(); n++ {
+		one, err := linkOne(d, pb, v.Index(n).Interface())
+		if err != nil {
+			return nil, err
+		}
+		result[n] = one
+	}
+	return result, nil
+}
+
+func linkOne(d *restShared, pb PBundle, wire interface{}) (interface{}, error) {
+	raw, err := json.Marshal(wire)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil { //nil pointer, nothing to link
+		return wire, nil
+	}
+	links, err := json.Marshal(computeLinks(d, pb, wire))
+	if err != nil {
+		return nil, err
+	}
+	fields[LINKS_FIELD] = json.RawMessage(links)
+	return fields, nil
+}
@@ -0,0 +1,99 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type linkedWire struct {
+	Id    int64
+	Foo   string
+	Links map[string]Link `json:"_links"`
+}
+
+type linkedSubWire struct {
+	Id    int64
+	Links map[string]Link `json:"_links"`
+}
+
+func TestLinks(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	io.Links = true
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.Rez(&someWire{}, &someResource{})
+	sub := &someSubResource{}
+	raw.SubResourceSeparate(&someWire{}, &someSubWire{}, sub, sub, sub, sub, sub)
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/rest/somewire/12")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	var found linkedWire
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		t.Fatalf("unable to decode: %v", err)
+	}
+	expected := map[string]string{
+		"self":        "/rest/somewire/12",
+		"collection":  "/rest/somewire",
+		"somesubwire": "/rest/somewire/12/somesubwire",
+	}
+	for rel, href := range expected {
+		if found.Links[rel].Href != href {
+			t.Errorf("expected %s to be %s but got %+v", rel, href, found.Links[rel])
+		}
+	}
+	if _, ok := found.Links["parent"]; ok {
+		t.Errorf("top level resource should not have a parent link")
+	}
+
+	resp, err = http.Get(server.URL + "/rest/somewire?limit=1&offset=3")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if len(resp.Header["Link"]) != 2 {
+		t.Errorf("expected next and prev links but got %v", resp.Header["Link"])
+	}
+
+	body := "{ \"Id\":-1, \"Bar\":\"grak\"}"
+	resp, err = http.Post(server.URL+"/rest/somewire/999/somesubwire", "text/json", strings.NewReader(body))
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+	var child linkedSubWire
+	if err := json.NewDecoder(resp.Body).Decode(&child); err != nil {
+		t.Fatalf("unable to decode: %v", err)
+	}
+	if child.Links["parent"].Href != "/rest/somewire/999" {
+		t.Errorf("bad parent link: %+v", child.Links)
+	}
+	if child.Links["self"].Href != "/rest/somewire/999/somesubwire/668" {
+		t.Errorf("bad self link: %+v", child.Links)
+	}
+}
+
+func TestPageParameters(t *testing.T) {
+	for _, c := range []struct {
+		limit, offset string
+		expected      [2]int
+	}{
+		{"", "", [2]int{100, 0}},
+		{"10", "20", [2]int{10, 20}},
+		{"0", "", [2]int{1, 0}},
+		{"5000", "", [2]int{MAX_PAGE_LIMIT, 0}},
+		{"", "-3", [2]int{100, 0}},
+	} {
+		query := make(map[string]string)
+		if c.limit != "" {
+			query[LIMIT_PARAM] = c.limit
+		}
+		if c.offset != "" {
+			query[OFFSET_PARAM] = c.offset
+		}
+		limit, offset := PageParameters(NewTestPBundle(nil, query, nil, nil, nil, nil), 100)
+		if limit != c.expected[0] || offset != c.expected[1] {
+			t.Errorf("%+v: expected %v but got %d %d", c, c.expected, limit, offset)
+		}
+	}
+}
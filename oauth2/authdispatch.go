@@ -106,6 +106,7 @@ func (self *AuthDispatcher) Logout(conn OauthConnector, w http.ResponseWriter, r
 	}
 	if err != NO_SUCH_COOKIE {
 		self.CookieMap.RemoveCookie(w)
+		NotifySession(self.SessionMgr, &SessionEvent{Type: SESSION_LOGOUT, SessionId: id})
 		self.SessionMgr.Destroy(id)
 	}
 	http.Redirect(w, r, self.PageMap.LogoutLandingPage(conn), http.StatusTemporaryRedirect)
@@ -0,0 +1,114 @@
+package seven5
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	//PASSWORD_SHA256 and PASSWORD_SHA512 are the names of the PBKDF2
+	//variants a PasswordHasher can use.
+	PASSWORD_SHA256 = "pbkdf2-sha256"
+	PASSWORD_SHA512 = "pbkdf2-sha512"
+	//DEFAULT_PASSWORD_ITERATIONS is the cost of a new PasswordHasher.  Raise it
+	//as computers get faster; stored hashes are upgraded as users log in.
+	DEFAULT_PASSWORD_ITERATIONS = 600000
+	//PASSWORD_MIN_ITERATIONS is the lowest cost a stored hash may have
+	//before it is refused outright.
+	PASSWORD_MIN_ITERATIONS = 1000
+	DEFAULT_PASSWORD_SALT   = 16
+)
+
+var passwordHashes = map[string]func() hash.Hash{
+	PASSWORD_SHA256: sha256.New,
+	PASSWORD_SHA512: sha512.New,
+}
+
+//PasswordHasher hashes passwords with PBKDF2.  A hash describes how it was
+//made, as "<alg>$<iterations>$<salt>$<key>" with the salt and key in
+//unpadded base64, so the settings of a PasswordHasher can be changed without
+//breaking the hashes it made before: Verify checks a hash with the settings
+//in it and reports when the hash should be made again with the current ones.
+//PBKDF2 comes from crypto/pbkdf2, so this needs Go 1.24 or later.
+type PasswordHasher struct {
+	//Alg is PASSWORD_SHA256 (the default) or PASSWORD_SHA512.
+	Alg        string
+	Iterations int
+	SaltLen    int
+	//Legacy, if not nil, checks stored hashes that are not in the format of
+	//a PasswordHasher, such as unsalted SHA1 from an older system.  A
+	//password accepted by Legacy always needs to be hashed again.
+	Legacy func(pwd, stored string) bool
+}
+
+//NewPasswordHasher returns a PasswordHasher with the default settings.
+func NewPasswordHasher() *PasswordHasher {
+	return &PasswordHasher{
+		Alg:        PASSWORD_SHA256,
+		Iterations: DEFAULT_PASSWORD_ITERATIONS,
+		SaltLen:    DEFAULT_PASSWORD_SALT,
+	}
+}
+
+//Hash returns a new hash of the password, with a random salt.
+func (self *PasswordHasher) Hash(pwd string) (string, error) {
+	h, ok := passwordHashes[self.Alg]
+	if !ok {
+		return "", fmt.Errorf("unknown password hash %q", self.Alg)
+	}
+	if self.Iterations < PASSWORD_MIN_ITERATIONS {
+		return "", fmt.Errorf("password hash iterations must be at least %d", PASSWORD_MIN_ITERATIONS)
+	}
+	salt := apiKeyRandom(self.SaltLen)
+	key, err := pbkdf2.Key(h, pwd, salt, self.Iterations, h().Size())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", self.Alg, self.Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//Verify is true if the password matches the stored hash.  The second result
+//is true if the password matched but the hash was not made with the
+//current settings, so the caller should store the result of Hash(pwd)
+//instead.  An error means the stored hash can't be understood.
+func (self *PasswordHasher) Verify(pwd, stored string) (bool, bool, error) {
+	parts := strings.Split(stored, "$")
+	h, ok := passwordHashes[parts[0]]
+	if len(parts) != 4 || !ok {
+		if self.Legacy != nil {
+			ok := self.Legacy(pwd, stored)
+			return ok, ok, nil
+		}
+		return false, false, fmt.Errorf("password hash is not in a known format")
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < PASSWORD_MIN_ITERATIONS {
+		return false, false, fmt.Errorf("bad password hash iterations %q", parts[1])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false, fmt.Errorf("bad password hash salt: %v", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false, false, fmt.Errorf("bad password hash key")
+	}
+	key, err := pbkdf2.Key(h, pwd, salt, iter, len(want))
+	if err != nil {
+		return false, false, err
+	}
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return false, false, nil
+	}
+	rehash := parts[0] != self.Alg || iter != self.Iterations || len(salt) < self.SaltLen ||
+		len(want) != h().Size()
+	return true, rehash, nil
+}
@@ -0,0 +1,148 @@
+package seven5
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testHasher returns a PasswordHasher that is cheap enough for tests.
+func testHasher() *PasswordHasher {
+	h := NewPasswordHasher()
+	h.Iterations = PASSWORD_MIN_ITERATIONS
+	return h
+}
+
+func TestPasswordHasher(t *testing.T) {
+	h := testHasher()
+	first, err := h.Hash("secret")
+	if err != nil {
+		t.Fatalf("unable to hash: %v", err)
+	}
+	second, _ := h.Hash("secret")
+	if first == second || !strings.HasPrefix(first, PASSWORD_SHA256+"$1000$") {
+		t.Errorf("expected salted, self describing hashes: %s %s", first, second)
+	}
+	if ok, rehash, err := h.Verify("secret", first); !ok || rehash || err != nil {
+		t.Errorf("expected password to match: %v %v %v", ok, rehash, err)
+	}
+	if ok, _, _ := h.Verify("Secret", first); ok {
+		t.Errorf("expected wrong password to fail")
+	}
+
+	//settings change, old hashes still work but should be replaced
+	h.Iterations = 2 * PASSWORD_MIN_ITERATIONS
+	if ok, rehash, _ := h.Verify("secret", first); !ok || !rehash {
+		t.Errorf("expected rehash after iterations change")
+	}
+	h.Alg = PASSWORD_SHA512
+	upgraded, _ := h.Hash("secret")
+	if ok, rehash, _ := h.Verify("secret", upgraded); !ok || rehash {
+		t.Errorf("expected sha512 hash to be current")
+	}
+
+	for _, bad := range []string{"", "plaintext", "pbkdf2-sha256$10$c2FsdA$a2V5", "pbkdf2-md5$1000$c2FsdA$a2V5"} {
+		if ok, _, err := h.Verify("secret", bad); ok || err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+	h.Legacy = func(pwd, stored string) bool {
+		sum := sha1.Sum([]byte(pwd))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(stored)) == 1
+	}
+	sum := sha1.Sum([]byte("secret"))
+	if ok, rehash, err := h.Verify("secret", hex.EncodeToString(sum[:])); !ok || !rehash || err != nil {
+		t.Errorf("expected legacy hash to match and need rehash: %v %v %v", ok, rehash, err)
+	}
+}
+
+func TestPasswordSessionManager(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Clock: clock, Keys: testSessionKeys()})
+	defer sm.Close()
+	store := NewMemoryCredentialStore()
+	h := testHasher()
+	psm := NewPasswordSessionManager(sm, store, h, clock)
+	var sent string
+	psm.SendReset = func(c *Credential, id string) error {
+		sent = id
+		return nil
+	}
+	reset := func(username string) string {
+		sent = ""
+		if id, err := psm.GenerateResetRequest(username); id != "" || err != nil {
+			t.Errorf("expected no id or error from a reset request: %q %v", id, err)
+		}
+		psm.resets.Wait()
+		return sent
+	}
+	var _ ValidatingSessionManager = psm
+
+	if err := psm.SetPassword("u1", "fred", "secret"); err != nil {
+		t.Fatalf("unable to set password: %v", err)
+	}
+	if uniq, ud, err := psm.ValidateCredentials("fred", "secret"); uniq != "u1" || ud != "u1" || err != nil {
+		t.Errorf("expected login: %s %v %v", uniq, ud, err)
+	}
+	for _, bad := range [][2]string{{"fred", "wrong"}, {"barney", "secret"}} {
+		if uniq, _, err := psm.ValidateCredentials(bad[0], bad[1]); uniq != "" || err != nil {
+			t.Errorf("expected %v to fail: %v", bad, err)
+		}
+	}
+
+	//a stored hash that can't be parsed fails, after wasting the same time
+	store.Save(&Credential{UniqueId: "u2", Username: "wilma", Hash: "garbage"})
+	psm.dummy = ""
+	psm.once = sync.Once{}
+	if uniq, _, err := psm.ValidateCredentials("wilma", "secret"); uniq != "" || err != nil {
+		t.Errorf("expected a bad hash to fail: %v", err)
+	}
+	if psm.dummy == "" {
+		t.Errorf("expected time to be wasted on a bad hash")
+	}
+
+	//rehash on login
+	old, _ := store.LoadUnique("u1")
+	h.Iterations = 2 * PASSWORD_MIN_ITERATIONS
+	psm.ValidateCredentials("fred", "secret")
+	upgraded, _ := store.LoadUnique("u1")
+	if upgraded.Hash == old.Hash || !strings.Contains(upgraded.Hash, "$2000$") {
+		t.Errorf("expected hash to be upgraded: %s", upgraded.Hash)
+	}
+	if uniq, _, _ := psm.ValidateCredentials("fred", "secret"); uniq != "u1" {
+		t.Errorf("expected login with the upgraded hash")
+	}
+
+	//reset
+	if reset("barney") != "" {
+		t.Errorf("expected unknown user to be ignored")
+	}
+	id := reset("fred")
+	if id == "" {
+		t.Fatalf("expected reset request to be sent")
+	}
+	if stored, _ := store.LoadUnique("u1"); stored.ResetHash == id {
+		t.Errorf("expected only the hash of the request to be stored")
+	}
+	if ok, _ := psm.UseResetRequest("u1", id+"x", "new"); ok {
+		t.Errorf("expected wrong request to fail")
+	}
+	if ok, err := psm.UseResetRequest("u1", id, "new"); !ok || err != nil {
+		t.Fatalf("expected reset: %v", err)
+	}
+	if ok, _ := psm.UseResetRequest("u1", id, "again"); ok {
+		t.Errorf("expected request to be used once")
+	}
+	if uniq, _, _ := psm.ValidateCredentials("fred", "new"); uniq != "u1" {
+		t.Errorf("expected login with the new password")
+	}
+	id = reset("fred")
+	clock.Advance(DEFAULT_RESET_LIFETIME)
+	if ok, _ := psm.UseResetRequest("u1", id, "late"); ok {
+		t.Errorf("expected expired request to fail")
+	}
+}
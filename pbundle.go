@@ -21,6 +21,71 @@ type PBundle interface {
 	IntQueryParameter(string, int64) int64
 }
 
+//DispatchBundle is implemented by a PBundle that can hold what the dispatcher
+//learns about a request: the path of the collection, the tenant and the cache
+//policy for the response.  The PBundle of NewSimplePBundle implements it.
+//Resources should use BundleResourcePath, BundleTenant, BundleCachePolicy
+//and SetBundleCachePolicy, which work with any PBundle.
+type DispatchBundle interface {
+	ResourcePath() string
+	SetResourcePath(string)
+	Tenant() string
+	SetTenant(string)
+	CachePolicy() *HTTPCachePolicy
+	SetCachePolicy(*HTTPCachePolicy)
+}
+
+//BundleResourcePath returns the path of the collection being acted on, or
+//"" if it is not known.
+func BundleResourcePath(pb PBundle) string {
+	if d, ok := pb.(DispatchBundle); ok {
+		return d.ResourcePath()
+	}
+	return ""
+}
+
+//BundleTenant returns the tenant of the request, or "" if there is none.
+func BundleTenant(pb PBundle) string {
+	if d, ok := pb.(DispatchBundle); ok {
+		return d.Tenant()
+	}
+	return ""
+}
+
+//BundleCachePolicy returns the cache policy for the response, or nil if none
+//has been chosen.
+func BundleCachePolicy(pb PBundle) *HTTPCachePolicy {
+	if d, ok := pb.(DispatchBundle); ok {
+		return d.CachePolicy()
+	}
+	return nil
+}
+
+//setBundleTenant records the tenant, if the PBundle can hold it.
+func setBundleTenant(pb PBundle, t string) {
+	if d, ok := pb.(DispatchBundle); ok {
+		d.SetTenant(t)
+	}
+}
+
+//setBundleResourcePath records the path of the collection, if the PBundle
+//can hold it.
+func setBundleResourcePath(pb PBundle, p string) {
+	if d, ok := pb.(DispatchBundle); ok {
+		d.SetResourcePath(p)
+	}
+}
+
+//SetBundleCachePolicy chooses the cache policy for the response, if the
+//PBundle can hold one.  A resource can call this to override the policy of
+//the dispatcher for a particular response, for example to prevent caching of
+//a response containing something sensitive.
+func SetBundleCachePolicy(pb PBundle, p *HTTPCachePolicy) {
+	if d, ok := pb.(DispatchBundle); ok {
+		d.SetCachePolicy(p)
+	}
+}
+
 type simplePBundle struct {
 	h      map[string]string
 	q      map[string]string
@@ -28,6 +93,12 @@ type simplePBundle struct {
 	mgr    SessionManager
 	out    map[string]string
 	parent map[reflect.Type]interface{}
+	path   string
+	tenant string
+	cache  *HTTPCachePolicy
+	audit  bool
+	before interface{}
+	caught bool
 }
 
 //ReturnHeaders gets all the header _keys_ that should be returned the client.
@@ -71,9 +142,14 @@ func (self *simplePBundle) Session() Session {
 }
 
 //UpdateSession associates a new data blob (i) with the currently in use session.
-//This will blow up if there is no associated SessionManager.
+//This will blow up if there is no associated SessionManager.  The session
+//returned becomes the session of this PBundle.
 func (self *simplePBundle) UpdateSession(i interface{}) (Session, error) {
-	return self.mgr.Update(self.s, i)
+	s, err := self.mgr.Update(self.s, i)
+	if err == nil && s != nil {
+		self.s = s
+	}
+	return s, err
 }
 
 //DestroySession removes the session associated with this Pbundle from the
@@ -83,6 +159,9 @@ func (self *simplePBundle) DestroySession() error {
 	if self.Session() == nil {
 		return nil
 	}
+	if cs, ok := self.s.(*CookieSession); ok {
+		cs.removeCookie()
+	}
 	return self.mgr.Destroy(self.s.SessionId())
 }
 
@@ -118,6 +197,69 @@ func (self *simplePBundle) IntQueryParameter(name string, def int64) int64 {
 	return i
 }
 
+//ResourcePath returns the url path of the collection that the current
+//request is acting on, such as /rest/house/12/room.  This is set by the
+//dispatcher once the target resource is known and is "" before that.
+func (self *simplePBundle) ResourcePath() string {
+	return self.path
+}
+
+//SetResourcePath is called by the dispatch mechanism to record the collection
+//being acted on.  Clients typically don't need this method.
+func (self *simplePBundle) SetResourcePath(p string) {
+	self.path = p
+}
+
+//Tenant returns the tenant the request is for, as determined by the
+//dispatcher's TenantResolver, or "" if there is no tenant.
+func (self *simplePBundle) Tenant() string {
+	return self.tenant
+}
+
+//SetTenant is called by the dispatch mechanism once the tenant is known.
+//Clients typically don't need this method.
+func (self *simplePBundle) SetTenant(t string) {
+	self.tenant = t
+}
+
+//CachePolicy returns the cache policy for the response, or nil if none has
+//been chosen.
+func (self *simplePBundle) CachePolicy() *HTTPCachePolicy {
+	return self.cache
+}
+
+//SetCachePolicy chooses the cache policy for the response.  A resource can
+//call this to override the policy of the dispatcher for a particular
+//response, for example to prevent caching of a response containing
+//something sensitive.
+func (self *simplePBundle) SetCachePolicy(p *HTTPCachePolicy) {
+	self.cache = p
+}
+
+//auditBefore is called by the dispatcher when the value of the object before
+//a change should be captured for the audit record.
+func (self *simplePBundle) auditBefore() {
+	self.audit = true
+}
+
+//captureBefore calls find and keeps the result if auditBefore was called.
+//A failed find is kept as nil, the object did not exist.
+func (self *simplePBundle) captureBefore(find func() (interface{}, error)) {
+	if !self.audit || self.caught {
+		return
+	}
+	self.caught = true
+	if v, err := find(); err == nil {
+		self.before = v
+	}
+}
+
+//capturedBefore returns the value given to captureBefore and true, or false
+//if nothing was captured.
+func (self *simplePBundle) capturedBefore() (interface{}, bool) {
+	return self.before, self.caught
+}
+
 //NewSimplePBundle needs to hold a reference to the session manager as well
 //as the session because it must be able to update the information stored
 //about a particular sesison.
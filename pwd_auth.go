@@ -7,26 +7,37 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	AUTH_OP_LOGIN         = "login"
-	AUTH_OP_LOGOUT        = "logout"
-	AUTH_OP_PWD_RESET     = "pwdreset"
-	AUTH_OP_PWD_RESET_REQ = "pwdresetreq"
+	AUTH_OP_LOGIN          = "login"
+	AUTH_OP_LOGIN_REMEMBER = "loginremember"
+	AUTH_OP_LOGIN_TOTP     = "logintotp"
+	AUTH_OP_LOGOUT         = "logout"
+	AUTH_OP_LOGOUT_ALL     = "logoutall"
+	AUTH_OP_PWD_RESET      = "pwdreset"
+	AUTH_OP_PWD_RESET_REQ  = "pwdresetreq"
+	AUTH_OP_TOTP_ENROLL    = "totpenroll"
+	AUTH_OP_TOTP_CONFIRM   = "totpconfirm"
+	AUTH_OP_TOTP_DISABLE   = "totpdisable"
 )
 
 //PasswordAuthParameters is passed from client to server to request login, login
 //or to use (consume) a reset request.  XXX Ugh, this has to be manually copied
-//over to the client side library. XXX
+//over to the client side library. XXX  Token and Code are used for two
+//factor authentication: Token is from the TwoFactorChallenge and Code is a
+//TOTP code or a recovery code.
 type PasswordAuthParameters struct {
 	Username         string
 	Password         string
 	ResetRequestUdid string
 	UserUdid         string
 	Op               string
+	Token            string
+	Code             string
 }
 
 //Valdating session manager is one that can also check the validity of a
@@ -35,7 +46,8 @@ type PasswordAuthParameters struct {
 //login attempt and use the error for something more serious, like the database
 //cannot be reached.  If the first returned value from ValidateCredentials is
 //not "" it should be a unique id, both of the first two returned values will be
-//sent to the (nested) session manager's Assign.
+//sent to the (nested) session manager's Assign.  GenerateResetRequest must not
+//return the secret id of the request, which only goes to the user.
 type ValidatingSessionManager interface {
 	SessionManager
 	ValidateCredentials(username, password string) (string, interface{}, error)
@@ -46,10 +58,17 @@ type ValidatingSessionManager interface {
 
 //SimplePasswordHandler is a utility for handling login-logout and authentication
 //checks.  It expects to be given a SessionManager that it will work in combination
-//with.
+//with.  If the session manager is also a SessionRevoker, a password reset
+//revokes all the sessions of the user, and the user may log out everywhere;
+//for this to work the unique id of the user's sessions must be the UserUdid
+//of the reset request.
 type SimplePasswordHandler struct {
-	vsm ValidatingSessionManager
-	cm  CookieMapper
+	vsm      ValidatingSessionManager
+	cm       CookieMapper
+	csrf     *CSRFGuard
+	remember *RememberMe
+	throttle *LoginThrottle
+	tf       *TwoFactor
 }
 
 //
@@ -64,20 +83,134 @@ func NewSimplePasswordHandler(vsm ValidatingSessionManager, cm CookieMapper) *Si
 	}
 }
 
+//SetCSRFGuard makes the handler check requests to AuthHandler with the guard
+//given.  Logging out requires the token of the session, the other operations
+//are only checked for their origin because they don't use the session.  The
+//token is sent to the client on login and by MeHandler.
+func (self *SimplePasswordHandler) SetCSRFGuard(g *CSRFGuard) {
+	self.csrf = g
+}
+
+//SetRememberMe lets users ask for a remember me token when they log in, with
+//AUTH_OP_LOGIN_REMEMBER.  MeHandler exchanges the token for a session when
+//there is none, logging out forgets the token, and logging out everywhere or
+//resetting the password forgets every token of the user.
+func (self *SimplePasswordHandler) SetRememberMe(rm *RememberMe) {
+	self.remember = rm
+}
+
+//SetLoginThrottle makes logins wait, or refuses them, after too many failed
+//attempts for the username or from the client's IP address (see
+//LoginThrottle).  A refused login gets 429 with a Retry-After header.
+func (self *SimplePasswordHandler) SetLoginThrottle(t *LoginThrottle) {
+	self.throttle = t
+}
+
+//SetTwoFactor turns on two factor authentication, if the session manager is
+//a TwoFactorSessionManager.  Users enroll with AUTH_OP_TOTP_ENROLL, which
+//responds with a TOTPEnrollment with the secret, and AUTH_OP_TOTP_CONFIRM
+//with a code, which responds with the recovery codes.  After that, a login
+//with the right password responds with 202 and a TwoFactorChallenge, and the
+//login is finished with AUTH_OP_LOGIN_TOTP, the challenge's token and a
+//code.  AUTH_OP_TOTP_DISABLE with a code turns it off again.
+func (self *SimplePasswordHandler) SetTwoFactor(tf *TwoFactor) {
+	if tf != nil {
+		if _, ok := self.vsm.(TwoFactorSessionManager); !ok {
+			log.Printf("[AUTH] two factor authentication needs a TwoFactorSessionManager, ignored")
+			return
+		}
+	}
+	self.tf = tf
+}
+
+//remembered exchanges the request's remember me token for a session and
+//responds with the user's details, if there is a RememberMe.  It returns
+//false if there is no session.
+func (self *SimplePasswordHandler) remembered(w http.ResponseWriter, r *http.Request) bool {
+	if self.remember == nil {
+		return false
+	}
+	s, err := self.remember.Exchange(w, r, self.vsm)
+	if err != nil {
+		log.Printf("[AUTH] unable to use remember me token: %v", err)
+		return false
+	}
+	if s == nil {
+		return false
+	}
+	self.cm.AssociateCookie(w, s)
+	self.issueToken(w, r, s)
+	if err := self.vsm.SendUserDetails(s.UserData(), w); err != nil {
+		log.Printf("failed to send user data: %v", err)
+	}
+	return true
+}
+
+//forgetAll forgets every remember me token of the user, if there is a
+//RememberMe.
+func (self *SimplePasswordHandler) forgetAll(uniq string) {
+	if self.remember != nil {
+		if err := self.remember.ForgetAll(uniq); err != nil {
+			log.Printf("[AUTH] unable to forget remember me tokens of user %s: %v", uniq, err)
+		}
+	}
+}
+
+//issueToken sends the csrf token of the session to the client, if there is
+//a CSRFGuard.
+func (self *SimplePasswordHandler) issueToken(w http.ResponseWriter, r *http.Request, s Session) {
+	if self.csrf != nil {
+		self.csrf.Issue(w, r, s.SessionId())
+	}
+}
+
+//removeCookies removes the session cookie and the csrf token from the client.
+func (self *SimplePasswordHandler) removeCookies(w http.ResponseWriter) {
+	self.cm.RemoveCookie(w)
+	if self.csrf != nil {
+		self.csrf.RemoveCookie(w)
+	}
+}
+
 //
 // Check verifies that the username and password provided are the ones we expect
 // via a calle the ValidatingSessionManager. It returns nil,nil in the case of a
-// failed check on the password provided.
+// failed check on the password provided.  Check can't ask for a second factor,
+// so it refuses, with 403, users that have enabled two factor authentication.
+// If there is a LoginThrottle, the username is throttled (but there is no IP
+// address to throttle) and a refused check returns 429.
 //
 func (self *SimplePasswordHandler) Check(username, pwd string) (Session, error) {
+	if self.throttle != nil {
+		if wait := self.throttle.Allow(username, ""); wait > 0 {
+			return nil, HTTPError(http.StatusTooManyRequests, fmt.Sprintf("try again in %v", wait))
+		}
+	}
 	uniq, userData, err := self.vsm.ValidateCredentials(username, pwd)
 	if err != nil {
+		self.release(username, "")
 		return nil, err
 	}
 	if uniq == "" {
+		if self.throttle != nil {
+			self.throttle.Failure(username, "")
+		}
 		return nil, nil
 	}
-	return self.vsm.Assign(uniq, userData, time.Time{})
+	if tfsm, ok := self.vsm.(TwoFactorSessionManager); ok {
+		state, err := tfsm.LoadTwoFactor(uniq)
+		if err != nil || (state != nil && state.Enabled) {
+			self.release(username, "")
+			if err == nil {
+				err = HTTPError(http.StatusForbidden, "second factor required")
+			}
+			return nil, err
+		}
+	}
+	if self.throttle != nil {
+		self.throttle.Success(username, "")
+	}
+	return assignSession(self.vsm, uniq, userData, nil)
 }
 
 //
@@ -93,20 +226,28 @@ func (self *SimplePasswordHandler) MeHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	if err != nil { //no cookie
-		http.Error(w, "no cookie", http.StatusUnauthorized)
+		if !self.remembered(w, r) {
+			http.Error(w, "no cookie", http.StatusUnauthorized)
+		}
 		return
 	}
-	sr, err := self.vsm.Find(strings.TrimSpace(val))
+	sr, err := findSession(self.vsm, strings.TrimSpace(val), r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	if sr == nil {
-		http.Error(w, "no session", http.StatusUnauthorized)
+		if !self.remembered(w, r) {
+			http.Error(w, "no session", http.StatusUnauthorized)
+		}
 		return
 	}
 
 	if sr.Session != nil {
+		if sr.Renewed {
+			self.cm.AssociateCookie(w, sr.Session)
+		}
+		self.issueToken(w, r, sr.Session)
 		if err := self.vsm.SendUserDetails(sr.Session.UserData(), w); err != nil {
 			log.Printf("failed to send user data: %v", err)
 		}
@@ -117,7 +258,13 @@ func (self *SimplePasswordHandler) MeHandler(w http.ResponseWriter, r *http.Requ
 		http.Error(w, fmt.Sprintf("unable to recover session: %v", err), http.StatusInternalServerError)
 		return
 	}
-	recovered, err := self.vsm.Assign(sr.UniqueId, i, time.Time{})
+	recovered, err := assignSession(self.vsm, sr.UniqueId, i, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to recover session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	self.cm.AssociateCookie(w, recovered)
+	self.issueToken(w, r, recovered)
 	if err := self.vsm.SendUserDetails(recovered.UserData(), w); err != nil {
 		log.Printf("failed to send user data: %v", err)
 	}
@@ -152,19 +299,28 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if self.csrf != nil {
+		sid := ""
+		switch auth.Op {
+		case AUTH_OP_LOGOUT, AUTH_OP_LOGOUT_ALL, AUTH_OP_TOTP_ENROLL, AUTH_OP_TOTP_CONFIRM, AUTH_OP_TOTP_DISABLE:
+			sid = val
+		}
+		if csrfErr := self.csrf.Check(r, sid); csrfErr != nil {
+			WriteError(w, csrfErr)
+			return
+		}
+	}
 
 	//
 	//PW RESET REQ? (Can be done without being logged in)
 	//
 	if auth.Op == AUTH_OP_PWD_RESET_REQ {
-		resetUdid, err := self.vsm.GenerateResetRequest(auth.Username)
-		if err != nil {
+		if _, err := self.vsm.GenerateResetRequest(auth.Username); err != nil {
 			WriteError(w, err)
 			log.Printf("[AUTH] error returned from GenerateResetRequest %v", err)
 			return
 		}
-		log.Printf("[AUTH] generated password reset req for user %s: %s",
-			auth.UserUdid, resetUdid)
+		log.Printf("[AUTH] password reset requested")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("{}")) //need to prevent the client-side dying
 		return
@@ -189,6 +345,14 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 		}
 		log.Printf("[AUTH] reset password for user %s with token %s",
 			auth.UserUdid, auth.ResetRequestUdid)
+		if revoker, ok := self.vsm.(SessionRevoker); ok {
+			if err := revoker.RevokeAll(auth.UserUdid); err != nil {
+				WriteError(w, err)
+				log.Printf("[AUTH] unable to revoke sessions of user %s: %v", auth.UserUdid, err)
+				return
+			}
+		}
+		self.forgetAll(auth.UserUdid)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("{}")) //need to prevent the client-side dying
 		return
@@ -201,7 +365,13 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 		if err == NO_SUCH_COOKIE {
 			http.Error(w, "not logged in", http.StatusBadRequest)
 		} else {
-			self.cm.RemoveCookie(w)
+			self.removeCookies(w)
+			if self.remember != nil {
+				if err := self.remember.Forget(w, r); err != nil {
+					log.Printf("[AUTH] unable to forget remember me token: %v", err)
+				}
+			}
+			NotifySession(self.vsm, &SessionEvent{Type: SESSION_LOGOUT, SessionId: val})
 			self.vsm.Destroy(val)
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("{}")) //prevent client side dying
@@ -210,19 +380,265 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	}
 
 	//
-	// MUST BE LOGIN
+	//LOGOUT EVERYWHERE?
 	//
-	session, err := self.Check(auth.Username, auth.Password)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if auth.Op == AUTH_OP_LOGOUT_ALL {
+		self.logoutAll(w, val, err)
+		return
+	}
+
+	//
+	//TWO FACTOR ENROLLMENT?
+	//
+	if auth.Op == AUTH_OP_TOTP_ENROLL || auth.Op == AUTH_OP_TOTP_CONFIRM || auth.Op == AUTH_OP_TOTP_DISABLE {
+		self.enroll(w, &auth, val, err)
 		return
 	}
-	if session == nil {
+
+	//
+	// MUST BE LOGIN, MAYBE WITH REMEMBER ME OR A SECOND FACTOR
+	//
+	var pending *pendingLogin
+	if auth.Op == AUTH_OP_LOGIN_TOTP {
+		if self.tf == nil {
+			http.Error(w, "two factor authentication not supported", http.StatusNotImplemented)
+			return
+		}
+		if pending = self.tf.claim(auth.Token); pending == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		auth.Username = pending.username
+	}
+	ip := ""
+	if self.throttle != nil {
+		ip = self.throttle.IP(r)
+		if wait := self.throttle.Allow(auth.Username, ip); wait > 0 {
+			log.Printf("[AUTH] login for %s from %s refused for %v", auth.Username, ip, wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+	var uniq string
+	var userData interface{}
+	remember := auth.Op == AUTH_OP_LOGIN_REMEMBER
+	if pending != nil {
+		ok, err := self.checkCode(pending.uniq, auth.Code)
+		if err != nil {
+			self.release(auth.Username, ip)
+			WriteError(w, err)
+			return
+		}
+		if ok && self.tf.complete(auth.Token) {
+			uniq, userData, remember = pending.uniq, pending.userData, pending.remember
+		}
+	} else {
+		uniq, userData, err = self.vsm.ValidateCredentials(auth.Username, auth.Password)
+		if err != nil {
+			self.release(auth.Username, ip)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if uniq == "" {
+		if self.throttle != nil {
+			self.throttle.Failure(auth.Username, ip)
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	if pending == nil {
+		state, err := self.twoFactorState(uniq)
+		if err != nil {
+			self.release(auth.Username, ip)
+			WriteError(w, err)
+			return
+		}
+		if state != nil && state.Enabled {
+			//the code is the attempt that counts
+			self.release(auth.Username, ip)
+			token := self.tf.pend(&pendingLogin{uniq: uniq, userData: userData, username: auth.Username,
+				remember: remember})
+			log.Printf("[AUTH] user %s needs a second factor", auth.Username)
+			w.WriteHeader(http.StatusAccepted)
+			SendJson(w, &TwoFactorChallenge{Token: token})
+			return
+		}
+	}
+	if self.throttle != nil {
+		self.throttle.Success(auth.Username, ip)
+	}
+	session, err := assignSession(self.vsm, uniq, userData, r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	log.Printf("[AUTH] user %s is authenticated", auth.Username)
 	self.cm.AssociateCookie(w, session)
+	self.issueToken(w, r, session)
+	if remember {
+		if self.remember == nil {
+			log.Printf("[AUTH] remember me requested but not configured")
+		} else if err := self.remember.Remember(w, SessionUniqueId(session)); err != nil {
+			log.Printf("[AUTH] unable to remember user %s: %v", auth.Username, err)
+		}
+	}
+	NotifySession(self.vsm, &SessionEvent{Type: SESSION_LOGIN, SessionId: session.SessionId(),
+		UniqueId: SessionUniqueId(session), UserData: session.UserData()})
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{}")) //need to prevent the client-side dying
 }
+
+//release ends a throttled attempt without counting it, if there is a
+//LoginThrottle.
+func (self *SimplePasswordHandler) release(username, ip string) {
+	if self.throttle != nil {
+		self.throttle.Release(username, ip)
+	}
+}
+
+//twoFactorState returns the two factor state of the user, or nil if two
+//factor authentication is off.
+func (self *SimplePasswordHandler) twoFactorState(uniq string) (*TwoFactorState, error) {
+	if self.tf == nil {
+		return nil, nil
+	}
+	return self.vsm.(TwoFactorSessionManager).LoadTwoFactor(uniq)
+}
+
+//checkCode is true if the code is right for the user's enabled second
+//factor.  The state is swapped so that, even with concurrent requests, a
+//code is only accepted once.
+func (self *SimplePasswordHandler) checkCode(uniq, code string) (bool, error) {
+	state, err := self.twoFactorState(uniq)
+	if err != nil || state == nil || !state.Enabled {
+		return false, err
+	}
+	return self.useCode(uniq, state, code)
+}
+
+//useCode is true if the code is right for the state and the state, changed
+//so the code can't be used again, was swapped in.
+func (self *SimplePasswordHandler) useCode(uniq string, state *TwoFactorState, code string) (bool, error) {
+	old := state.copy()
+	if !self.tf.Verify(state, code) {
+		return false, nil
+	}
+	return self.vsm.(TwoFactorSessionManager).SwapTwoFactor(uniq, old, state)
+}
+
+//loggedIn returns the unique id of the user of the session id given (val),
+//or sends an error to the client and returns "".  err is the error from
+//reading the cookie.
+func (self *SimplePasswordHandler) loggedIn(w http.ResponseWriter, val string, err error) string {
+	if err == NO_SUCH_COOKIE {
+		http.Error(w, "not logged in", http.StatusBadRequest)
+		return ""
+	}
+	sr, err := self.vsm.Find(strings.TrimSpace(val))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ""
+	}
+	if sr == nil {
+		http.Error(w, "no session", http.StatusUnauthorized)
+		return ""
+	}
+	uniq := sr.UniqueId
+	if sr.Session != nil {
+		uniq = SessionUniqueId(sr.Session)
+	}
+	if uniq == "" {
+		http.Error(w, "session has no unique id", http.StatusInternalServerError)
+	}
+	return uniq
+}
+
+//enroll handles the two factor operations of a logged in user: starting
+//enrollment, confirming it and turning it off.
+func (self *SimplePasswordHandler) enroll(w http.ResponseWriter, auth *PasswordAuthParameters, val string, err error) {
+	if self.tf == nil {
+		http.Error(w, "two factor authentication not supported", http.StatusNotImplemented)
+		return
+	}
+	uniq := self.loggedIn(w, val, err)
+	if uniq == "" {
+		return
+	}
+	tfsm := self.vsm.(TwoFactorSessionManager)
+	old, err := tfsm.LoadTwoFactor(uniq)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	var state *TwoFactorState
+	if old != nil {
+		state = old.copy()
+	}
+	var result *TOTPEnrollment
+	switch auth.Op {
+	case AUTH_OP_TOTP_ENROLL:
+		if state != nil && state.Enabled {
+			http.Error(w, "two factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		account := auth.Username
+		if account == "" {
+			account = uniq
+		}
+		state = &TwoFactorState{Secret: self.tf.GenerateSecret()}
+		result = &TOTPEnrollment{Secret: state.Secret, URI: self.tf.URI(state.Secret, account)}
+	case AUTH_OP_TOTP_CONFIRM:
+		if state == nil || state.Enabled || !self.tf.Verify(state, auth.Code) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		state.Enabled = true
+		result = &TOTPEnrollment{RecoveryCodes: self.tf.NewRecoveryCodes(state)}
+	default:
+		if state == nil || !state.Enabled || !self.tf.Verify(state, auth.Code) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		state = nil
+		result = &TOTPEnrollment{}
+	}
+	swapped, err := tfsm.SwapTwoFactor(uniq, old, state)
+	if err != nil {
+		WriteError(w, err)
+		log.Printf("[AUTH] unable to save two factor state of user %s: %v", uniq, err)
+		return
+	}
+	if !swapped {
+		http.Error(w, "two factor state changed, try again", http.StatusConflict)
+		return
+	}
+	log.Printf("[AUTH] two factor %s for user %s", auth.Op, uniq)
+	SendJson(w, result)
+}
+
+//logoutAll revokes every session of the user that owns the session id given
+//(val), if the session manager is a SessionRevoker.  err is the error from
+//reading the cookie.
+func (self *SimplePasswordHandler) logoutAll(w http.ResponseWriter, val string, err error) {
+	revoker, ok := self.vsm.(SessionRevoker)
+	if !ok {
+		http.Error(w, "logout everywhere not supported", http.StatusNotImplemented)
+		return
+	}
+	uniq := self.loggedIn(w, val, err)
+	if uniq == "" {
+		return
+	}
+	if err := revoker.RevokeAll(uniq); err != nil {
+		WriteError(w, err)
+		log.Printf("[AUTH] unable to revoke sessions of user %s: %v", uniq, err)
+		return
+	}
+	log.Printf("[AUTH] revoked all sessions of user %s", uniq)
+	self.forgetAll(uniq)
+	self.removeCookies(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}")) //prevent client side dying
+}
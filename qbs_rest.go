@@ -85,25 +85,39 @@ type qbsWrappedUdid struct {
 	post  QbsRestPost
 }
 
-//
-// WRAPPED
-//
-
-func (self *qbsWrapped) applyPolicy(pb PBundle, fn func(tx *qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
-	q, err := qbs.GetQbs()
+//qbsApplyPolicy runs fn in a transaction on the store for the tenant of the
+//request, according to that store's policy.
+func qbsApplyPolicy(store *QbsStore, pb PBundle, fn func(tx *qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
+	s, err := store.ForTenant(BundleTenant(pb))
+	if err != nil {
+		return nil, err
+	}
+	policy := s.Policy
+	if policy == nil {
+		policy = store.Policy
+	}
+	q, err := s.Qbs()
 	if err != nil {
 		return nil, err
 	}
 	defer q.Close()
 
-	tx := self.store.Policy.StartTransaction(q)
+	tx := policy.StartTransaction(q)
 	defer func() {
 		if x := recover(); x != nil {
-			result_obj, result_error = self.store.Policy.HandlePanic(tx, x)
+			result_obj, result_error = policy.HandlePanic(tx, x)
 		}
 	}()
 	value, err := fn(tx)
-	return self.store.Policy.HandleResult(tx, value, err)
+	return policy.HandleResult(tx, value, err)
+}
+
+//
+// WRAPPED
+//
+
+func (self *qbsWrapped) applyPolicy(pb PBundle, fn func(tx *qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
+	return qbsApplyPolicy(self.store, pb, fn)
 }
 
 //Index meets the interface RestIndex but calls the wrapped QBSRestIndex
@@ -123,6 +137,7 @@ func (self *qbsWrapped) Find(id int64, pb PBundle) (interface{}, error) {
 //Delete meets the interface RestDelete but calls the wrapped QBSRestDelete
 func (self *qbsWrapped) Delete(id int64, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		self.captureBefore(id, pb, tx)
 		return self.del.DeleteQbs(id, pb, tx)
 	})
 }
@@ -130,6 +145,7 @@ func (self *qbsWrapped) Delete(id int64, pb PBundle) (interface{}, error) {
 //Put meets the interface RestPut but calls the wrapped QBSRestPut
 func (self *qbsWrapped) Put(id int64, value interface{}, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		self.captureBefore(id, pb, tx)
 		return self.put.PutQbs(id, value, pb, tx)
 	})
 }
@@ -178,24 +194,28 @@ func (self *qbsWrapped) Allow(id int64, method string, pb PBundle) bool {
 
 }
 
+//capturesBefore is true if the wrapper can read the object being changed.
+func (self *qbsWrapped) capturesBefore() bool {
+	return self.find != nil
+}
+
+//captureBefore reads the object being changed in the transaction of the
+//change, for the audit record.
+func (self *qbsWrapped) captureBefore(id int64, pb PBundle, tx *qbs.Qbs) {
+	if self.find == nil {
+		return
+	}
+	captureBefore(pb, func() (interface{}, error) {
+		return self.find.FindQbs(id, pb, tx)
+	})
+}
+
 //
 // WRAPPED UDID
 //
 
 func (self *qbsWrappedUdid) applyPolicy(pb PBundle, fn func(*qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
-	q, err := qbs.GetQbs()
-	if err != nil {
-		return nil, err
-	}
-	defer q.Close()
-	tx := self.store.Policy.StartTransaction(q)
-	defer func() {
-		if x := recover(); x != nil {
-			result_obj, result_error = self.store.Policy.HandlePanic(tx, x)
-		}
-	}()
-	value, err := fn(tx)
-	return self.store.Policy.HandleResult(tx, value, err)
+	return qbsApplyPolicy(self.store, pb, fn)
 }
 
 //Index meets the interface RestIndex but calls the wrapped QBSRestIndex
@@ -215,6 +235,7 @@ func (self *qbsWrappedUdid) Find(id string, pb PBundle) (interface{}, error) {
 //DeleteUdid meets the interface RestDeleteUdid but calls the wrapped QBSRestDeleteUdid
 func (self *qbsWrappedUdid) Delete(id string, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		self.captureBefore(id, pb, tx)
 		return self.del.DeleteQbs(id, pb, tx)
 	})
 }
@@ -229,6 +250,7 @@ func (self *qbsWrappedUdid) Post(value interface{}, pb PBundle) (interface{}, er
 //PutUdid meets the interface RestPutUdid but calls the wrapped QBSRestPutUdid
 func (self *qbsWrappedUdid) Put(id string, value interface{}, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		self.captureBefore(id, pb, tx)
 		return self.put.PutQbs(id, value, pb, tx)
 	})
 }
@@ -270,6 +292,22 @@ func (self *qbsWrappedUdid) Allow(udid string, method string, pb PBundle) bool {
 
 }
 
+//capturesBefore is true if the wrapper can read the object being changed.
+func (self *qbsWrappedUdid) capturesBefore() bool {
+	return self.find != nil
+}
+
+//captureBefore reads the object being changed in the transaction of the
+//change, for the audit record.
+func (self *qbsWrappedUdid) captureBefore(id string, pb PBundle, tx *qbs.Qbs) {
+	if self.find == nil {
+		return
+	}
+	captureBefore(pb, func() (interface{}, error) {
+		return self.find.FindQbs(id, pb, tx)
+	})
+}
+
 //
 // WRAPPING FUNCITONS
 //
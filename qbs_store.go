@@ -1,19 +1,30 @@
 package seven5
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/coocood/qbs"
 )
 
+//QbsStore is the connection between the QBS wrappers and the database.  A
+//store can have a separate store for each tenant, in which case the QBS
+//wrappers use the store for the tenant of the request.
 type QbsStore struct {
 	Policy *QbsDefaultOrmTransactionPolicy
 	Dsn    *qbs.DataSourceName
+	//Db and Dialect are used instead of the database registered with qbs
+	//if Db is not nil.
+	Db      *sql.DB
+	Dialect qbs.Dialect
+	tenants map[string]*QbsStore
+	lock    sync.RWMutex
 }
 
 // NewQbsStoreFromDSN creates a *QbsStore from a DSN; DSNs can be created
@@ -28,6 +39,75 @@ func NewQbsStoreFromDSN(dsn *qbs.DataSourceName) *QbsStore {
 	return result
 }
 
+//NewQbsStoreFromDB creates a *QbsStore that uses an already opened database
+//rather than the one registered with qbs.  This is typically used for the
+//stores of tenants that have their own database.
+func NewQbsStoreFromDB(db *sql.DB, dialect qbs.Dialect) *QbsStore {
+	return &QbsStore{
+		Db:      db,
+		Dialect: dialect,
+		Policy:  NewQbsDefaultOrmTransactionPolicy(),
+	}
+}
+
+//AddTenant sets the store to use for requests for the given tenant.  Once
+//any tenant has been added, requests for tenants that have not been added,
+//and requests without a tenant, are refused with 404 by the QBS wrappers.
+func (self *QbsStore) AddTenant(tenant string, s *QbsStore) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tenants == nil {
+		self.tenants = make(map[string]*QbsStore)
+	}
+	self.tenants[tenant] = s
+}
+
+//ForTenant returns the store for the given tenant.  If no tenants have been
+//added, this store is used for every tenant.
+func (self *QbsStore) ForTenant(tenant string) (*QbsStore, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if len(self.tenants) == 0 {
+		return self, nil
+	}
+	if tenant == "" {
+		return nil, HTTPError(http.StatusNotFound, "no tenant")
+	}
+	s, ok := self.tenants[tenant]
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("unknown tenant %s", tenant))
+	}
+	return s, nil
+}
+
+//stores returns the stores that ForTenant can return, each once: this store
+//if no tenants have been added, or else the stores of the tenants.
+func (self *QbsStore) stores() []*QbsStore {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if len(self.tenants) == 0 {
+		return []*QbsStore{self}
+	}
+	var result []*QbsStore
+	seen := make(map[*QbsStore]bool)
+	for _, s := range self.tenants {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+//Qbs returns a new qbs object connected to this store's database.  The caller
+//must Close() it.
+func (self *QbsStore) Qbs() (*qbs.Qbs, error) {
+	if self.Db == nil {
+		return qbs.GetQbs()
+	}
+	return qbs.New(self.Db, self.Dialect), nil
+}
+
 //ParamsToDSN allows you to create a DSN directly from some values. This
 //is useful for testing.  If driver or user is "", the default driver and
 //user are used.
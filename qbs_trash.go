@@ -0,0 +1,299 @@
+package seven5
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	DELETED_AT_FIELD  = "DeletedAt"
+	DELETED_AT_COLUMN = "deleted_at"
+	DELETED_PARAM     = "deleted"
+	RESTORE_PARAM     = "restore"
+)
+
+//TrashAllower is an interface that a soft-deleting resource can implement
+//to allow users to see the deleted (trashed) objects with ?deleted=true and
+//to restore them with a PUT to the object's url with ?restore=true.  If the
+//resource does not implement TrashAllower, nobody is allowed to do either.
+type TrashAllower interface {
+	AllowTrash(PBundle) bool
+}
+
+//qbsTrashed wraps a QbsRestAll so that DELETE marks the DeletedAt column of
+//the row type rather than calling the wrapped DeleteQbs.  The row type is
+//the type stored in the database, not the wire type.
+type qbsTrashed struct {
+	*qbsWrapped
+	row reflect.Type
+	all QbsRestAllSoftDelete
+}
+
+//QbsRestIndexSoftDelete is the index of a soft deleted resource.  It is
+//IndexQbs, except that the rows returned must also meet the condition where,
+//which selects either the live rows or the deleted ones.  The condition must
+//be part of the query, for example with
+//	q.Condition(where.AndEqual("owner", uniq))
+//so that LIMIT and OFFSET count only the rows that are returned.
+type QbsRestIndexSoftDelete interface {
+	IndexQbsWhere(pb PBundle, q *qbs.Qbs, where *qbs.Condition) (interface{}, error)
+}
+
+//QbsRestAllSoftDelete is a QbsRestAll with an index for soft deletes.
+type QbsRestAllSoftDelete interface {
+	QbsRestAll
+	QbsRestIndexSoftDelete
+}
+
+//QbsWrapAllSoftDelete is like QbsWrapAll but the resource uses soft deletes.
+//The rowExample must be a pointer to the struct that qbs stores for the
+//resource and it must have an Id field and a DeletedAt field of type
+//time.Time; the zero time means the row is not deleted.  Index calls
+//IndexQbsWhere with the condition that selects the live (or deleted) rows.
+//Find does not return deleted rows, so the wrapped FindQbs need not know
+//about DeletedAt.  The wrapped IndexQbs and DeleteQbs are never called.
+func QbsWrapAllSoftDelete(a QbsRestAllSoftDelete, s *QbsStore, rowExample interface{}) RestAll {
+	t := reflect.TypeOf(rowExample)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("row example is not a pointer to a struct")
+	}
+	f, ok := t.Elem().FieldByName(DELETED_AT_FIELD)
+	if !ok || f.Type != reflect.TypeOf(time.Time{}) {
+		panic(fmt.Sprintf("row type %v has no %s field of type time.Time", t, DELETED_AT_FIELD))
+	}
+	if f, ok := t.Elem().FieldByName("Id"); !ok || f.Type.Kind() != reflect.Int64 {
+		panic(fmt.Sprintf("row type %v has no Id field of type int64", t))
+	}
+	return &qbsTrashed{
+		qbsWrapped: &qbsWrapped{store: s, index: a, find: a, del: a, put: a, post: a},
+		row:        t,
+		all:        a,
+	}
+}
+
+//allowTrash returns true if the bundle may see or restore deleted rows.
+func (self *qbsTrashed) allowTrash(pb PBundle) bool {
+	allow, ok := self.all.(TrashAllower)
+	if !ok {
+		return false
+	}
+	return allow.AllowTrash(pb)
+}
+
+//wantsDeleted returns true if the request is for the trash view, or an
+//error if the request is for the trash view but not allowed.
+func (self *qbsTrashed) wantsDeleted(pb PBundle) (bool, error) {
+	v, ok := pb.Query(DELETED_PARAM)
+	if !ok || v != "true" {
+		return false, nil
+	}
+	if !self.allowTrash(pb) {
+		return false, HTTPError(http.StatusUnauthorized, "not allowed to view deleted objects")
+	}
+	return true, nil
+}
+
+//load returns the row with the given id.
+func (self *qbsTrashed) load(id int64, tx *qbs.Qbs) (reflect.Value, error) {
+	row := reflect.New(self.row.Elem())
+	row.Elem().FieldByName("Id").SetInt(id)
+	if err := tx.Find(row.Interface()); err != nil {
+		return row, HTTPError(http.StatusNotFound, fmt.Sprintf("could not find %d", id))
+	}
+	return row, nil
+}
+
+//setDeleted marks or clears the DeletedAt field of the row with the given id.
+func (self *qbsTrashed) setDeleted(id int64, t time.Time, tx *qbs.Qbs) error {
+	row, err := self.load(id, tx)
+	if err != nil {
+		return err
+	}
+	row.Elem().FieldByName(DELETED_AT_FIELD).Set(reflect.ValueOf(t))
+	_, err = tx.Save(row.Interface())
+	return err
+}
+
+//trashWhere returns the expression and arguments of the condition that
+//selects the deleted rows, if trash is true, or the live rows.  A live row
+//has a DeletedAt of the zero time, or NULL if the column allows it.
+func trashWhere(trash bool) (string, []interface{}) {
+	if trash {
+		return DELETED_AT_COLUMN + " > ?", []interface{}{time.Time{}}
+	}
+	return "(" + DELETED_AT_COLUMN + " IS NULL OR " + DELETED_AT_COLUMN + " <= ?)", []interface{}{time.Time{}}
+}
+
+//Index meets the interface RestIndex by calling the wrapped IndexQbsWhere
+//with the condition for the live rows, or for the deleted rows if
+//?deleted=true was requested.
+func (self *qbsTrashed) Index(pb PBundle) (interface{}, error) {
+	trash, err := self.wantsDeleted(pb)
+	if err != nil {
+		return nil, err
+	}
+	expr, args := trashWhere(trash)
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		return self.all.IndexQbsWhere(pb, tx, qbs.NewCondition(expr, args...))
+	})
+}
+
+//Find meets the interface RestFind but returns 404 for a deleted row unless
+//?deleted=true was requested.
+func (self *qbsTrashed) Find(id int64, pb PBundle) (interface{}, error) {
+	trash, err := self.wantsDeleted(pb)
+	if err != nil {
+		return nil, err
+	}
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		row, err := self.load(id, tx)
+		if err != nil {
+			return nil, err
+		}
+		if deletedAt(row).IsZero() == trash {
+			return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("could not find %d", id))
+		}
+		return self.find.FindQbs(id, pb, tx)
+	})
+}
+
+//deletedAt returns the DeletedAt field of the row.
+func deletedAt(row reflect.Value) time.Time {
+	return row.Elem().FieldByName(DELETED_AT_FIELD).Interface().(time.Time)
+}
+
+//Delete meets the interface RestDelete by setting the DeletedAt field of the
+//row.  The value returned is the result of the wrapped FindQbs before the
+//row was deleted.  Deleting a row that is already in the trash does nothing,
+//so it keeps the time it was first deleted.
+func (self *qbsTrashed) Delete(id int64, pb PBundle) (interface{}, error) {
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		row, err := self.load(id, tx)
+		if err != nil {
+			return nil, err
+		}
+		result, err := self.find.FindQbs(id, pb, tx)
+		captureBefore(pb, func() (interface{}, error) { return result, err })
+		if err != nil || !deletedAt(row).IsZero() {
+			return result, err
+		}
+		if err := self.setDeleted(id, time.Now(), tx); err != nil {
+			return nil, err
+		}
+		return result, nil
+	})
+}
+
+//Put meets the interface RestPut.  If ?restore=true was requested, the body
+//is ignored and the row is taken out of the trash, otherwise this calls the
+//wrapped PutQbs, or returns 404 if the row is in the trash.
+func (self *qbsTrashed) Put(id int64, value interface{}, pb PBundle) (interface{}, error) {
+	v, ok := pb.Query(RESTORE_PARAM)
+	if !ok || v != "true" {
+		return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+			row, err := self.load(id, tx)
+			if err != nil {
+				return nil, err
+			}
+			if !deletedAt(row).IsZero() {
+				return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("could not find %d", id))
+			}
+			self.captureBefore(id, pb, tx)
+			return self.put.PutQbs(id, value, pb, tx)
+		})
+	}
+	if !self.allowTrash(pb) {
+		return nil, HTTPError(http.StatusUnauthorized, "not allowed to restore deleted objects")
+	}
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		self.captureBefore(id, pb, tx)
+		if err := self.setDeleted(id, time.Time{}, tx); err != nil {
+			return nil, err
+		}
+		return self.find.FindQbs(id, pb, tx)
+	})
+}
+
+//QbsPurgeDeleted removes the rows of the given row type that were soft
+//deleted more than retention ago from the database of the store or, if it
+//has tenants, from the databases of its tenants.  It returns the number of rows removed.
+func QbsPurgeDeleted(s *QbsStore, rowExample interface{}, retention time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-retention)
+	var total int64
+	for _, store := range s.stores() {
+		q, err := store.Qbs()
+		if err != nil {
+			return total, err
+		}
+		n, err := q.Where(DELETED_AT_COLUMN+" > ? and "+DELETED_AT_COLUMN+" < ?", time.Time{}, cutoff).
+			Delete(reflect.New(reflect.TypeOf(rowExample).Elem()).Interface())
+		q.Close()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+//QbsPurgeJob periodically calls QbsPurgeDeleted for a set of row types.
+type QbsPurgeJob struct {
+	store     *QbsStore
+	every     time.Duration
+	retention time.Duration
+	rows      []interface{}
+	stop      chan bool
+}
+
+//NewQbsPurgeJob creates a job that, once started, purges the soft deleted
+//rows of each of the row types given that are older than retention from
+//the store (or its tenants).  The purge is run at startup and then at the
+//interval every.
+func NewQbsPurgeJob(s *QbsStore, every time.Duration, retention time.Duration, rowExamples ...interface{}) *QbsPurgeJob {
+	return &QbsPurgeJob{
+		store:     s,
+		every:     every,
+		retention: retention,
+		rows:      rowExamples,
+		stop:      make(chan bool),
+	}
+}
+
+//Start runs the job in its own goroutine.
+func (self *QbsPurgeJob) Start() {
+	go func() {
+		ticker := time.NewTicker(self.every)
+		defer ticker.Stop()
+		for {
+			self.purge()
+			select {
+			case <-ticker.C:
+			case <-self.stop:
+				return
+			}
+		}
+	}()
+}
+
+//Stop ends the job.  It must only be called after Start.
+func (self *QbsPurgeJob) Stop() {
+	self.stop <- true
+}
+
+func (self *QbsPurgeJob) purge() {
+	for _, row := range self.rows {
+		n, err := QbsPurgeDeleted(self.store, row, self.retention)
+		if err != nil {
+			log.Printf("[PURGE] unable to purge %T: %v", row, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("[PURGE] removed %d deleted rows of %T", n, row)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package seven5
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+func TestTrashWhere(t *testing.T) {
+	live, args := trashWhere(false)
+	if !strings.Contains(live, "IS NULL") || len(args) != 1 || !args[0].(time.Time).IsZero() {
+		t.Errorf("bad condition for live rows: %s %v", live, args)
+	}
+	trash, args := trashWhere(true)
+	if trash != DELETED_AT_COLUMN+" > ?" || len(args) != 1 || !args[0].(time.Time).IsZero() {
+		t.Errorf("bad condition for deleted rows: %s %v", trash, args)
+	}
+}
+
+/*---- soft deleted row type ----*/
+type TrashHouse struct {
+	Id        int64
+	Address   string
+	DeletedAt time.Time
+}
+
+type trashObj struct{}
+
+func (self *trashObj) IndexQbs(pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	expr, args := trashWhere(false)
+	return self.IndexQbsWhere(pb, q, qbs.NewCondition(expr, args...))
+}
+
+func (self *trashObj) IndexQbsWhere(pb PBundle, q *qbs.Qbs, where *qbs.Condition) (interface{}, error) {
+	limit, offset := PageParameters(pb, 100)
+	var houses []*TrashHouse
+	if err := q.Condition(where).OrderBy("id").Limit(limit).Offset(offset).FindAll(&houses); err != nil {
+		return nil, err
+	}
+	result := make([]*HouseWire, len(houses))
+	for i, h := range houses {
+		result[i] = &HouseWire{Id: h.Id, Addr: h.Address}
+	}
+	return result, nil
+}
+
+func (self *trashObj) FindQbs(id int64, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	h := &TrashHouse{Id: id}
+	if err := q.Find(h); err != nil {
+		return nil, HTTPError(http.StatusNotFound, "no such house")
+	}
+	return &HouseWire{Id: h.Id, Addr: h.Address}, nil
+}
+
+func (self *trashObj) DeleteQbs(id int64, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	panic("soft deleted resources are never deleted")
+}
+
+func (self *trashObj) PutQbs(id int64, value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	h := &TrashHouse{Id: id}
+	if err := q.Find(h); err != nil {
+		return nil, HTTPError(http.StatusNotFound, "no such house")
+	}
+	h.Address = value.(*HouseWire).Addr
+	if _, err := q.Save(h); err != nil {
+		return nil, err
+	}
+	return &HouseWire{Id: h.Id, Addr: h.Address}, nil
+}
+
+func (self *trashObj) PostQbs(value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	h := &TrashHouse{Address: value.(*HouseWire).Addr}
+	if _, err := q.Save(h); err != nil {
+		return nil, err
+	}
+	return &HouseWire{Id: h.Id, Addr: h.Address}, nil
+}
+
+func (self *trashObj) AllowTrash(pb PBundle) bool {
+	return true
+}
+
+func TestSoftDelete(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	store := setupTestStore()
+	q, err := store.Qbs()
+	if err != nil {
+		t.Fatalf("couldn't get QBS: %v", err)
+	}
+	defer q.Close()
+	if _, err := q.Exec(`CREATE TABLE IF NOT EXISTS trash_house (id BIGSERIAL PRIMARY KEY,
+		address TEXT NOT NULL, deleted_at TIMESTAMP WITH TIME ZONE)`); err != nil {
+		t.Fatalf("unable to create table: %v", err)
+	}
+	if _, err := q.Exec("DELETE FROM trash_house"); err != nil {
+		t.Fatalf("unable to empty table: %v", err)
+	}
+
+	wrapped := QbsWrapAllSoftDelete(&trashObj{}, store, &TrashHouse{})
+	live := NewTestPBundle(nil, nil, nil, nil, nil, nil)
+	trash := NewTestPBundle(nil, map[string]string{DELETED_PARAM: "true"}, nil, nil, nil, nil)
+	restore := NewTestPBundle(nil, map[string]string{RESTORE_PARAM: "true"}, nil, nil, nil, nil)
+	count := func(pb PBundle) int {
+		result, err := wrapped.Index(pb)
+		if err != nil {
+			t.Fatalf("unable to index: %v", err)
+		}
+		return len(result.([]*HouseWire))
+	}
+	status := func(err error) int {
+		if e, ok := err.(*Error); ok {
+			return e.StatusCode
+		}
+		return 0
+	}
+
+	var ids []int64
+	for _, addr := range []string{"1 main st", "2 main st"} {
+		h, err := wrapped.Post(&HouseWire{Addr: addr}, live)
+		if err != nil {
+			t.Fatalf("unable to post: %v", err)
+		}
+		ids = append(ids, h.(*HouseWire).Id)
+	}
+	if _, err := wrapped.Delete(ids[0], live); err != nil {
+		t.Fatalf("unable to delete: %v", err)
+	}
+	if count(live) != 1 || count(trash) != 1 {
+		t.Errorf("expected one live and one deleted house")
+	}
+	if _, err := wrapped.Find(ids[0], live); status(err) != http.StatusNotFound {
+		t.Errorf("expected deleted house to be hidden: %v", err)
+	}
+	if _, err := wrapped.Find(ids[0], trash); err != nil {
+		t.Errorf("expected deleted house in the trash: %v", err)
+	}
+	if _, err := wrapped.Put(ids[0], &HouseWire{Addr: "x"}, live); status(err) != http.StatusNotFound {
+		t.Errorf("expected put on a deleted house to fail: %v", err)
+	}
+
+	first := &TrashHouse{Id: ids[0]}
+	q.Find(first)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := wrapped.Delete(ids[0], live); err != nil {
+		t.Errorf("expected delete to be idempotent: %v", err)
+	}
+	again := &TrashHouse{Id: ids[0]}
+	q.Find(again)
+	if !again.DeletedAt.Equal(first.DeletedAt) {
+		t.Errorf("expected the time of deletion to be kept: %v %v", first.DeletedAt, again.DeletedAt)
+	}
+
+	if _, err := wrapped.Put(ids[0], nil, restore); err != nil {
+		t.Fatalf("unable to restore: %v", err)
+	}
+	if count(live) != 2 || count(trash) != 0 {
+		t.Errorf("expected restored house to be live")
+	}
+
+	wrapped.Delete(ids[1], live)
+	if n, err := QbsPurgeDeleted(store, &TrashHouse{}, time.Hour); err != nil || n != 0 {
+		t.Errorf("expected recent deletes to be kept: %d %v", n, err)
+	}
+	if n, err := QbsPurgeDeleted(store, &TrashHouse{}, -time.Hour); err != nil || n != 1 {
+		t.Errorf("expected one house to be purged: %d %v", n, err)
+	}
+	if count(live) != 1 || count(trash) != 0 {
+		t.Errorf("expected the purged house to be gone")
+	}
+
+	//pages are full even when there are more deleted rows than fit in one
+	for i := 0; i < 5; i++ {
+		h, err := wrapped.Post(&HouseWire{Addr: "page"}, live)
+		if err != nil {
+			t.Fatalf("unable to post: %v", err)
+		}
+		if i < 4 {
+			wrapped.Delete(h.(*HouseWire).Id, live)
+		}
+	}
+	page := func(trash bool, offset string) int {
+		q := map[string]string{LIMIT_PARAM: "2", OFFSET_PARAM: offset}
+		if trash {
+			q[DELETED_PARAM] = "true"
+		}
+		return count(NewTestPBundle(nil, q, nil, nil, nil, nil))
+	}
+	if page(false, "0") != 2 || page(false, "2") != 0 {
+		t.Errorf("expected a full page of the two live houses")
+	}
+	if page(true, "0") != 2 || page(true, "2") != 2 || page(true, "4") != 0 {
+		t.Errorf("expected the four deleted houses in two full pages")
+	}
+}
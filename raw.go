@@ -26,6 +26,7 @@ func NewRawDispatcher(io IOHook, sm SessionManager, a Authorizer, prefix string)
 		SessionMgr: sm,
 		Auth:       a,
 		Prefix:     prefix,
+		Scope:      ResourceScope,
 	}
 }
 
@@ -58,6 +59,21 @@ type RawDispatcher struct {
 	SessionMgr SessionManager
 	Auth       Authorizer
 	Prefix     string
+	Cache      *ResponseCache
+	Audit      *Auditor
+	//Tenants, if not nil, is used to determine the tenant of each request
+	//before the resources are dispatched.
+	Tenants TenantResolver
+	//HTTPCache, if not nil, chooses the cache policy of successful GETs
+	//of resources that are not HTTPCachers.  If it is nil, the policy of
+	//the ServeMux is used.
+	HTTPCache *HTTPCacheDefaults
+	//Scope returns the scope a ScopedSession, such as the session of an api
+	//key, must have for each request.  It is checked before the Authorizer,
+	//so a key can do no more than its scopes allow even if its owner could.
+	//NewRawDispatcher sets it to ResourceScope; if it is nil, scopes are
+	//not checked.
+	Scope ScopeFunc
 }
 
 func (self *RawDispatcher) validateType(example interface{}) reflect.Type {
@@ -89,6 +105,8 @@ func (self *RawDispatcher) AddResourceSeparate(node *RestNode, name string, wire
 		del:  del,
 		put:  put,
 	}
+	obj.linker = findLinker(index, find, post, put, del)
+	obj.cacher = findHTTPCacher(index, find)
 	node.Res[strings.ToLower(name)] = obj
 }
 
@@ -122,11 +140,14 @@ func (self *RawDispatcher) AddResourceSeparateUdid(node *RestNode, name string,
 			name:  name,
 			index: index,
 			post:  post,
+			udid:  true,
 		},
 		find: find,
 		del:  del,
 		put:  put,
 	}
+	obj.linker = findLinker(index, find, post, put, del)
+	obj.cacher = findHTTPCacher(index, find)
 	node.ResUdid[strings.ToLower(name)] = obj
 }
 
@@ -188,8 +209,10 @@ func (self *RawDispatcher) SubResource(parentWire interface{},
 	}
 	child := NewRestNode()
 	parent.Children[subresourcename] = child
+	self.addChildName(parent, parentWire, subresourcename)
 	self.AddResourceSeparate(child, subresourcename, wireExample,
 		index, find, post, put, del)
+	child.Res[strings.ToLower(subresourcename)].parent = reflect.TypeOf(parentWire)
 }
 
 //SubResourceSeparate is for adding a subresource, analagous to ResourceSeparate.
@@ -216,8 +239,10 @@ func (self *RawDispatcher) SubResourceUdid(parentWire interface{}, subresourcena
 	}
 	child := NewRestNode()
 	parent.ChildrenUdid[strings.ToLower(exampleTypeToName(wireExample))] = child
+	self.addChildName(parent, parentWire, strings.ToLower(exampleTypeToName(wireExample)))
 	self.AddResourceSeparateUdid(child, subresourcename, wireExample, index,
 		find, post, put, del)
+	child.ResUdid[strings.ToLower(subresourcename)].parent = reflect.TypeOf(parentWire)
 }
 
 //SubResourceSeparateUdid is for adding a subresource udid, analagous to ResourceSeparateUdid.
@@ -230,6 +255,22 @@ func (self *RawDispatcher) SubResourceSeparateUdid(parentWire interface{}, wireE
 		wireExample, index, find, post, put, del)
 }
 
+//addChildName records, on the parent resource, the name of a subresource
+//collection so it can be advertised in links.
+func (self *RawDispatcher) addChildName(node *RestNode, parentWire interface{}, name string) {
+	t := reflect.TypeOf(parentWire)
+	for _, v := range node.Res {
+		if v.typ == t {
+			v.children = append(v.children, name)
+		}
+	}
+	for _, v := range node.ResUdid {
+		if v.typ == t {
+			v.children = append(v.children, name)
+		}
+	}
+}
+
 //FindWireType searches the tree of rest resources trying to find one that has the
 //given type as a target. This is only of interest to dispatch implementors.
 func (self *RawDispatcher) FindWireType(target reflect.Type, curr *RestNode) *RestNode {
@@ -278,9 +319,18 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 	parts := strings.Split(path, "/")
 	bundle, err := self.IO.BundleHook(w, r, self.SessionMgr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create parameter bundle:%s", err), http.StatusInternalServerError)
+		self.SendError(err, w, "failed to create parameter bundle")
 		return nil
 	}
+	if self.Tenants != nil {
+		var tenant string
+		tenant, parts, err = resolveTenant(self.Tenants, r, parts, bundle)
+		if err != nil {
+			self.SendError(err, w, "unable to determine tenant")
+			return nil
+		}
+		setBundleTenant(bundle, tenant)
+	}
 	self.DispatchSegment(mux, w, r, parts, self.Root, bundle)
 	return nil
 }
@@ -340,6 +390,9 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 				http.Error(w, "Not implemented (FIND)", http.StatusNotImplemented)
 				return
 			}
+			if !self.allowScope(w, &rez.restShared, "GET", bundle) {
+				return
+			}
 			if self.Auth != nil && !self.Auth.Find(rez, num, bundle) {
 				//typically trips the error dispatcher
 				http.Error(w, "Not authorized (FIND)", http.StatusUnauthorized)
@@ -371,6 +424,9 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			http.Error(w, "Not implemented (FIND,UDID)", http.StatusNotImplemented)
 			return
 		}
+		if !self.allowScope(w, &rezUdid.restShared, "GET", bundle) {
+			return
+		}
 		if self.Auth != nil && !self.Auth.FindUdid(rezUdid, id, bundle) {
 			//typically trips the error dispatcher
 			http.Error(w, "Not authorized (FIND, UDID)", http.StatusUnauthorized)
@@ -396,21 +452,31 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 		return
 	}
 
+	//an api key (or other ScopedSession) must have the scope for the request
+	var shared *restShared
+	if rez != nil {
+		shared = &rez.restShared
+	} else {
+		shared = &rezUdid.restShared
+	}
+	scopeMethod := method
+	if method == "GET" && id == "" {
+		scopeMethod = RBAC_INDEX
+	}
+	if !self.allowScope(w, shared, scopeMethod, bundle) {
+		return
+	}
+
+	//this is the resource that will be acted on, so links are relative to it
+	setBundleResourcePath(bundle, self.Prefix+"/"+self.collectionPath(r, parts))
+
 	//
 	//pull anything from the body that's there, we might need it
 	//
-	if rezUdid == nil {
-		body, err = self.IO.BodyHook(r, &rez.restShared)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
-			return
-		}
-	} else {
-		body, err = self.IO.BodyHook(r, &rezUdid.restShared)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
-			return
-		}
+	body, err = self.body(r, method, id, num, rez, rezUdid, bundle)
+	if err != nil {
+		self.bodyError(err, w)
+		return
 	}
 
 	switch method {
@@ -428,10 +494,13 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (INDEX)", http.StatusUnauthorized)
 					return
 				}
-				result, err := rez.index.Index(bundle)
+				result, err := self.cached(&rez.restShared, r, parts, "", bundle, func() (interface{}, error) {
+					return rez.index.Index(bundle)
+				})
 				if err != nil {
 					self.SendError(err, w, "Internal error on Index")
 				} else {
+					self.resolveHTTPCache(&rez.restShared, bundle)
 					//go through encoding
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
@@ -447,10 +516,13 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (INDEX, UDID)", http.StatusUnauthorized)
 					return
 				}
-				result, err := rezUdid.index.Index(bundle)
+				result, err := self.cached(&rezUdid.restShared, r, parts, "", bundle, func() (interface{}, error) {
+					return rezUdid.index.Index(bundle)
+				})
 				if err != nil {
 					self.SendError(err, w, "Internal error on Index (UDID)")
 				} else {
+					self.resolveHTTPCache(&rezUdid.restShared, bundle)
 					//go through encoding
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
@@ -468,10 +540,13 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (FIND)", http.StatusUnauthorized)
 					return
 				}
-				result, err := rez.find.Find(num, bundle)
+				result, err := self.cached(&rez.restShared, r, parts, id, bundle, func() (interface{}, error) {
+					return rez.find.Find(num, bundle)
+				})
 				if err != nil {
 					self.SendError(err, w, "Internal error on Find")
 				} else {
+					self.resolveHTTPCache(&rez.restShared, bundle)
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
 				return
@@ -487,10 +562,13 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (FIND, UDID)", http.StatusUnauthorized)
 					return
 				}
-				result, err := rezUdid.find.Find(id, bundle)
+				result, err := self.cached(&rezUdid.restShared, r, parts, id, bundle, func() (interface{}, error) {
+					return rezUdid.find.Find(id, bundle)
+				})
 				if err != nil {
 					self.SendError(err, w, "Internal error on Find (UDID")
 				} else {
+					self.resolveHTTPCache(&rezUdid.restShared, bundle)
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
 				return
@@ -514,6 +592,7 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			if err != nil {
 				self.SendError(err, w, "Internal error on Post")
 			} else {
+				self.mutated(r, parts, bundle, wireId(false, result), nil, result)
 				self.IO.SendHook(&rez.restShared, w, bundle, result, self.location(rez.name, false, result))
 			}
 			return
@@ -535,6 +614,7 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			if err != nil {
 				self.SendError(err, w, "Internal error on Post")
 			} else {
+				self.mutated(r, parts, bundle, wireId(true, result), nil, result)
 				self.IO.SendHook(&rezUdid.restShared, w, bundle, result, self.location(rezUdid.name, true, result))
 			}
 			return
@@ -555,10 +635,12 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (PUT)", http.StatusUnauthorized)
 					return
 				}
+				before := self.before(rez.find, rez.put, num, bundle)
 				result, err := rez.put.Put(num, body, bundle)
 				if err != nil {
 					self.SendError(err, w, "Internal error on Put")
 				} else {
+					self.mutated(r, parts, bundle, id, before, result)
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
 			} else {
@@ -571,10 +653,12 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (PUT, UDID)", http.StatusUnauthorized)
 					return
 				}
+				before := self.beforeUdid(rezUdid.find, rezUdid.put, id, bundle)
 				result, err := rezUdid.put.Put(id, body, bundle)
 				if err != nil {
 					self.SendError(err, w, "Internal error on Put (UDID)")
 				} else {
+					self.mutated(r, parts, bundle, id, before, result)
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
 			}
@@ -588,10 +672,12 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (DELETE)", http.StatusUnauthorized)
 					return
 				}
+				before := self.before(rez.find, rez.del, num, bundle)
 				result, err := rez.del.Delete(num, bundle)
 				if err != nil {
 					self.SendError(err, w, "Internal error on Delete")
 				} else {
+					self.mutated(r, parts, bundle, id, before, nil)
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
 			} else {
@@ -604,10 +690,12 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 					http.Error(w, "Not authorized (DELETE, UDID)", http.StatusUnauthorized)
 					return
 				}
+				before := self.beforeUdid(rezUdid.find, rezUdid.del, id, bundle)
 				result, err := rezUdid.del.Delete(id, bundle)
 				if err != nil {
 					self.SendError(err, w, "Internal error on Delete")
 				} else {
+					self.mutated(r, parts, bundle, id, before, nil)
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
 			}
@@ -618,6 +706,172 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 	http.Error(w, "bad client behavior", http.StatusBadRequest)
 }
 
+//cached calls fn through the ResponseCache, if there is one.
+func (self *RawDispatcher) cached(d *restShared, r *http.Request, parts []string, id string,
+	bundle PBundle, fn func() (interface{}, error)) (interface{}, error) {
+	if self.Cache == nil {
+		return fn()
+	}
+	return self.Cache.Lookup(d, self.collectionPath(r, parts), id, r, bundle, fn)
+}
+
+//invalidate removes any cached results of the bundle's tenant for the
+//collection at the front of parts and the collections below it.
+func (self *RawDispatcher) invalidate(r *http.Request, parts []string, bundle PBundle) {
+	if self.Cache == nil {
+		return
+	}
+	self.Cache.Invalidate(BundleTenant(bundle), self.collectionPath(r, parts))
+}
+
+//allowScope checks that the session, if it is a ScopedSession, has the scope
+//needed for method (RBAC_INDEX for an index) on the resource d.  If it does
+//not, a 403 is sent and false is returned.
+func (self *RawDispatcher) allowScope(w http.ResponseWriter, d *restShared, method string, bundle PBundle) bool {
+	if self.Scope == nil || bundle.Session() == nil {
+		return true
+	}
+	scope := self.Scope(strings.ToLower(d.name), method)
+	if scope == "" || SessionHasScope(bundle.Session(), scope) {
+		return true
+	}
+	//typically trips the error dispatcher
+	http.Error(w, fmt.Sprintf("Forbidden (scope %s required)", scope), http.StatusForbidden)
+	return false
+}
+
+//resolveHTTPCache chooses the cache policy for a successful GET, unless the
+//resource has already chosen one with SetBundleCachePolicy.  The resource's
+//HTTPCache method is consulted first, then the dispatcher's defaults.  The
+//policy is applied by the SendHook.
+func (self *RawDispatcher) resolveHTTPCache(d *restShared, bundle PBundle) {
+	if BundleCachePolicy(bundle) != nil {
+		return
+	}
+	var p *HTTPCachePolicy
+	if d.cacher != nil {
+		p = d.cacher.HTTPCache(bundle)
+	}
+	if p == nil && self.HTTPCache != nil {
+		p = self.HTTPCache.Policy(bundle)
+	}
+	if p != nil {
+		SetBundleCachePolicy(bundle, p)
+	}
+}
+
+//mutated is called after a successful POST, PUT or DELETE to clear the
+//cache and, if there is an Auditor, record the change.  If the resource
+//captured the value before the change in its own transaction, that value
+//is used in place of before.
+func (self *RawDispatcher) mutated(r *http.Request, parts []string, bundle PBundle, id string,
+	before interface{}, after interface{}) {
+	self.invalidate(r, parts, bundle)
+	if self.Audit == nil {
+		return
+	}
+	if c, ok := bundle.(beforeCapture); ok {
+		if v, caught := c.capturedBefore(); caught {
+			before = v
+		}
+	}
+	self.Audit.Record(r, bundle, self.collectionPath(r, parts), id, before, after)
+}
+
+//capturing returns true if the resource that makes the change, mutator, will
+//capture the value before the change itself (see beforeCapturer).
+func (self *RawDispatcher) capturing(mutator interface{}, bundle PBundle) bool {
+	m, ok := mutator.(beforeCapturer)
+	if !ok || !m.capturesBefore() {
+		return false
+	}
+	c, ok := bundle.(beforeCapture)
+	if !ok {
+		return false
+	}
+	c.auditBefore()
+	return true
+}
+
+//before returns the current value of the object about to be changed, for
+//the audit record.  It returns nil if there is no Auditor, no way to find
+//the object, or if mutator will capture the value in the transaction of the
+//change.
+func (self *RawDispatcher) before(find RestFind, mutator interface{}, num int64, bundle PBundle) interface{} {
+	if self.Audit == nil || self.capturing(mutator, bundle) || find == nil {
+		return nil
+	}
+	result, err := find.Find(num, bundle)
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+//beforeUdid is the UDID version of before.
+func (self *RawDispatcher) beforeUdid(find RestFindUdid, mutator interface{}, id string, bundle PBundle) interface{} {
+	if self.Audit == nil || self.capturing(mutator, bundle) || find == nil {
+		return nil
+	}
+	result, err := find.Find(id, bundle)
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+//collectionPath returns the path, without the prefix, of the collection named
+//by parts[0].  For /rest/house/12/room/3, with parts of [room 3], this is
+//house/12/room.
+func (self *RawDispatcher) collectionPath(r *http.Request, parts []string) string {
+	path := r.URL.Path
+	if strings.HasSuffix(path, "/") && path != "/" {
+		path = path[0 : len(path)-1]
+	}
+	if self.Prefix != "" {
+		path = strings.TrimPrefix(path, self.Prefix+"/")
+	}
+	all := strings.Split(path, "/")
+	return strings.Join(all[:len(all)-len(parts)+1], "/")
+}
+
+//body reads the body of the request with the IOHook, using FieldBodyHook if
+//it has it.  For a PUT, the object being replaced is available to the hook
+//from the resource's finder.
+func (self *RawDispatcher) body(r *http.Request, method string, id string, num int64, rez *restObj,
+	rezUdid *restObjUdid, bundle PBundle) (interface{}, error) {
+	var shared *restShared
+	if rezUdid == nil {
+		shared = &rez.restShared
+	} else {
+		shared = &rezUdid.restShared
+	}
+	fbh, ok := self.IO.(FieldBodyHook)
+	if !ok {
+		return self.IO.BodyHook(r, shared)
+	}
+	var current func() (interface{}, error)
+	if method == "PUT" && id != "" {
+		if rez != nil && rez.find != nil {
+			current = func() (interface{}, error) { return rez.find.Find(num, bundle) }
+		}
+		if rezUdid != nil && rezUdid.find != nil {
+			current = func() (interface{}, error) { return rezUdid.find.Find(id, bundle) }
+		}
+	}
+	return fbh.FieldBodyHook(r, shared, bundle, current)
+}
+
+//bodyError reports a failure of the BodyHook.  Errors created with
+//HTTPError keep their status code, anything else is a bad request.
+func (self *RawDispatcher) bodyError(err error, w http.ResponseWriter) {
+	if _, ok := err.(*Error); ok {
+		self.SendError(err, w, "")
+		return
+	}
+	http.Error(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
+}
+
 func (self *RawDispatcher) SendError(err error, w http.ResponseWriter, msg string) {
 	ours, ok := err.(*Error)
 	if !ok {
@@ -665,6 +919,10 @@ func (self *RawDispatcher) resolve(parts []string, node *RestNode) (string, stri
 	if okUdid && len(parts) == 1 {
 		return parts[0], "", nil, rezUdid
 	}
+	if len(parts) < 2 {
+		//unknown resource with no id
+		return "", "", nil, nil
+	}
 	id := parts[1]
 	uriPathParent := parts[0]
 
@@ -0,0 +1,286 @@
+package seven5
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+const (
+	ROLE_ANONYMOUS     = "anonymous"
+	ROLE_AUTHENTICATED = "authenticated"
+	RBAC_ANY           = "*"
+	RBAC_INDEX         = "INDEX"
+)
+
+//RoleHolder is an interface that the user data of a session can implement
+//to tell the RBACAuthorizer what roles the user has.
+type RoleHolder interface {
+	Roles() []string
+}
+
+//RoleFunc returns the roles of the user making a request.
+type RoleFunc func(PBundle) []string
+
+//SessionRoles is the default RoleFunc.  A request without a session has
+//only the role ROLE_ANONYMOUS.  A request with a session has the role
+//ROLE_AUTHENTICATED plus the roles returned by the session's user data,
+//if the user data is a RoleHolder.
+func SessionRoles(pb PBundle) []string {
+	s := pb.Session()
+	if s == nil {
+		return []string{ROLE_ANONYMOUS}
+	}
+	result := []string{ROLE_AUTHENTICATED}
+	if holder, ok := s.UserData().(RoleHolder); ok {
+		result = append(result, holder.Roles()...)
+	}
+	return result
+}
+
+//ScopeFunc returns the scope a ScopedSession, such as the session of an api
+//key, must have to perform method on resource, or "" if no scope is needed.
+type ScopeFunc func(resource string, method string) string
+
+//ResourceScope is the default ScopeFunc.  Reading a resource (INDEX and GET)
+//needs the scope "<resource>:read" and changing it (POST, PUT and DELETE)
+//needs "<resource>:write", where resource is the lowercase name of the
+//resource.
+func ResourceScope(resource string, method string) string {
+	switch method {
+	case RBAC_INDEX, "GET":
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+//OwnerFunc is a predicate that decides if the user making a request owns
+//the object with the given id.  The id is "" for INDEX and POST.  For
+//subresources, the parent objects are available via PBundle.ParentValue.
+type OwnerFunc func(id string, pb PBundle) bool
+
+//RBACRule grants a role access to some methods of a resource, possibly
+//only when an ownership predicate is true.
+type RBACRule struct {
+	Resource string
+	Methods  []string
+	Role     string
+	Owner    OwnerFunc
+	//OwnerName describes Owner in the policy dump.
+	OwnerName string
+}
+
+//IfOwner restricts the rule to requests where fn returns true.  The name
+//is used only in the policy dump.
+func (self *RBACRule) IfOwner(name string, fn OwnerFunc) *RBACRule {
+	self.OwnerName = name
+	self.Owner = fn
+	return self
+}
+
+func (self *RBACRule) matches(resource string, method string, roles []string) bool {
+	if self.Resource != RBAC_ANY && self.Resource != resource {
+		return false
+	}
+	methodOk := false
+	for _, m := range self.Methods {
+		if m == RBAC_ANY || m == method {
+			methodOk = true
+			break
+		}
+	}
+	if !methodOk {
+		return false
+	}
+	for _, r := range roles {
+		if self.Role == RBAC_ANY || self.Role == r {
+			return true
+		}
+	}
+	return false
+}
+
+//RBACPolicy is a list of rules.  Anything not granted by some rule is
+//denied.  Resources are named by their lowercase name as it appears in
+//the url and methods are INDEX, GET, POST, PUT and DELETE; RBAC_ANY
+//matches any resource, method or role.
+type RBACPolicy struct {
+	rules []*RBACRule
+	lock  sync.RWMutex
+}
+
+//NewRBACPolicy returns an empty policy, which denies everything.
+func NewRBACPolicy() *RBACPolicy {
+	return &RBACPolicy{}
+}
+
+//Grant adds a rule allowing role to perform the given methods on resource.
+//The rule is returned so that an ownership predicate can be added with
+//IfOwner, as in
+//	policy.Grant("user", "house", "GET", "PUT").IfOwner("owns house", ownsHouse)
+func (self *RBACPolicy) Grant(role string, resource string, methods ...string) *RBACRule {
+	upper := make([]string, len(methods))
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+	}
+	rule := &RBACRule{
+		Resource: strings.ToLower(resource),
+		Methods:  upper,
+		Role:     role,
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.rules = append(self.rules, rule)
+	return rule
+}
+
+//Allowed returns true if some rule allows a user with the given roles
+//to perform method on the object id of resource.
+func (self *RBACPolicy) Allowed(resource string, method string, id string, roles []string, pb PBundle) bool {
+	resource = strings.ToLower(resource)
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, rule := range self.rules {
+		if !rule.matches(resource, method, roles) {
+			continue
+		}
+		if rule.Owner == nil || rule.Owner(id, pb) {
+			return true
+		}
+	}
+	return false
+}
+
+//Dump writes the policy as a table, sorted by resource and role, for review.
+func (self *RBACPolicy) Dump(w io.Writer) error {
+	self.lock.RLock()
+	rules := make([]*RBACRule, len(self.rules))
+	copy(rules, self.rules)
+	self.lock.RUnlock()
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Resource != rules[j].Resource {
+			return rules[i].Resource < rules[j].Resource
+		}
+		return rules[i].Role < rules[j].Role
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE\tROLE\tMETHODS\tCONDITION")
+	for _, rule := range rules {
+		cond := "always"
+		if rule.Owner != nil {
+			cond = rule.OwnerName
+			if cond == "" {
+				cond = "owner"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rule.Resource, rule.Role, strings.Join(rule.Methods, ","), cond)
+	}
+	return tw.Flush()
+}
+
+//Uncovered returns the names of the resources registered with the
+//dispatcher that are not mentioned by any rule, and so cannot be used by
+//anyone.  This is useful as part of the review of a policy.
+func (self *RBACPolicy) Uncovered(raw *RawDispatcher) []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	covered := make(map[string]bool)
+	for _, rule := range self.rules {
+		if rule.Resource == RBAC_ANY {
+			return nil
+		}
+		covered[rule.Resource] = true
+	}
+	var result []string
+	walkRestNodes(raw.Root, func(name string) {
+		if !covered[name] {
+			result = append(result, name)
+		}
+	})
+	sort.Strings(result)
+	return result
+}
+
+func walkRestNodes(node *RestNode, fn func(string)) {
+	for name := range node.Res {
+		fn(name)
+	}
+	for name := range node.ResUdid {
+		fn(name)
+	}
+	for _, child := range node.Children {
+		walkRestNodes(child, fn)
+	}
+	for _, child := range node.ChildrenUdid {
+		walkRestNodes(child, fn)
+	}
+}
+
+//RBACAuthorizer is an Authorizer that checks every request against an
+//RBACPolicy instead of the Allow* methods of the resources.  It can be
+//installed in place of the checks of a BaseDispatcher with
+//	base.Auth = NewRBACAuthorizer(policy, nil)
+//The scopes of a ScopedSession are checked by the RawDispatcher before any
+//Authorizer is consulted.
+type RBACAuthorizer struct {
+	Policy *RBACPolicy
+	Roles  RoleFunc
+}
+
+//NewRBACAuthorizer returns an authorizer for the given policy.  If roles
+//is nil, SessionRoles is used.
+func NewRBACAuthorizer(policy *RBACPolicy, roles RoleFunc) *RBACAuthorizer {
+	if roles == nil {
+		roles = SessionRoles
+	}
+	return &RBACAuthorizer{Policy: policy, Roles: roles}
+}
+
+func (self *RBACAuthorizer) check(d *restShared, method string, id string, bundle PBundle) bool {
+	return self.Policy.Allowed(d.name, method, id, self.Roles(bundle), bundle)
+}
+
+//Index checks the policy for INDEX.
+func (self *RBACAuthorizer) Index(d *restShared, bundle PBundle) bool {
+	return self.check(d, RBAC_INDEX, "", bundle)
+}
+
+//Post checks the policy for POST.
+func (self *RBACAuthorizer) Post(d *restShared, bundle PBundle) bool {
+	return self.check(d, "POST", "", bundle)
+}
+
+//Find checks the policy for GET.
+func (self *RBACAuthorizer) Find(d *restObj, num int64, bundle PBundle) bool {
+	return self.check(&d.restShared, "GET", strconv.FormatInt(num, 10), bundle)
+}
+
+//FindUdid checks the policy for GET.
+func (self *RBACAuthorizer) FindUdid(d *restObjUdid, id string, bundle PBundle) bool {
+	return self.check(&d.restShared, "GET", id, bundle)
+}
+
+//Put checks the policy for PUT.
+func (self *RBACAuthorizer) Put(d *restObj, num int64, bundle PBundle) bool {
+	return self.check(&d.restShared, "PUT", strconv.FormatInt(num, 10), bundle)
+}
+
+//PutUdid checks the policy for PUT.
+func (self *RBACAuthorizer) PutUdid(d *restObjUdid, id string, bundle PBundle) bool {
+	return self.check(&d.restShared, "PUT", id, bundle)
+}
+
+//Delete checks the policy for DELETE.
+func (self *RBACAuthorizer) Delete(d *restObj, num int64, bundle PBundle) bool {
+	return self.check(&d.restShared, "DELETE", strconv.FormatInt(num, 10), bundle)
+}
+
+//DeleteUdid checks the policy for DELETE.
+func (self *RBACAuthorizer) DeleteUdid(d *restObjUdid, id string, bundle PBundle) bool {
+	return self.check(&d.restShared, "DELETE", id, bundle)
+}
@@ -0,0 +1,63 @@
+package seven5
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type rolesUser struct {
+	name  string
+	roles []string
+}
+
+func (self *rolesUser) Roles() []string {
+	return self.roles
+}
+
+func TestRBAC(t *testing.T) {
+	policy := NewRBACPolicy()
+	policy.Grant(RBAC_ANY, "somewire", RBAC_INDEX, "GET")
+	policy.Grant("admin", "somewire", RBAC_ANY)
+	policy.Grant(ROLE_AUTHENTICATED, "somewire", "PUT").IfOwner("id is 12", func(id string, pb PBundle) bool {
+		return id == "12"
+	})
+	auth := NewRBACAuthorizer(policy, nil)
+
+	raw := NewRawDispatcher(nil, nil, auth, "/rest")
+	raw.Rez(&someWire{}, &someResource{})
+	raw.SubResourceSeparate(&someWire{}, &someSubWire{}, nil, nil, nil, nil, nil)
+	rez := raw.Root.Res["somewire"]
+
+	anon := NewTestPBundle(nil, nil, nil, nil, nil, nil)
+	user := NewTestPBundle(nil, nil, NewSimpleSession(&rolesUser{"fred", nil}, "x"), nil, nil, nil)
+	admin := NewTestPBundle(nil, nil, NewSimpleSession(&rolesUser{"root", []string{"admin"}}, "y"), nil, nil, nil)
+
+	if !auth.Index(&rez.restShared, anon) || !auth.Find(rez, 3, anon) {
+		t.Errorf("anonymous should be able to read")
+	}
+	if auth.Put(rez, 12, anon) || auth.Post(&rez.restShared, anon) {
+		t.Errorf("anonymous should not be able to write")
+	}
+	if !auth.Put(rez, 12, user) || auth.Put(rez, 13, user) {
+		t.Errorf("owner check failed for PUT")
+	}
+	if auth.Delete(rez, 12, user) {
+		t.Errorf("user should not be able to delete")
+	}
+	if !auth.Delete(rez, 13, admin) || !auth.Post(&rez.restShared, admin) {
+		t.Errorf("admin should be able to do anything")
+	}
+
+	var buf bytes.Buffer
+	if err := policy.Dump(&buf); err != nil {
+		t.Fatalf("unable to dump policy: %v", err)
+	}
+	if !strings.Contains(buf.String(), "id is 12") || strings.Count(buf.String(), "\n") != 4 {
+		t.Errorf("unexpected policy dump:\n%s", buf.String())
+	}
+	uncovered := policy.Uncovered(raw)
+	if len(uncovered) != 1 || uncovered[0] != "somesubwire" {
+		t.Errorf("expected somesubwire to be uncovered, got %v", uncovered)
+	}
+}
@@ -0,0 +1,295 @@
+package seven5
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REMEMBER_COOKIE = "%s-seven5-remember"
+	//DEFAULT_REMEMBER_LIFETIME is how long a remember me token lasts if it
+	//is not used.
+	DEFAULT_REMEMBER_LIFETIME = 30 * 24 * time.Hour
+	//REMEMBER_GRACE is how long the previous validator of a token is still
+	//accepted after the token is rotated, so requests the browser sent at the
+	//same time don't look like theft.
+	REMEMBER_GRACE = time.Minute
+)
+
+//RememberToken is a remember me token as it is stored.  The selector finds
+//the token and stays the same as the token is rotated; the validator is
+//secret and only its hash is stored.
+type RememberToken struct {
+	Selector string
+	UniqueId string
+	Hash     string
+	//PrevHash is the hash of the validator before the last rotation, at
+	//Rotated.
+	PrevHash string
+	Rotated  time.Time
+	Created  time.Time
+	Expires  time.Time
+}
+
+//RememberStore keeps remember me tokens.  Load returns nil, nil for a token
+//that is not in the store.  Rotate stores the token given only if the Hash
+//of the stored token with its selector is still oldHash, and returns false
+//if it is not; this must be atomic, so that of two requests using the same
+//token at once only one rotates it.  Implementations must be safe to use
+//from multiple goroutines.
+type RememberStore interface {
+	Load(selector string) (*RememberToken, error)
+	Save(*RememberToken) error
+	Rotate(selector string, oldHash string, t *RememberToken) (bool, error)
+	Delete(selector string) error
+	DeleteAll(uniqueId string) error
+}
+
+//MemoryRememberStore keeps remember me tokens in a map, so they are lost at
+//exit.  This is mostly useful for tests.
+type MemoryRememberStore struct {
+	lock   sync.Mutex
+	tokens map[string]*RememberToken
+}
+
+//NewMemoryRememberStore returns an empty MemoryRememberStore.
+func NewMemoryRememberStore() *MemoryRememberStore {
+	return &MemoryRememberStore{tokens: make(map[string]*RememberToken)}
+}
+
+//Load returns a copy of the token.
+func (self *MemoryRememberStore) Load(selector string) (*RememberToken, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	t, ok := self.tokens[selector]
+	if !ok {
+		return nil, nil
+	}
+	c := *t
+	return &c, nil
+}
+
+//Save stores a copy of the token.
+func (self *MemoryRememberStore) Save(t *RememberToken) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c := *t
+	self.tokens[t.Selector] = &c
+	return nil
+}
+
+//Rotate stores a copy of the token if the stored one still has oldHash.
+func (self *MemoryRememberStore) Rotate(selector string, oldHash string, t *RememberToken) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	old, ok := self.tokens[selector]
+	if !ok || old.Hash != oldHash {
+		return false, nil
+	}
+	c := *t
+	self.tokens[selector] = &c
+	return true, nil
+}
+
+//Delete removes the token.
+func (self *MemoryRememberStore) Delete(selector string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.tokens, selector)
+	return nil
+}
+
+//DeleteAll removes every token of the unique id.
+func (self *MemoryRememberStore) DeleteAll(uniqueId string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for sel, t := range self.tokens {
+		if t.UniqueId == uniqueId {
+			delete(self.tokens, sel)
+		}
+	}
+	return nil
+}
+
+//RememberMe keeps users logged in for longer than their sessions last with
+//a remember me token in a cookie of its own.  When a request has no session,
+//the token is exchanged for a new one (see Exchange).  The token is the
+//selector, ":" and the validator; the validator changes every time the token
+//is used.  If a token is used with an old validator, it has been copied, so
+//every token of the user is deleted and, if the session manager is a
+//SessionRevoker, every session of the user is revoked.
+type RememberMe struct {
+	store  RememberStore
+	clock  Clock
+	cookie string
+	//Lifetime is how long a token lasts without being used, the default is
+	//DEFAULT_REMEMBER_LIFETIME.
+	Lifetime time.Duration
+}
+
+//NewRememberMe returns a RememberMe for the application named that keeps
+//tokens in the store.  If clock is nil, the SystemClock is used.
+func NewRememberMe(appName string, store RememberStore, clock Clock) *RememberMe {
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+	return &RememberMe{
+		store:    store,
+		clock:    clock,
+		cookie:   fmt.Sprintf(REMEMBER_COOKIE, appName),
+		Lifetime: DEFAULT_REMEMBER_LIFETIME,
+	}
+}
+
+//CookieName returns the name of the cookie with the token.
+func (self *RememberMe) CookieName() string {
+	return self.cookie
+}
+
+func rememberHash(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
+
+//newValidator gives the token a new validator and returns it.
+func newValidator(t *RememberToken) string {
+	validator := base64.RawURLEncoding.EncodeToString(apiKeyRandom(32))
+	t.Hash = rememberHash(validator)
+	return validator
+}
+
+//setCookie sends the validator of the token to the client.
+func (self *RememberMe) setCookie(w http.ResponseWriter, t *RememberToken, validator string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     self.cookie,
+		Value:    t.Selector + ":" + validator,
+		Path:     "/",
+		Expires:  t.Expires,
+		HttpOnly: true,
+	})
+}
+
+//RemoveCookie removes the token from the client.
+func (self *RememberMe) RemoveCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: self.cookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+//Remember sends a new token for the unique id to the client.
+func (self *RememberMe) Remember(w http.ResponseWriter, uniq string) error {
+	now := self.clock.Now()
+	t := &RememberToken{
+		Selector: hex.EncodeToString(apiKeyRandom(12)),
+		UniqueId: uniq,
+		Created:  now,
+		Expires:  now.Add(self.Lifetime),
+	}
+	validator := newValidator(t)
+	if err := self.store.Save(t); err != nil {
+		return err
+	}
+	self.setCookie(w, t, validator)
+	return nil
+}
+
+//token returns the selector and validator of the request's token, or "" if
+//there is none.
+func (self *RememberMe) token(r *http.Request) (string, string) {
+	c, err := r.Cookie(self.cookie)
+	if err != nil {
+		return "", ""
+	}
+	parts := strings.SplitN(c.Value, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+//Forget deletes the request's token and removes it from the client.
+func (self *RememberMe) Forget(w http.ResponseWriter, r *http.Request) error {
+	self.RemoveCookie(w)
+	if sel, _ := self.token(r); sel != "" {
+		return self.store.Delete(sel)
+	}
+	return nil
+}
+
+//ForgetAll deletes every token of the unique id.
+func (self *RememberMe) ForgetAll(uniq string) error {
+	return self.store.DeleteAll(uniq)
+}
+
+//Exchange returns a new session for the user of the request's token, or nil
+//if there is no valid token.  The session is created with the session
+//manager's Generate and Assign, and the caller must send it to the client
+//(with AssociateCookie).  If Generate returns nil user data, there is no
+//session.  The token's validator is changed and sent to the client; if
+//another request rotates the token first, this one is treated like a
+//request sent before the client got the new validator.
+func (self *RememberMe) Exchange(w http.ResponseWriter, r *http.Request, sm SessionManager) (Session, error) {
+	sel, validator := self.token(r)
+	if sel == "" {
+		return nil, nil
+	}
+	t, err := self.store.Load(sel)
+	if err != nil {
+		return nil, err
+	}
+	now := self.clock.Now()
+	if t == nil || !now.Before(t.Expires) {
+		self.RemoveCookie(w)
+		if t != nil {
+			return nil, self.store.Delete(sel)
+		}
+		return nil, nil
+	}
+	hash := rememberHash(validator)
+	switch {
+	case subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1:
+		rotated := *t
+		rotated.PrevHash, rotated.Rotated = t.Hash, now
+		rotated.Expires = now.Add(self.Lifetime)
+		validator := newValidator(&rotated)
+		ok, err := self.store.Rotate(sel, t.Hash, &rotated)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			self.setCookie(w, &rotated, validator)
+		}
+		//otherwise another request rotated it first, like the grace case
+	case subtle.ConstantTimeCompare([]byte(hash), []byte(t.PrevHash)) == 1 && now.Sub(t.Rotated) < REMEMBER_GRACE:
+		//sent before the client got the new validator
+	default:
+		log.Printf("[REMEMBER] token %s of %s was used with an old validator, assuming theft", sel, t.UniqueId)
+		self.RemoveCookie(w)
+		if err := self.store.DeleteAll(t.UniqueId); err != nil {
+			return nil, err
+		}
+		if revoker, ok := sm.(SessionRevoker); ok {
+			if err := revoker.RevokeAll(t.UniqueId); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	ud, err := sm.Generate(t.UniqueId)
+	if err != nil || ud == nil {
+		return nil, err
+	}
+	s, err := assignSession(sm, t.UniqueId, ud, r)
+	if err != nil {
+		return nil, err
+	}
+	NotifySession(sm, &SessionEvent{Type: SESSION_LOGIN, SessionId: s.SessionId(), UniqueId: t.UniqueId,
+		UserData: ud})
+	return s, nil
+}
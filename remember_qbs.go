@@ -0,0 +1,154 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	REMEMBER_TABLE = "remember_record"
+)
+
+//RememberRecord is the row type used by QbsRememberStore.
+type RememberRecord struct {
+	Id       int64
+	Selector string
+	UniqueId string
+	Hash     string
+	PrevHash string
+	Rotated  time.Time
+	Created  time.Time
+	Expires  time.Time
+}
+
+//QbsRememberStore keeps remember me tokens in the remember_record table,
+//which can be created with RememberMigrationUp.
+type QbsRememberStore struct {
+	store *QbsStore
+}
+
+//NewQbsRememberStore returns a remember me token store that uses the
+//database of the QbsStore given.
+func NewQbsRememberStore(s *QbsStore) *QbsRememberStore {
+	return &QbsRememberStore{store: s}
+}
+
+func (self *QbsRememberStore) find(q *qbs.Qbs, selector string) (*RememberRecord, error) {
+	rec := &RememberRecord{}
+	err := q.WhereEqual("selector", selector).Find(rec)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//Load reads the token's row.
+func (self *QbsRememberStore) Load(selector string) (*RememberToken, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rec, err := self.find(q, selector)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	return &RememberToken{Selector: rec.Selector, UniqueId: rec.UniqueId, Hash: rec.Hash,
+		PrevHash: rec.PrevHash, Rotated: rec.Rotated, Created: rec.Created, Expires: rec.Expires}, nil
+}
+
+//Save creates or updates the token's row.
+func (self *QbsRememberStore) Save(t *RememberToken) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	rec, err := self.find(q, t.Selector)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		rec = &RememberRecord{Selector: t.Selector}
+	}
+	rec.UniqueId = t.UniqueId
+	rec.Hash = t.Hash
+	rec.PrevHash = t.PrevHash
+	rec.Rotated = t.Rotated
+	rec.Created = t.Created
+	rec.Expires = t.Expires
+	_, err = q.Save(rec)
+	return err
+}
+
+//Rotate updates the token's row with a single UPDATE that only matches if
+//its hash is still oldHash.
+func (self *QbsRememberStore) Rotate(selector string, oldHash string, t *RememberToken) (bool, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return false, err
+	}
+	defer q.Close()
+	result, err := q.Exec(fmt.Sprintf(`UPDATE %s SET hash = ?, prev_hash = ?, rotated = ?, expires = ?
+		WHERE selector = ? AND hash = ?`, REMEMBER_TABLE),
+		t.Hash, t.PrevHash, t.Rotated, t.Expires, selector, oldHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+//Delete removes the token's row.
+func (self *QbsRememberStore) Delete(selector string) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.WhereEqual("selector", selector).Delete(&RememberRecord{})
+	return err
+}
+
+//DeleteAll removes the rows of the tokens of the unique id.
+func (self *QbsRememberStore) DeleteAll(uniqueId string) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.WhereEqual("unique_id", uniqueId).Delete(&RememberRecord{})
+	return err
+}
+
+//RememberMigrationUp is a migration function (see the migrate package) that
+//creates the table used by QbsRememberStore.  This is postgres specific.
+func RememberMigrationUp(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		id BIGSERIAL PRIMARY KEY,
+		selector VARCHAR(64) NOT NULL UNIQUE,
+		unique_id VARCHAR(255) NOT NULL,
+		hash VARCHAR(128) NOT NULL,
+		prev_hash VARCHAR(128) NOT NULL DEFAULT '',
+		rotated TIMESTAMP WITH TIME ZONE,
+		created TIMESTAMP WITH TIME ZONE NOT NULL,
+		expires TIMESTAMP WITH TIME ZONE NOT NULL)`, REMEMBER_TABLE))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE INDEX %s_unique_id_idx ON %s (unique_id)",
+		REMEMBER_TABLE, REMEMBER_TABLE))
+	return err
+}
+
+//RememberMigrationDown is the inverse of RememberMigrationUp.
+func RememberMigrationDown(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", REMEMBER_TABLE))
+	return err
+}
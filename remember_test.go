@@ -0,0 +1,127 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//rememberCookie returns the remember me cookie set on rec, or nil.
+func rememberCookie(rm *RememberMe, rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == rm.CookieName() && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestRememberMe(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Clock: clock, Keys: testSessionKeys()})
+	defer sm.Close()
+	store := NewMemoryRememberStore()
+	rm := NewRememberMe("test", store, clock)
+	cm := NewSimpleCookieMapper("test")
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	io.Remember = rm
+
+	bundle := func(method string, c *http.Cookie) (PBundle, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(method, "http://example.com/rest/x", nil)
+		r.AddCookie(c)
+		rec := httptest.NewRecorder()
+		pb, err := io.BundleHook(rec, r, sm)
+		if err != nil {
+			t.Fatalf("bundle hook failed: %v", err)
+		}
+		return pb, rec
+	}
+
+	rec := httptest.NewRecorder()
+	if err := rm.Remember(rec, "fred"); err != nil {
+		t.Fatalf("unable to remember: %v", err)
+	}
+	first := rememberCookie(rm, rec)
+	sel := strings.Split(first.Value, ":")[0]
+	if stored, _ := store.Load(sel); stored == nil || strings.Contains(first.Value, stored.Hash) {
+		t.Fatalf("expected only the hash of the validator to be stored: %+v", stored)
+	}
+
+	if pb, _ := bundle("POST", first); pb.Session() != nil {
+		t.Errorf("expected no session for a POST")
+	}
+	pb, rec := bundle("GET", first)
+	if SessionUniqueId(pb.Session()) != "fred" {
+		t.Fatalf("expected session from the token")
+	}
+	second := rememberCookie(rm, rec)
+	if second == nil || second.Value == first.Value || !strings.HasPrefix(second.Value, sel+":") {
+		t.Fatalf("expected the validator to be rotated: %v", second)
+	}
+	var sessionCookie bool
+	for _, c := range rec.Result().Cookies() {
+		sessionCookie = sessionCookie || c.Name == cm.CookieName()
+	}
+	if !sessionCookie {
+		t.Errorf("expected the new session to be sent to the client")
+	}
+
+	//a request sent at the same time as the first one
+	if pb, _ := bundle("GET", first); pb.Session() == nil {
+		t.Errorf("expected the previous validator to work for a moment")
+	}
+	clock.Advance(REMEMBER_GRACE)
+	if pb, _ := bundle("GET", first); pb.Session() != nil {
+		t.Errorf("expected an old validator to be refused")
+	}
+	if pb, _ := bundle("GET", second); pb.Session() != nil {
+		t.Errorf("expected theft to forget every token")
+	}
+
+	rec = httptest.NewRecorder()
+	rm.Remember(rec, "fred")
+	clock.Advance(DEFAULT_REMEMBER_LIFETIME)
+	if pb, _ := bundle("GET", rememberCookie(rm, rec)); pb.Session() != nil {
+		t.Errorf("expected an expired token to be refused")
+	}
+}
+
+func TestRememberMeConcurrent(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Clock: clock, Keys: testSessionKeys()})
+	defer sm.Close()
+	rm := NewRememberMe("test", NewMemoryRememberStore(), clock)
+	rec := httptest.NewRecorder()
+	rm.Remember(rec, "fred")
+	cookie := rememberCookie(rm, rec)
+
+	type result struct {
+		ok      bool
+		rotated bool
+	}
+	results := make(chan result, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			r := httptest.NewRequest("GET", "http://example.com/rest/x", nil)
+			r.AddCookie(cookie)
+			rec := httptest.NewRecorder()
+			s, err := rm.Exchange(rec, r, sm)
+			results <- result{err == nil && s != nil, rememberCookie(rm, rec) != nil}
+		}()
+	}
+	rotated := 0
+	for i := 0; i < cap(results); i++ {
+		res := <-results
+		if !res.ok {
+			t.Errorf("expected every request with the token to get a session")
+		}
+		if res.rotated {
+			rotated++
+		}
+	}
+	if rotated != 1 {
+		t.Errorf("expected the token to be rotated once but it was rotated %d times", rotated)
+	}
+}
@@ -50,10 +50,15 @@ type RestAllUdid interface {
 }
 
 type restShared struct {
-	typ   reflect.Type
-	name  string
-	index RestIndex
-	post  RestPost
+	typ      reflect.Type
+	name     string
+	index    RestIndex
+	post     RestPost
+	udid     bool
+	parent   reflect.Type
+	children []string
+	linker   Linker
+	cacher   HTTPCacher
 }
 
 type restObj struct {
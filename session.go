@@ -1,16 +1,12 @@
 package seven5
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"log"
-	"os"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +14,10 @@ const (
 	s5CookiePrefix = "s5" //helps for detecting keys have changed and shuffling attacks
 )
 
+var (
+	SESSION_MANAGER_CLOSED = HTTPError(http.StatusServiceUnavailable, "session manager is closed")
+)
+
 //Generator is a type that converts from a small amount of unique info to the
 //data that should be stored in a session.  It is called when an http request
 //is received (see IOHook) and the user has previously visited this website.
@@ -53,10 +53,28 @@ type Session interface {
 	UserData() interface{}
 }
 
+//UniqueSession is implemented by sessions that know the unique id
+//(as passed to Assign) of the user they belong to.  SimpleSession implements
+//this interface.
+type UniqueSession interface {
+	Session
+	UniqueId() string
+}
+
+//SessionUniqueId returns the unique id of the user that owns the session, or
+//"" if the session is nil or does not implement UniqueSession.
+func SessionUniqueId(s Session) string {
+	if u, ok := s.(UniqueSession); ok {
+		return u.UniqueId()
+	}
+	return ""
+}
+
 //SimpleSession is a default implementation of Session suitable for most applications.
 type SimpleSession struct {
-	id string
-	ud interface{}
+	id   string
+	ud   interface{}
+	uniq string
 }
 
 //SessionId returns the sessionId. To make sessions stable across runs, the
@@ -74,6 +92,12 @@ func (self *SimpleSession) UserData() interface{} {
 	return self.ud
 }
 
+//UniqueId returns the unique id that the session was created for with
+//Assign.  This is "" for sessions created with NewSimpleSession.
+func (self *SimpleSession) UniqueId() string {
+	return self.uniq
+}
+
 //NewSimpleSession returns a new simple session with its SessionId initialized.
 //If the sid is "", a new UDID is generated as the session ID, but most applications
 //will want to control this so that sessions are stable across runs.
@@ -82,7 +106,7 @@ func NewSimpleSession(userData interface{}, sid string) *SimpleSession {
 	if sid == "" {
 		s = UDID()
 	}
-	return &SimpleSession{s, userData}
+	return &SimpleSession{id: s, ud: userData}
 }
 
 //SimpleSessionManager is an implementation of the SessionManager that knows about the semantics
@@ -90,52 +114,149 @@ func NewSimpleSession(userData interface{}, sid string) *SimpleSession {
 type SimpleSessionManager struct {
 	generator Generator
 	out       chan *sessionPacket
+	core      *sessionCore
+	stop      chan bool
+	closing   sync.Once
 }
 
+//SessionConfig controls where a SimpleSessionManager keeps sessions and
+//when they expire.  Zero values mean the defaults.
+type SessionConfig struct {
+	//Store holds the sessions, the default is a MemorySessionStore.
+	Store SessionStore
+	//Clock is the source of the time, the default is the SystemClock.
+	Clock Clock
+	//Keys seal the session ids, the default is SessionKeyringFromEnv().
+	Keys *SessionKeyring
+	//Lifetime is how long a session lasts when Assign is not given an
+	//expiration time, and how long a renewed session lasts.  The default
+	//is DEFAULT_SESSION_LIFETIME.
+	Lifetime time.Duration
+	//Absolute is the longest a session can last, no matter how often it is
+	//renewed.  Zero means no limit.
+	Absolute time.Duration
+	//Idle is how long a session can go unused before it expires.  Zero
+	//means no limit.
+	Idle time.Duration
+	//RenewWithin causes a session that is used within this long of its
+	//expiration to be replaced by one with a new expiration time (sliding
+	//expiration).  Zero means sessions are never renewed.
+	RenewWithin time.Duration
+	//SweepEvery is how often the store is swept of expired sessions.  Zero
+	//means expired sessions are only removed when they are next used.
+	SweepEvery time.Duration
+}
+
+//sessionTouchFraction of the idle timeout must pass before the last access
+//time of a session is saved again, to avoid a write on every request.
+const sessionTouchFraction = 10
+
+//sessionTouchInterval is how often the last access time is saved when
+//there is no idle timeout.
+const sessionTouchInterval = time.Minute
+
+const (
+	DEFAULT_SESSION_LIFETIME = 24 * time.Hour
+)
+
 //NewSimpleSessionManager returns an instance of seven5.SessionManager.
 //This keeps the sessions in memory, not on disk or database but does try to
 //insure that sessions are stable across runs by encrypting the session ids
 //with a key only the session manager knows. The key must be supplied in
 //the environment variable SERVER_SESSION_KEY or this function panics. That
-//key should be a 32 character hex string (see key2hex).  If you pass nil
+//key should be a 32 or 64 character hex string (see key2hex); retired keys
+//may be given in SERVER_SESSION_RETIRED_KEYS (see SessionKeyring).  If you pass nil
 //as your generator, we are assuming that you will explicitly connect each
 //user session via a call to Assign.
 func NewSimpleSessionManager(g Generator) *SimpleSessionManager {
-	if os.Getenv("SERVER_SESSION_KEY") == "" {
-		log.Fatalf("unable to find environment variable SERVER_SESSION_KEY")
-	}
-	keyRaw := strings.TrimSpace(os.Getenv("SERVER_SESSION_KEY"))
-	if len(keyRaw) != aes.BlockSize*2 {
-		log.Fatalf("expected SERVER_SESSION_KEY length to be %d, but was %d", aes.BlockSize*2, len(keyRaw))
-	}
-	buf := make([]byte, aes.BlockSize)
-	l, err := hex.Decode(buf, []byte(keyRaw))
-	if err != nil {
-		log.Fatalf("Unable to decode SERVER_SESSION_KEY, maybe it's not in hex? %v", err)
-	}
-	if l != aes.BlockSize {
-		log.Fatalf("expected SERVER_SESSION_KEY decoded length to be %d, but was %d", aes.BlockSize, l)
+	return NewSimpleSessionManagerWithConfig(g, &SessionConfig{})
+}
+
+//NewSimpleSessionManagerWithStore is like NewSimpleSessionManager but keeps
+//the sessions in the given store.  With a store that persists sessions, the
+//user data of a session survives a restart and the Generator is only
+//needed for sessions the store does not have.
+func NewSimpleSessionManagerWithStore(g Generator, store SessionStore) *SimpleSessionManager {
+	return NewSimpleSessionManagerWithConfig(g, &SessionConfig{Store: store})
+}
+
+//NewSimpleSessionManagerWithConfig is like NewSimpleSessionManager but the
+//store and expiration of sessions are controlled by conf.  When an Idle or
+//Absolute timeout is set, a session that is not in the store cannot be
+//recovered from its session id (see Find), since there is no way to know
+//when it was created or last used.
+func NewSimpleSessionManagerWithConfig(g Generator, conf *SessionConfig) *SimpleSessionManager {
+	keys := conf.Keys
+	if keys == nil {
+		keys = sessionKeyringFromEnv()
 	}
-	key := buf[0:l]
+	return newSimpleSessionManager(g, keys, conf)
+}
 
+//newSimpleSessionManager starts the session manager; keys are nil for a
+//dumb session manager.
+func newSimpleSessionManager(g Generator, keys *SessionKeyring, conf *SessionConfig) *SimpleSessionManager {
+	c := withSessionDefaults(conf, func() SessionStore { return NewMemorySessionStore() })
 	result := &SimpleSessionManager{
 		out:       make(chan *sessionPacket),
 		generator: g,
+		core:      newSessionCore(keys, c),
+		stop:      make(chan bool),
+	}
+	go handleSessionChecks(result.out, result.core)
+	if c.SweepEvery > 0 {
+		go result.core.sweep(result.stop)
 	}
-	go handleSessionChecks(result.out, key)
 	return result
 }
 
+//withSessionDefaults returns a copy of conf with the zero values replaced
+//by the defaults; newStore is called if there is no Store.
+func withSessionDefaults(conf *SessionConfig, newStore func() SessionStore) *SessionConfig {
+	c := *conf
+	if c.Store == nil {
+		c.Store = newStore()
+	}
+	if c.Clock == nil {
+		c.Clock = &SystemClock{}
+	}
+	if c.Lifetime == 0 {
+		c.Lifetime = DEFAULT_SESSION_LIFETIME
+	}
+	return &c
+}
+
+//AddSessionListener adds a listener for the events of this session manager.
+func (self *SimpleSessionManager) AddSessionListener(l SessionListener) {
+	self.core.events.add(l)
+}
+
+//NotifySession sends an event to the listeners of this session manager.
+func (self *SimpleSessionManager) NotifySession(ev *SessionEvent) {
+	self.core.events.emit(ev)
+}
+
+//ListSessions returns the sessions of the unique id that have not expired.
+//This is safe to call without going through the session goroutine since
+//the store is safe for concurrent use.
+func (self *SimpleSessionManager) ListSessions(uniqueId string) ([]*StoredSession, error) {
+	return self.core.list(uniqueId)
+}
+
+//sessionKeyringFromEnv returns the keys from the environment or exits.
+func sessionKeyringFromEnv() *SessionKeyring {
+	keys, err := SessionKeyringFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return keys
+}
+
 //NewDumbSessionManager returns a session manager that makes no attempt
 //to conceal the client session id from the client, so this is probably only
 //useful for tests.
 func NewDumbSessionManager() *SimpleSessionManager {
-	result := &SimpleSessionManager{
-		out:       make(chan *sessionPacket),
-		generator: nil,
-	}
-	go handleSessionChecks(result.out, []byte{})
-	return result
+	return newSimpleSessionManager(nil, nil, &SessionConfig{})
 }
 
 //counter is useful for tests
@@ -148,6 +269,8 @@ const (
 	_SESSION_OP_CREATE
 	_SESSION_OP_FIND
 	_SESSION_OP_UPDATE
+	_SESSION_OP_STOP
+	_SESSION_OP_REVOKE
 )
 
 //sessionPacket is the type exchanged over the channel from the session manager to the go routine
@@ -158,7 +281,14 @@ type sessionPacket struct {
 	uniqueInfo string
 	expires    time.Time
 	userData   interface{}
-	ret        chan *SessionReturn
+	client     *SessionClient
+	ret        chan *sessionReply
+}
+
+//sessionReply is the response to a sessionPacket.
+type sessionReply struct {
+	sr  *SessionReturn
+	err error
 }
 
 //SessionReturn is returned from a call to Find.  It contains either a Session
@@ -166,93 +296,311 @@ type sessionPacket struct {
 //cookie that was originally passed to Assign(), although perhaps not on this run
 //of the program.  When Find() returns nil, then there was either no session data
 //to recover or the session expired, keys changed or some other event that means
-//you better re-check the user.
+//you better re-check the user.  If Renewed is true, the Session has been
+//given a new id with a later expiration time and the new id must be sent to
+//the client (see CookieMapper.AssociateCookie).
 type SessionReturn struct {
 	Session  Session
 	UniqueId string
+	Renewed  bool
 }
 
 //handleSessionChecks is the goroutine that reads session manager requests and responds based on its
-//map.  Each operation has a sessionPacket and that has on op to tell us how to
+//store.  Each operation has a sessionPacket and that has on op to tell us how to
 //process each one.
-func handleSessionChecks(ch chan *sessionPacket, key []byte) {
-	hash := make(map[string]Session)
-
+func handleSessionChecks(ch chan *sessionPacket, core *sessionCore) {
 	var err error
-	var block cipher.Block
-
-	if len(key) != 0 {
-		block, err = aes.NewCipher(key)
-		if err != nil {
-			log.Fatalf("unable to get AES cipher: %v", err)
-		}
-	}
-
 	var result *SessionReturn
 	for {
 		pkt := <-ch
 		packetsProcessed++
 
 		result = nil //safety
+		err = nil
 		switch pkt.op {
 
+		case _SESSION_OP_STOP:
+			pkt.ret <- &sessionReply{}
+			return
+
 		case _SESSION_OP_DEL:
-			_, ok := hash[pkt.sessionId]
-			if ok {
-				delete(hash, pkt.sessionId)
-			}
-			result = nil
+			err = core.destroy(pkt.sessionId)
+		case _SESSION_OP_REVOKE:
+			err = core.revoke(pkt.uniqueInfo)
 		case _SESSION_OP_CREATE:
-			var sid string
-			if block == nil {
-				sid = pkt.uniqueInfo
-			} else {
-				sessionId := computeRawSessionId(pkt.uniqueInfo, pkt.expires)
-				sid = encryptSessionId(sessionId, block)
-			}
-			s := NewSimpleSession(pkt.userData, sid)
-			hash[sid] = s
-			result = &SessionReturn{Session: s}
+			result, err = core.create(pkt.uniqueInfo, pkt.userData, pkt.expires, pkt.client)
 		case _SESSION_OP_UPDATE:
-			_, ok := hash[pkt.sessionId]
-			if !ok {
-				result = nil
-			} else {
-				s := NewSimpleSession(pkt.userData, pkt.sessionId)
-				result = &SessionReturn{Session: s}
-			}
+			result, err = core.update(pkt.sessionId, pkt.userData)
 		case _SESSION_OP_FIND:
-			s, ok := hash[pkt.sessionId]
-			if !ok {
-				if block == nil {
-					//this is the dodgy bit
-					result = &SessionReturn{UniqueId: pkt.sessionId}
-					break
-				}
-				uniq, ok := decryptSessionId(pkt.sessionId, block)
-				if !ok {
-					result = nil
-					break
-				}
-				result = &SessionReturn{UniqueId: uniq}
-			} else {
-				if block == nil {
-					result = &SessionReturn{Session: s}
-					break
-				}
-				//expired?
-				_, ok := decryptSessionId(pkt.sessionId, block)
-				if !ok {
-					delete(hash, pkt.sessionId)
-					result = nil
-				} else {
-					result = &SessionReturn{Session: s}
-				}
+			result, err = core.find(pkt.sessionId, pkt.client)
+		}
+		pkt.ret <- &sessionReply{sr: result, err: err}
+
+	}
+}
+
+//sessionCore implements the session operations on top of a store.  It is
+//shared by the session manager implementations, which differ in how they
+//keep operations on the same session from running at the same time.
+type sessionCore struct {
+	//keys are nil for a dumb session manager
+	keys   *SessionKeyring
+	conf   *SessionConfig
+	events *sessionEvents
+}
+
+func newSessionCore(keys *SessionKeyring, conf *SessionConfig) *sessionCore {
+	return &sessionCore{keys: keys, conf: conf, events: newSessionEvents()}
+}
+
+//emit sends an event about a session to the listeners.
+func (self *sessionCore) emit(t SessionEventType, id string, uniq string, ud interface{}) {
+	self.events.emit(&SessionEvent{Type: t, SessionId: id, UniqueId: uniq, UserData: ud,
+		Time: self.conf.Clock.Now()})
+}
+
+//sweep periodically removes expired sessions from the store until stop is
+//closed.
+func (self *sessionCore) sweep(stop chan bool) {
+	ticker := time.NewTicker(self.conf.SweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			swept, err := self.conf.Store.Sweep(self.conf.Clock.Now(), self.conf.Idle)
+			if err != nil {
+				log.Printf("[SESSION] unable to sweep expired sessions: %v", err)
+				continue
+			}
+			if len(swept) > 0 {
+				log.Printf("[SESSION] swept %d expired sessions", len(swept))
+			}
+			for _, s := range swept {
+				self.emit(SESSION_EXPIRED, s.Id, s.UniqueId, nil)
 			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+//newId returns the session id for a session of uniq that expires at t
+//and was issued (created) at issued
+func (self *sessionCore) newId(uniq string, t time.Time, issued time.Time) string {
+	if self.keys == nil {
+		return uniq
+	}
+	return self.keys.Seal(computeRawSessionId(uniq, t, issued))
+}
+
+//failed logs errors from the store.
+func (self *sessionCore) failed(err error) error {
+	if err != nil {
+		log.Printf("[SESSION] session store failed: %v", err)
+	}
+	return err
+}
+
+func (self *sessionCore) destroy(id string) error {
+	var uniq string
+	if self.events.active() {
+		//only needed for the event
+		if old, err := self.conf.Store.Load(id); err == nil && old != nil {
+			uniq = old.UniqueId
 		}
-		pkt.ret <- result
+	}
+	if err := self.conf.Store.Delete(id); err != nil {
+		return self.failed(err)
+	}
+	self.emit(SESSION_DESTROYED, id, uniq, nil)
+	return nil
+}
 
+func (self *sessionCore) revoke(uniq string) error {
+	if err := self.conf.Store.Revoke(uniq, self.conf.Clock.Now()); err != nil {
+		return self.failed(err)
 	}
+	self.emit(SESSION_REVOKED, "", uniq, nil)
+	return nil
+}
+
+func (self *sessionCore) create(uniq string, ud interface{}, expires time.Time, client *SessionClient) (*SessionReturn, error) {
+	now := self.conf.Clock.Now()
+	if expires.IsZero() {
+		expires = now.Add(self.conf.Lifetime)
+	}
+	if self.conf.Absolute > 0 && expires.After(now.Add(self.conf.Absolute)) {
+		expires = now.Add(self.conf.Absolute)
+	}
+	sid := self.newId(uniq, expires, now)
+	stored := &StoredSession{
+		Id:         sid,
+		UniqueId:   uniq,
+		UserData:   ud,
+		Expires:    expires,
+		Created:    now,
+		LastAccess: now,
+	}
+	client.apply(stored)
+	err := self.conf.Store.Save(stored)
+	if err != nil {
+		return nil, self.failed(err)
+	}
+	self.emit(SESSION_CREATED, sid, uniq, ud)
+	s := NewSimpleSession(ud, sid)
+	s.uniq = uniq
+	return &SessionReturn{Session: s}, nil
+}
+
+func (self *sessionCore) update(id string, ud interface{}) (*SessionReturn, error) {
+	old, err := self.conf.Store.Load(id)
+	if err != nil || old == nil {
+		return nil, self.failed(err)
+	}
+	old.UserData = ud
+	if err = self.conf.Store.Save(old); err != nil {
+		return nil, self.failed(err)
+	}
+	self.emit(SESSION_UPDATED, id, old.UniqueId, ud)
+	s := NewSimpleSession(ud, id)
+	s.uniq = old.UniqueId
+	return &SessionReturn{Session: s}, nil
+}
+
+func (self *sessionCore) find(id string, client *SessionClient) (*SessionReturn, error) {
+	result, err := self.findStored(id, client)
+	if err != nil {
+		return nil, self.failed(err)
+	}
+	return result, nil
+}
+
+func (self *sessionCore) findStored(id string, client *SessionClient) (*SessionReturn, error) {
+	conf, store, keys := self.conf, self.conf.Store, self.keys
+	now := conf.Clock.Now()
+	stored, err := store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		if conf.Idle > 0 || conf.Absolute > 0 {
+			//can't know if it timed out
+			return nil, nil
+		}
+		//this is the dodgy bit when there are no keys
+		token := &sessionToken{uniq: id}
+		if keys != nil {
+			if token = decryptSessionId(id, keys, now); token == nil {
+				return nil, nil
+			}
+		}
+		revoked, err := store.RevokedBefore(token.uniq)
+		if err != nil {
+			return nil, err
+		}
+		if token.issued.Before(revoked) {
+			//issued before the revocation, or no way to know
+			return nil, nil
+		}
+		return &SessionReturn{UniqueId: token.uniq}, nil
+	}
+	//expired?
+	expired := !stored.Expires.IsZero() && !now.Before(stored.Expires)
+	if conf.Idle > 0 && !stored.LastAccess.IsZero() && now.Sub(stored.LastAccess) >= conf.Idle {
+		expired = true
+	}
+	stale := false
+	if keys != nil {
+		if token := decryptSessionId(id, keys, now); token == nil {
+			expired = true
+		} else {
+			stale = token.stale
+		}
+	}
+	revoked, err := store.RevokedBefore(stored.UniqueId)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Created.Before(revoked) {
+		expired = true
+	}
+	if expired {
+		if err := store.Delete(id); err != nil {
+			return nil, err
+		}
+		self.emit(SESSION_EXPIRED, id, stored.UniqueId, nil)
+		return nil, nil
+	}
+	return self.renewOrTouch(stored, now, stale, client)
+}
+
+//list returns the sessions of the unique id that have not expired.
+func (self *sessionCore) list(uniq string) ([]*StoredSession, error) {
+	all, err := self.conf.Store.List(uniq)
+	if err != nil {
+		return nil, self.failed(err)
+	}
+	now := self.conf.Clock.Now()
+	var result []*StoredSession
+	for _, s := range all {
+		if !sessionExpired(s.Expires, s.LastAccess, now, self.conf.Idle) {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+//renewOrTouch returns the result of a successful find of the stored session.
+//If the session is near expiration, or its id was sealed with a retired key
+//(stale), it is replaced by a new one with a new id and possibly a new
+//expiration time, otherwise its last access time and client are updated if
+//needed.
+func (self *sessionCore) renewOrTouch(stored *StoredSession, now time.Time, stale bool,
+	client *SessionClient) (*SessionReturn, error) {
+	conf := self.conf
+	expires := stored.Expires
+	if conf.RenewWithin > 0 && stored.Expires.Sub(now) < conf.RenewWithin {
+		expires = now.Add(conf.Lifetime)
+		if conf.Absolute > 0 && expires.After(stored.Created.Add(conf.Absolute)) {
+			expires = stored.Created.Add(conf.Absolute)
+		}
+		if !expires.After(stored.Expires) {
+			expires = stored.Expires
+		}
+	}
+	if stale || !expires.Equal(stored.Expires) {
+		oldId := stored.Id
+		stored.Id = self.newId(stored.UniqueId, expires, stored.Created)
+		stored.Expires = expires
+		stored.LastAccess = now
+		client.apply(stored)
+		if err := conf.Store.Save(stored); err != nil {
+			return nil, err
+		}
+		if stored.Id != oldId {
+			if err := conf.Store.Delete(oldId); err != nil {
+				return nil, err
+			}
+			self.events.emit(&SessionEvent{Type: SESSION_RENEWED, SessionId: stored.Id,
+				UniqueId: stored.UniqueId, PreviousId: oldId, Time: now})
+		}
+		s := NewSimpleSession(stored.UserData, stored.Id)
+		s.uniq = stored.UniqueId
+		return &SessionReturn{Session: s, Renewed: stored.Id != oldId}, nil
+	}
+	touch := sessionTouchInterval
+	if conf.Idle > 0 {
+		touch = conf.Idle / sessionTouchFraction
+	}
+	if changed := client.apply(stored); changed || now.Sub(stored.LastAccess) >= touch {
+		stored.LastAccess = now
+		if err := conf.Store.Save(stored); err != nil {
+			return nil, err
+		}
+	}
+	s := NewSimpleSession(stored.UserData, stored.Id)
+	s.uniq = stored.UniqueId
+	return &SessionReturn{Session: s}, nil
 }
 
 //Assign is responsible for connecting the unique key for the user to a session.
@@ -261,28 +609,32 @@ func handleSessionChecks(ch chan *sessionPacket, key []byte) {
 //new session.  Note that you can't change the uniqueInfo later without some
 //work, so making it the email address can be trying.  The expiration time
 //can be in the past, that is useful for testing. If the expiration time is
-//the time zero value, the expiration time of one day from now will be used.
+//the time zero value, the Lifetime of the SessionConfig (one day by default)
+//is used.
 func (self *SimpleSessionManager) Assign(uniqueInfo string, userData interface{}, expires time.Time) (Session, error) {
+	return self.AssignFrom(uniqueInfo, userData, expires, nil)
+}
 
-	ch := make(chan *SessionReturn)
+//AssignFrom is Assign for a session used by the client given, which may be nil.
+func (self *SimpleSessionManager) AssignFrom(uniqueInfo string, userData interface{}, expires time.Time,
+	client *SessionClient) (Session, error) {
 
-	if expires.IsZero() {
-		expires = time.Now().Add(24 * time.Hour)
-	}
-
-	pkt := &sessionPacket{
+	reply := self.send(&sessionPacket{
 		op:         _SESSION_OP_CREATE,
 		uniqueInfo: uniqueInfo,
 		userData:   userData,
 		expires:    expires,
-		ret:        ch,
-	}
-	self.out <- pkt
-	sr := <-ch
-	close(ch)
+		client:     client,
+	})
 
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	if reply.sr == nil {
+		return nil, nil
+	}
 	//this the now initialized session
-	return sr.Session, nil
+	return reply.sr.Session, nil
 }
 
 //Update is called from the actual response handlers in the web app to inform
@@ -292,37 +644,31 @@ func (self *SimpleSessionManager) Assign(uniqueInfo string, userData interface{}
 //Find each time.  Note that you may not change the value of the unique id
 //via this method or everything will go very badly wrong.
 func (self *SimpleSessionManager) Update(session Session, i interface{}) (Session, error) {
-	ch := make(chan *SessionReturn)
-
-	pkt := &sessionPacket{
+	reply := self.send(&sessionPacket{
 		op:        _SESSION_OP_UPDATE,
 		userData:  i,
 		sessionId: session.SessionId(),
-		ret:       ch,
-	}
-	self.out <- pkt
-	sr := <-ch
-	close(ch)
+	})
 
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	if reply.sr == nil {
+		return nil, nil
+	}
 	//this the now initialized session
-	return sr.Session, nil
+	return reply.sr.Session, nil
 }
 
 //Destroy is called when a user requests to logout. The value provided should be
 //the session id, not the unique user info.
 func (self *SimpleSessionManager) Destroy(id string) error {
-	ch := make(chan *SessionReturn)
-
-	pkt := &sessionPacket{
+	reply := self.send(&sessionPacket{
 		op:        _SESSION_OP_DEL,
 		sessionId: id,
-		ret:       ch,
-	}
-	self.out <- pkt
-	_ = <-ch
-	close(ch)
+	})
 
-	return nil
+	return reply.err
 }
 
 //Find is called by the cookie management layer to see if a particular session
@@ -332,83 +678,122 @@ func (self *SimpleSessionManager) Destroy(id string) error {
 //a session, it would be wise to create a session immediately since we have
 //confirmed that at some point in the past that sesison existed for this user.
 func (self *SimpleSessionManager) Find(id string) (*SessionReturn, error) {
+	return self.FindFrom(id, nil)
+}
+
+//FindFrom is Find for a request from the client given, which may be nil.  The
+//client is recorded with the session.
+func (self *SimpleSessionManager) FindFrom(id string, client *SessionClient) (*SessionReturn, error) {
 
 	if id == "" {
 		log.Printf("[SESSION] likely programming error, called find with id=\"\"")
 		return nil, nil
 	}
-	ch := make(chan *SessionReturn)
-
-	pkt := &sessionPacket{
+	reply := self.send(&sessionPacket{
 		op:        _SESSION_OP_FIND,
 		sessionId: id,
-		ret:       ch,
-	}
-	self.out <- pkt
-	s := <-ch
-	close(ch)
+		client:    client,
+	})
 
-	return s, nil
+	return reply.sr, reply.err
 }
 
 //given a uniqueId, compute a related blob of stuff that can be used to
-//shove into the session (currently a prefix and an expiration time)
-func computeRawSessionId(uniqueId string, t time.Time) string {
-	return fmt.Sprintf("%s:%s,%d", s5CookiePrefix, uniqueId, t.Unix())
-}
-
-//given a blob of text to encode, returns a hex-encoded string with
-//the provided block cipher's ouptut.  note that a random initialization
-//vector is used and placed at the front of the cleartext.  this iv
-//does not need to be secure, but does need to be random.
-func encryptSessionId(cleartext string, block cipher.Block) string {
-	ciphertext := make([]byte, len(cleartext)+aes.BlockSize)
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		log.Panicf("failed to read the random stream: %v", err)
-	}
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], []byte(cleartext))
-	output := make([]byte, len(ciphertext)*2)
-	hex.Encode(output, ciphertext)
-	return string(output)
-}
-
-//given a blob of text to decode, checks a few things and returns either
-//the originally given unique id and true or "" and false.
-func decryptSessionId(encryptedHex string, block cipher.Block) (string, bool) {
-	ciphertext := make([]byte, len(encryptedHex)/2)
-	l, err := hex.Decode(ciphertext, []byte(encryptedHex))
+//shove into the session (currently a prefix, an expiration time and the
+//time the session was issued)
+func computeRawSessionId(uniqueId string, t time.Time, issued time.Time) string {
+	return fmt.Sprintf("%s:%s,%d,%d", s5CookiePrefix, uniqueId, t.Unix(), issued.UnixNano())
+}
+
+//sessionToken is the content of a session id.
+type sessionToken struct {
+	uniq    string
+	expires time.Time
+	issued  time.Time
+	//stale is true if the session id was sealed with a retired key
+	stale bool
+}
+
+//given a session id, checks a few things and returns either the content
+//of the session id or nil if it is not valid or has expired.
+func decryptSessionId(id string, keys *SessionKeyring, now time.Time) *sessionToken {
+	s, stale, err := keys.Open(id)
 	if err != nil {
-		log.Printf("unable to decode the hex bytes of session id (%s,%d): %v", encryptedHex, len(encryptedHex), err)
-		return "", false
+		log.Printf("[SESSION] rejected session id: %v", err)
+		return nil
 	}
-	iv := ciphertext[:aes.BlockSize]
-	stream := cipher.NewCTR(block, iv)
-
-	cleartext := make([]byte, l-len(iv))
-	stream.XORKeyStream(cleartext, ciphertext[aes.BlockSize:])
-	s := string(cleartext)
-	if !strings.HasPrefix(s, s5CookiePrefix) {
-		log.Printf("No cookie prefix found, probably keys changed")
-		return "", false
+	if !strings.HasPrefix(s, s5CookiePrefix+":") {
+		log.Printf("[SESSION] no cookie prefix found in session id")
+		return nil
 	}
 	s = strings.TrimPrefix(s, s5CookiePrefix+":")
 	parts := strings.Split(s, ",")
-	if len(parts) != 2 {
-		log.Printf("Failed to understand parts of session id: %s", s)
-		return "", false
+	if len(parts) != 3 {
+		log.Printf("[SESSION] failed to understand parts of session id: %s", s)
+		return nil
 	}
 	t, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
-		log.Printf("Could not understand expiration time in session id: %s", s)
-		return "", false
+		log.Printf("[SESSION] could not understand expiration time in session id: %s", s)
+		return nil
+	}
+	issued, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		log.Printf("[SESSION] could not understand issue time in session id: %s", s)
+		return nil
 	}
 	expires := time.Unix(t, 0)
-	if expires.Before(time.Now()) {
-		return "", false
+	if expires.Before(now) {
+		return nil
+	}
+	return &sessionToken{uniq: parts[0], expires: expires, issued: time.Unix(0, issued), stale: stale}
+}
+
+//SessionRevoker is implemented by session managers that can revoke all the
+//sessions of a user, such as when the user logs out everywhere or changes
+//their password.  SimpleSessionManager implements this interface.
+type SessionRevoker interface {
+	RevokeAll(uniqueId string) error
+}
+
+//RevokeAll destroys every session of the unique id (as passed to Assign) and
+//makes sure that no session id issued before now can be used to recover a
+//session for it with Find.
+func (self *SimpleSessionManager) RevokeAll(uniqueId string) error {
+	reply := self.send(&sessionPacket{
+		op:         _SESSION_OP_REVOKE,
+		uniqueInfo: uniqueId,
+	})
+
+	return reply.err
+}
+
+//Close stops the goroutine that holds the session map.  Any session held
+//in memory is lost and the session manager may not be used after this call;
+//calls to any other method return SESSION_MANAGER_CLOSED.  This is normally
+//only called during server shutdown.  Calling Close more than once does
+//nothing.
+func (self *SimpleSessionManager) Close() error {
+	self.closing.Do(func() {
+		ch := make(chan *sessionReply)
+		self.out <- &sessionPacket{op: _SESSION_OP_STOP, ret: ch}
+		<-ch
+		close(self.stop)
+	})
+	return nil
+}
+
+//send gives the packet to the goroutine that holds the session map and
+//returns its reply, or a reply with the error SESSION_MANAGER_CLOSED if the
+//session manager has been closed.
+func (self *SimpleSessionManager) send(pkt *sessionPacket) *sessionReply {
+	pkt.ret = make(chan *sessionReply, 1)
+	select {
+	case self.out <- pkt:
+	case <-self.stop:
+		return &sessionReply{err: SESSION_MANAGER_CLOSED}
 	}
-	return parts[0], true
+	return <-pkt.ret
 }
 
 //
@@ -0,0 +1,358 @@
+package seven5
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	//COOKIE_SESSION_CHUNK is the most bytes of a session put in one cookie,
+	//browsers allow about 4k for the name, value and attributes.
+	COOKIE_SESSION_CHUNK = 3800
+	//COOKIE_SESSION_MAX_CHUNKS is the most cookies a session can be spread
+	//over.  Assign and Update fail for user data that would need more.
+	COOKIE_SESSION_MAX_CHUNKS = 5
+)
+
+//SessionBinder is implemented by session managers whose sessions must write
+//to the response when they are updated, such as the CookieSessionManager.
+//Bind returns the session to use while responding with w.
+type SessionBinder interface {
+	Bind(s Session, w http.ResponseWriter) Session
+}
+
+//bindSession calls Bind if the session manager is a SessionBinder.
+func bindSession(sm SessionManager, s Session, w http.ResponseWriter) Session {
+	if b, ok := sm.(SessionBinder); ok && s != nil {
+		return b.Bind(s, w)
+	}
+	return s
+}
+
+//CookieSession is the session of a CookieSessionManager.  The session id is
+//the sealed session, including the user data.
+type CookieSession struct {
+	SimpleSession
+	created time.Time
+	expires time.Time
+	w       http.ResponseWriter
+	cm      *CookieSessionMapper
+}
+
+//removeCookie removes the session from the client, if the session is bound
+//to a response.
+func (self *CookieSession) removeCookie() {
+	if self.w != nil {
+		self.cm.RemoveCookie(self.w)
+	}
+}
+
+//CookieSessionManager is a SessionManager that keeps no state on the server:
+//the unique id, expiration time and user data of a session are encoded with a
+//SessionCodec, sealed with the session keys and sent to the client as the
+//session id.  It must be used with its CookieMapper, which spreads the
+//session over several cookies if it is too big for one.  Since the session
+//id changes when the user data does, Update sends the new session to the
+//client in the response; this works for the sessions of PBundles, which are
+//bound to the response (see SessionBinder).  Destroy can't stop a session
+//that a client has kept from working until it expires, so keep the Lifetime
+//short.  Of the SessionConfig, the Store, Idle and SweepEvery are not used.
+//The csrf token of a session changes with its id, so an application that
+//uses a CSRFGuard must give it to SetCSRFGuard.
+type CookieSessionManager struct {
+	generator Generator
+	conf      *SessionConfig
+	keys      *SessionKeyring
+	codec     SessionCodec
+	cm        *CookieSessionMapper
+	events    *sessionEvents
+	csrf      *CSRFGuard
+}
+
+//NewCookieSessionManager returns a session manager for the application
+//named.  If codec is nil, a GobSessionCodec is used.  If conf has no Keys,
+//they are read from the environment as for NewSimpleSessionManager.
+func NewCookieSessionManager(appName string, g Generator, conf *SessionConfig, codec SessionCodec) *CookieSessionManager {
+	c := withSessionDefaults(conf, func() SessionStore { return nil })
+	keys := c.Keys
+	if keys == nil {
+		keys = sessionKeyringFromEnv()
+	}
+	if codec == nil {
+		codec = &GobSessionCodec{}
+	}
+	return &CookieSessionManager{
+		generator: g,
+		conf:      c,
+		keys:      keys,
+		codec:     codec,
+		cm:        NewCookieSessionMapper(appName),
+		events:    newSessionEvents(),
+	}
+}
+
+//CookieMapper returns the cookie mapper that must be used with this session
+//manager.
+func (self *CookieSessionManager) CookieMapper() CookieMapper {
+	return self.cm
+}
+
+//SetCSRFGuard makes Update send the csrf token of the new session to the
+//client along with the session, so the client's next unsafe request is not
+//refused.  A nil guard turns this off.
+func (self *CookieSessionManager) SetCSRFGuard(g *CSRFGuard) {
+	self.csrf = g
+}
+
+//seal returns a session holding the values given.
+func (self *CookieSessionManager) seal(uniq string, ud interface{}, created, expires time.Time) (*CookieSession, error) {
+	data, err := self.codec.Encode(ud)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 3*binary.MaxVarintLen64, 3*binary.MaxVarintLen64+len(uniq)+len(data))
+	n := binary.PutVarint(buf, created.Unix())
+	n += binary.PutVarint(buf[n:], expires.Unix())
+	n += binary.PutUvarint(buf[n:], uint64(len(uniq)))
+	buf = append(append(buf[:n], uniq...), data...)
+	id := base64.RawURLEncoding.EncodeToString(self.keys.seal(buf))
+	if len(id) > COOKIE_SESSION_CHUNK*COOKIE_SESSION_MAX_CHUNKS {
+		return nil, fmt.Errorf("session of %s is too big for cookies (%d bytes)", uniq, len(id))
+	}
+	s := &CookieSession{created: created, expires: expires, cm: self.cm}
+	s.id, s.ud, s.uniq = id, ud, uniq
+	return s, nil
+}
+
+//open returns the session in a session id, with no user data, and the user
+//data still encoded.  It returns nil if the id is not valid.
+func (self *CookieSessionManager) open(id string) (*CookieSession, []byte, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, nil, false
+	}
+	clear, stale, err := self.keys.open(b)
+	if err != nil {
+		return nil, nil, false
+	}
+	created, n := binary.Varint(clear)
+	if n <= 0 {
+		return nil, nil, false
+	}
+	clear = clear[n:]
+	expires, n := binary.Varint(clear)
+	if n <= 0 {
+		return nil, nil, false
+	}
+	clear = clear[n:]
+	size, n := binary.Uvarint(clear)
+	if n <= 0 || uint64(len(clear)-n) < size {
+		return nil, nil, false
+	}
+	clear = clear[n:]
+	s := &CookieSession{created: time.Unix(created, 0), expires: time.Unix(expires, 0), cm: self.cm}
+	s.id, s.uniq = id, string(clear[:size])
+	return s, clear[size:], stale
+}
+
+func (self *CookieSessionManager) emit(t SessionEventType, s *CookieSession) {
+	self.events.emit(&SessionEvent{Type: t, SessionId: s.id, UniqueId: s.uniq, UserData: s.ud,
+		Time: self.conf.Clock.Now()})
+}
+
+//Assign creates a new session for the unique id.  The session is not sent
+//to the client until it is given to the CookieMapper's AssociateCookie.
+func (self *CookieSessionManager) Assign(uniq string, ud interface{}, expires time.Time) (Session, error) {
+	now := self.conf.Clock.Now()
+	if expires.IsZero() {
+		expires = now.Add(self.conf.Lifetime)
+	}
+	if self.conf.Absolute > 0 && expires.After(now.Add(self.conf.Absolute)) {
+		expires = now.Add(self.conf.Absolute)
+	}
+	s, err := self.seal(uniq, ud, now, expires)
+	if err != nil {
+		return nil, err
+	}
+	self.emit(SESSION_CREATED, s)
+	return s, nil
+}
+
+//Find opens the session id.  If the user data can't be decoded, perhaps
+//because the application has changed its type, the unique id is returned so
+//the session can be recovered with the Generator.  A session that is renewed,
+//or was sealed with a retired key, is returned with Renewed set.
+func (self *CookieSessionManager) Find(id string) (*SessionReturn, error) {
+	now := self.conf.Clock.Now()
+	s, data, stale := self.open(id)
+	if s == nil {
+		return nil, nil
+	}
+	if !now.Before(s.expires) || (self.conf.Absolute > 0 && !now.Before(s.created.Add(self.conf.Absolute))) {
+		self.emit(SESSION_EXPIRED, s)
+		return nil, nil
+	}
+	ud, err := self.codec.Decode(data)
+	if err != nil {
+		log.Printf("[SESSION] unable to decode user data of %s: %v", s.uniq, err)
+		return &SessionReturn{UniqueId: s.uniq}, nil
+	}
+	s.ud = ud
+	expires := s.expires
+	if self.conf.RenewWithin > 0 && s.expires.Sub(now) < self.conf.RenewWithin {
+		expires = now.Add(self.conf.Lifetime)
+		if self.conf.Absolute > 0 && expires.After(s.created.Add(self.conf.Absolute)) {
+			expires = s.created.Add(self.conf.Absolute)
+		}
+		if !expires.After(s.expires) {
+			expires = s.expires
+		}
+	}
+	if !stale && expires.Equal(s.expires) {
+		return &SessionReturn{Session: s}, nil
+	}
+	renewed, err := self.seal(s.uniq, ud, s.created, expires)
+	if err != nil {
+		return nil, err
+	}
+	self.events.emit(&SessionEvent{Type: SESSION_RENEWED, SessionId: renewed.id, UniqueId: s.uniq,
+		PreviousId: id, Time: now})
+	return &SessionReturn{Session: renewed, Renewed: true}, nil
+}
+
+//Update returns a session with the new user data.  If the session is bound
+//to a response, the new session, and its csrf token if there is a
+//CSRFGuard, are sent to the client.
+func (self *CookieSessionManager) Update(s Session, ud interface{}) (Session, error) {
+	old, ok := s.(*CookieSession)
+	if !ok {
+		if old, _, _ = self.open(s.SessionId()); old == nil {
+			return nil, fmt.Errorf("not a session of this session manager")
+		}
+	}
+	result, err := self.seal(old.uniq, ud, old.created, old.expires)
+	if err != nil {
+		return nil, err
+	}
+	self.emit(SESSION_UPDATED, result)
+	if old.w != nil {
+		result.w = old.w
+		self.cm.AssociateCookie(result.w, result)
+		if self.csrf != nil {
+			self.csrf.Issue(result.w, nil, result.id)
+		}
+	}
+	return result, nil
+}
+
+//Destroy only sends a SESSION_DESTROYED event, the session must be removed
+//from the client with the CookieMapper's RemoveCookie.  The sessions of
+//PBundles are removed from the client by DestroySession.
+func (self *CookieSessionManager) Destroy(id string) error {
+	if s, _, _ := self.open(id); s != nil {
+		self.emit(SESSION_DESTROYED, s)
+	}
+	return nil
+}
+
+//Generate calls the Generator provided at creation time, if there is one.
+func (self *CookieSessionManager) Generate(uniq string) (interface{}, error) {
+	if self.generator == nil {
+		return nil, nil
+	}
+	return self.generator.Generate(uniq)
+}
+
+//Bind returns a copy of the session that sends itself to the client with w
+//when it is updated or destroyed.
+func (self *CookieSessionManager) Bind(s Session, w http.ResponseWriter) Session {
+	cs, ok := s.(*CookieSession)
+	if !ok {
+		return s
+	}
+	bound := *cs
+	bound.w = w
+	return &bound
+}
+
+//AddSessionListener adds a listener for the events of this session manager.
+func (self *CookieSessionManager) AddSessionListener(l SessionListener) {
+	self.events.add(l)
+}
+
+//NotifySession sends an event to the listeners of this session manager.
+func (self *CookieSessionManager) NotifySession(ev *SessionEvent) {
+	self.events.emit(ev)
+}
+
+//CookieSessionMapper is the CookieMapper of a CookieSessionManager.  The
+//first COOKIE_SESSION_CHUNK bytes of a session id are in the cookie with the
+//name of a SimpleCookieMapper, and the rest are in cookies with that name
+//followed by -1, -2 and so on.
+type CookieSessionMapper struct {
+	SimpleCookieMapper
+}
+
+//NewCookieSessionMapper returns the cookie mapper for the application named.
+//Normally this is created by NewCookieSessionManager.
+func NewCookieSessionMapper(appName string) *CookieSessionMapper {
+	return &CookieSessionMapper{SimpleCookieMapper{cook: fmt.Sprintf(SESSION_COOKIE, appName)}}
+}
+
+//chunkName returns the name of the cookie with chunk i of the session.
+func (self *CookieSessionMapper) chunkName(i int) string {
+	if i == 0 {
+		return self.CookieName()
+	}
+	return fmt.Sprintf("%s-%d", self.CookieName(), i)
+}
+
+//Value joins the chunks of the session id in the request.
+func (self *CookieSessionMapper) Value(r *http.Request) (string, error) {
+	var parts []string
+	for i := 0; i < COOKIE_SESSION_MAX_CHUNKS; i++ {
+		c, err := r.Cookie(self.chunkName(i))
+		if err == http.ErrNoCookie {
+			break
+		}
+		parts = append(parts, strings.TrimSpace(c.Value))
+	}
+	if len(parts) == 0 {
+		return "", NO_SUCH_COOKIE
+	}
+	return strings.Join(parts, ""), nil
+}
+
+//AssociateCookie sends the session to the client in as many cookies as
+//needed, and removes any other chunks the client may have from a bigger
+//session.
+func (self *CookieSessionMapper) AssociateCookie(w http.ResponseWriter, s Session) {
+	id := s.SessionId()
+	i := 0
+	for ; len(id) > 0 || i == 0; i++ {
+		n := len(id)
+		if n > COOKIE_SESSION_CHUNK {
+			n = COOKIE_SESSION_CHUNK
+		}
+		http.SetCookie(w, &http.Cookie{Name: self.chunkName(i), Value: id[:n], Path: "/", HttpOnly: true})
+		id = id[n:]
+	}
+	self.remove(w, i)
+}
+
+//RemoveCookie removes all the chunks of the session from the client.
+func (self *CookieSessionMapper) RemoveCookie(w http.ResponseWriter) {
+	self.remove(w, 0)
+}
+
+//remove removes the chunks from the one given on.
+func (self *CookieSessionMapper) remove(w http.ResponseWriter, from int) {
+	for i := from; i < COOKIE_SESSION_MAX_CHUNKS; i++ {
+		http.SetCookie(w, &http.Cookie{Name: self.chunkName(i), Value: "", Path: "/", MaxAge: -1})
+	}
+}
@@ -0,0 +1,118 @@
+package seven5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//requestWithCookies returns a request carrying the cookies set on rec.
+func requestWithCookies(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/rest/x", nil)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestCookieSessionManager(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	mgr := NewCookieSessionManager("test", nil, &SessionConfig{Clock: clock, Keys: testSessionKeys(),
+		Lifetime: time.Hour, RenewWithin: 10 * time.Minute}, nil)
+
+	s, err := mgr.Assign("fred", "data", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	sr, err := mgr.Find(s.SessionId())
+	if err != nil || sr == nil || sr.Session.UserData() != "data" || SessionUniqueId(sr.Session) != "fred" {
+		t.Fatalf("bad find: %+v %v", sr, err)
+	}
+	tampered := []byte(s.SessionId())
+	tampered[len(tampered)/2] ^= 1
+	if sr, _ := mgr.Find(string(tampered)); sr != nil {
+		t.Errorf("expected tampered session to be refused")
+	}
+	other := NewCookieSessionManager("test", nil, &SessionConfig{Clock: clock, Keys: testSessionKeys()},
+		&JsonSessionCodec{New: func() interface{} { return new(int) }})
+	if sr, _ := other.Find(s.SessionId()); sr == nil || sr.Session != nil || sr.UniqueId != "fred" {
+		t.Errorf("expected recovery of unique id when user data can't be decoded: %+v", sr)
+	}
+
+	clock.Advance(55 * time.Minute)
+	sr, _ = mgr.Find(s.SessionId())
+	if sr == nil || !sr.Renewed || sr.Session.UserData() != "data" {
+		t.Fatalf("expected renewal: %+v", sr)
+	}
+	clock.Advance(10 * time.Minute)
+	if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+		t.Errorf("expected old session to expire: %+v", sr)
+	}
+	if sr, _ := mgr.Find(sr.Session.SessionId()); sr == nil || sr.Session == nil {
+		t.Errorf("expected renewed session to be valid")
+	}
+}
+
+func TestCookieSessionChunks(t *testing.T) {
+	mgr := NewCookieSessionManager("test", nil, &SessionConfig{Keys: testSessionKeys()}, nil)
+	cm := mgr.CookieMapper()
+	random := make([]byte, COOKIE_SESSION_CHUNK)
+	rand.Read(random)
+	big := hex.EncodeToString(random)
+
+	s, err := mgr.Assign("fred", big, time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	cm.AssociateCookie(rec, s)
+	r := requestWithCookies(rec)
+	if n := len(r.Cookies()); n < 3 {
+		t.Fatalf("expected session in several cookies, got %d", n)
+	}
+	for _, c := range r.Cookies() {
+		if len(c.Value) > COOKIE_SESSION_CHUNK {
+			t.Errorf("cookie %s is too big: %d", c.Name, len(c.Value))
+		}
+	}
+	id, err := cm.Value(r)
+	if err != nil || id != s.SessionId() {
+		t.Fatalf("expected chunks to be joined: %v", err)
+	}
+
+	//update through a bundle re-issues the cookies, dropping the extra chunks
+	rec = httptest.NewRecorder()
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	pb, err := io.BundleHook(rec, r, mgr)
+	if err != nil || pb.Session() == nil || pb.Session().UserData() != big {
+		t.Fatalf("bad bundle: %v", err)
+	}
+	if _, err := pb.UpdateSession("small"); err != nil {
+		t.Fatalf("unable to update: %v", err)
+	}
+	r = requestWithCookies(rec)
+	if n := len(r.Cookies()); n != 1 {
+		t.Errorf("expected one cookie after update, got %d", n)
+	}
+	id, _ = cm.Value(r)
+	if sr, _ := mgr.Find(id); sr == nil || sr.Session.UserData() != "small" {
+		t.Errorf("expected updated session in the cookie: %+v", sr)
+	}
+
+	rec = httptest.NewRecorder()
+	pb, _ = io.BundleHook(rec, r, mgr)
+	pb.DestroySession()
+	if r = requestWithCookies(rec); len(r.Cookies()) != 0 {
+		t.Errorf("expected destroy to remove the cookies: %v", r.Cookies())
+	}
+
+	if _, err := mgr.Assign("fred", string(bytes.Repeat([]byte{'x'}, 3*COOKIE_SESSION_CHUNK*COOKIE_SESSION_MAX_CHUNKS)), time.Time{}); err == nil {
+		t.Errorf("expected session that is too big to fail")
+	}
+}
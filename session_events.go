@@ -0,0 +1,153 @@
+package seven5
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+//SessionEventType says what happened to a session.
+type SessionEventType int
+
+const (
+	SESSION_CREATED SessionEventType = iota
+	SESSION_UPDATED
+	SESSION_DESTROYED
+	SESSION_EXPIRED
+	SESSION_RENEWED
+	SESSION_REVOKED
+	SESSION_LOGIN
+	SESSION_LOGOUT
+)
+
+//SESSION_EVENT_QUEUE is the number of events that can wait to be delivered
+//to listeners.  When the queue is full, further events are dropped (and
+//logged) rather than slow down the session manager.
+const SESSION_EVENT_QUEUE = 256
+
+var sessionEventNames = map[SessionEventType]string{
+	SESSION_CREATED:   "created",
+	SESSION_UPDATED:   "updated",
+	SESSION_DESTROYED: "destroyed",
+	SESSION_EXPIRED:   "expired",
+	SESSION_RENEWED:   "renewed",
+	SESSION_REVOKED:   "revoked",
+	SESSION_LOGIN:     "login",
+	SESSION_LOGOUT:    "logout",
+}
+
+func (self SessionEventType) String() string {
+	if n, ok := sessionEventNames[self]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+//SessionEvent is passed to SessionListeners.  SessionId is empty for
+//SESSION_REVOKED, which is about all the sessions of UniqueId.  UniqueId is
+//empty for SESSION_LOGOUT, the SESSION_DESTROYED event that follows has it.
+//UserData is only set for SESSION_CREATED, SESSION_UPDATED and SESSION_LOGIN.
+type SessionEvent struct {
+	Type      SessionEventType
+	SessionId string
+	UniqueId  string
+	//PreviousId is the id a SESSION_RENEWED session had before.
+	PreviousId string
+	UserData   interface{}
+	Time       time.Time
+}
+
+//SessionListener is called with every event of a session manager it has been
+//added to.  Listeners are called one at a time, in the order the events
+//happened, on a goroutine of their own, so a slow listener delays the other
+//listeners but not the session manager.
+type SessionListener func(*SessionEvent)
+
+//SessionNotifier is implemented by session managers that send events to
+//listeners.  NotifySession sends an event that did not come from the session
+//manager, such as SESSION_LOGIN, to the listeners.  SimpleSessionManager and
+//ShardedSessionManager implement this interface.
+type SessionNotifier interface {
+	AddSessionListener(SessionListener)
+	NotifySession(*SessionEvent)
+}
+
+//NotifySession sends the event to the listeners of sm, if it is a
+//SessionNotifier.  If the time of the event is not set, it is set to now.
+func NotifySession(sm interface{}, ev *SessionEvent) {
+	if n, ok := sm.(SessionNotifier); ok {
+		if ev.Time.IsZero() {
+			ev.Time = time.Now()
+		}
+		n.NotifySession(ev)
+	}
+}
+
+//sessionEvents holds the listeners of a session manager and the queue of
+//events waiting to be delivered to them.
+type sessionEvents struct {
+	lock      sync.RWMutex
+	listeners []SessionListener
+	queue     chan *SessionEvent
+}
+
+func newSessionEvents() *sessionEvents {
+	return &sessionEvents{}
+}
+
+//add adds a listener, starting the goroutine that delivers events when the
+//first one is added.
+func (self *sessionEvents) add(l SessionListener) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.queue == nil {
+		self.queue = make(chan *SessionEvent, SESSION_EVENT_QUEUE)
+		go self.deliver(self.queue)
+	}
+	self.listeners = append(self.listeners, l)
+}
+
+//active is true if there are listeners, so callers can avoid work needed
+//only to build events.
+func (self *sessionEvents) active() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.listeners) > 0
+}
+
+//emit queues the event for delivery without waiting.
+func (self *sessionEvents) emit(ev *SessionEvent) {
+	self.lock.RLock()
+	queue := self.queue
+	self.lock.RUnlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- ev:
+	default:
+		log.Printf("[SESSION] event queue is full, dropped %s event for %s", ev.Type, ev.UniqueId)
+	}
+}
+
+func (self *sessionEvents) deliver(queue chan *SessionEvent) {
+	for ev := range queue {
+		self.lock.RLock()
+		listeners := self.listeners
+		self.lock.RUnlock()
+		for _, l := range listeners {
+			self.call(l, ev)
+		}
+	}
+}
+
+//call calls the listener, a panic is logged and does not stop delivery.
+func (self *sessionEvents) call(l SessionListener, ev *SessionEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[SESSION] listener panic on %s event: %v\n%s", ev.Type, r, debug.Stack())
+		}
+	}()
+	l(ev)
+}
@@ -0,0 +1,90 @@
+package seven5
+
+import (
+	"testing"
+	"time"
+)
+
+func nextSessionEvent(t *testing.T, ch chan *SessionEvent) *SessionEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for session event")
+	}
+	return nil
+}
+
+func TestSessionEvents(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	for name, mgr := range sessionManagers(SessionConfig{Clock: clock, Keys: testSessionKeys(),
+		Lifetime: time.Hour, RenewWithin: 10 * time.Minute}) {
+
+		ch := make(chan *SessionEvent, 20)
+		n := mgr.(SessionNotifier)
+		n.AddSessionListener(func(ev *SessionEvent) {
+			panic("listeners that panic don't stop delivery")
+		})
+		n.AddSessionListener(func(ev *SessionEvent) { ch <- ev })
+
+		s, _ := mgr.Assign("fred", "data", time.Time{})
+		s, _ = mgr.Update(s, "new data")
+		clock.Advance(55 * time.Minute)
+		sr, _ := mgr.Find(s.SessionId())
+		if sr == nil || !sr.Renewed {
+			t.Fatalf("%s: expected renewal: %+v", name, sr)
+		}
+		mgr.Destroy(sr.Session.SessionId())
+		other, _ := mgr.Assign("barney", "data", clock.Now().Add(time.Minute))
+		clock.Advance(2 * time.Minute)
+		mgr.Find(other.SessionId())
+		mgr.(SessionRevoker).RevokeAll("fred")
+		NotifySession(mgr, &SessionEvent{Type: SESSION_LOGIN, UniqueId: "wilma"})
+
+		expected := []struct {
+			t    SessionEventType
+			uniq string
+		}{
+			{SESSION_CREATED, "fred"},
+			{SESSION_UPDATED, "fred"},
+			{SESSION_RENEWED, "fred"},
+			{SESSION_DESTROYED, "fred"},
+			{SESSION_CREATED, "barney"},
+			{SESSION_EXPIRED, "barney"},
+			{SESSION_REVOKED, "fred"},
+			{SESSION_LOGIN, "wilma"},
+		}
+		for i, e := range expected {
+			ev := nextSessionEvent(t, ch)
+			if ev.Type != e.t || ev.UniqueId != e.uniq {
+				t.Errorf("%s: event %d: expected %s for %s but got %s for %s", name, i, e.t, e.uniq, ev.Type, ev.UniqueId)
+			}
+			if ev.Type == SESSION_RENEWED && (ev.PreviousId != s.SessionId() || ev.SessionId != sr.Session.SessionId()) {
+				t.Errorf("%s: bad renewal event: %+v", name, ev)
+			}
+			if ev.Type == SESSION_UPDATED && ev.UserData != "new data" {
+				t.Errorf("%s: bad update event: %+v", name, ev)
+			}
+		}
+	}
+}
+
+func TestSessionEventsDoNotBlock(t *testing.T) {
+	mgr := NewShardedSessionManager(nil, &SessionConfig{Keys: testSessionKeys()}, 0)
+	block := make(chan bool)
+	defer close(block)
+	mgr.AddSessionListener(func(ev *SessionEvent) { <-block })
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < SESSION_EVENT_QUEUE*2; i++ {
+			mgr.Assign("fred", "data", time.Time{})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("slow listener blocked the session manager")
+	}
+}
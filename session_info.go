@@ -0,0 +1,278 @@
+package seven5
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	//MAX_USER_AGENT is the longest user agent recorded with a session.
+	MAX_USER_AGENT = 512
+)
+
+//SessionClient describes the client using a session.
+type SessionClient struct {
+	IP        string
+	UserAgent string
+}
+
+//NewSessionClient returns the client of the request.  The IP is the address
+//of the connection, so behind a proxy it is the proxy's address unless the
+//proxy rewrites the request's RemoteAddr.
+func NewSessionClient(r *http.Request) *SessionClient {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	ua := r.UserAgent()
+	if len(ua) > MAX_USER_AGENT {
+		ua = ua[:MAX_USER_AGENT]
+	}
+	return &SessionClient{IP: ip, UserAgent: ua}
+}
+
+//apply records the client in the session and returns true if that changed
+//the session.  A nil client changes nothing.
+func (self *SessionClient) apply(s *StoredSession) bool {
+	if self == nil || (s.IP == self.IP && s.UserAgent == self.UserAgent) {
+		return false
+	}
+	s.IP = self.IP
+	s.UserAgent = self.UserAgent
+	return true
+}
+
+//SessionTracker is implemented by session managers that record the client
+//that uses each session.  SimpleSessionManager and ShardedSessionManager
+//implement this interface.
+type SessionTracker interface {
+	FindFrom(id string, client *SessionClient) (*SessionReturn, error)
+	AssignFrom(uniq string, ud interface{}, expires time.Time, client *SessionClient) (Session, error)
+}
+
+//findSession calls Find, or FindFrom with the client of the request if
+//the session manager is a SessionTracker.
+func findSession(sm SessionManager, id string, r *http.Request) (*SessionReturn, error) {
+	if t, ok := sm.(SessionTracker); ok && r != nil {
+		return t.FindFrom(id, NewSessionClient(r))
+	}
+	return sm.Find(id)
+}
+
+//assignSession calls Assign, or AssignFrom with the client of the request if
+//the session manager is a SessionTracker.
+func assignSession(sm SessionManager, uniq string, ud interface{}, r *http.Request) (Session, error) {
+	if t, ok := sm.(SessionTracker); ok && r != nil {
+		return t.AssignFrom(uniq, ud, time.Time{}, NewSessionClient(r))
+	}
+	return sm.Assign(uniq, ud, time.Time{})
+}
+
+//SessionLister is a session manager that can list the sessions of a user.
+//SimpleSessionManager and ShardedSessionManager implement this interface.
+type SessionLister interface {
+	SessionManager
+	ListSessions(uniqueId string) ([]*StoredSession, error)
+}
+
+//SessionInfo is the wire type of SessionResource and SessionAdminResource.
+//The Id is not the session id, which would allow anyone that sees it to use
+//the session, but a handle derived from it.  Current is true for the session
+//of the request.
+type SessionInfo struct {
+	Id        string
+	UniqueId  string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	IP        string
+	UserAgent string
+	Current   bool
+}
+
+//sessionHandle returns the Id of the SessionInfo for a session.  The unique
+//id is part of the handle so the session can be found without looking at
+//the sessions of every user.
+func sessionHandle(uniq, sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString([]byte(uniq)) + "-" + hex.EncodeToString(sum[:12])
+}
+
+//handleUniqueId returns the unique id in a handle, or "" if it is not a handle.
+func handleUniqueId(handle string) string {
+	i := strings.LastIndex(handle, "-")
+	if i < 0 {
+		return ""
+	}
+	uniq, err := hex.DecodeString(handle[:i])
+	if err != nil {
+		return ""
+	}
+	return string(uniq)
+}
+
+func newSessionInfo(s *StoredSession, pb PBundle) *SessionInfo {
+	current := pb.Session() != nil && pb.Session().SessionId() == s.Id
+	return &SessionInfo{
+		Id:        sessionHandle(s.UniqueId, s.Id),
+		UniqueId:  s.UniqueId,
+		Created:   s.Created,
+		LastSeen:  s.LastAccess,
+		Expires:   s.Expires,
+		IP:        s.IP,
+		UserAgent: s.UserAgent,
+		Current:   current,
+	}
+}
+
+//sessionResource has the parts shared by SessionResource and SessionAdminResource.
+type sessionResource struct {
+	sm SessionLister
+}
+
+func (self *sessionResource) index(uniq string, pb PBundle) (interface{}, error) {
+	sessions, err := self.sm.ListSessions(uniq)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*SessionInfo, len(sessions))
+	for i, s := range sessions {
+		result[i] = newSessionInfo(s, pb)
+	}
+	return result, nil
+}
+
+//lookup returns the session with the handle, it must belong to uniq.
+func (self *sessionResource) lookup(handle string, uniq string) (*StoredSession, error) {
+	if uniq != "" && handleUniqueId(handle) == uniq {
+		sessions, err := self.sm.ListSessions(uniq)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			if sessionHandle(s.UniqueId, s.Id) == handle {
+				return s, nil
+			}
+		}
+	}
+	return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no session %s", handle))
+}
+
+func (self *sessionResource) find(handle string, uniq string, pb PBundle) (interface{}, error) {
+	s, err := self.lookup(handle, uniq)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionInfo(s, pb), nil
+}
+
+func (self *sessionResource) del(handle string, uniq string, pb PBundle) (interface{}, error) {
+	s, err := self.lookup(handle, uniq)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.sm.Destroy(s.Id); err != nil {
+		return nil, err
+	}
+	return newSessionInfo(s, pb), nil
+}
+
+//SessionResource lets a user see where they are logged in and log out any of
+//their sessions.  It implements RestIndex, RestFindUdid and RestDeleteUdid
+//and is typically registered like this:
+//	base.ResourceSeparateUdid("Session", &SessionInfo{}, r, r, nil, nil, r)
+//Only the sessions of the user making the request are visible.
+type SessionResource struct {
+	sessionResource
+}
+
+//NewSessionResource returns a resource for the sessions of the session manager.
+func NewSessionResource(sm SessionLister) *SessionResource {
+	return &SessionResource{sessionResource{sm: sm}}
+}
+
+//currentUser returns the unique id of the user making the request.
+func currentUser(pb PBundle) (string, error) {
+	uniq := SessionUniqueId(pb.Session())
+	if uniq == "" {
+		return "", HTTPError(http.StatusUnauthorized, "not logged in")
+	}
+	return uniq, nil
+}
+
+//Index returns the sessions of the current user.
+func (self *SessionResource) Index(pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	return self.index(uniq, pb)
+}
+
+//Find returns one session of the current user.
+func (self *SessionResource) Find(id string, pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	return self.find(id, uniq, pb)
+}
+
+//Delete logs out one session of the current user.
+func (self *SessionResource) Delete(id string, pb PBundle) (interface{}, error) {
+	uniq, err := currentUser(pb)
+	if err != nil {
+		return nil, err
+	}
+	return self.del(id, uniq, pb)
+}
+
+//SessionAdminResource lets administrators see and log out the sessions of any
+//user.  It implements RestIndex, RestFindUdid and RestDeleteUdid, and is
+//typically registered like this:
+//	base.ResourceSeparateUdid("SessionAdmin", &SessionInfo{}, r, r, nil, nil, r)
+//Index requires the query parameter unique_id.
+type SessionAdminResource struct {
+	sessionResource
+	allow func(PBundle) bool
+}
+
+//NewSessionAdminResource returns a resource that only allows access when
+//allow returns true.  Allow must not be nil.
+func NewSessionAdminResource(sm SessionLister, allow func(PBundle) bool) *SessionAdminResource {
+	return &SessionAdminResource{sessionResource: sessionResource{sm: sm}, allow: allow}
+}
+
+//AllowRead checks the allow function given at creation time.
+func (self *SessionAdminResource) AllowRead(pb PBundle) bool {
+	return self.allow(pb)
+}
+
+//Allow checks the allow function given at creation time.
+func (self *SessionAdminResource) Allow(id string, method string, pb PBundle) bool {
+	return self.allow(pb)
+}
+
+//Index returns the sessions of the user in the unique_id query parameter.
+func (self *SessionAdminResource) Index(pb PBundle) (interface{}, error) {
+	uniq, ok := pb.Query("unique_id")
+	if !ok || uniq == "" {
+		return nil, HTTPError(http.StatusBadRequest, "unique_id is required")
+	}
+	return self.index(uniq, pb)
+}
+
+//Find returns any session.
+func (self *SessionAdminResource) Find(id string, pb PBundle) (interface{}, error) {
+	return self.find(id, handleUniqueId(id), pb)
+}
+
+//Delete logs out any session.
+func (self *SessionAdminResource) Delete(id string, pb PBundle) (interface{}, error) {
+	return self.del(id, handleUniqueId(id), pb)
+}
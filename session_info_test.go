@@ -0,0 +1,98 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getSessionInfos(t *testing.T, url string, cookie *http.Cookie, ua string) []*SessionInfo {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.AddCookie(cookie)
+	req.Header.Set("User-Agent", ua)
+	resp, err := http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	defer resp.Body.Close()
+	var result []*SessionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("unable to decode sessions: %v", err)
+	}
+	return result
+}
+
+func TestSessionResource(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	cm := NewSimpleCookieMapper("test")
+	base := NewBaseDispatcher(sm, cm)
+	r := NewSessionResource(sm)
+	base.ResourceSeparateUdid("Session", &SessionInfo{}, r, r, nil, nil, r)
+	admin := NewSessionAdminResource(sm, func(pb PBundle) bool {
+		return SessionUniqueId(pb.Session()) == "admin"
+	})
+	base.ResourceSeparateUdid("SessionAdmin", &SessionInfo{}, admin, admin, nil, nil, admin)
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", base)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	laptop, _ := sm.Assign("fred", "data", time.Time{})
+	phone, _ := sm.Assign("fred", "data", time.Time{})
+	sm.Assign("barney", "data", time.Time{})
+	laptopCookie := &http.Cookie{Name: cm.CookieName(), Value: laptop.SessionId()}
+
+	infos := getSessionInfos(t, server.URL+"/rest/session", laptopCookie, "laptop browser")
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 sessions for fred, got %d", len(infos))
+	}
+	var current, other *SessionInfo
+	for _, info := range infos {
+		if info.UniqueId != "fred" || info.Id == laptop.SessionId() || info.Id == phone.SessionId() {
+			t.Errorf("bad session info: %+v", info)
+		}
+		if info.Current {
+			current = info
+		} else {
+			other = info
+		}
+	}
+	if current == nil || other == nil {
+		t.Fatalf("expected one current session: %+v", infos)
+	}
+	if current.UserAgent != "laptop browser" || current.IP == "" {
+		t.Errorf("expected client of the request to be recorded: %+v", current)
+	}
+
+	//fred can't see barney's sessions, or anyone's through the admin resource
+	req, _ := http.NewRequest("GET", server.URL+"/rest/sessionadmin?unique_id=barney", nil)
+	req.AddCookie(laptopCookie)
+	resp, err := http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusUnauthorized)
+
+	//log out the phone
+	req, _ = http.NewRequest("DELETE", server.URL+"/rest/session/"+other.Id, nil)
+	req.AddCookie(laptopCookie)
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if sr, _ := sm.Find(phone.SessionId()); sr != nil && sr.Session != nil {
+		t.Errorf("expected phone session to be destroyed")
+	}
+
+	//admin
+	adm, _ := sm.Assign("admin", "data", time.Time{})
+	adminCookie := &http.Cookie{Name: cm.CookieName(), Value: adm.SessionId()}
+	infos = getSessionInfos(t, server.URL+"/rest/sessionadmin?unique_id=barney", adminCookie, "admin browser")
+	if len(infos) != 1 || infos[0].UniqueId != "barney" {
+		t.Fatalf("expected admin to see barney's session: %+v", infos)
+	}
+	req, _ = http.NewRequest("DELETE", server.URL+"/rest/sessionadmin/"+infos[0].Id, nil)
+	req.AddCookie(adminCookie)
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if list, _ := sm.ListSessions("barney"); len(list) != 0 {
+		t.Errorf("expected barney's session to be destroyed: %+v", list)
+	}
+}
@@ -0,0 +1,157 @@
+package seven5
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	//SESSION_TOKEN_V1 is the version byte of session ids sealed with AES-GCM.
+	//The version is followed by the key id, the nonce and the sealed data.
+	SESSION_TOKEN_V1 = 1
+
+	sessionKeyIdSize  = 4
+	sessionHeaderSize = 1 + sessionKeyIdSize
+)
+
+//SessionKeyring holds the keys used to seal and open session ids.  Session
+//ids are always sealed with the primary key, but may be opened with any of
+//the retired keys, so keys can be rotated without logging everyone out:
+//make a new key primary, and move the old primary key to the retired list
+//until the longest session lifetime has passed.  Sessions that were sealed
+//with a retired key are given a new id when they are next used.
+type SessionKeyring struct {
+	primary   cipher.AEAD
+	primaryId uint32
+	keys      map[uint32]cipher.AEAD
+}
+
+//NewSessionKeyring returns a keyring for the primary key and any retired keys.
+//Keys must be 16 or 32 bytes long, for AES-128 or AES-256.
+func NewSessionKeyring(primary []byte, retired ...[]byte) (*SessionKeyring, error) {
+	result := &SessionKeyring{keys: make(map[uint32]cipher.AEAD)}
+	for i, key := range append([][]byte{primary}, retired...) {
+		id, aead, err := newSessionAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := result.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate session key (key %d)", i)
+		}
+		result.keys[id] = aead
+		if i == 0 {
+			result.primary = aead
+			result.primaryId = id
+		}
+	}
+	return result, nil
+}
+
+//newSessionAEAD returns the id and GCM cipher of a key.  The id is derived
+//from the key so a token names the key that sealed it without revealing it.
+func newSessionAEAD(key []byte) (uint32, cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return 0, nil, fmt.Errorf("session key must be 16 or 32 bytes, but was %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return 0, nil, err
+	}
+	sum := sha256.Sum256(append([]byte("seven5 session key id:"), key...))
+	return binary.BigEndian.Uint32(sum[:sessionKeyIdSize]), aead, nil
+}
+
+//SessionKeyringFromEnv returns a keyring with the hex encoded primary key in
+//SERVER_SESSION_KEY and the comma separated, hex encoded, retired keys in
+//SERVER_SESSION_RETIRED_KEYS.  It returns an error if SERVER_SESSION_KEY is
+//not set or a key is not valid.
+func SessionKeyringFromEnv() (*SessionKeyring, error) {
+	raw := strings.TrimSpace(os.Getenv("SERVER_SESSION_KEY"))
+	if raw == "" {
+		return nil, fmt.Errorf("unable to find environment variable SERVER_SESSION_KEY")
+	}
+	primary, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode SERVER_SESSION_KEY, maybe it's not in hex? %v", err)
+	}
+	var retired [][]byte
+	for _, r := range strings.Split(os.Getenv("SERVER_SESSION_RETIRED_KEYS"), ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		key, err := hex.DecodeString(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode SERVER_SESSION_RETIRED_KEYS, maybe it's not in hex? %v", err)
+		}
+		retired = append(retired, key)
+	}
+	return NewSessionKeyring(primary, retired...)
+}
+
+//Seal encrypts and authenticates the cleartext with the primary key and
+//returns the hex encoded token.
+func (self *SessionKeyring) Seal(cleartext string) string {
+	return hex.EncodeToString(self.seal([]byte(cleartext)))
+}
+
+//seal is Seal without the hex encoding.
+func (self *SessionKeyring) seal(cleartext []byte) []byte {
+	header := make([]byte, sessionHeaderSize, sessionHeaderSize+self.primary.NonceSize())
+	header[0] = SESSION_TOKEN_V1
+	binary.BigEndian.PutUint32(header[1:], self.primaryId)
+	nonce := make([]byte, self.primary.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Panicf("failed to read the random stream: %v", err)
+	}
+	out := append(header, nonce...)
+	return self.primary.Seal(out, nonce, cleartext, header)
+}
+
+//Open returns the cleartext of a token from Seal.  The bool is true if
+//the token was sealed with a retired key and should be replaced.  An error
+//is returned if the token is not valid under any of the keys, including if
+//it has been tampered with.
+func (self *SessionKeyring) Open(token string) (string, bool, error) {
+	b, err := hex.DecodeString(token)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to decode the hex bytes of session id: %v", err)
+	}
+	clear, stale, err := self.open(b)
+	return string(clear), stale, err
+}
+
+//open is Open without the hex decoding.
+func (self *SessionKeyring) open(b []byte) ([]byte, bool, error) {
+	if len(b) < sessionHeaderSize || b[0] != SESSION_TOKEN_V1 {
+		return nil, false, fmt.Errorf("unknown session id version")
+	}
+	id := binary.BigEndian.Uint32(b[1:sessionHeaderSize])
+	aead, ok := self.keys[id]
+	if !ok {
+		return nil, false, fmt.Errorf("session id sealed with an unknown key")
+	}
+	rest := b[sessionHeaderSize:]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, false, fmt.Errorf("session id is too short")
+	}
+	nonce := rest[:aead.NonceSize()]
+	clear, err := aead.Open(nil, nonce, rest[aead.NonceSize():], b[:sessionHeaderSize])
+	if err != nil {
+		return nil, false, fmt.Errorf("session id failed authentication: %v", err)
+	}
+	return clear, id != self.primaryId, nil
+}
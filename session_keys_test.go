@@ -0,0 +1,76 @@
+package seven5
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestSessionKeyringTamper(t *testing.T) {
+	keys, err := NewSessionKeyring(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatalf("unable to create keyring: %v", err)
+	}
+	token := keys.Seal("s5:fred,12345")
+	clear, stale, err := keys.Open(token)
+	if err != nil || clear != "s5:fred,12345" || stale {
+		t.Fatalf("failed to open token: %s %v %v", clear, stale, err)
+	}
+	b, _ := hex.DecodeString(token)
+	for i := range b {
+		flipped := append([]byte{}, b...)
+		flipped[i] ^= 1
+		if _, _, err := keys.Open(hex.EncodeToString(flipped)); err == nil {
+			t.Errorf("expected flipped byte %d to be rejected", i)
+		}
+	}
+	if _, err := NewSessionKeyring([]byte("short")); err == nil {
+		t.Errorf("expected short key to be rejected")
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	oldKeys, _ := NewSessionKeyring(oldKey)
+	newKeys, err := NewSessionKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("unable to create keyring: %v", err)
+	}
+	store := NewMemorySessionStore()
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	before := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Store: store, Clock: clock, Keys: oldKeys})
+	s, err := before.Assign("fred", "data", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	before.Close()
+
+	after := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Store: store, Clock: clock, Keys: newKeys})
+	defer after.Close()
+	sr, err := after.Find(s.SessionId())
+	if err != nil || sr == nil || sr.Session == nil {
+		t.Fatalf("expected to find session sealed with retired key: %+v %v", sr, err)
+	}
+	if !sr.Renewed || sr.Session.SessionId() == s.SessionId() {
+		t.Fatalf("expected session to be re-issued under the primary key")
+	}
+	if _, stale, err := newKeys.Open(sr.Session.SessionId()); err != nil || stale {
+		t.Errorf("expected new id to be sealed with the primary key: %v %v", stale, err)
+	}
+	if SessionUniqueId(sr.Session) != "fred" || sr.Session.UserData() != "data" {
+		t.Errorf("bad re-issued session: %+v", sr.Session)
+	}
+	again, _ := after.Find(sr.Session.SessionId())
+	if again == nil || again.Session == nil || again.Renewed {
+		t.Errorf("expected re-issued session to be current: %+v", again)
+	}
+
+	//without the old key, the old id is useless
+	strict, _ := NewSessionKeyring(newKey)
+	if decryptSessionId(s.SessionId(), strict, clock.Now()) != nil {
+		t.Errorf("expected id sealed with unknown key to be rejected")
+	}
+}
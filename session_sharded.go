@@ -0,0 +1,218 @@
+package seven5
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SESSION_SHARDS = 32
+)
+
+//shardOf returns the shard, out of n, for the key.
+func shardOf(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+//ShardedSessionManager is a SessionManager with the same behavior as the
+//SimpleSessionManager, but without a single goroutine that every request
+//must wait on.  Operations on the same session id are serialized by one of
+//a number of mutexes, chosen by the id, so operations on different sessions
+//rarely wait for each other.  By default, it keeps sessions in a
+//ShardedMemorySessionStore with the same number of shards.
+type ShardedSessionManager struct {
+	generator Generator
+	core      *sessionCore
+	locks     []sync.Mutex
+	stop      chan bool
+	closing   sync.Once
+}
+
+//NewShardedSessionManager returns a session manager with the given number of
+//shards, or DEFAULT_SESSION_SHARDS if shards is not positive.  The keys, store
+//and expiration of sessions are controlled by conf as for
+//NewSimpleSessionManagerWithConfig.
+func NewShardedSessionManager(g Generator, conf *SessionConfig, shards int) *ShardedSessionManager {
+	if shards <= 0 {
+		shards = DEFAULT_SESSION_SHARDS
+	}
+	keys := conf.Keys
+	if keys == nil {
+		keys = sessionKeyringFromEnv()
+	}
+	c := withSessionDefaults(conf, func() SessionStore { return NewShardedMemorySessionStore(shards) })
+	result := &ShardedSessionManager{
+		generator: g,
+		core:      newSessionCore(keys, c),
+		locks:     make([]sync.Mutex, shards),
+		stop:      make(chan bool),
+	}
+	if c.SweepEvery > 0 {
+		go result.core.sweep(result.stop)
+	}
+	return result
+}
+
+//lock locks the shard of the session id and returns it.
+func (self *ShardedSessionManager) lock(id string) *sync.Mutex {
+	l := &self.locks[shardOf(id, len(self.locks))]
+	l.Lock()
+	return l
+}
+
+//Assign creates a new session, see SimpleSessionManager.Assign.
+func (self *ShardedSessionManager) Assign(uniqueInfo string, userData interface{}, expires time.Time) (Session, error) {
+	return self.AssignFrom(uniqueInfo, userData, expires, nil)
+}
+
+//AssignFrom is Assign for a session used by the client given, which may be nil.
+func (self *ShardedSessionManager) AssignFrom(uniqueInfo string, userData interface{}, expires time.Time,
+	client *SessionClient) (Session, error) {
+	sr, err := self.core.create(uniqueInfo, userData, expires, client)
+	if err != nil || sr == nil {
+		return nil, err
+	}
+	return sr.Session, nil
+}
+
+//Find looks up a session, see SimpleSessionManager.Find.
+func (self *ShardedSessionManager) Find(id string) (*SessionReturn, error) {
+	return self.FindFrom(id, nil)
+}
+
+//FindFrom is Find for a request from the client given, which may be nil.
+func (self *ShardedSessionManager) FindFrom(id string, client *SessionClient) (*SessionReturn, error) {
+	if id == "" {
+		log.Printf("[SESSION] likely programming error, called find with id=\"\"")
+		return nil, nil
+	}
+	defer self.lock(id).Unlock()
+	return self.core.find(id, client)
+}
+
+//ListSessions returns the sessions of the unique id that have not expired.
+func (self *ShardedSessionManager) ListSessions(uniqueId string) ([]*StoredSession, error) {
+	return self.core.list(uniqueId)
+}
+
+//Update changes the user data of a session, see SimpleSessionManager.Update.
+func (self *ShardedSessionManager) Update(session Session, i interface{}) (Session, error) {
+	defer self.lock(session.SessionId()).Unlock()
+	sr, err := self.core.update(session.SessionId(), i)
+	if err != nil || sr == nil {
+		return nil, err
+	}
+	return sr.Session, nil
+}
+
+//Destroy removes a session, see SimpleSessionManager.Destroy.
+func (self *ShardedSessionManager) Destroy(id string) error {
+	defer self.lock(id).Unlock()
+	return self.core.destroy(id)
+}
+
+//RevokeAll destroys every session of the unique id, see
+//SimpleSessionManager.RevokeAll.
+func (self *ShardedSessionManager) RevokeAll(uniqueId string) error {
+	return self.core.revoke(uniqueId)
+}
+
+//AddSessionListener adds a listener for the events of this session manager.
+func (self *ShardedSessionManager) AddSessionListener(l SessionListener) {
+	self.core.events.add(l)
+}
+
+//NotifySession sends an event to the listeners of this session manager.
+func (self *ShardedSessionManager) NotifySession(ev *SessionEvent) {
+	self.core.events.emit(ev)
+}
+
+//Generate calls the Generator, if there is one.
+func (self *ShardedSessionManager) Generate(uniq string) (interface{}, error) {
+	if self.generator == nil {
+		return nil, nil
+	}
+	return self.generator.Generate(uniq)
+}
+
+//Close stops sweeping the store.  Unlike SimpleSessionManager, the session
+//manager may still be used after this call.  Calling Close more than once
+//does nothing.
+func (self *ShardedSessionManager) Close() error {
+	self.closing.Do(func() {
+		close(self.stop)
+	})
+	return nil
+}
+
+//ShardedMemorySessionStore is a MemorySessionStore split into shards by
+//session id, so that sessions in different shards do not contend for the
+//same lock.
+type ShardedMemorySessionStore struct {
+	shards []*MemorySessionStore
+}
+
+//NewShardedMemorySessionStore returns an empty store with n shards.
+func NewShardedMemorySessionStore(n int) *ShardedMemorySessionStore {
+	result := &ShardedMemorySessionStore{shards: make([]*MemorySessionStore, n)}
+	for i := range result.shards {
+		result.shards[i] = NewMemorySessionStore()
+	}
+	return result
+}
+
+func (self *ShardedMemorySessionStore) shard(key string) *MemorySessionStore {
+	return self.shards[shardOf(key, len(self.shards))]
+}
+
+//Load returns the session from its shard.
+func (self *ShardedMemorySessionStore) Load(id string) (*StoredSession, error) {
+	return self.shard(id).Load(id)
+}
+
+//Save puts the session in its shard.
+func (self *ShardedMemorySessionStore) Save(s *StoredSession) error {
+	return self.shard(s.Id).Save(s)
+}
+
+//Delete removes the session from its shard.
+func (self *ShardedMemorySessionStore) Delete(id string) error {
+	return self.shard(id).Delete(id)
+}
+
+//Sweep sweeps each shard in turn.
+func (self *ShardedMemorySessionStore) Sweep(now time.Time, idle time.Duration) ([]*StoredSession, error) {
+	var result []*StoredSession
+	for _, s := range self.shards {
+		swept, _ := s.Sweep(now, idle)
+		result = append(result, swept...)
+	}
+	return result, nil
+}
+
+//Revoke revokes the unique id in every shard.
+func (self *ShardedMemorySessionStore) Revoke(uniqueId string, before time.Time) error {
+	for _, s := range self.shards {
+		s.Revoke(uniqueId, before)
+	}
+	return nil
+}
+
+//List collects the sessions of the unique id from every shard.
+func (self *ShardedMemorySessionStore) List(uniqueId string) ([]*StoredSession, error) {
+	var result []*StoredSession
+	for _, s := range self.shards {
+		found, _ := s.List(uniqueId)
+		result = append(result, found...)
+	}
+	return result, nil
+}
+
+//RevokedBefore returns the time the unique id was last revoked.
+func (self *ShardedMemorySessionStore) RevokedBefore(uniqueId string) (time.Time, error) {
+	return self.shard(uniqueId).RevokedBefore(uniqueId)
+}
@@ -0,0 +1,152 @@
+package seven5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+//sessionManagers returns a SimpleSessionManager and a ShardedSessionManager
+//that share nothing but their configuration.
+func sessionManagers(conf SessionConfig) map[string]SessionManager {
+	simple := conf
+	simple.Store = NewMemorySessionStore()
+	sharded := conf
+	sharded.Store = NewShardedMemorySessionStore(8)
+	return map[string]SessionManager{
+		"simple":  NewSimpleSessionManagerWithConfig(&testGen{}, &simple),
+		"sharded": NewShardedSessionManager(&testGen{}, &sharded, 8),
+	}
+}
+
+func testSessionKeys() *SessionKeyring {
+	keys, _ := NewSessionKeyring(bytes.Repeat([]byte{3}, 16))
+	return keys
+}
+
+func TestShardedSessionSemantics(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	for name, mgr := range sessionManagers(SessionConfig{Clock: clock, Keys: testSessionKeys()}) {
+		s, err := mgr.Assign("fred", "data", time.Time{})
+		if err != nil || s == nil {
+			t.Fatalf("%s: unable to assign: %v", name, err)
+		}
+		sr, err := mgr.Find(s.SessionId())
+		if err != nil || sr == nil || sr.Session.UserData() != "data" || SessionUniqueId(sr.Session) != "fred" {
+			t.Errorf("%s: bad find: %+v %v", name, sr, err)
+		}
+		if u, err := mgr.Update(s, "new data"); err != nil || u.UserData() != "new data" {
+			t.Errorf("%s: bad update: %+v %v", name, u, err)
+		}
+		if err := mgr.Destroy(s.SessionId()); err != nil {
+			t.Errorf("%s: unable to destroy: %v", name, err)
+		}
+		//recovery from the id
+		sr, err = mgr.Find(s.SessionId())
+		if err != nil || sr == nil || sr.Session != nil || sr.UniqueId != "fred" {
+			t.Errorf("%s: expected to recover unique id: %+v %v", name, sr, err)
+		}
+		ud, err := mgr.Generate(sr.UniqueId)
+		if err != nil || ud != "fred" {
+			t.Errorf("%s: bad generate: %v %v", name, ud, err)
+		}
+		if sr, _ := mgr.Find("bogus"); sr != nil {
+			t.Errorf("%s: unexpected find of bogus: %+v", name, sr)
+		}
+		clock.Advance(time.Second)
+		if err := mgr.(SessionRevoker).RevokeAll("fred"); err != nil {
+			t.Errorf("%s: unable to revoke: %v", name, err)
+		}
+		if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+			t.Errorf("%s: expected revoked id to be useless: %+v", name, sr)
+		}
+	}
+}
+
+func TestSessionManagersCloseTwice(t *testing.T) {
+	for name, mgr := range sessionManagers(SessionConfig{Keys: testSessionKeys(), SweepEvery: time.Hour}) {
+		closer := mgr.(io.Closer)
+		if err := closer.Close(); err != nil {
+			t.Errorf("%s: unable to close: %v", name, err)
+		}
+		if err := closer.Close(); err != nil {
+			t.Errorf("%s: expected a second close to do nothing: %v", name, err)
+		}
+	}
+}
+
+//run with -race to check the session managers for data races.
+func TestSessionManagersConcurrent(t *testing.T) {
+	conf := SessionConfig{Keys: testSessionKeys(), Idle: time.Hour, RenewWithin: 23 * time.Hour}
+	for name, mgr := range sessionManagers(conf) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					uniq := fmt.Sprintf("user%d", g)
+					s, err := mgr.Assign(uniq, i, time.Time{})
+					if err != nil {
+						errs <- err
+						return
+					}
+					sr, err := mgr.Find(s.SessionId())
+					if err != nil || sr == nil || sr.Session == nil {
+						errs <- fmt.Errorf("lost session %s: %+v %v", uniq, sr, err)
+						return
+					}
+					if _, err := mgr.Update(sr.Session, i+1); err != nil {
+						errs <- err
+						return
+					}
+					if i%10 == 0 {
+						mgr.(SessionRevoker).RevokeAll(uniq)
+					} else {
+						mgr.Destroy(sr.Session.SessionId())
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func benchmarkSessionFind(b *testing.B, mgr SessionManager) {
+	ids := make([]string, 1000)
+	for i := range ids {
+		s, err := mgr.Assign(fmt.Sprintf("user%d", i), i, time.Time{})
+		if err != nil {
+			b.Fatalf("unable to assign: %v", err)
+		}
+		ids[i] = s.SessionId()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if sr, _ := mgr.Find(ids[i%len(ids)]); sr == nil {
+				b.Fatalf("lost session")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkSimpleSessionFind(b *testing.B) {
+	mgr := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Keys: testSessionKeys()})
+	defer mgr.Close()
+	benchmarkSessionFind(b, mgr)
+}
+
+func BenchmarkShardedSessionFind(b *testing.B) {
+	benchmarkSessionFind(b, NewShardedSessionManager(nil, &SessionConfig{Keys: testSessionKeys()}, 0))
+}
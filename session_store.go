@@ -0,0 +1,472 @@
+package seven5
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//StoredSession is the information a SessionStore keeps about a session.
+type StoredSession struct {
+	Id       string
+	UniqueId string
+	UserData interface{}
+	Expires  time.Time
+	//Created is when the session was first assigned.
+	Created time.Time
+	//LastAccess is when the session was last found, see SessionConfig.Idle.
+	LastAccess time.Time
+	//IP and UserAgent are of the client that last used the session, if
+	//known (see SessionClient).
+	IP        string
+	UserAgent string
+}
+
+//SessionStore is where the SimpleSessionManager keeps its sessions.  Stores
+//other than the MemorySessionStore allow sessions, and their user data, to
+//survive a restart and to be shared by several instances of a server.
+//Implementations must be safe for use from multiple goroutines.
+type SessionStore interface {
+	//Load returns the session with the given id, or nil if there is none.
+	Load(id string) (*StoredSession, error)
+	//Save creates or replaces the session with the id of the one given.
+	Save(*StoredSession) error
+	//Delete removes the session with the given id, if there is one.
+	Delete(id string) error
+	//Sweep removes the sessions that expired before now, or, if idle is
+	//not zero, were last accessed more than idle before now.  It returns
+	//the sessions removed; their user data may be nil.
+	Sweep(now time.Time, idle time.Duration) ([]*StoredSession, error)
+	//Revoke removes every session of the unique id and records that any
+	//session of the unique id created before the time given is not valid.
+	Revoke(uniqueId string, before time.Time) error
+	//RevokedBefore returns the latest time given to Revoke for the unique
+	//id, or the zero time if it has never been revoked.
+	RevokedBefore(uniqueId string) (time.Time, error)
+	//List returns the sessions of the unique id, including any that have
+	//expired but not been removed.  Their user data may be nil.
+	List(uniqueId string) ([]*StoredSession, error)
+}
+
+//sessionExpired returns true if Sweep should remove the session.
+func sessionExpired(expires, lastAccess, now time.Time, idle time.Duration) bool {
+	if !expires.IsZero() && !now.Before(expires) {
+		return true
+	}
+	return idle > 0 && !lastAccess.IsZero() && now.Sub(lastAccess) >= idle
+}
+
+//SessionCodec converts user data to and from bytes for the stores that
+//keep sessions outside of memory.
+type SessionCodec interface {
+	Encode(userData interface{}) ([]byte, error)
+	Decode([]byte) (interface{}, error)
+}
+
+//GobSessionCodec encodes user data with encoding/gob.  The concrete type
+//of the user data must be registered with gob.Register.
+type GobSessionCodec struct {
+}
+
+type gobUserData struct {
+	UserData interface{}
+}
+
+//Encode encodes the user data with gob.
+func (self *GobSessionCodec) Encode(ud interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&gobUserData{ud}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Decode decodes user data encoded with Encode.
+func (self *GobSessionCodec) Decode(b []byte) (interface{}, error) {
+	var result gobUserData
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.UserData, nil
+}
+
+//JsonSessionCodec encodes user data as json.  Since json does not record
+//the type, New must return a pointer to a new, empty value of the type of
+//user data the application uses.
+type JsonSessionCodec struct {
+	New func() interface{}
+}
+
+//Encode encodes the user data as json.
+func (self *JsonSessionCodec) Encode(ud interface{}) ([]byte, error) {
+	return json.Marshal(ud)
+}
+
+//Decode decodes the user data into a new value from New.
+func (self *JsonSessionCodec) Decode(b []byte) (interface{}, error) {
+	result := self.New()
+	if err := json.Unmarshal(b, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//MemorySessionStore keeps sessions in a map.  This is the store used by
+//NewSimpleSessionManager; sessions are lost when the program exits.  So are
+//revocations: after a restart, a session id issued before a RevokeAll can
+//be used with Find again until it expires.  Use a FileSessionStore or a
+//QbsSessionStore if revocations must survive a restart.
+type MemorySessionStore struct {
+	sessions map[string]*StoredSession
+	revoked  map[string]time.Time
+	lock     sync.RWMutex
+}
+
+//NewMemorySessionStore returns an empty memory store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*StoredSession),
+		revoked:  make(map[string]time.Time),
+	}
+}
+
+//Load returns the session from the map.
+func (self *MemorySessionStore) Load(id string) (*StoredSession, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	s, ok := self.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	copy := *s
+	return &copy, nil
+}
+
+//Save puts the session in the map.
+func (self *MemorySessionStore) Save(s *StoredSession) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	copy := *s
+	self.sessions[s.Id] = &copy
+	return nil
+}
+
+//Delete removes the session from the map.
+func (self *MemorySessionStore) Delete(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.sessions, id)
+	return nil
+}
+
+//Sweep removes expired sessions from the map.
+func (self *MemorySessionStore) Sweep(now time.Time, idle time.Duration) ([]*StoredSession, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var result []*StoredSession
+	for id, s := range self.sessions {
+		if sessionExpired(s.Expires, s.LastAccess, now, idle) {
+			delete(self.sessions, id)
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+//Revoke removes the sessions of the unique id from the map.
+func (self *MemorySessionStore) Revoke(uniqueId string, before time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for id, s := range self.sessions {
+		if s.UniqueId == uniqueId {
+			delete(self.sessions, id)
+		}
+	}
+	if before.After(self.revoked[uniqueId]) {
+		self.revoked[uniqueId] = before
+	}
+	return nil
+}
+
+//List returns copies of the sessions of the unique id in the map.
+func (self *MemorySessionStore) List(uniqueId string) ([]*StoredSession, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var result []*StoredSession
+	for _, s := range self.sessions {
+		if s.UniqueId == uniqueId {
+			copy := *s
+			result = append(result, &copy)
+		}
+	}
+	return result, nil
+}
+
+//RevokedBefore returns the time the unique id was last revoked.
+func (self *MemorySessionStore) RevokedBefore(uniqueId string) (time.Time, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.revoked[uniqueId], nil
+}
+
+//FileSessionStore keeps each session in its own file in a directory.  This
+//is suitable for a single server that must keep its sessions across a
+//restart, or several servers that share a file system.  Revocations are kept
+//in the revoked subdirectory.
+type FileSessionStore struct {
+	dir   string
+	codec SessionCodec
+}
+
+type fileSession struct {
+	Id         string
+	UniqueId   string
+	UserData   []byte
+	Expires    time.Time
+	Created    time.Time
+	LastAccess time.Time
+	IP         string
+	UserAgent  string
+}
+
+//stored returns the session in the file, without its user data.
+func (self *fileSession) stored() *StoredSession {
+	return &StoredSession{Id: self.Id, UniqueId: self.UniqueId, Expires: self.Expires,
+		Created: self.Created, LastAccess: self.LastAccess, IP: self.IP, UserAgent: self.UserAgent}
+}
+
+//NewFileSessionStore returns a store that keeps sessions in dir, which is
+//created if needed.  If codec is nil, a GobSessionCodec is used.
+func NewFileSessionStore(dir string, codec SessionCodec) (*FileSessionStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, revokedDir), 0700); err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		codec = &GobSessionCodec{}
+	}
+	return &FileSessionStore{dir: dir, codec: codec}, nil
+}
+
+const revokedDir = "revoked"
+
+//path returns the file for a session id.  The id is hashed because it comes
+//from the client.
+func (self *FileSessionStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(self.dir, hex.EncodeToString(sum[:]))
+}
+
+//Load reads the session's file.
+func (self *FileSessionStore) Load(id string) (*StoredSession, error) {
+	b, err := ioutil.ReadFile(self.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fs fileSession
+	if err := json.Unmarshal(b, &fs); err != nil {
+		return nil, err
+	}
+	if fs.Id != id {
+		return nil, nil
+	}
+	ud, err := self.codec.Decode(fs.UserData)
+	if err != nil {
+		return nil, err
+	}
+	result := fs.stored()
+	result.UserData = ud
+	return result, nil
+}
+
+//Save writes the session's file.  The file is replaced atomically so a
+//concurrent Load sees either the old or the new session.
+func (self *FileSessionStore) Save(s *StoredSession) error {
+	ud, err := self.codec.Encode(s.UserData)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&fileSession{Id: s.Id, UniqueId: s.UniqueId, UserData: ud, Expires: s.Expires,
+		Created: s.Created, LastAccess: s.LastAccess, IP: s.IP, UserAgent: s.UserAgent})
+	if err != nil {
+		return err
+	}
+	return self.writeFile(self.path(s.Id), b)
+}
+
+//writeFile replaces the file at path with b atomically.
+func (self *FileSessionStore) writeFile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(self.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//Delete removes the session's file.
+func (self *FileSessionStore) Delete(id string) error {
+	err := os.Remove(self.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Sweep removes the files of expired sessions.  The user data is not decoded.
+func (self *FileSessionStore) Sweep(now time.Time, idle time.Duration) ([]*StoredSession, error) {
+	return self.remove(func(fs *fileSession) bool {
+		return sessionExpired(fs.Expires, fs.LastAccess, now, idle)
+	})
+}
+
+//remove deletes the files of the sessions for which fn returns true and
+//returns the sessions deleted, without their user data.
+func (self *FileSessionStore) remove(fn func(*fileSession) bool) ([]*StoredSession, error) {
+	return self.scan(fn, true)
+}
+
+//scan reads every session file and returns the sessions, without their
+//user data, for which fn returns true.  If del is true, their files are
+//deleted (see removeIf).  A file that can't be read or understood is logged
+//and skipped, so one bad file doesn't stop the sweep of the others.
+func (self *FileSessionStore) scan(fn func(*fileSession) bool, del bool) ([]*StoredSession, error) {
+	infos, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []*StoredSession
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(self.dir, info.Name())
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[SESSION] skipping unreadable session file %s: %v", path, err)
+			continue
+		}
+		var fs fileSession
+		if err := json.Unmarshal(b, &fs); err != nil {
+			log.Printf("[SESSION] skipping bad session file %s: %v", path, err)
+			continue
+		}
+		if !fn(&fs) {
+			continue
+		}
+		if del {
+			removed, err := self.removeIf(path, fn)
+			if err != nil {
+				return result, err
+			}
+			if removed == nil {
+				continue
+			}
+			fs = *removed
+		}
+		result = append(result, fs.stored())
+	}
+	return result, nil
+}
+
+//removeIf deletes the session file at path if fn is still true of it and
+//returns the session deleted, or nil if the file was kept.  The file may
+//have been replaced by a Save since it was read, so it is first renamed to
+//a tombstone, which takes whatever file is there atomically, and checked
+//again.  A file that no longer matches is put back, unless yet another
+//Save has replaced it in the meantime.
+func (self *FileSessionStore) removeIf(path string, fn func(*fileSession) bool) (*fileSession, error) {
+	tomb := filepath.Join(self.dir, ".del"+filepath.Base(path))
+	if err := os.Rename(path, tomb); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var fs fileSession
+	b, err := ioutil.ReadFile(tomb)
+	if err == nil {
+		err = json.Unmarshal(b, &fs)
+	}
+	if err == nil && fn(&fs) {
+		return &fs, os.Remove(tomb)
+	}
+	//a link, unlike a rename, does not replace a newer file
+	if err := os.Link(tomb, path); err != nil && !os.IsExist(err) {
+		return nil, os.Rename(tomb, path)
+	}
+	return nil, os.Remove(tomb)
+}
+
+//List reads every session file to find the sessions of the unique id.  The
+//user data is not decoded.
+func (self *FileSessionStore) List(uniqueId string) ([]*StoredSession, error) {
+	return self.scan(func(fs *fileSession) bool {
+		return fs.UniqueId == uniqueId
+	}, false)
+}
+
+//revokedPath returns the file that records the revocation of a unique id.
+func (self *FileSessionStore) revokedPath(uniqueId string) string {
+	sum := sha256.Sum256([]byte(uniqueId))
+	return filepath.Join(self.dir, revokedDir, hex.EncodeToString(sum[:]))
+}
+
+//Revoke records the revocation and removes the files of the sessions of the
+//unique id.  The revocation is recorded first, so a session that is saved
+//while the files are being removed is still rejected.
+func (self *FileSessionStore) Revoke(uniqueId string, before time.Time) error {
+	prev, err := self.RevokedBefore(uniqueId)
+	if err != nil {
+		return err
+	}
+	if before.After(prev) {
+		b, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		if err := self.writeFile(self.revokedPath(uniqueId), b); err != nil {
+			return err
+		}
+	}
+	_, err = self.remove(func(fs *fileSession) bool {
+		return fs.UniqueId == uniqueId
+	})
+	return err
+}
+
+//RevokedBefore reads the revocation of the unique id, if there is one.
+func (self *FileSessionStore) RevokedBefore(uniqueId string) (time.Time, error) {
+	var result time.Time
+	b, err := ioutil.ReadFile(self.revokedPath(uniqueId))
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(b, &result)
+	return result, err
+}
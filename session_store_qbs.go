@@ -0,0 +1,290 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	SESSION_TABLE            = "session_record"
+	SESSION_REVOCATION_TABLE = "session_revocation"
+)
+
+//SessionRecord is the row type used by QbsSessionStore.
+type SessionRecord struct {
+	Id         int64
+	SessionId  string
+	UniqueId   string
+	UserData   []byte
+	Expires    time.Time
+	Created    time.Time
+	LastAccess time.Time
+	Ip         string
+	UserAgent  string
+}
+
+//stored returns the session in the row, without its user data.
+func (self *SessionRecord) stored() *StoredSession {
+	return &StoredSession{Id: self.SessionId, UniqueId: self.UniqueId, Expires: self.Expires,
+		Created: self.Created, LastAccess: self.LastAccess, IP: self.Ip, UserAgent: self.UserAgent}
+}
+
+//SessionRevocation is the row type used by QbsSessionStore to record the
+//revocation of the sessions of a unique id.
+type SessionRevocation struct {
+	Id            int64
+	UniqueId      string
+	RevokedBefore time.Time
+}
+
+//QbsSessionStore keeps sessions in the session_record table, so they can be
+//shared by every server that uses the database.  The table can be created
+//with SessionMigrationUp, which also creates the session_revocation table.
+type QbsSessionStore struct {
+	store *QbsStore
+	codec SessionCodec
+}
+
+//NewQbsSessionStore returns a session store that uses the database of the
+//QbsStore given.  If codec is nil, a GobSessionCodec is used.
+func NewQbsSessionStore(s *QbsStore, codec SessionCodec) *QbsSessionStore {
+	if codec == nil {
+		codec = &GobSessionCodec{}
+	}
+	return &QbsSessionStore{store: s, codec: codec}
+}
+
+func (self *QbsSessionStore) find(q *qbs.Qbs, id string) (*SessionRecord, error) {
+	rec := &SessionRecord{}
+	err := q.WhereEqual("session_id", id).Find(rec)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//Load reads the session's row.
+func (self *QbsSessionStore) Load(id string) (*StoredSession, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	rec, err := self.find(q, id)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	ud, err := self.codec.Decode(rec.UserData)
+	if err != nil {
+		return nil, err
+	}
+	result := rec.stored()
+	result.UserData = ud
+	return result, nil
+}
+
+//Save creates or updates the session's row.
+func (self *QbsSessionStore) Save(s *StoredSession) error {
+	ud, err := self.codec.Encode(s.UserData)
+	if err != nil {
+		return err
+	}
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	rec, err := self.find(q, s.Id)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		rec = &SessionRecord{SessionId: s.Id}
+	}
+	rec.UniqueId = s.UniqueId
+	rec.UserData = ud
+	rec.Expires = s.Expires
+	rec.Created = s.Created
+	rec.LastAccess = s.LastAccess
+	rec.Ip = s.IP
+	rec.UserAgent = s.UserAgent
+	_, err = q.Save(rec)
+	return err
+}
+
+//Delete removes the session's row.
+func (self *QbsSessionStore) Delete(id string) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.WhereEqual("session_id", id).Delete(&SessionRecord{})
+	return err
+}
+
+//inTx runs fn in a transaction on the database, which is committed if fn
+//returns nil and rolled back otherwise.
+func (self *QbsSessionStore) inTx(fn func(*qbs.Qbs) error) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	if err := q.Begin(); err != nil {
+		return err
+	}
+	if err := fn(q); err != nil {
+		if rerr := q.Rollback(); rerr != nil {
+			log.Printf("[SESSION] unable to roll back: %v", rerr)
+		}
+		return err
+	}
+	return q.Commit()
+}
+
+//Sweep deletes the rows of expired sessions.  The rows are locked (this is
+//postgres specific) and deleted by id in one transaction, so a session that
+//is used while the sweep runs is either swept and returned or kept.  The
+//user data of the sessions returned is not decoded.
+func (self *QbsSessionStore) Sweep(now time.Time, idle time.Duration) ([]*StoredSession, error) {
+	var where string
+	var args []interface{}
+	if idle > 0 {
+		where, args = "expires <= ? OR last_access <= ?", []interface{}{now, now.Add(-idle)}
+	} else {
+		where, args = "expires <= ?", []interface{}{now}
+	}
+	var recs []*SessionRecord
+	err := self.inTx(func(q *qbs.Qbs) error {
+		query := fmt.Sprintf("SELECT * FROM %s WHERE %s FOR UPDATE", SESSION_TABLE, where)
+		if err := q.QueryStruct(&recs, query, args...); err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return nil
+		}
+		marks := make([]string, len(recs))
+		ids := make([]interface{}, len(recs))
+		for i, rec := range recs {
+			marks[i] = "?"
+			ids[i] = rec.Id
+		}
+		_, err := q.Where(fmt.Sprintf("id IN (%s)", strings.Join(marks, ",")), ids...).Delete(&SessionRecord{})
+		return err
+	})
+	if err != nil || len(recs) == 0 {
+		return nil, err
+	}
+	result := make([]*StoredSession, len(recs))
+	for i, rec := range recs {
+		result[i] = rec.stored()
+	}
+	return result, nil
+}
+
+//Revoke records the revocation and deletes the rows of the sessions of the
+//unique id, in one transaction.
+func (self *QbsSessionStore) Revoke(uniqueId string, before time.Time) error {
+	return self.inTx(func(q *qbs.Qbs) error {
+		rev := &SessionRevocation{}
+		err := q.WhereEqual("unique_id", uniqueId).Find(rev)
+		if err == sql.ErrNoRows {
+			rev = &SessionRevocation{UniqueId: uniqueId}
+		} else if err != nil {
+			return err
+		}
+		if before.After(rev.RevokedBefore) {
+			rev.RevokedBefore = before
+			if _, err := q.Save(rev); err != nil {
+				return err
+			}
+		}
+		_, err = q.WhereEqual("unique_id", uniqueId).Delete(&SessionRecord{})
+		return err
+	})
+}
+
+//List reads the rows of the sessions of the unique id.  The user data is not
+//decoded.
+func (self *QbsSessionStore) List(uniqueId string) ([]*StoredSession, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	var recs []*SessionRecord
+	if err := q.WhereEqual("unique_id", uniqueId).FindAll(&recs); err != nil {
+		return nil, err
+	}
+	result := make([]*StoredSession, len(recs))
+	for i, rec := range recs {
+		result[i] = rec.stored()
+	}
+	return result, nil
+}
+
+//RevokedBefore reads the revocation row of the unique id, if there is one.
+func (self *QbsSessionStore) RevokedBefore(uniqueId string) (time.Time, error) {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer q.Close()
+	rev := &SessionRevocation{}
+	err = q.WhereEqual("unique_id", uniqueId).Find(rev)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return rev.RevokedBefore, err
+}
+
+//SessionMigrationUp is a migration function (see the migrate package) that
+//creates the tables used by QbsSessionStore.  This is postgres specific.
+func SessionMigrationUp(tx *sql.Tx) error {
+	_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		id BIGSERIAL PRIMARY KEY,
+		session_id VARCHAR(512) NOT NULL UNIQUE,
+		unique_id VARCHAR(255) NOT NULL,
+		user_data BYTEA,
+		expires TIMESTAMP WITH TIME ZONE NOT NULL,
+		created TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_access TIMESTAMP WITH TIME ZONE NOT NULL,
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		user_agent VARCHAR(512) NOT NULL DEFAULT '')`, SESSION_TABLE))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE INDEX %s_unique_id_idx ON %s (unique_id)",
+		SESSION_TABLE, SESSION_TABLE))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE INDEX %s_expires_idx ON %s (expires)",
+		SESSION_TABLE, SESSION_TABLE))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`CREATE TABLE %s (
+		id BIGSERIAL PRIMARY KEY,
+		unique_id VARCHAR(255) NOT NULL UNIQUE,
+		revoked_before TIMESTAMP WITH TIME ZONE NOT NULL)`, SESSION_REVOCATION_TABLE))
+	return err
+}
+
+//SessionMigrationDown is the inverse of SessionMigrationUp.
+func SessionMigrationDown(tx *sql.Tx) error {
+	if _, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", SESSION_REVOCATION_TABLE)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", SESSION_TABLE))
+	return err
+}
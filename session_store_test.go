@@ -0,0 +1,230 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileSessionStore(dir, nil)
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+	first := NewSimpleSessionManagerWithStore(nil, store)
+	s, err := first.Assign("fred", "some data", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	first.Close()
+
+	//simulate a restart
+	second := NewSimpleSessionManagerWithStore(nil, store)
+	defer second.Close()
+	sr, err := second.Find(s.SessionId())
+	if err != nil || sr == nil || sr.Session == nil {
+		t.Fatalf("expected to find session after restart: %+v %v", sr, err)
+	}
+	if sr.Session.UserData() != "some data" || SessionUniqueId(sr.Session) != "fred" {
+		t.Errorf("bad session after restart: %+v", sr.Session)
+	}
+	if _, err := second.Update(sr.Session, "new data"); err != nil {
+		t.Fatalf("unable to update: %v", err)
+	}
+	sr, _ = second.Find(s.SessionId())
+	if sr == nil || sr.Session == nil || sr.Session.UserData() != "new data" {
+		t.Errorf("update was lost: %+v", sr)
+	}
+	if err := second.Destroy(s.SessionId()); err != nil {
+		t.Fatalf("unable to destroy: %v", err)
+	}
+	if loaded, err := store.Load(s.SessionId()); err != nil || loaded != nil {
+		t.Errorf("expected session to be removed: %+v %v", loaded, err)
+	}
+
+	//a bad file is skipped, not an error
+	if _, err := second.Assign("fred", "more data", time.Time{}); err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "garbage"), []byte("{not json"), 0600); err != nil {
+		t.Fatalf("unable to write bad file: %v", err)
+	}
+	if list, err := store.List("fred"); err != nil || len(list) != 1 {
+		t.Errorf("expected the bad file to be skipped: %v %v", list, err)
+	}
+}
+
+func TestFileSessionSweepRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileSessionStore(dir, nil)
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	store.Save(&StoredSession{Id: "renewed", UniqueId: "fred", Expires: now.Add(-time.Minute)})
+	store.Save(&StoredSession{Id: "expired", UniqueId: "fred", Expires: now.Add(-time.Minute)})
+
+	//the session is saved again after the sweep has read it as expired
+	saved := false
+	removed, err := store.remove(func(fs *fileSession) bool {
+		if fs.Id == "renewed" && !saved {
+			saved = true
+			store.Save(&StoredSession{Id: "renewed", UniqueId: "fred", Expires: now.Add(time.Hour)})
+		}
+		return fs.Expires.Before(now)
+	})
+	if err != nil || len(removed) != 1 || removed[0].Id != "expired" {
+		t.Errorf("expected only the expired session to be removed: %+v %v", removed, err)
+	}
+	if s, err := store.Load("renewed"); err != nil || s == nil || !s.Expires.After(now) {
+		t.Errorf("expected the session saved during the sweep to be kept: %+v %v", s, err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 2 {
+		t.Errorf("expected the session and the revoked dir, but found %d files", len(infos))
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	store := NewMemorySessionStore()
+	mgr := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{
+		Store:       store,
+		Clock:       clock,
+		Lifetime:    time.Hour,
+		Absolute:    3 * time.Hour,
+		Idle:        20 * time.Minute,
+		RenewWithin: 15 * time.Minute,
+	})
+	defer mgr.Close()
+
+	//idle timeout
+	s, err := mgr.Assign("idle", "data", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	clock.Advance(10 * time.Minute)
+	if sr, _ := mgr.Find(s.SessionId()); sr == nil || sr.Session == nil || sr.Renewed {
+		t.Fatalf("expected to find session before idle timeout: %+v", sr)
+	}
+	clock.Advance(15 * time.Minute)
+	if sr, _ := mgr.Find(s.SessionId()); sr == nil || sr.Session == nil || sr.Renewed {
+		t.Fatalf("expected access to reset idle timeout: %+v", sr)
+	}
+	clock.Advance(21 * time.Minute)
+	if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+		t.Errorf("expected idle session to be expired: %+v", sr)
+	}
+	//not recoverable from the id with timeouts
+	if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+		t.Errorf("expected idle session to stay expired: %+v", sr)
+	}
+
+	//sliding expiration, up to the absolute limit
+	s, err = mgr.Assign("slide", "data", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	id := s.SessionId()
+	renewals := 0
+	for i := 0; i < 9; i++ {
+		clock.Advance(19 * time.Minute)
+		sr, _ := mgr.Find(id)
+		if sr == nil || sr.Session == nil {
+			t.Fatalf("expected session to be renewed (%d): %+v", i, sr)
+		}
+		if sr.Renewed {
+			renewals++
+			if sr.Session.SessionId() == id {
+				t.Errorf("expected renewed session to have a new id")
+			}
+			if old, _ := store.Load(id); old != nil {
+				t.Errorf("expected old session id to be removed")
+			}
+			id = sr.Session.SessionId()
+		}
+	}
+	if renewals == 0 {
+		t.Errorf("expected session to be renewed")
+	}
+	clock.Advance(10 * time.Minute) //past 3 hours
+	if sr, _ := mgr.Find(id); sr != nil {
+		t.Errorf("expected session to hit absolute timeout: %+v", sr)
+	}
+
+	//sweep
+	if _, err := mgr.Assign("a", "data", time.Time{}); err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	if _, err := mgr.Assign("b", "data", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if swept, err := store.Sweep(clock.Now(), 30*time.Minute); err != nil || len(swept) != 1 || swept[0].UniqueId != "b" {
+		t.Errorf("expected to sweep one session: %+v %v", swept, err)
+	}
+	clock.Advance(30 * time.Minute)
+	if swept, err := store.Sweep(clock.Now(), 30*time.Minute); err != nil || len(swept) != 1 || swept[0].UniqueId != "a" {
+		t.Errorf("expected to sweep idle session: %+v %v", swept, err)
+	}
+}
+
+func TestSessionRevoke(t *testing.T) {
+	keys, _ := NewSessionKeyring([]byte(strings.Repeat("k", 16)))
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileSessionStore(dir, nil)
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+	mgr := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Store: store, Clock: clock, Keys: keys})
+	defer mgr.Close()
+
+	first, _ := mgr.Assign("fred", "data", time.Time{})
+	second, _ := mgr.Assign("fred", "data", time.Time{})
+	other, _ := mgr.Assign("barney", "data", time.Time{})
+	//lost from the store, but the id can still be used to recover
+	lost, _ := mgr.Assign("fred", "data", time.Time{})
+	store.Delete(lost.SessionId())
+	if sr, _ := mgr.Find(lost.SessionId()); sr == nil || sr.UniqueId != "fred" {
+		t.Fatalf("expected to recover unique id from session id: %+v", sr)
+	}
+
+	clock.Advance(time.Minute)
+	if err := mgr.RevokeAll("fred"); err != nil {
+		t.Fatalf("unable to revoke: %v", err)
+	}
+	for _, s := range []Session{first, second, lost} {
+		if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+			t.Errorf("expected revoked session to be gone: %+v", sr)
+		}
+	}
+	if sr, _ := mgr.Find(other.SessionId()); sr == nil || sr.Session == nil {
+		t.Errorf("expected other user's session to survive: %+v", sr)
+	}
+
+	//logging in again works
+	again, _ := mgr.Assign("fred", "data", time.Time{})
+	store.Delete(again.SessionId())
+	if sr, _ := mgr.Find(again.SessionId()); sr == nil || sr.UniqueId != "fred" {
+		t.Errorf("expected session issued after revocation to be valid: %+v", sr)
+	}
+}
@@ -0,0 +1,136 @@
+package seven5
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	TENANT_HEADER = "X-Tenant"
+	TENANT_DIR    = "tenants"
+)
+
+//TenantResolver determines which tenant (customer) a request is for.  It is
+//given the segments of the url path that remain to be dispatched and returns
+//the tenant name, the segments that remain after any that named the tenant
+//have been consumed, and an error.  A tenant of "" means the request is not
+//for any particular tenant.  An error created with HTTPError is sent to the
+//client with its status code, so a resolver can refuse requests that must
+//have a tenant.
+type TenantResolver interface {
+	ResolveTenant(r *http.Request, parts []string, pb PBundle) (string, []string, error)
+}
+
+//TenantHolder is an interface that the user data of a session can implement
+//to tell the SessionTenantResolver which tenant the user belongs to.  The
+//dispatchers refuse, with 403, requests whose session belongs to a tenant
+//other than the one the request is for.
+type TenantHolder interface {
+	Tenant() string
+}
+
+//resolveTenant determines the tenant of the request with the resolver given
+//and checks that the session of the request, if its user data is a
+//TenantHolder, belongs to that tenant.  Otherwise, a client could reach the
+//data of another tenant just by changing the Host or a header.
+func resolveTenant(resolver TenantResolver, r *http.Request, parts []string, pb PBundle) (string, []string, error) {
+	tenant, rest, err := resolver.ResolveTenant(r, parts, pb)
+	if err != nil {
+		return "", parts, err
+	}
+	if pb != nil && pb.Session() != nil {
+		if holder, ok := pb.Session().UserData().(TenantHolder); ok && holder.Tenant() != tenant {
+			return "", parts, HTTPError(http.StatusForbidden, "session is for another tenant")
+		}
+	}
+	return tenant, rest, nil
+}
+
+//HostTenantResolver takes the tenant from the subdomain of the Host of the
+//request, so acme.example.com is the tenant acme if the Domain is
+//example.com.  Requests for the Domain itself, or any other host, have no
+//tenant.
+type HostTenantResolver struct {
+	Domain string
+}
+
+//ResolveTenant returns the leftmost part of the host if it is a subdomain of
+//Domain.
+func (self *HostTenantResolver) ResolveTenant(r *http.Request, parts []string, pb PBundle) (string, []string, error) {
+	host := strings.ToLower(r.Host)
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	suffix := "." + strings.ToLower(self.Domain)
+	if !strings.HasSuffix(host, suffix) {
+		return "", parts, nil
+	}
+	sub := strings.TrimSuffix(host, suffix)
+	if i := strings.LastIndex(sub, "."); i != -1 {
+		sub = sub[i+1:]
+	}
+	return sub, parts, nil
+}
+
+//HeaderTenantResolver takes the tenant from a request header, X-Tenant if
+//Header is "".  This is typically only useful when the requests come from
+//a proxy that sets the header.
+type HeaderTenantResolver struct {
+	Header string
+}
+
+//ResolveTenant returns the value of the header.
+func (self *HeaderTenantResolver) ResolveTenant(r *http.Request, parts []string, pb PBundle) (string, []string, error) {
+	h := self.Header
+	if h == "" {
+		h = TENANT_HEADER
+	}
+	return strings.TrimSpace(r.Header.Get(h)), parts, nil
+}
+
+//PathTenantResolver takes the tenant from the first segment of the path
+//after the dispatcher's prefix, as in /rest/acme/house/12.  Every request
+//must have a tenant, those that don't are not found.
+type PathTenantResolver struct {
+}
+
+//ResolveTenant consumes the first segment of the path.
+func (self *PathTenantResolver) ResolveTenant(r *http.Request, parts []string, pb PBundle) (string, []string, error) {
+	if len(parts) < 2 || parts[0] == "" {
+		return "", parts, HTTPError(http.StatusNotFound, "no tenant in url")
+	}
+	return parts[0], parts[1:], nil
+}
+
+//SessionTenantResolver takes the tenant from the user data of the session,
+//if it is a TenantHolder.
+type SessionTenantResolver struct {
+}
+
+//ResolveTenant returns the tenant of the logged in user.
+func (self *SessionTenantResolver) ResolveTenant(r *http.Request, parts []string, pb PBundle) (string, []string, error) {
+	if pb == nil || pb.Session() == nil {
+		return "", parts, nil
+	}
+	holder, ok := pb.Session().UserData().(TenantHolder)
+	if !ok {
+		return "", parts, nil
+	}
+	return holder.Tenant(), parts, nil
+}
+
+//FirstTenant is a TenantResolver that tries each of the resolvers in order
+//and uses the first tenant found.
+type FirstTenant []TenantResolver
+
+//ResolveTenant returns the result of the first resolver that finds a
+//tenant or returns an error.
+func (self FirstTenant) ResolveTenant(r *http.Request, parts []string, pb PBundle) (string, []string, error) {
+	for _, resolver := range self {
+		t, rest, err := resolver.ResolveTenant(r, parts, pb)
+		if err != nil || t != "" {
+			return t, rest, err
+		}
+	}
+	return "", parts, nil
+}
@@ -0,0 +1,117 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type tenantResource struct {
+	someResource
+}
+
+func (self *tenantResource) Find(id int64, pb PBundle) (interface{}, error) {
+	return &someWire{id, BundleTenant(pb)}, nil
+}
+
+//tenantUser is user data that belongs to a tenant.
+type tenantUser string
+
+func (self tenantUser) Tenant() string {
+	return string(self)
+}
+
+func TestTenantResolvers(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://acme.example.com:8080/rest/house", nil)
+	r.Header.Set(TENANT_HEADER, "fromheader")
+	parts := []string{"house"}
+
+	tenant, _, _ := (&HostTenantResolver{"example.com"}).ResolveTenant(r, parts, nil)
+	if tenant != "acme" {
+		t.Errorf("expected acme from host but got %q", tenant)
+	}
+	tenant, _, _ = (&HostTenantResolver{"other.com"}).ResolveTenant(r, parts, nil)
+	if tenant != "" {
+		t.Errorf("expected no tenant from host but got %q", tenant)
+	}
+	tenant, _, _ = FirstTenant{&HostTenantResolver{"other.com"}, &HeaderTenantResolver{}}.ResolveTenant(r, parts, nil)
+	if tenant != "fromheader" {
+		t.Errorf("expected tenant from header but got %q", tenant)
+	}
+	tenant, rest, err := (&PathTenantResolver{}).ResolveTenant(r, []string{"acme", "house", "12"}, nil)
+	if err != nil || tenant != "acme" || len(rest) != 2 || rest[0] != "house" {
+		t.Errorf("bad path resolution: %q %v %v", tenant, rest, err)
+	}
+	if _, _, err := (&PathTenantResolver{}).ResolveTenant(r, []string{"acme"}, nil); err == nil {
+		t.Errorf("expected error for path without resource")
+	}
+}
+
+func TestTenantDispatch(t *testing.T) {
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, "/rest")
+	raw.Tenants = &PathTenantResolver{}
+	raw.Rez(&someWire{}, &tenantResource{})
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/rest/acme/somewire/3")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	var found someWire
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		t.Fatalf("unable to decode: %v", err)
+	}
+	if found.Foo != "acme" {
+		t.Errorf("expected tenant acme but got %q", found.Foo)
+	}
+	resp, err = http.Get(server.URL + "/rest/somewire")
+	checkHttpStatus(t, resp, err, http.StatusNotFound)
+}
+
+func TestTenantSession(t *testing.T) {
+	sm := NewSimpleSessionManagerWithConfig(nil, &SessionConfig{Keys: testSessionKeys()})
+	defer sm.Close()
+	cm := NewSimpleCookieMapper("test")
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm), sm, nil, "/rest")
+	raw.Tenants = &HeaderTenantResolver{}
+	raw.Rez(&someWire{}, &tenantResource{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s, _ := sm.Assign("fred", tenantUser("acme"), time.Time{})
+	get := func(tenant string) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", server.URL+"/rest/somewire/3", nil)
+		req.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+		req.Header.Set(TENANT_HEADER, tenant)
+		return http.DefaultClient.Do(req)
+	}
+	resp, err := get("acme")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	resp, err = get("other")
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	resp, err = get("")
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+}
+
+func TestQbsStoreForTenant(t *testing.T) {
+	root := NewQbsStoreFromDB(nil, nil)
+	if s, err := root.ForTenant(""); s != root || err != nil {
+		t.Errorf("expected root store without tenants: %v", err)
+	}
+	acme := NewQbsStoreFromDB(nil, nil)
+	root.AddTenant("acme", acme)
+	if s, err := root.ForTenant("acme"); s != acme || err != nil {
+		t.Errorf("expected tenant store: %v", err)
+	}
+	for _, tenant := range []string{"", "other"} {
+		if _, err := root.ForTenant(tenant); err == nil {
+			t.Errorf("expected %q to be refused once tenants are added", tenant)
+		}
+	}
+}
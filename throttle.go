@@ -0,0 +1,322 @@
+package seven5
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//DEFAULT_THROTTLE_FREE is how many failed logins are allowed before the
+	//next attempt has to wait.
+	DEFAULT_THROTTLE_FREE = 3
+	//DEFAULT_THROTTLE_DELAY is the first wait, it doubles with each failure
+	//up to DEFAULT_THROTTLE_MAX_DELAY.
+	DEFAULT_THROTTLE_DELAY     = time.Second
+	DEFAULT_THROTTLE_MAX_DELAY = 5 * time.Minute
+	//DEFAULT_LOCKOUT_FAILURES is how many failed logins for a username lock
+	//it out for DEFAULT_LOCKOUT_DURATION.
+	DEFAULT_LOCKOUT_FAILURES = 10
+	DEFAULT_LOCKOUT_DURATION = 30 * time.Minute
+	//DEFAULT_IP_LOCKOUT_FAILURES is how many failed logins, for any username,
+	//lock out an IP address.
+	DEFAULT_IP_LOCKOUT_FAILURES = 50
+	//DEFAULT_THROTTLE_WINDOW is how long after its last failure a counter is
+	//forgotten.
+	DEFAULT_THROTTLE_WINDOW = 24 * time.Hour
+)
+
+//throttleCounter counts the failed logins of a username or an IP address.
+//Attempts are counted as failures when they start; lockedAt is the count at
+//which the lockout in until started, and notify is true if that lockout has
+//not been reported.
+type throttleCounter struct {
+	failures int
+	last     time.Time
+	until    time.Time
+	lockedAt int
+	notify   bool
+}
+
+//LoginThrottle slows down password guessing.  Failed logins are counted by
+//username and by IP address; after FreeFailures failures, each attempt must
+//wait for a delay that doubles with every failure, and after LockoutFailures
+//(or IPLockoutFailures) failures the username (or IP address) is locked out
+//for LockoutDuration.  Usernames that don't exist are counted like the ones
+//that do, so the throttle doesn't reveal which usernames exist.  Note that
+//anyone can lock out a username by failing to log in as it; keep
+//LockoutDuration short.  A LoginThrottle keeps its counters in memory, so
+//each server counts separately.  Allow counts an attempt as a failure before
+//the password is checked, so that parallel requests can't try more passwords
+//than the throttle allows; each attempt allowed must then be ended with
+//Failure, Success or Release.  The IP address of a request is its RemoteAddr
+//unless ClientIP is set.  Behind a reverse proxy, RemoteAddr is the proxy's
+//address, so every client would share one counter and a few failures from
+//anyone would lock out everyone; set ClientIP to ForwardedClientIP with the
+//proxy's address.
+type LoginThrottle struct {
+	clock  Clock
+	lock   sync.Mutex
+	users  map[string]*throttleCounter
+	ips    map[string]*throttleCounter
+	pruned time.Time
+
+	FreeFailures      int
+	Delay             time.Duration
+	MaxDelay          time.Duration
+	LockoutFailures   int
+	IPLockoutFailures int
+	LockoutDuration   time.Duration
+	Window            time.Duration
+	//OnLockout, if not nil, is called when a username is locked out, so the
+	//application can tell the user.  It is called without any locks held.
+	OnLockout func(username, ip string, until time.Time)
+	//ClientIP, if not nil, returns the IP address of a request.
+	ClientIP func(r *http.Request) string
+}
+
+//NewLoginThrottle returns a LoginThrottle with the default settings.  If
+//clock is nil, the SystemClock is used.
+func NewLoginThrottle(clock Clock) *LoginThrottle {
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+	return &LoginThrottle{
+		clock:             clock,
+		users:             make(map[string]*throttleCounter),
+		ips:               make(map[string]*throttleCounter),
+		pruned:            clock.Now(),
+		FreeFailures:      DEFAULT_THROTTLE_FREE,
+		Delay:             DEFAULT_THROTTLE_DELAY,
+		MaxDelay:          DEFAULT_THROTTLE_MAX_DELAY,
+		LockoutFailures:   DEFAULT_LOCKOUT_FAILURES,
+		IPLockoutFailures: DEFAULT_IP_LOCKOUT_FAILURES,
+		LockoutDuration:   DEFAULT_LOCKOUT_DURATION,
+		Window:            DEFAULT_THROTTLE_WINDOW,
+	}
+}
+
+//RemoteAddrClientIP returns the address of the connection of the request.
+func RemoteAddrClientIP(r *http.Request) string {
+	return NewSessionClient(r).IP
+}
+
+//ForwardedClientIP returns a function for LoginThrottle.ClientIP that, for
+//requests that come from one of the proxies given, takes the address of the
+//client from the X-Forwarded-For header the proxies add.  A proxy is an IP
+//address or a CIDR block such as 10.0.0.0/8.  The header is read from the
+//right, skipping the proxies, because a client can put anything at its
+//start.
+func ForwardedClientIP(proxies ...string) func(r *http.Request) string {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(r *http.Request) string {
+		ip := RemoteAddrClientIP(r)
+		if !trusted(ip) {
+			return ip
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !trusted(hop) {
+				return hop
+			}
+			ip = hop
+		}
+		return ip
+	}
+}
+
+//IP returns the IP address of the request, as the throttle counts it.
+func (self *LoginThrottle) IP(r *http.Request) string {
+	if self.ClientIP != nil {
+		return self.ClientIP(r)
+	}
+	return RemoteAddrClientIP(r)
+}
+
+//throttleUser is the key of the username, so "Fred" and "fred " are the same.
+func throttleUser(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+//counter returns the live counter of the key, or nil.  The lock must be held.
+func (self *LoginThrottle) counter(m map[string]*throttleCounter, key string, now time.Time) *throttleCounter {
+	c, ok := m[key]
+	if !ok {
+		return nil
+	}
+	if now.Sub(c.last) >= self.Window && !now.Before(c.until) {
+		delete(m, key)
+		return nil
+	}
+	return c
+}
+
+//wait is how long the counter's key must wait before trying again.
+func (self *LoginThrottle) wait(c *throttleCounter, now time.Time) time.Duration {
+	if c == nil {
+		return 0
+	}
+	if now.Before(c.until) {
+		return c.until.Sub(now)
+	}
+	if c.failures < self.FreeFailures {
+		return 0
+	}
+	delay := self.Delay
+	for i := self.FreeFailures; i < c.failures && delay < self.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > self.MaxDelay {
+		delay = self.MaxDelay
+	}
+	if next := c.last.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+//Allow returns how long a login for the username from the IP address must
+//wait, or 0 if it can be tried now.  If it can, the attempt is counted as a
+//failure until it is ended with Success or Release.  An ip of "" is not
+//counted by address.
+func (self *LoginThrottle) Allow(username, ip string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.clock.Now()
+	self.prune(now)
+	user := throttleUser(username)
+	wait := self.wait(self.counter(self.users, user, now), now)
+	if ip != "" {
+		if ipWait := self.wait(self.counter(self.ips, ip, now), now); ipWait > wait {
+			wait = ipWait
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	self.fail(self.users, user, self.LockoutFailures, now)
+	if ip != "" {
+		self.fail(self.ips, ip, self.IPLockoutFailures, now)
+	}
+	return 0
+}
+
+//fail counts a failure for the key, locking it out if that makes limit
+//failures.  The lock must be held.
+func (self *LoginThrottle) fail(m map[string]*throttleCounter, key string, limit int, now time.Time) {
+	c := self.counter(m, key, now)
+	if c == nil {
+		c = &throttleCounter{}
+		m[key] = c
+	}
+	c.failures++
+	c.last = now
+	if limit > 0 && c.failures%limit == 0 {
+		c.until = now.Add(self.LockoutDuration)
+		c.lockedAt = c.failures
+		c.notify = true
+	}
+}
+
+//undo takes back the failure counted for an attempt.  The lock must be held.
+func (self *LoginThrottle) undo(m map[string]*throttleCounter, key string) {
+	c, ok := m[key]
+	if !ok || c.failures == 0 {
+		return
+	}
+	if c.lockedAt == c.failures {
+		c.until = time.Time{}
+		c.lockedAt = 0
+		c.notify = false
+	}
+	c.failures--
+}
+
+//Failure ends an attempt that failed.  Its failure has already been counted
+//by Allow; this reports the lockout of the username, if the attempt caused
+//one, to OnLockout.
+func (self *LoginThrottle) Failure(username, ip string) {
+	self.lock.Lock()
+	var until time.Time
+	if c, ok := self.users[throttleUser(username)]; ok && c.notify {
+		c.notify = false
+		until = c.until
+	}
+	self.lock.Unlock()
+	if !until.IsZero() && self.OnLockout != nil {
+		self.OnLockout(username, ip, until)
+	}
+}
+
+//Success ends an attempt that succeeded: the failed logins of the username
+//are forgotten and the attempt is not counted against the IP address.  The
+//other failures of the IP address are kept, so logging in to one account
+//doesn't allow guessing the passwords of others.
+func (self *LoginThrottle) Success(username, ip string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.users, throttleUser(username))
+	if ip != "" {
+		self.undo(self.ips, ip)
+	}
+}
+
+//Release ends an attempt that neither failed nor succeeded, such as one
+//that could not be checked, or a right password that still needs a second
+//factor.  The attempt is not counted, but earlier failures are kept.
+func (self *LoginThrottle) Release(username, ip string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.undo(self.users, throttleUser(username))
+	if ip != "" {
+		self.undo(self.ips, ip)
+	}
+}
+
+//Unlock forgets the failed logins of the username, ending any lockout.
+func (self *LoginThrottle) Unlock(username string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.users, throttleUser(username))
+}
+
+//prune removes the counters that have been forgotten, at most once per
+//Window.  The lock must be held.
+func (self *LoginThrottle) prune(now time.Time) {
+	if now.Sub(self.pruned) < self.Window {
+		return
+	}
+	self.pruned = now
+	for _, m := range []map[string]*throttleCounter{self.users, self.ips} {
+		for key := range m {
+			self.counter(m, key, now)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	th := NewLoginThrottle(clock)
+	var locked []string
+	th.OnLockout = func(username, ip string, until time.Time) {
+		locked = append(locked, username)
+	}
+	//fail is a failed attempt
+	fail := func(username, ip string) time.Duration {
+		wait := th.Allow(username, ip)
+		if wait == 0 {
+			th.Failure(username, ip)
+		}
+		return wait
+	}
+
+	for i := 0; i < DEFAULT_THROTTLE_FREE; i++ {
+		if wait := fail("fred", "1.1.1.1"); wait != 0 {
+			t.Fatalf("expected free attempt %d: %v", i, wait)
+		}
+	}
+	if wait := th.Allow("Fred ", "2.2.2.2"); wait != DEFAULT_THROTTLE_DELAY {
+		t.Errorf("expected username to wait from any address: %v", wait)
+	}
+	clock.Advance(DEFAULT_THROTTLE_DELAY)
+	fail("fred", "1.1.1.1")
+	if wait := th.Allow("fred", "1.1.1.1"); wait != 2*DEFAULT_THROTTLE_DELAY {
+		t.Errorf("expected the wait to double: %v", wait)
+	}
+	if wait := th.Allow("barney", "2.2.2.2"); wait != 0 {
+		t.Errorf("expected other users to be unaffected: %v", wait)
+	}
+	th.Release("barney", "2.2.2.2")
+
+	for i := DEFAULT_THROTTLE_FREE + 1; i < DEFAULT_LOCKOUT_FAILURES; i++ {
+		clock.Advance(DEFAULT_THROTTLE_MAX_DELAY)
+		fail("fred", "1.1.1.1")
+	}
+	if len(locked) != 1 || locked[0] != "fred" {
+		t.Fatalf("expected lockout to be reported: %v", locked)
+	}
+	if wait := th.Allow("fred", "3.3.3.3"); wait != DEFAULT_LOCKOUT_DURATION {
+		t.Errorf("expected lockout: %v", wait)
+	}
+	th.Unlock("fred")
+	if wait := th.Allow("fred", "3.3.3.3"); wait != 0 {
+		t.Errorf("expected unlock to end lockout: %v", wait)
+	}
+	th.Success("fred", "3.3.3.3")
+
+	//many usernames from one address
+	for i := 0; i < DEFAULT_IP_LOCKOUT_FAILURES; i++ {
+		clock.Advance(DEFAULT_THROTTLE_MAX_DELAY)
+		fail(strings.Repeat("x", i+1), "4.4.4.4")
+	}
+	if wait := th.Allow("wilma", "4.4.4.4"); wait != DEFAULT_LOCKOUT_DURATION {
+		t.Errorf("expected address lockout: %v", wait)
+	}
+	clock.Advance(DEFAULT_THROTTLE_WINDOW)
+	if wait := th.Allow("wilma", "4.4.4.4"); wait != 0 {
+		t.Errorf("expected failures to be forgotten: %v", wait)
+	}
+	th.Success("wilma", "4.4.4.4")
+	if wait := th.Allow("wilma", "4.4.4.4"); wait != 0 {
+		t.Errorf("expected success not to count: %v", wait)
+	}
+	th.Release("wilma", "4.4.4.4")
+	fail("x", "5.5.5.5")
+	clock.Advance(DEFAULT_THROTTLE_WINDOW)
+	fail("y", "6.6.6.6")
+	if len(th.ips) != 1 || len(th.users) != 1 {
+		t.Errorf("expected old counters to be pruned: %d %d", len(th.ips), len(th.users))
+	}
+}
+
+func TestLoginThrottleBurst(t *testing.T) {
+	th := NewLoginThrottle(NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)))
+	allowed := make(chan bool, 20)
+	for i := 0; i < cap(allowed); i++ {
+		go func() {
+			allowed <- th.Allow("fred", "1.1.1.1") == 0
+		}()
+	}
+	n := 0
+	for i := 0; i < cap(allowed); i++ {
+		if <-allowed {
+			n++
+		}
+	}
+	if n != DEFAULT_THROTTLE_FREE {
+		t.Errorf("expected parallel attempts to be counted before they are checked: %d", n)
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	ip := ForwardedClientIP("10.0.0.0/8", "192.0.2.7")
+	r := httptest.NewRequest("GET", "http://example.com/auth", nil)
+	r.RemoteAddr = "10.1.2.3:5555"
+	r.Header.Add("X-Forwarded-For", "6.6.6.6, 7.7.7.7")
+	r.Header.Add("X-Forwarded-For", "192.0.2.7")
+	if got := ip(r); got != "7.7.7.7" {
+		t.Errorf("expected the address the proxy saw but got %s", got)
+	}
+	r.RemoteAddr = "8.8.8.8:5555"
+	if got := ip(r); got != "8.8.8.8" {
+		t.Errorf("expected the header to be ignored if not from a proxy but got %s", got)
+	}
+}
+
+func TestLoginThrottleAuthHandler(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Clock: clock, Keys: testSessionKeys()})
+	defer sm.Close()
+	psm := NewPasswordSessionManager(sm, NewMemoryCredentialStore(), testHasher(), clock)
+	psm.SetPassword("u1", "fred", "secret")
+	handler := NewSimplePasswordHandler(psm, NewSimpleCookieMapper("test"))
+	handler.SetLoginThrottle(NewLoginThrottle(clock))
+
+	//each from its own address, so only the username counts
+	addrs := map[string]string{"fred": "10.0.0.1:1234", "nobody": "10.0.0.2:1234"}
+	login := func(username, pwd string) *httptest.ResponseRecorder {
+		body := `{"Op":"login","Username":"` + username + `","Password":"` + pwd + `"}`
+		r := httptest.NewRequest("POST", "http://example.com/auth", strings.NewReader(body))
+		r.RemoteAddr = addrs[username]
+		rec := httptest.NewRecorder()
+		handler.AuthHandler(rec, r)
+		return rec
+	}
+	for _, user := range []string{"fred", "nobody"} {
+		for i := 0; i < DEFAULT_THROTTLE_FREE; i++ {
+			if rec := login(user, "wrong"); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("%s: expected unauthorized: %d", user, rec.Code)
+			}
+		}
+		rec := login(user, "secret")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: expected the same throttled response for every user: %d %v", user, rec.Code, rec.Header())
+		}
+		clock.Advance(DEFAULT_THROTTLE_DELAY)
+	}
+	if rec := login("fred", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("expected login after the wait: %d", rec.Code)
+	}
+}
@@ -0,0 +1,290 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//TOTP_PERIOD and TOTP_DIGITS are the RFC 6238 parameters used by
+	//TwoFactor, which are the ones authenticator apps expect.
+	TOTP_PERIOD     = 30 * time.Second
+	TOTP_DIGITS     = 6
+	TOTP_SECRET_LEN = 20
+	//TOTP_RECOVERY_CODES is how many recovery codes a user gets.
+	TOTP_RECOVERY_CODES = 10
+	//DEFAULT_PENDING_LOGIN_LIFETIME is how long a user has to enter a code
+	//after entering the right password.
+	DEFAULT_PENDING_LOGIN_LIFETIME = 5 * time.Minute
+	//DEFAULT_PENDING_LOGIN_ATTEMPTS is how many wrong codes end a pending
+	//login.
+	DEFAULT_PENDING_LOGIN_ATTEMPTS = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TwoFactorState is what must be kept about the two factor authentication of
+//a user.  Secret is the TOTP secret, in base32; it is needed to check codes,
+//so it can't be hashed.  Enabled is false until the user has confirmed they
+//can produce codes.  LastStep is the time step of the last code used, so a
+//code can't be used twice.  Recovery has the hashes of the recovery codes
+//that have not been used.
+type TwoFactorState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+	Recovery []string
+}
+
+//copy returns a copy of the state that shares nothing with it.
+func (self *TwoFactorState) copy() *TwoFactorState {
+	c := *self
+	c.Recovery = append([]string(nil), self.Recovery...)
+	return &c
+}
+
+//SameTwoFactor is true if the states are the same; nil is the same as the
+//zero state.  It is useful to implement SwapTwoFactor.
+func SameTwoFactor(a, b *TwoFactorState) bool {
+	if a == nil {
+		a = &TwoFactorState{}
+	}
+	if b == nil {
+		b = &TwoFactorState{}
+	}
+	return a.Secret == b.Secret && a.Enabled == b.Enabled && a.LastStep == b.LastStep &&
+		strings.Join(a.Recovery, " ") == strings.Join(b.Recovery, " ")
+}
+
+//TwoFactorSessionManager is a ValidatingSessionManager that keeps the two
+//factor authentication state of users.  LoadTwoFactor returns nil, nil for
+//a user without two factor authentication, and a nil state turns it off.
+//SwapTwoFactor stores the state only if the stored state is still old (see
+//SameTwoFactor), and returns false if it is not; this must be atomic, so
+//that concurrent requests can't use the same code twice.  If the session
+//manager of a SimplePasswordHandler implements this interface, users that
+//have enabled two factor authentication must enter a code to log in (see
+//SetTwoFactor).
+type TwoFactorSessionManager interface {
+	ValidatingSessionManager
+	LoadTwoFactor(uniq string) (*TwoFactorState, error)
+	SwapTwoFactor(uniq string, old, state *TwoFactorState) (bool, error)
+}
+
+//TOTPEnrollment is sent to the client when it enrolls in two factor
+//authentication (Secret and URI) and when it confirms the enrollment
+//(RecoveryCodes).  XXX Manually copied to the client side library. XXX
+type TOTPEnrollment struct {
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+//TwoFactorChallenge is sent to the client when the password was right but a
+//code is needed to finish logging in.  The Token is sent back with the code.
+type TwoFactorChallenge struct {
+	Token string
+}
+
+//totpCode computes the RFC 4226 code of the counter.
+func totpCode(secret []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, secret)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+//pendingLogin is a login waiting for a code.
+type pendingLogin struct {
+	uniq     string
+	userData interface{}
+	username string
+	remember bool
+	expires  time.Time
+	attempts int
+	done     bool
+}
+
+//TwoFactor has the settings of RFC 6238 TOTP two factor authentication and
+//keeps the logins that are waiting for a code.  Pending logins are kept in
+//memory, so the code must be sent to the server that checked the password.
+type TwoFactor struct {
+	clock   Clock
+	lock    sync.Mutex
+	pending map[string]*pendingLogin
+	//Issuer names the application in authenticator apps.
+	Issuer string
+	//Skew is how many periods before and after the current one are also
+	//accepted, to allow for clocks that are off.  The default is 1.
+	Skew            int
+	PendingLifetime time.Duration
+	MaxAttempts     int
+}
+
+//NewTwoFactor returns a TwoFactor for the issuer given.  If clock is nil, the
+//SystemClock is used.
+func NewTwoFactor(issuer string, clock Clock) *TwoFactor {
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+	return &TwoFactor{
+		clock:           clock,
+		pending:         make(map[string]*pendingLogin),
+		Issuer:          issuer,
+		Skew:            1,
+		PendingLifetime: DEFAULT_PENDING_LOGIN_LIFETIME,
+		MaxAttempts:     DEFAULT_PENDING_LOGIN_ATTEMPTS,
+	}
+}
+
+//GenerateSecret returns a new TOTP secret, in base32.
+func (self *TwoFactor) GenerateSecret() string {
+	return totpEncoding.EncodeToString(apiKeyRandom(TOTP_SECRET_LEN))
+}
+
+//URI returns the otpauth URI of the secret for the account, which is
+//usually shown as a QR code for authenticator apps to scan.
+func (self *TwoFactor) URI(secret, account string) string {
+	label := url.PathEscape(account)
+	if self.Issuer != "" {
+		label = url.PathEscape(self.Issuer) + ":" + label
+	}
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	v.Set("period", fmt.Sprint(int(TOTP_PERIOD/time.Second)))
+	if self.Issuer != "" {
+		v.Set("issuer", self.Issuer)
+	}
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+//Code returns the code of the secret at the time given.
+func (self *TwoFactor) Code(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("bad TOTP secret: %v", err)
+	}
+	return totpCode(key, uint64(t.Unix()/int64(TOTP_PERIOD/time.Second)), TOTP_DIGITS), nil
+}
+
+//recoveryNormal removes the formatting of a recovery code.
+func recoveryNormal(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+//NewRecoveryCodes replaces the recovery codes of the state and returns the
+//new codes.  Only their hashes are kept in the state.
+func (self *TwoFactor) NewRecoveryCodes(state *TwoFactorState) []string {
+	codes := make([]string, TOTP_RECOVERY_CODES)
+	state.Recovery = make([]string, TOTP_RECOVERY_CODES)
+	for i := range codes {
+		c := hex.EncodeToString(apiKeyRandom(5))
+		codes[i] = c[:5] + "-" + c[5:]
+		state.Recovery[i] = apiKeyHash(recoveryNormal(codes[i]))
+	}
+	return codes
+}
+
+//Verify is true if the code is a TOTP code of the state's secret that has
+//not been used, or one of its recovery codes.  The state is changed so the
+//code can't be used again and must be saved.
+func (self *TwoFactor) Verify(state *TwoFactorState, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) == TOTP_DIGITS {
+		key, err := totpEncoding.DecodeString(strings.ToUpper(state.Secret))
+		if err != nil {
+			return false
+		}
+		now := self.clock.Now().Unix() / int64(TOTP_PERIOD/time.Second)
+		for step := now - int64(self.Skew); step <= now+int64(self.Skew); step++ {
+			if step <= state.LastStep || step < 0 {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step), TOTP_DIGITS)), []byte(code)) == 1 {
+				state.LastStep = step
+				return true
+			}
+		}
+		return false
+	}
+	hash := apiKeyHash(recoveryNormal(code))
+	for i, h := range state.Recovery {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(h)) == 1 {
+			state.Recovery = append(state.Recovery[:i:i], state.Recovery[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//pend keeps a login that needs a code and returns its token.
+func (self *TwoFactor) pend(p *pendingLogin) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.clock.Now()
+	for token, old := range self.pending {
+		if !now.Before(old.expires) {
+			delete(self.pending, token)
+		}
+	}
+	p.expires = now.Add(self.PendingLifetime)
+	token := hex.EncodeToString(apiKeyRandom(24))
+	self.pending[token] = p
+	return token
+}
+
+//claim counts an attempt to finish the pending login of the token and
+//returns a copy of it, or nil if there is no such login or it has had
+//MaxAttempts attempts.  The attempt is counted before the code is checked,
+//so parallel requests can't try more codes than that.
+func (self *TwoFactor) claim(token string) *pendingLogin {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	p, ok := self.pending[token]
+	if !ok {
+		return nil
+	}
+	if !self.clock.Now().Before(p.expires) {
+		delete(self.pending, token)
+		return nil
+	}
+	if p.done || p.attempts >= self.MaxAttempts {
+		return nil
+	}
+	p.attempts++
+	c := *p
+	return &c
+}
+
+//complete ends the pending login of the token after a right code.  Only one
+//request can complete a login; the others get false.
+func (self *TwoFactor) complete(token string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	p, ok := self.pending[token]
+	if !ok || p.done {
+		return false
+	}
+	p.done = true
+	delete(self.pending, token)
+	return true
+}
@@ -0,0 +1,225 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//RFC 6238, appendix B
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		if got := totpCode(secret, uint64(unix/30), 8); got != want {
+			t.Errorf("%d: expected %s but got %s", unix, want, got)
+		}
+	}
+
+	tf := NewTwoFactor("Example Co", nil)
+	uri := tf.URI("JBSWY3DPEHPK3PXP", "fred@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Example%20Co:fred@example.com?") ||
+		!strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=Example+Co") {
+		t.Errorf("bad otpauth uri: %s", uri)
+	}
+}
+
+func TestTwoFactorVerify(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	tf := NewTwoFactor("test", clock)
+	state := &TwoFactorState{Secret: tf.GenerateSecret()}
+	code, _ := tf.Code(state.Secret, clock.Now().Add(-TOTP_PERIOD))
+	if !tf.Verify(state, code) {
+		t.Errorf("expected the previous code to be accepted")
+	}
+	if tf.Verify(state, code) {
+		t.Errorf("expected a code to be used only once")
+	}
+	code, _ = tf.Code(state.Secret, clock.Now().Add(-2*TOTP_PERIOD))
+	if tf.Verify(&TwoFactorState{Secret: state.Secret}, code) {
+		t.Errorf("expected an old code to be refused")
+	}
+
+	codes := tf.NewRecoveryCodes(state)
+	if len(codes) != TOTP_RECOVERY_CODES || strings.Contains(strings.Join(state.Recovery, " "), codes[0]) {
+		t.Fatalf("expected only hashes of recovery codes to be kept")
+	}
+	if !tf.Verify(state, strings.ToUpper(strings.Replace(codes[3], "-", " ", 1))) {
+		t.Errorf("expected recovery code to be accepted")
+	}
+	if tf.Verify(state, codes[3]) || len(state.Recovery) != TOTP_RECOVERY_CODES-1 {
+		t.Errorf("expected a recovery code to be used only once")
+	}
+}
+
+func TestTwoFactorAuthHandler(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	sm := NewSimpleSessionManagerWithConfig(&testGen{}, &SessionConfig{Clock: clock, Keys: testSessionKeys()})
+	defer sm.Close()
+	psm := NewPasswordSessionManager(sm, NewMemoryCredentialStore(), testHasher(), clock)
+	psm.SetPassword("u1", "fred", "secret")
+	cm := NewSimpleCookieMapper("test")
+	tf := NewTwoFactor("test", clock)
+	handler := NewSimplePasswordHandler(psm, cm)
+	handler.SetTwoFactor(tf)
+
+	send := func(auth *PasswordAuthParameters, c *http.Cookie, result interface{}) (int, *http.Cookie) {
+		b, _ := json.Marshal(auth)
+		r := httptest.NewRequest("POST", "http://example.com/auth", strings.NewReader(string(b)))
+		if c != nil {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		handler.AuthHandler(rec, r)
+		if result != nil {
+			json.Unmarshal(rec.Body.Bytes(), result)
+		}
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == cm.CookieName() {
+				return rec.Code, c
+			}
+		}
+		return rec.Code, nil
+	}
+
+	code, cookie := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "secret"}, nil, nil)
+	if code != http.StatusOK || cookie == nil {
+		t.Fatalf("expected login without two factor: %d", code)
+	}
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_TOTP_ENROLL}, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expected enrollment to need a session: %d", code)
+	}
+	var enrollment TOTPEnrollment
+	send(&PasswordAuthParameters{Op: AUTH_OP_TOTP_ENROLL, Username: "fred"}, cookie, &enrollment)
+	if enrollment.Secret == "" || !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Fatalf("expected secret and uri: %+v", enrollment)
+	}
+	if state, _ := psm.LoadTwoFactor("u1"); state == nil || state.Enabled {
+		t.Fatalf("expected two factor to wait for confirmation: %+v", state)
+	}
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "secret"}, nil, nil); code != http.StatusOK {
+		t.Errorf("expected unconfirmed two factor to be ignored: %d", code)
+	}
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_TOTP_CONFIRM, Code: "000000"}, cookie, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected wrong code to fail confirmation: %d", code)
+	}
+	totp, _ := tf.Code(enrollment.Secret, clock.Now())
+	var confirmed TOTPEnrollment
+	send(&PasswordAuthParameters{Op: AUTH_OP_TOTP_CONFIRM, Code: totp}, cookie, &confirmed)
+	if len(confirmed.RecoveryCodes) != TOTP_RECOVERY_CODES {
+		t.Fatalf("expected recovery codes: %+v", confirmed)
+	}
+
+	if s, err := handler.Check("fred", "secret"); s != nil || err == nil {
+		t.Errorf("expected Check to refuse a user with two factor authentication")
+	}
+
+	login := func() string {
+		var challenge TwoFactorChallenge
+		code, c := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "secret"}, nil, &challenge)
+		if code != http.StatusAccepted || c != nil || challenge.Token == "" {
+			t.Fatalf("expected a challenge and no session: %d %v", code, c)
+		}
+		return challenge.Token
+	}
+	token := login()
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: totp}, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected the code used to confirm to be refused: %d", code)
+	}
+	clock.Advance(TOTP_PERIOD)
+	totp, _ = tf.Code(enrollment.Secret, clock.Now())
+	if code, c := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: totp}, nil, nil); code != http.StatusOK || c == nil {
+		t.Errorf("expected login with the code: %d", code)
+	}
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: confirmed.RecoveryCodes[0]}, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected token to be used once: %d", code)
+	}
+
+	token = login()
+	for i := 0; i < DEFAULT_PENDING_LOGIN_ATTEMPTS; i++ {
+		send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: "00000-00000"}, nil, nil)
+	}
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: confirmed.RecoveryCodes[0]}, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected too many wrong codes to end the login: %d", code)
+	}
+	token = login()
+	clock.Advance(DEFAULT_PENDING_LOGIN_LIFETIME)
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: confirmed.RecoveryCodes[0]}, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected pending login to expire: %d", code)
+	}
+	token = login()
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN_TOTP, Token: token, Code: confirmed.RecoveryCodes[0]}, nil, nil); code != http.StatusOK {
+		t.Errorf("expected login with a recovery code: %d", code)
+	}
+
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_TOTP_DISABLE, Code: confirmed.RecoveryCodes[1]}, cookie, nil); code != http.StatusOK {
+		t.Errorf("expected two factor to be turned off: %d", code)
+	}
+	if code, _ := send(&PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "secret"}, nil, nil); code != http.StatusOK {
+		t.Errorf("expected login without two factor: %d", code)
+	}
+}
+
+func TestTwoFactorConcurrentCodes(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC))
+	tf := NewTwoFactor("test", clock)
+	token := tf.pend(&pendingLogin{uniq: "u1"})
+	claims := make(chan bool, 20)
+	for i := 0; i < cap(claims); i++ {
+		go func() {
+			claims <- tf.claim(token) != nil
+		}()
+	}
+	claimed := 0
+	for i := 0; i < cap(claims); i++ {
+		if <-claims {
+			claimed++
+		}
+	}
+	if claimed != DEFAULT_PENDING_LOGIN_ATTEMPTS {
+		t.Errorf("expected %d attempts but got %d", DEFAULT_PENDING_LOGIN_ATTEMPTS, claimed)
+	}
+	token = tf.pend(&pendingLogin{uniq: "u1"})
+	tf.claim(token)
+	tf.claim(token)
+	if !tf.complete(token) || tf.complete(token) || tf.claim(token) != nil {
+		t.Errorf("expected a pending login to be completed once")
+	}
+
+	store := NewMemoryCredentialStore()
+	store.Save(&Credential{UniqueId: "u1", Username: "fred"})
+	state := &TwoFactorState{Secret: tf.GenerateSecret(), Enabled: true}
+	codes := tf.NewRecoveryCodes(state)
+	store.SwapTwoFactor("u1", nil, state)
+	results := make(chan bool, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			c, _ := store.LoadUnique("u1")
+			old := c.twoFactor()
+			s := old.copy()
+			ok := tf.Verify(s, codes[0])
+			if ok {
+				ok, _ = store.SwapTwoFactor("u1", old, s)
+			}
+			results <- ok
+		}()
+	}
+	used := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results {
+			used++
+		}
+	}
+	if used != 1 {
+		t.Errorf("expected a recovery code to be used once but it was used %d times", used)
+	}
+}